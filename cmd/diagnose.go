@@ -3,7 +3,8 @@ package cmd
 import (
 	"fmt"
 
-	"github.com/rahul/nsha/pkg/git"
+	"github.com/rahul/nsha/pkg/nsha"
+	"github.com/rahul/nsha/pkg/report"
 	"github.com/spf13/cobra"
 )
 
@@ -13,34 +14,69 @@ var diagnoseCmd = &cobra.Command{
 	Long:  `Scans the repository for corrupt objects, null SHA references, and broken trees`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		PrintStep(1, "Scanning repository for issues...")
-		
+
 		// Run fsck
-		issues, err := git.RunFsck(repoPath, verbose)
+		result, err := nsha.Diagnose(cmd.Context(), nsha.DiagnoseOptions{
+			RepoPath:          repoPath,
+			Events:            cliSink(),
+			RecurseSubmodules: recurseSubmodules,
+		})
 		if err != nil {
-			return fmt.Errorf("fsck failed: %w", err)
+			return err
+		}
+
+		if !textOutput() {
+			err := writeFindings(&report.Findings{
+				Command:   "diagnose",
+				RepoPath:  result.RepoPath,
+				StartTime: result.StartTime,
+				EndTime:   result.StartTime.Add(result.Duration),
+				Issues:    result.AllIssues(),
+			})
+			if err != nil {
+				return err
+			}
+			return exitStatus(scanStatus(result))
 		}
 
-		if len(issues) == 0 {
+		if result.Healthy() {
 			PrintSuccess("No issues found! Repository is healthy.")
 			return nil
 		}
 
 		// Display issues
-		PrintWarning(fmt.Sprintf("Found %d issue(s):", len(issues)))
+		lines := issueLines(result)
+		PrintWarning(fmt.Sprintf("Found %d issue(s):", len(lines)))
 		fmt.Println()
-		
-		for i, issue := range issues {
-			fmt.Printf("  %d. %s\n", i+1, issue.String())
+
+		for i, line := range lines {
+			fmt.Printf("  %d. %s\n", i+1, line)
 		}
 
 		fmt.Println()
 		PrintInfo("Run 'nsha fix' to automatically fix these issues")
 
-		return nil
+		return exitStatus(ExitIssues)
 	},
 }
 
+// issueLines describes the issues of a repository followed by those of its
+// submodules, which are prefixed with the submodule's path
+func issueLines(result *nsha.DiagnoseResult) []string {
+	var lines []string
+	for _, issue := range result.Issues {
+		lines = append(lines, issue.String())
+	}
+	for _, sub := range result.Submodules {
+		for _, line := range issueLines(sub) {
+			lines = append(lines, fmt.Sprintf("submodule %s: %s", sub.RepoPath, line))
+		}
+	}
+	return lines
+}
+
 func init() {
+	diagnoseCmd.Flags().BoolVar(&recurseSubmodules, "recurse-submodules", false, "Also diagnose checked out submodules, recursively")
 	rootCmd.AddCommand(diagnoseCmd)
 }
 
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rahul/nsha/pkg/nsha"
+)
+
+// Exit codes shared by diagnose, verify and fix so scripts can gate on them
+const (
+	ExitHealthy   = 0 // No issues found
+	ExitInternal  = 1 // nsha itself failed: bad flags, unreadable repository, git errors
+	ExitIssues    = 2 // Issues found (diagnose, verify, fix --dry-run)
+	ExitFixed     = 3 // fix repaired every issue and verification passed
+	ExitRemaining = 4 // fix ran but verification still reports issues
+	ExitAborted   = 5 // Interrupted, or a confirmation prompt was declined
+)
+
+// ExitError carries the process exit code for a command result. Err is nil
+// when the outcome was already reported and only the code matters.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	if e.Err == nil {
+		return ""
+	}
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// exitStatus ends a command with code without printing an error
+func exitStatus(code int) error {
+	if code == ExitHealthy {
+		return nil
+	}
+	return &ExitError{Code: code}
+}
+
+// ExitCode maps an error returned by Execute to the process exit code
+func ExitCode(err error) int {
+	var exitErr *ExitError
+	switch {
+	case err == nil:
+		return ExitHealthy
+	case errors.As(err, &exitErr):
+		return exitErr.Code
+	case errors.Is(err, nsha.ErrAborted), errors.Is(err, nsha.ErrCancelled), errors.Is(err, context.Canceled):
+		return ExitAborted
+	}
+	return ExitInternal
+}
+
+// scanStatus is the exit code of diagnose and verify
+func scanStatus(result *nsha.DiagnoseResult) int {
+	if result.Healthy() {
+		return ExitHealthy
+	}
+	return ExitIssues
+}
+
+// fixStatus is the exit code of fix. A dry run reports the issues it found.
+func fixStatus(result *nsha.FixResult) int {
+	switch {
+	case result.Healthy():
+		return ExitHealthy
+	case result.DryRun:
+		return ExitIssues
+	case len(result.AllFinalIssues()) > 0:
+		return ExitRemaining
+	}
+	return ExitFixed
+}
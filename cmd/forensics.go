@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/rahul/nsha/pkg/nsha"
+	"github.com/rahul/nsha/pkg/report"
+	"github.com/spf13/cobra"
+)
+
+var forensicsOut string
+
+var forensicsCmd = &cobra.Command{
+	Use:   "forensics",
+	Short: "Capture evidence of repository corruption without changing anything",
+	Long: `Writes a gzip-compressed tar archive with the raw bytes of every
+corrupt object and reference, their file metadata (mtime, size, inode,
+permissions), the git fsck output, the git version, the repository
+config and the newest reflog entries of every affected reference.
+manifest.json in the archive lists every file with its SHA-256 checksum.
+
+Use 'nsha fix --forensics' to collect the same bundle right before a fix.`,
+	Args: cobra.NoArgs,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := rootCmd.PersistentPreRunE(cmd, args); err != nil {
+			return err
+		}
+		if outputFormat == report.FormatSARIF {
+			return fmt.Errorf("forensics supports --output text or json")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manifest, err := nsha.Forensics(cmd.Context(), nsha.ForensicsOptions{
+			RepoPath: repoPath,
+			Events:   cliSink(),
+			Out:      forensicsOut,
+		})
+		if err != nil {
+			return err
+		}
+
+		if !textOutput() {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(manifest)
+		}
+		PrintSuccess(fmt.Sprintf("Evidence bundle written: %s", forensicsOut))
+		PrintInfo(fmt.Sprintf("%d issue(s), %d file(s) captured", len(manifest.Issues), len(manifest.Files)))
+		return nil
+	},
+}
+
+func init() {
+	forensicsCmd.Flags().StringVar(&forensicsOut, "out", "", "Path of the .tar.gz evidence bundle to write")
+	forensicsCmd.MarkFlagRequired("out")
+	rootCmd.AddCommand(forensicsCmd)
+}
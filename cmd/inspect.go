@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rahul/nsha/pkg/nsha"
+	"github.com/rahul/nsha/pkg/report"
+	"github.com/spf13/cobra"
+)
+
+// maxDumpBytes limits how much of a damaged region inspect prints
+const maxDumpBytes = 512
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <oid|path>",
+	Short: "Show an object as stored, even when git cannot parse it",
+	Long: `Reads an object from its loose file, pack or quarantine without
+requiring it to be well-formed, where git cat-file and go-git refuse.
+It shows the object header, the entries of trees including ones with
+bad modes, names, order or duplicates, the header lines of commits
+and tags, and a hexdump of every region that cannot be decoded.
+
+The object is named by a full or abbreviated ID, or by the path of a
+loose object file. The exit status is 2 when the object has problems.`,
+	Args: cobra.ExactArgs(1),
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := rootCmd.PersistentPreRunE(cmd, args); err != nil {
+			return err
+		}
+		if outputFormat == report.FormatSARIF {
+			return fmt.Errorf("inspect supports --output text or json")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		obj, err := nsha.Inspect(cmd.Context(), nsha.InspectOptions{RepoPath: repoPath, Events: cliSink()}, args[0])
+		if err != nil {
+			return err
+		}
+
+		if !textOutput() {
+			doc := struct {
+				SchemaVersion string `json:"schema_version"`
+				*nsha.RawObject
+			}{report.SchemaVersion, obj}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(doc); err != nil {
+				return err
+			}
+		} else {
+			printRawObject(obj)
+		}
+		if !obj.Healthy() {
+			return exitStatus(ExitIssues)
+		}
+		return nil
+	},
+}
+
+// printRawObject prints the header, problems, content and damaged regions
+// of an inspected object
+func printRawObject(obj *nsha.RawObject) {
+	hash := obj.Hash
+	if hash == "" {
+		hash = "(unknown)"
+	}
+	fmt.Printf("Object:  %s\n", hash)
+	fmt.Printf("Source:  %s\n", obj.Source)
+	if obj.Type != "" {
+		fmt.Printf("Type:    %s\n", obj.Type)
+		fmt.Printf("Size:    %d byte(s)\n", obj.Size)
+	}
+
+	if len(obj.Problems) > 0 {
+		fmt.Println()
+		PrintWarning(fmt.Sprintf("%d problem(s):", len(obj.Problems)))
+		for _, problem := range obj.Problems {
+			fmt.Printf("  - %s\n", problem)
+		}
+	}
+
+	switch obj.Type {
+	case "tree":
+		fmt.Printf("\nEntries (%d):\n", len(obj.Entries))
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, e := range obj.Entries {
+			kind := e.Type
+			if kind == "" {
+				kind = "?"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\n", e.StoredMode, kind, e.Hash, e.Name, strings.Join(e.Problems, "; "))
+		}
+		tw.Flush()
+	case "commit", "tag":
+		fmt.Println()
+		for _, line := range strings.Split(strings.TrimRight(string(obj.Data), "\n"), "\n") {
+			fmt.Printf("  %s\n", strings.ReplaceAll(line, "\x00", `\0`))
+		}
+	}
+
+	for _, r := range obj.Damaged {
+		where := "Content bytes"
+		if r.Stored {
+			where = "Stored bytes"
+		}
+		fmt.Println()
+		PrintWarning(fmt.Sprintf("%s %d-%d %s:", where, r.Start, r.End, r.Reason))
+		data := obj.Bytes(r)
+		if len(data) > maxDumpBytes {
+			fmt.Print(indent(nsha.Hexdump(data[:maxDumpBytes], r.Start)))
+			fmt.Printf("  ... %d more byte(s)\n", len(data)-maxDumpBytes)
+		} else {
+			fmt.Print(indent(nsha.Hexdump(data, r.Start)))
+		}
+	}
+}
+
+// indent indents every line of s by two spaces
+func indent(s string) string {
+	lines := strings.SplitAfter(s, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = "  " + line
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+}
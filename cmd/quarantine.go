@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rahul/nsha/pkg/nsha"
+	"github.com/rahul/nsha/pkg/report"
+	"github.com/spf13/cobra"
+)
+
+var (
+	restoreAll   bool
+	restoreForce bool
+)
+
+var quarantineCmd = &cobra.Command{
+	Use:   "quarantine",
+	Short: "List or restore damaged objects and conflict copies moved into quarantine",
+	Long: `nsha fix never deletes damaged loose objects. Empty, truncated,
+zero-filled and undecompressable object files are moved into
+.git/nsha-quarantine/ and recorded in its manifest.json, as are the
+cloud-sync conflict copies it merged. Use these commands to inspect
+them or put them back.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := rootCmd.PersistentPreRunE(cmd, args); err != nil {
+			return err
+		}
+		if outputFormat == report.FormatSARIF {
+			return fmt.Errorf("quarantine supports --output text or json")
+		}
+		return nil
+	},
+}
+
+var quarantineListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List quarantined objects",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		objects, err := nsha.ListQuarantine(nsha.QuarantineOptions{RepoPath: repoPath, Events: cliSink()})
+		if err != nil {
+			return err
+		}
+
+		if !textOutput() {
+			return writeQuarantineJSON(objects)
+		}
+		if len(objects) == 0 {
+			PrintInfo("No objects in quarantine")
+			return nil
+		}
+		printQuarantineTable(objects)
+		return nil
+	},
+}
+
+var quarantineRestoreCmd = &cobra.Command{
+	Use:   "restore [id|hash...]",
+	Short: "Move quarantined objects back into the object store",
+	Long: `Moves quarantined objects, named by ID or object hash, back to the
+location they were found at. An object that exists there again, for
+example because it was fetched, is only overwritten with --force.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := nsha.QuarantineOptions{RepoPath: repoPath, Events: cliSink(), Force: restoreForce}
+		if restoreAll {
+			objects, err := nsha.ListQuarantine(opts)
+			if err != nil {
+				return err
+			}
+			args = nil
+			for _, object := range objects {
+				args = append(args, object.ID)
+			}
+		}
+		if len(args) == 0 {
+			if restoreAll {
+				PrintInfo("No objects in quarantine")
+				return nil
+			}
+			return fmt.Errorf("name the objects to restore, or use --all")
+		}
+
+		restored, err := nsha.RestoreQuarantine(opts, args)
+		if !textOutput() {
+			if werr := writeQuarantineJSON(restored); werr != nil {
+				return werr
+			}
+		} else {
+			for _, object := range restored {
+				PrintSuccess(fmt.Sprintf("Restored %s to %s", object.ID, object.Path))
+			}
+		}
+		return err
+	},
+}
+
+// printQuarantineTable prints one row per quarantined object
+func printQuarantineTable(objects []nsha.QuarantinedObject) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tDAMAGE\tSIZE\tMOVED\tPATH")
+	for _, object := range objects {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", object.ID, object.Damage, object.Size,
+			object.Moved.Local().Format(time.DateTime), object.Path)
+	}
+	tw.Flush()
+}
+
+// writeQuarantineJSON prints quarantined objects as a JSON array
+func writeQuarantineJSON(objects []nsha.QuarantinedObject) error {
+	if objects == nil {
+		objects = []nsha.QuarantinedObject{}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(objects)
+}
+
+func init() {
+	quarantineRestoreCmd.Flags().BoolVar(&restoreAll, "all", false, "Restore every quarantined object")
+	quarantineRestoreCmd.Flags().BoolVar(&restoreForce, "force", false, "Overwrite objects that exist again at their original location")
+	quarantineCmd.AddCommand(quarantineListCmd, quarantineRestoreCmd)
+	rootCmd.AddCommand(quarantineCmd)
+}
@@ -1,18 +1,37 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
+	"github.com/rahul/nsha/pkg/events"
+	"github.com/rahul/nsha/pkg/progress"
+	"github.com/rahul/nsha/pkg/report"
 	"github.com/spf13/cobra"
 )
 
 var (
-	repoPath string
-	verbose  bool
+	repoPath     string
+	verbose      bool
+	progressFlag string
+	outputFlag   string
+
+	// recurseSubmodules is shared by diagnose, verify and fix
+	recurseSubmodules bool
 )
 
+// outputFormat is the parsed --output flag
+var outputFormat = report.FormatText
+
+// progressRenderer draws progress events on stderr, set up from --progress
+var progressRenderer *progress.Renderer
+
 var rootCmd = &cobra.Command{
 	Use:   "nsha",
 	Short: "Fix null SHA and broken tree issues in Git repositories",
@@ -27,15 +46,76 @@ var rootCmd = &cobra.Command{
 `),
 	Version:           "1.3.0",
 	CompletionOptions: cobra.CompletionOptions{DisableDefaultCmd: true},
+	// Execute prints errors itself, so that exit statuses stay quiet
+	SilenceErrors: true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		format, err := report.ParseFormat(outputFlag)
+		if err != nil {
+			return err
+		}
+		outputFormat = format
+		if !textOutput() {
+			// Keep stdout for the machine-readable result
+			color.Output = os.Stderr
+		}
+
+		mode, err := progress.ParseMode(progressFlag)
+		if err != nil {
+			return err
+		}
+		if mode == progress.ModeAuto {
+			switch {
+			case !textOutput():
+				mode = progress.ModeJSON
+			case isatty.IsTerminal(os.Stderr.Fd()) || isatty.IsCygwinTerminal(os.Stderr.Fd()):
+				mode = progress.ModeBar
+			default:
+				mode = progress.ModeLines
+			}
+		}
+		progressRenderer = progress.NewRenderer(os.Stderr, mode)
+
+		// Flags are valid; from here on errors are not usage mistakes
+		cmd.SilenceUsage = true
+		return nil
+	},
 }
 
+// Execute runs the root command and returns its error; ExitCode maps it to
+// the process exit code. SIGINT and SIGTERM cancel the command's context so
+// that long-running operations stop at the next safe point; a second signal
+// falls back to the default behaviour and terminates at once.
 func Execute() error {
-	return rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stop()
+			if progressRenderer != nil {
+				progressRenderer.Clear()
+			}
+			fmt.Fprintln(color.Output)
+			PrintWarning("Interrupt received - finishing the current step (press Ctrl+C again to force quit)")
+		case <-done:
+		}
+	}()
+
+	err := rootCmd.ExecuteContext(ctx)
+	if err != nil && err.Error() != "" {
+		rootCmd.PrintErrln("Error:", err)
+	}
+	return err
 }
 
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&repoPath, "repo", "r", ".", "Path to Git repository")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Verbose output")
+	rootCmd.PersistentFlags().StringVar(&progressFlag, "progress", "auto", "Progress output: auto, bar, lines, json or none")
+	rootCmd.PersistentFlags().StringVarP(&outputFlag, "output", "o", "text", "Result format: text, json or sarif")
 }
 
 // Helper functions for colored output
@@ -59,11 +139,67 @@ func PrintStep(step int, msg string) {
 	color.Cyan(fmt.Sprintf("\n[STEP %d] %s", step, msg))
 }
 
+// cliSink renders library events as colored terminal output.
+// Debug events are only shown with --verbose; progress goes to stderr.
+func cliSink() events.Sink {
+	var mu sync.Mutex
+	return events.SinkFunc(func(e events.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if e.Type == events.TypeProgress {
+			if progressRenderer != nil && e.Progress != nil {
+				progressRenderer.Render(*e.Progress)
+			}
+			return
+		}
+		if progressRenderer != nil {
+			progressRenderer.Clear()
+		}
+
+		switch e.Type {
+		case events.TypeStep:
+			PrintStep(e.Step, e.Message)
+		case events.TypeSuccess:
+			PrintSuccess(e.Message)
+		case events.TypeWarning:
+			PrintWarning(e.Message)
+		case events.TypeError:
+			PrintError(e.Message)
+		case events.TypeInfo:
+			PrintInfo(e.Message)
+		case events.TypeDetail:
+			fmt.Fprintf(color.Output, "  %s\n", e.Message)
+		case events.TypeDebug:
+			if verbose {
+				fmt.Fprintf(color.Output, "  %s\n", e.Message)
+			}
+		}
+	})
+}
+
+// textOutput reports whether results are printed for humans
+func textOutput() bool {
+	return outputFormat == report.FormatText
+}
+
+// writeFindings prints command results in the machine-readable --output format
+func writeFindings(f *report.Findings) error {
+	f.ToolVersion = rootCmd.Version
+	switch outputFormat {
+	case report.FormatJSON:
+		return report.WriteJSON(os.Stdout, f)
+	case report.FormatSARIF:
+		return report.WriteSARIF(os.Stdout, f)
+	}
+	return nil
+}
+
 func ExitWithError(msg string, err error) {
 	if err != nil {
 		PrintError(fmt.Sprintf("%s: %v", msg, err))
 	} else {
 		PrintError(msg)
 	}
-	os.Exit(1)
+	os.Exit(ExitInternal)
 }
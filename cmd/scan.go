@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rahul/nsha/pkg/nsha"
+	"github.com/rahul/nsha/pkg/report"
+	"github.com/spf13/cobra"
+)
+
+var (
+	scanJobs   int
+	scanFix    bool
+	scanReport string
+	scanLogDir string
+)
+
+var scanCmd = &cobra.Command{
+	Use:   "scan [root]",
+	Short: "Diagnose every repository under a directory",
+	Long: `Finds every bare and non-bare Git repository under root (default: current
+directory), diagnoses them concurrently and prints a summary table.
+With --fix, repositories with issues are fixed; each gets its own log
+directory and backup.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if outputFormat == report.FormatSARIF {
+			return fmt.Errorf("scan supports --output text or json; use --report for a CSV file")
+		}
+
+		root := "."
+		if len(args) > 0 {
+			root = args[0]
+		}
+
+		PrintStep(1, fmt.Sprintf("Scanning %s for repositories...", root))
+		result, err := nsha.Scan(cmd.Context(), nsha.ScanOptions{
+			Root:   root,
+			Jobs:   scanJobs,
+			Events: cliSink(),
+			Fix:    scanFix,
+			FixOptions: nsha.FixOptions{
+				DryRun:  dryRun,
+				Force:   force,
+				Confirm: confirmScanFix,
+				LogDir:  scanLogDir,
+			},
+		})
+		if result == nil || result.Repos == nil {
+			return err
+		}
+
+		findings := scanFindings(result)
+		if scanReport != "" {
+			if werr := writeScanReport(scanReport, findings); werr != nil {
+				return werr
+			}
+			PrintInfo(fmt.Sprintf("Report written to: %s", scanReport))
+		}
+
+		if textOutput() {
+			printScanTable(result)
+		} else if werr := report.WriteScanJSON(os.Stdout, findings); werr != nil {
+			return werr
+		}
+
+		if err != nil {
+			return err
+		}
+		return exitStatus(scanExitCode(result))
+	},
+}
+
+// confirmScanFix answers fix prompts without asking, since many repositories
+// are fixed at once. History is only rewritten with --yes.
+func confirmScanFix(p nsha.Prompt) bool {
+	return p == nsha.PromptRewriteHistory && yes
+}
+
+// scanFindings converts a scan result for the report writers
+func scanFindings(result *nsha.ScanResult) *report.ScanFindings {
+	f := &report.ScanFindings{
+		Root:        result.Root,
+		ToolVersion: rootCmd.Version,
+		StartTime:   result.StartTime,
+		EndTime:     result.StartTime.Add(result.Duration),
+	}
+	for _, repo := range result.Repos {
+		rf := report.RepoFindings{
+			Name:     repo.Name,
+			Path:     repo.Path,
+			Bare:     repo.Bare,
+			Status:   string(repo.Status),
+			Duration: repo.Duration,
+			Issues:   repo.Issues,
+		}
+		if repo.Err != nil {
+			rf.Error = repo.Err.Error()
+		}
+		if repo.Fix != nil && !repo.Fix.DryRun && !repo.Fix.Healthy() {
+			rf.Fixed = true
+			rf.Issues = repo.Fix.InitialIssues
+			rf.Remaining = repo.Fix.FinalIssues
+			rf.LogDir = repo.Fix.LogDir
+		}
+		f.Repos = append(f.Repos, rf)
+	}
+	return f
+}
+
+// writeScanReport writes the combined report, as CSV for *.csv files and JSON otherwise
+func writeScanReport(path string, f *report.ScanFindings) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create report: %w", err)
+	}
+	defer file.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = report.WriteScanCSV(file, f)
+	} else {
+		err = report.WriteScanJSON(file, f)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return file.Close()
+}
+
+// printScanTable prints one row per repository with an issue count column
+// for every issue type that was found
+func printScanTable(result *nsha.ScanResult) {
+	var types []nsha.IssueType
+	for _, t := range nsha.IssueTypes {
+		for _, repo := range result.Repos {
+			if countIssues(repo.Issues, t) > 0 {
+				types = append(types, t)
+				break
+			}
+		}
+	}
+
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := []string{"REPOSITORY", "STATUS", "ISSUES"}
+	for _, t := range types {
+		header = append(header, strings.ToUpper(string(t)))
+	}
+	header = append(header, "DURATION")
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+
+	for _, repo := range result.Repos {
+		name := repo.Name
+		if repo.Bare {
+			name += " (bare)"
+		}
+		row := []string{name, string(repo.Status), fmt.Sprint(len(repo.Issues))}
+		for _, t := range types {
+			row = append(row, fmt.Sprint(countIssues(repo.Issues, t)))
+		}
+		row = append(row, repo.Duration.Round(time.Millisecond).String())
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+	fmt.Println()
+
+	var failed []nsha.RepoScan
+	for _, repo := range result.Repos {
+		if repo.Err != nil {
+			failed = append(failed, repo)
+		}
+	}
+	if len(failed) > 0 {
+		PrintWarning(fmt.Sprintf("%d repositories could not be completed:", len(failed)))
+		for _, repo := range failed {
+			fmt.Printf("  %s: %v\n", repo.Name, repo.Err)
+		}
+		fmt.Println()
+	}
+
+	summary := fmt.Sprintf("Scanned %d repositories in %s: %d healthy, %d with issues",
+		len(result.Repos), result.Duration.Round(time.Millisecond),
+		result.Count(nsha.StatusHealthy), result.Count(nsha.StatusIssues))
+	if scanFix {
+		summary += fmt.Sprintf(", %d fixed, %d with remaining issues", result.Count(nsha.StatusFixed), result.Count(nsha.StatusRemaining))
+	}
+	if n := result.Count(nsha.StatusFailed); n > 0 {
+		summary += fmt.Sprintf(", %d failed", n)
+	}
+	PrintInfo(summary)
+	if result.LogDir != "" && result.Count(nsha.StatusFixed)+result.Count(nsha.StatusRemaining) > 0 {
+		PrintInfo(fmt.Sprintf("Per-repository logs and backups saved under: %s", result.LogDir))
+	}
+}
+
+// countIssues counts the issues of one type
+func countIssues(issues []nsha.Issue, t nsha.IssueType) int {
+	n := 0
+	for _, issue := range issues {
+		if issue.Type == t {
+			n++
+		}
+	}
+	return n
+}
+
+// scanExitCode reports the most important outcome across all repositories:
+// unfixed problems first, then interruptions and failures, then fixes
+func scanExitCode(result *nsha.ScanResult) int {
+	for _, c := range []struct {
+		status nsha.RepoStatus
+		code   int
+	}{
+		{nsha.StatusRemaining, ExitRemaining},
+		{nsha.StatusIssues, ExitIssues},
+		{nsha.StatusAborted, ExitAborted},
+		{nsha.StatusFailed, ExitInternal},
+		{nsha.StatusFixed, ExitFixed},
+	} {
+		if result.Count(c.status) > 0 {
+			return c.code
+		}
+	}
+	return ExitHealthy
+}
+
+func init() {
+	scanCmd.Flags().IntVarP(&scanJobs, "jobs", "j", 0, "Repositories to process in parallel (default: number of CPUs)")
+	scanCmd.Flags().BoolVar(&scanFix, "fix", false, "Fix repositories with issues")
+	scanCmd.Flags().BoolVar(&dryRun, "dry-run", false, "With --fix, show what would be done without making changes")
+	scanCmd.Flags().BoolVarP(&force, "force", "f", false, "With --fix, force history rewrites even if there are warnings")
+	scanCmd.Flags().BoolVarP(&yes, "yes", "y", false, "With --fix, allow history rewrites without asking")
+	scanCmd.Flags().StringVar(&scanReport, "report", "", "Write a combined report to this file (CSV for *.csv, JSON otherwise)")
+	scanCmd.Flags().StringVar(&scanLogDir, "log-dir", "", "With --fix, parent directory of the per-repository logs (default: ~/nsha/<timestamp>)")
+	rootCmd.AddCommand(scanCmd)
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/rahul/nsha/pkg/nsha"
+	"github.com/rahul/nsha/pkg/report"
+	"github.com/spf13/cobra"
+)
+
+var timelineCmd = &cobra.Command{
+	Use:   "timeline",
+	Short: "Show when the repository was damaged",
+	Long: `Correlates the modification times of damaged loose objects, ref files
+and other files with the newest reflog entries of the affected references
+and the commit and author dates of their last good commits. Events are
+listed oldest first, damage marked with "!", followed by the incident
+window: from the last activity known to be good to the last damaged write.
+
+Compare the window with antivirus scans, sync client activity or crashes
+to find out what damaged the repository.`,
+	Args: cobra.NoArgs,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := rootCmd.PersistentPreRunE(cmd, args); err != nil {
+			return err
+		}
+		if outputFormat == report.FormatSARIF {
+			return fmt.Errorf("timeline supports --output text or json")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		timeline, err := nsha.BuildTimeline(cmd.Context(), nsha.TimelineOptions{RepoPath: repoPath, Events: cliSink()})
+		if err != nil {
+			return err
+		}
+
+		if !textOutput() {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(timeline)
+		}
+		timeline.WriteSummary(os.Stdout)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(timelineCmd)
+}
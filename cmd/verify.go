@@ -2,8 +2,10 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
 
-	"github.com/rahul/nsha/pkg/git"
+	"github.com/rahul/nsha/pkg/nsha"
+	"github.com/rahul/nsha/pkg/report"
 	"github.com/spf13/cobra"
 )
 
@@ -13,14 +15,39 @@ var verifyCmd = &cobra.Command{
 	Long:  `Checks if the repository is healthy and has no corrupt objects`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		PrintStep(1, "Verifying repository integrity...")
-		
-		err := git.VerifyRepository(repoPath)
+
+		result, err := nsha.Verify(cmd.Context(), nsha.DiagnoseOptions{
+			RepoPath:          repoPath,
+			Events:            cliSink(),
+			RecurseSubmodules: recurseSubmodules,
+		})
 		if err != nil {
+			return err
+		}
+
+		if !textOutput() {
+			err := writeFindings(&report.Findings{
+				Command:   "verify",
+				RepoPath:  result.RepoPath,
+				StartTime: result.StartTime,
+				EndTime:   result.StartTime.Add(result.Duration),
+				Issues:    result.AllIssues(),
+			})
+			if err != nil {
+				return err
+			}
+			return exitStatus(scanStatus(result))
+		}
+
+		if !result.Healthy() {
+			msgs := issueLines(result)
+			err = fmt.Errorf("found %d issue(s):\n%s", len(msgs), strings.Join(msgs, "\n"))
+
 			PrintError(fmt.Sprintf("Repository has issues: %v", err))
 			fmt.Println()
 			PrintInfo("Run 'nsha diagnose' for detailed information")
 			PrintInfo("Run 'nsha fix' to fix the issues")
-			return err
+			return exitStatus(ExitIssues)
 		}
 
 		PrintSuccess("Repository is healthy! No issues found.")
@@ -29,6 +56,7 @@ var verifyCmd = &cobra.Command{
 }
 
 func init() {
+	verifyCmd.Flags().BoolVar(&recurseSubmodules, "recurse-submodules", false, "Also verify checked out submodules, recursively")
 	rootCmd.AddCommand(verifyCmd)
 }
 
@@ -1,11 +1,17 @@
 package backup
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
 	"time"
+
+	"github.com/rahul/nsha/pkg/events"
+	"github.com/rahul/nsha/pkg/git"
+	"github.com/rahul/nsha/pkg/gitdir"
+	"github.com/rahul/nsha/pkg/progress"
 )
 
 // BackupInfo contains information about a backup
@@ -18,11 +24,13 @@ type BackupInfo struct {
 }
 
 // CreateBackup creates a full backup of the repository before modifications
-// This includes ALL history, branches, tags, refs, and objects
-func CreateBackup(repoPath, logDir string, verbose bool) (*BackupInfo, error) {
-	if verbose {
-		fmt.Println("  Creating complete repository backup with full history...")
-	}
+// This includes ALL history, branches, tags, refs, and objects.
+// The backup is written outside the repository, so cancelling ctx only
+// leaves an incomplete backup behind and never touches the repository itself.
+func CreateBackup(ctx context.Context, repoPath, logDir string, sink events.Sink) (*BackupInfo, error) {
+	em := events.Emitter{Sink: sink}
+
+	em.Debugf("Creating complete repository backup with full history...")
 
 	// Create backup directory
 	backupDir := filepath.Join(logDir, "backup")
@@ -35,53 +43,49 @@ func CreateBackup(repoPath, logDir string, verbose bool) (*BackupInfo, error) {
 
 	// Try git bundle first (preferred method for healthy repos)
 	// --all ensures we capture everything including all branches, tags, and refs
-	cmd := exec.Command("git", "bundle", "create", backupPath, "--all", "--branches", "--tags", "--remotes")
-	cmd.Dir = repoPath
-	_, err = cmd.CombinedOutput()
+	cmd := git.Command(ctx, repoPath, "bundle", "create", "--progress", backupPath, "--all", "--branches", "--tags", "--remotes")
+	out := progress.NewGitWriter(em)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err = cmd.Run()
+	out.Output()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
 
 	// If git bundle fails (e.g., due to broken refs), fall back to directory copy
 	if err != nil {
-		if verbose {
-			fmt.Println("  Git bundle failed, falling back to .git directory copy...")
-		}
-		return createDirectoryCopyBackup(repoPath, logDir, verbose)
+		em.Debugf("Git bundle failed, falling back to .git directory copy...")
+		return createDirectoryCopyBackup(ctx, repoPath, logDir, sink)
 	}
 
-	if verbose {
-		fmt.Println("  Backing up all references...")
-	}
+	em.Debugf("Backing up all references...")
 
 	// Backup all refs (branches, tags, remotes, etc.)
 	refsBackupPath := filepath.Join(backupDir, "refs-backup.txt")
-	refsCmd := exec.Command("git", "for-each-ref", "--format=%(refname) %(objectname) %(objecttype)")
-	refsCmd.Dir = repoPath
+	refsCmd := git.Command(ctx, repoPath, "for-each-ref", "--format=%(refname) %(objectname) %(objecttype)")
 	refsOutput, err := refsCmd.CombinedOutput()
 	if err != nil {
-		if verbose {
-			fmt.Printf("  Warning: Could not backup refs: %v\n", err)
-		}
+		em.Debugf("Warning: Could not backup refs: %v", err)
 	} else {
 		err = os.WriteFile(refsBackupPath, refsOutput, 0644)
 		if err != nil {
-			if verbose {
-				fmt.Printf("  Warning: Could not write refs backup: %v\n", err)
-			}
+			em.Debugf("Warning: Could not write refs backup: %v", err)
 		}
 	}
 
 	// Backup packed-refs if it exists (contains packed references)
-	packedRefsPath := filepath.Join(repoPath, ".git", "packed-refs")
+	dir := gitdir.ResolveOrDefault(repoPath)
+	packedRefsPath := dir.Path("packed-refs")
 	if _, err := os.Stat(packedRefsPath); err == nil {
-		if verbose {
-			fmt.Println("  Backing up packed-refs...")
-		}
+		em.Debugf("Backing up packed-refs...")
 		packedRefsBackup := filepath.Join(backupDir, "packed-refs")
 		input, _ := os.ReadFile(packedRefsPath)
 		os.WriteFile(packedRefsBackup, input, 0644)
 	}
 
 	// Backup HEAD
-	headPath := filepath.Join(repoPath, ".git", "HEAD")
+	headPath := dir.Path("HEAD")
 	if _, err := os.Stat(headPath); err == nil {
 		headBackup := filepath.Join(backupDir, "HEAD")
 		input, _ := os.ReadFile(headPath)
@@ -89,7 +93,7 @@ func CreateBackup(repoPath, logDir string, verbose bool) (*BackupInfo, error) {
 	}
 
 	// Backup config
-	configPath := filepath.Join(repoPath, ".git", "config")
+	configPath := dir.Path("config")
 	if _, err := os.Stat(configPath); err == nil {
 		configBackup := filepath.Join(backupDir, "config")
 		input, _ := os.ReadFile(configPath)
@@ -110,9 +114,7 @@ func CreateBackup(repoPath, logDir string, verbose bool) (*BackupInfo, error) {
 		Method:       "bundle",
 	}
 
-	if verbose {
-		fmt.Printf("  Backup created: %s (%.2f MB)\n", backupPath, float64(info.Size)/(1024*1024))
-	}
+	em.Debugf("Backup created: %s (%.2f MB)", backupPath, float64(info.Size)/(1024*1024))
 
 	// Write backup info file
 	infoPath := filepath.Join(backupDir, "backup-info.txt")
@@ -146,9 +148,7 @@ Note: This backup was created before NSHA modifications.
 
 	err = os.WriteFile(infoPath, []byte(infoContent), 0644)
 	if err != nil {
-		if verbose {
-			fmt.Printf("  Warning: Could not write backup info: %v\n", err)
-		}
+		em.Debugf("Warning: Could not write backup info: %v", err)
 	}
 
 	return info, nil
@@ -156,10 +156,10 @@ Note: This backup was created before NSHA modifications.
 
 // createDirectoryCopyBackup creates a backup by copying the entire repository folder
 // This is used as a fallback when git bundle fails (e.g., due to broken refs)
-func createDirectoryCopyBackup(repoPath, logDir string, verbose bool) (*BackupInfo, error) {
-	if verbose {
-		fmt.Println("  Copying entire repository folder to ensure complete backup...")
-	}
+func createDirectoryCopyBackup(ctx context.Context, repoPath, logDir string, sink events.Sink) (*BackupInfo, error) {
+	em := events.Emitter{Sink: sink}
+
+	em.Debugf("Copying entire repository folder to ensure complete backup...")
 
 	backupDir := filepath.Join(logDir, "backup")
 	repoBackupDir := filepath.Join(backupDir, "repository")
@@ -169,8 +169,22 @@ func createDirectoryCopyBackup(repoPath, logDir string, verbose bool) (*BackupIn
 		return nil, fmt.Errorf("repository not found at %s", repoPath)
 	}
 
+	// Git data kept outside the repository folder (gitfiles, linked
+	// worktrees, GIT_DIR) is copied next to it
+	external := externalGitDirs(repoPath, gitdir.ResolveOrDefault(repoPath))
+	total := countFiles(repoPath)
+	for _, dir := range external {
+		total += countFiles(dir.src)
+	}
+
 	// Copy entire repository folder recursively
-	err := copyDir(repoPath, repoBackupDir)
+	tracker := progress.New(em, "Copying repository files", total)
+	err := copyDir(ctx, repoPath, repoBackupDir, tracker)
+	for i := 0; err == nil && i < len(external); i++ {
+		em.Debugf("Copying git directory %s...", external[i].src)
+		err = copyDir(ctx, external[i].src, filepath.Join(backupDir, external[i].name), tracker)
+	}
+	tracker.Finish()
 	if err != nil {
 		return nil, fmt.Errorf("failed to copy repository: %w", err)
 	}
@@ -192,9 +206,7 @@ func createDirectoryCopyBackup(repoPath, logDir string, verbose bool) (*BackupIn
 		Method:       "directory-copy",
 	}
 
-	if verbose {
-		fmt.Printf("  Backup created: %s (%.2f MB)\n", repoBackupDir, float64(totalSize)/(1024*1024))
-	}
+	em.Debugf("Backup created: %s (%.2f MB)", repoBackupDir, float64(totalSize)/(1024*1024))
 
 	// Write backup info file
 	infoPath := filepath.Join(backupDir, "backup-info.txt")
@@ -222,6 +234,8 @@ To restore this backup:
 
 Note: This backup contains the COMPLETE repository folder including
 all files, .git directory, objects, refs, and configuration files.
+Git directories kept outside the repository folder (linked worktrees,
+gitfiles, GIT_DIR) are copied to git-common-dir/ and git-dir/ next to it.
 This method was used because git bundle failed (likely due to broken
 references).
 `, repoPath, repoBackupDir, info.Timestamp.Format("2006-01-02 15:04:05"),
@@ -229,16 +243,56 @@ references).
 
 	err = os.WriteFile(infoPath, []byte(infoContent), 0644)
 	if err != nil {
-		if verbose {
-			fmt.Printf("  Warning: Could not write backup info: %v\n", err)
-		}
+		em.Debugf("Warning: Could not write backup info: %v", err)
 	}
 
 	return info, nil
 }
 
-// copyDir recursively copies a directory
-func copyDir(src, dst string) error {
+// gitDirCopy is a git directory outside the repository folder and the
+// name of its copy in the backup directory
+type gitDirCopy struct {
+	src  string
+	name string
+}
+
+// externalGitDirs lists the git directories that a copy of repoPath would miss
+func externalGitDirs(repoPath string, dir *gitdir.Dir) []gitDirCopy {
+	var dirs []gitDirCopy
+	if !within(dir.CommonDir, repoPath) {
+		dirs = append(dirs, gitDirCopy{src: dir.CommonDir, name: "git-common-dir"})
+	}
+	if !within(dir.GitDir, repoPath) && !within(dir.GitDir, dir.CommonDir) {
+		dirs = append(dirs, gitDirCopy{src: dir.GitDir, name: "git-dir"})
+	}
+	return dirs
+}
+
+// within reports whether path is parent or below it
+func within(path, parent string) bool {
+	absPath, err1 := filepath.Abs(path)
+	absParent, err2 := filepath.Abs(parent)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absParent, absPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// countFiles counts the regular files below dir, for progress reporting
+func countFiles(dir string) int64 {
+	var count int64
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+// copyDir recursively copies a directory, stopping between files when ctx is cancelled
+func copyDir(ctx context.Context, src, dst string, tracker *progress.Tracker) error {
 	// Get source directory info
 	srcInfo, err := os.Stat(src)
 	if err != nil {
@@ -259,6 +313,10 @@ func copyDir(src, dst string) error {
 
 	// Copy each entry
 	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// Skip .nsha or nsha directories to avoid backing up old backups
 		if entry.Name() == ".nsha" || entry.Name() == "nsha" {
 			continue
@@ -269,7 +327,7 @@ func copyDir(src, dst string) error {
 
 		if entry.IsDir() {
 			// Recursively copy subdirectory
-			err = copyDir(srcPath, dstPath)
+			err = copyDir(ctx, srcPath, dstPath, tracker)
 			if err != nil {
 				return err
 			}
@@ -279,6 +337,7 @@ func copyDir(src, dst string) error {
 			if err != nil {
 				return err
 			}
+			tracker.Add(1)
 		}
 	}
 
@@ -315,22 +374,20 @@ func copyFile(src, dst string) error {
 // VerifyBackup verifies that a backup is valid
 // For bundle backups, it uses git bundle verify
 // For directory-copy backups, it checks if the directory exists and contains .git
-func VerifyBackup(backupInfo *BackupInfo, verbose bool) error {
-	if verbose {
-		fmt.Printf("  Verifying backup: %s\n", backupInfo.BackupPath)
-	}
+func VerifyBackup(ctx context.Context, backupInfo *BackupInfo, sink events.Sink) error {
+	em := events.Emitter{Sink: sink}
+
+	em.Debugf("Verifying backup: %s", backupInfo.BackupPath)
 
 	if backupInfo.Method == "bundle" {
 		// Verify git bundle
-		cmd := exec.Command("git", "bundle", "verify", backupInfo.BackupPath)
+		cmd := git.Command(ctx, "", "bundle", "verify", backupInfo.BackupPath)
 		output, err := cmd.CombinedOutput()
 		if err != nil {
 			return fmt.Errorf("bundle verification failed: %w\nOutput: %s", err, string(output))
 		}
 
-		if verbose {
-			fmt.Println("  [SUCCESS] Bundle backup verified successfully")
-		}
+		em.Debugf("Bundle backup verified successfully")
 	} else if backupInfo.Method == "directory-copy" {
 		// Verify directory copy backup
 		// Check if backup directory exists
@@ -338,15 +395,14 @@ func VerifyBackup(backupInfo *BackupInfo, verbose bool) error {
 			return fmt.Errorf("backup directory not found: %s", backupInfo.BackupPath)
 		}
 
-		// Check if .git directory exists in backup
+		// Check that the backup holds git data: a .git folder or gitfile,
+		// or the copied folder is itself a bare repository
 		gitDir := filepath.Join(backupInfo.BackupPath, ".git")
-		if _, err := os.Stat(gitDir); os.IsNotExist(err) {
+		if _, err := os.Stat(gitDir); os.IsNotExist(err) && !gitdir.IsGitDir(backupInfo.BackupPath) {
 			return fmt.Errorf("backup directory does not contain .git folder: %s", backupInfo.BackupPath)
 		}
 
-		if verbose {
-			fmt.Println("  [SUCCESS] Directory copy backup verified successfully")
-		}
+		em.Debugf("Directory copy backup verified successfully")
 	} else {
 		return fmt.Errorf("unknown backup method: %s", backupInfo.Method)
 	}
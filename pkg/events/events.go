@@ -0,0 +1,124 @@
+package events
+
+import (
+	"fmt"
+	"time"
+)
+
+// Type classifies an event so consumers can decide how to present it
+type Type string
+
+const (
+	TypeStep     Type = "step"     // A new numbered phase of an operation started
+	TypeInfo     Type = "info"     // General information
+	TypeSuccess  Type = "success"  // Something completed successfully
+	TypeWarning  Type = "warning"  // Something went wrong but the operation continues
+	TypeError    Type = "error"    // Something failed
+	TypeDetail   Type = "detail"   // A line of detail that belongs to the current step
+	TypeDebug    Type = "debug"    // Verbose diagnostics, usually hidden
+	TypeProgress Type = "progress" // Progress of a long-running task, see Event.Progress
+)
+
+// Event is a single message reported by a running operation
+type Event struct {
+	Time    time.Time
+	Type    Type
+	Step    int // Step number, only set for TypeStep
+	Message string
+
+	// Progress is only set for TypeProgress
+	Progress *Progress
+}
+
+// Progress describes how far a long-running task has got
+type Progress struct {
+	Task     string        // What is being done, e.g. "Rewriting commits"
+	Done     int64         // Items completed so far
+	Total    int64         // Total items, 0 when unknown
+	Rate     float64       // Items per second since the task started
+	Elapsed  time.Duration // Time since the task started
+	ETA      time.Duration // Estimated time remaining, 0 when unknown
+	Finished bool          // Set on the last event of the task
+}
+
+// Percent returns the completed share of the task, or -1 when the total is unknown
+func (p Progress) Percent() float64 {
+	if p.Total <= 0 {
+		return -1
+	}
+	return float64(p.Done) * 100 / float64(p.Total)
+}
+
+// Sink receives events from library operations.
+// Implementations must be safe for concurrent use: progress of tasks that
+// report no counts of their own is emitted from a background goroutine.
+type Sink interface {
+	Emit(Event)
+}
+
+// SinkFunc adapts a plain function to the Sink interface
+type SinkFunc func(Event)
+
+// Emit calls f(e)
+func (f SinkFunc) Emit(e Event) {
+	f(e)
+}
+
+// Discard is a Sink that drops every event
+var Discard Sink = SinkFunc(func(Event) {})
+
+// Emitter wraps a Sink with formatting helpers. The zero value discards events.
+type Emitter struct {
+	Sink Sink
+}
+
+// Emit stamps e with the current time and forwards it to the sink
+func (em Emitter) Emit(e Event) {
+	if em.Sink == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	em.Sink.Emit(e)
+}
+
+// Step reports the start of a numbered phase
+func (em Emitter) Step(step int, msg string) {
+	em.Emit(Event{Type: TypeStep, Step: step, Message: msg})
+}
+
+// Infof reports general information
+func (em Emitter) Infof(format string, args ...interface{}) {
+	em.Emit(Event{Type: TypeInfo, Message: fmt.Sprintf(format, args...)})
+}
+
+// Successf reports a successful result
+func (em Emitter) Successf(format string, args ...interface{}) {
+	em.Emit(Event{Type: TypeSuccess, Message: fmt.Sprintf(format, args...)})
+}
+
+// Warnf reports a non-fatal problem
+func (em Emitter) Warnf(format string, args ...interface{}) {
+	em.Emit(Event{Type: TypeWarning, Message: fmt.Sprintf(format, args...)})
+}
+
+// Errorf reports a failure
+func (em Emitter) Errorf(format string, args ...interface{}) {
+	em.Emit(Event{Type: TypeError, Message: fmt.Sprintf(format, args...)})
+}
+
+// Detailf reports a detail line of the current step
+func (em Emitter) Detailf(format string, args ...interface{}) {
+	em.Emit(Event{Type: TypeDetail, Message: fmt.Sprintf(format, args...)})
+}
+
+// Progress reports how far a long-running task has got
+func (em Emitter) Progress(p Progress) {
+	em.Emit(Event{Type: TypeProgress, Message: p.Task, Progress: &p})
+}
+
+// Debugf reports verbose diagnostics
+func (em Emitter) Debugf(format string, args ...interface{}) {
+	em.Emit(Event{Type: TypeDebug, Message: fmt.Sprintf(format, args...)})
+}
@@ -0,0 +1,52 @@
+package git
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/rahul/nsha/pkg/gitdir"
+	"github.com/rahul/nsha/pkg/progress"
+)
+
+// gitWaitDelay is how long an interrupted git process gets to remove its lock
+// files and exit before it is killed
+const gitWaitDelay = 10 * time.Second
+
+// gitCommand builds a git command bound to ctx and run inside repoPath.
+// When ctx is cancelled git receives an interrupt first (so it can clean up
+// *.lock files the same way it does on Ctrl+C) and is only killed if it has
+// not exited after gitWaitDelay. GIT_DIR and the related variables only
+// reach git for the top-level repository.
+func gitCommand(ctx context.Context, repoPath string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = repoPath
+	cmd.Env = gitdir.Environ(repoPath)
+	cmd.Cancel = func() error {
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			// Interrupts are not supported on every platform (e.g. Windows)
+			return cmd.Process.Kill()
+		}
+		return nil
+	}
+	cmd.WaitDelay = gitWaitDelay
+	return cmd
+}
+
+// Command is gitCommand for the other packages that run git
+func Command(ctx context.Context, repoPath string, args ...string) *exec.Cmd {
+	return gitCommand(ctx, repoPath, args...)
+}
+
+// runGitProgress runs a git command that reports progress on stderr (most
+// need --progress when stderr is not a terminal). Progress is reported
+// through opts.Events; the rest of the output is returned like CombinedOutput.
+func runGitProgress(ctx context.Context, opts Options, args ...string) ([]byte, error) {
+	cmd := gitCommand(ctx, opts.RepoPath, args...)
+	out := progress.NewGitWriter(opts.emit())
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := cmd.Run()
+	return out.Output(), err
+}
@@ -0,0 +1,430 @@
+package git
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// commitGraphMagic starts every commit-graph file
+const commitGraphMagic = "CGPH"
+
+const (
+	// commitGraphNoParent fills a parent slot that is not used
+	commitGraphNoParent = 0x70000000
+	// commitGraphExtraEdges marks a second parent slot that points into the
+	// EDGE chunk, which lists the parents of octopus merges
+	commitGraphExtraEdges = 0x80000000
+)
+
+// chunkFile holds the chunks of a commit-graph or multi-pack-index by ID.
+// Both are a header, a table of contents, the chunks it lists and a checksum
+// of everything before it.
+type chunkFile map[string][]byte
+
+// parseChunkFile checks the checksum of a chunk file and reads the table of
+// contents at tocAt
+func parseChunkFile(data []byte, tocAt, numChunks int, format ObjectFormat) (chunkFile, error) {
+	if err := verifyTrailer(data, format); err != nil {
+		return nil, err
+	}
+	end := len(data) - format.HexSize()/2
+	chunksAt := tocAt + (numChunks+1)*12
+	if chunksAt > end {
+		return nil, fmt.Errorf("table of contents is truncated")
+	}
+
+	chunks := make(chunkFile)
+	for i := 0; i < numChunks; i++ {
+		entry := data[tocAt+i*12:]
+		id := string(entry[:4])
+		start, next := binary.BigEndian.Uint64(entry[4:]), binary.BigEndian.Uint64(entry[16:])
+		if start < uint64(chunksAt) || start > next || next > uint64(end) {
+			return nil, fmt.Errorf("chunk %s is out of bounds", id)
+		}
+		chunks[id] = data[start:next]
+	}
+	if binary.BigEndian.Uint32(data[tocAt+numChunks*12:]) != 0 {
+		return nil, fmt.Errorf("table of contents is not terminated")
+	}
+	return chunks, nil
+}
+
+// commitGraphLayer is a commit-graph file: the only one, or one layer of a
+// split commit-graph chain
+type commitGraphLayer struct {
+	file    string
+	bases   []string // Hashes of the layers below, from the BASE chunk
+	commits []graphCommit
+}
+
+// graphCommit is a commit as a commit-graph records it. Parents are
+// positions in the whole chain, counting from the first commit of the base.
+type graphCommit struct {
+	hash    string
+	tree    string
+	parents []uint32
+}
+
+// readCommitGraph reads and validates the structure of a commit-graph file
+func readCommitGraph(file string, format ObjectFormat) (*commitGraphLayer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	layer, err := parseCommitGraph(data, format)
+	if err != nil {
+		return nil, err
+	}
+	layer.file = file
+	return layer, nil
+}
+
+// parseCommitGraph parses a commit-graph file
+func parseCommitGraph(data []byte, format ObjectFormat) (*commitGraphLayer, error) {
+	if len(data) < 8 || string(data[:4]) != commitGraphMagic {
+		return nil, fmt.Errorf("not a commit-graph")
+	}
+	if data[4] != 1 {
+		return nil, fmt.Errorf("unsupported commit-graph version %d", data[4])
+	}
+	if want := graphHashVersion(format); data[5] != want {
+		return nil, fmt.Errorf("hash version %d does not match the %s repository", data[5], format)
+	}
+	chunks, err := parseChunkFile(data, 8, int(data[6]), format)
+	if err != nil {
+		return nil, err
+	}
+
+	hs := format.HexSize() / 2
+	fanout, oids, cdat := chunks["OIDF"], chunks["OIDL"], chunks["CDAT"]
+	if len(fanout) != 256*4 {
+		return nil, fmt.Errorf("OIDF chunk is missing or has the wrong size")
+	}
+	count, err := readFanout(fanout, 0, len(fanout))
+	if err != nil {
+		return nil, err
+	}
+	if len(oids) != count*hs || len(cdat) != count*(hs+16) {
+		return nil, fmt.Errorf("OIDL or CDAT chunk does not hold %d commits", count)
+	}
+
+	layer := &commitGraphLayer{}
+	if numBase := int(data[7]); numBase > 0 {
+		base := chunks["BASE"]
+		if len(base) != numBase*hs {
+			return nil, fmt.Errorf("BASE chunk does not list %d graphs", numBase)
+		}
+		for i := 0; i < numBase; i++ {
+			layer.bases = append(layer.bases, hex.EncodeToString(base[i*hs:(i+1)*hs]))
+		}
+	}
+
+	var hashes []string
+	edges := chunks["EDGE"]
+	for i := 0; i < count; i++ {
+		entry := cdat[i*(hs+16):]
+		c := graphCommit{hash: hex.EncodeToString(oids[i*hs : (i+1)*hs]), tree: hex.EncodeToString(entry[:hs])}
+		if i > 0 && hashes[i-1] >= c.hash {
+			return nil, fmt.Errorf("OIDL chunk is not sorted at %s", c.hash)
+		}
+		hashes = append(hashes, c.hash)
+
+		first, second := binary.BigEndian.Uint32(entry[hs:]), binary.BigEndian.Uint32(entry[hs+4:])
+		if first != commitGraphNoParent {
+			c.parents = append(c.parents, first)
+		}
+		switch {
+		case second == commitGraphNoParent:
+		case second&commitGraphExtraEdges != 0:
+			// Every parent after the first, the last one marked by the top bit
+			for at := int(second&^commitGraphExtraEdges) * 4; ; at += 4 {
+				if at+4 > len(edges) {
+					return nil, fmt.Errorf("commit %s has parents past the EDGE chunk", c.hash)
+				}
+				edge := binary.BigEndian.Uint32(edges[at:])
+				c.parents = append(c.parents, edge&^commitGraphExtraEdges)
+				if edge&commitGraphExtraEdges != 0 {
+					break
+				}
+			}
+		default:
+			c.parents = append(c.parents, second)
+		}
+		layer.commits = append(layer.commits, c)
+	}
+	if err := checkFanout(fanout, hashes); err != nil {
+		return nil, err
+	}
+	return layer, nil
+}
+
+// graphHashVersion returns how commit-graphs and multi-pack-indexes name the
+// object format
+func graphHashVersion(format ObjectFormat) byte {
+	if format == ObjectFormatSHA256 {
+		return 2
+	}
+	return 1
+}
+
+// commitGraphFiles returns the commit-graph file and the split chain file of
+// the repository
+func commitGraphFiles(opts Options) (single, chain string) {
+	d := opts.gitDir()
+	return d.Path("objects", "info", "commit-graph"), d.Path("objects", "info", "commit-graphs", "commit-graph-chain")
+}
+
+// checkCommitGraphs validates the commit-graph and every layer of a split
+// commit-graph chain against the object store. Graphs left behind after
+// history was rewritten or objects were pruned or quarantined list commits
+// that no longer exist, and git reports them as errors.
+func checkCommitGraphs(ctx context.Context, opts Options, repo store) []Issue {
+	format := opts.objectFormat()
+	single, chain := commitGraphFiles(opts)
+
+	var issues []Issue
+	if _, err := os.Stat(single); err == nil {
+		layer, err := readCommitGraph(single, format)
+		switch {
+		case err != nil:
+			issues = append(issues, commitGraphIssue(opts, single, fmt.Sprintf("Cannot read commit-graph: %v", err)))
+		case len(layer.bases) > 0:
+			issues = append(issues, commitGraphIssue(opts, single, "Names base graphs but is not part of a split chain"))
+		default:
+			issues = append(issues, checkGraphCommits(ctx, opts, repo, []*commitGraphLayer{layer})...)
+		}
+	}
+
+	content, err := os.ReadFile(chain)
+	if err != nil {
+		return issues
+	}
+	var layers []*commitGraphLayer
+	var names []string
+	for _, name := range splitLines(string(content)) {
+		file := filepath.Join(filepath.Dir(chain), "graph-"+name+".graph")
+		layer, err := readCommitGraph(file, format)
+		if err != nil {
+			message := fmt.Sprintf("Cannot read commit-graph layer: %v", err)
+			if os.IsNotExist(err) {
+				file, message = chain, fmt.Sprintf("Chain lists graph-%s.graph, which does not exist", name)
+			}
+			return append(issues, commitGraphIssue(opts, file, message))
+		}
+		if strings.Join(layer.bases, " ") != strings.Join(names, " ") {
+			return append(issues, commitGraphIssue(opts, file, "Base graphs do not match the layers below it in the chain"))
+		}
+		names = append(names, name)
+		layers = append(layers, layer)
+	}
+	return append(issues, checkGraphCommits(ctx, opts, repo, layers)...)
+}
+
+// checkGraphCommits checks that every commit of a chain of layers exists
+// with the tree and parents the graph records, reporting one issue per layer
+func checkGraphCommits(ctx context.Context, opts Options, repo store, layers []*commitGraphLayer) []Issue {
+	var all []graphCommit
+	for _, layer := range layers {
+		all = append(all, layer.commits...)
+	}
+
+	var issues []Issue
+	for _, layer := range layers {
+		stale, example := 0, ""
+		for _, c := range layer.commits {
+			if ctx.Err() != nil {
+				return issues
+			}
+			problem := graphCommitProblem(repo, c, all)
+			if problem == "" {
+				continue
+			}
+			if stale == 0 {
+				example = problem
+			}
+			stale++
+		}
+		if stale > 0 {
+			issues = append(issues, commitGraphIssue(opts, layer.file,
+				fmt.Sprintf("%d of %d commit(s) are missing or differ from the object store, e.g. %s", stale, len(layer.commits), example)))
+		}
+	}
+	return issues
+}
+
+// graphCommitProblem says how a commit differs from what the graph records
+func graphCommitProblem(repo store, c graphCommit, all []graphCommit) string {
+	commit, err := repo.Commit(c.hash)
+	if err != nil {
+		return fmt.Sprintf("commit %s is missing", shortHash(c.hash))
+	}
+	if commit.Tree != c.tree {
+		return fmt.Sprintf("commit %s has tree %s, the graph records %s", shortHash(c.hash), shortHash(commit.Tree), shortHash(c.tree))
+	}
+	if len(commit.Parents) != len(c.parents) {
+		return fmt.Sprintf("commit %s has %d parent(s), the graph records %d", shortHash(c.hash), len(commit.Parents), len(c.parents))
+	}
+	for i, pos := range c.parents {
+		if int(pos) >= len(all) || all[pos].hash != commit.Parents[i] {
+			return fmt.Sprintf("commit %s has different parents than the graph records", shortHash(c.hash))
+		}
+	}
+	return ""
+}
+
+// commitGraphIssue reports a stale commit-graph file
+func commitGraphIssue(opts Options, file, message string) Issue {
+	return Issue{
+		Type:    IssueTypeStaleCommitGraph,
+		Object:  filepath.ToSlash(relativeToCommonDir(opts.gitDir(), file)),
+		Message: message,
+		Path:    repoRelative(opts.RepoPath, file),
+	}
+}
+
+// checkObjectIndexes validates the commit-graphs and the multi-pack-index
+func checkObjectIndexes(ctx context.Context, opts Options, repo store) []Issue {
+	issues := checkCommitGraphs(ctx, opts, repo)
+	return append(issues, checkMultiPackIndex(opts)...)
+}
+
+// recheckObjectIndex rechecks the commit-graph or multi-pack-index file an
+// issue named by name is about
+func recheckObjectIndex(ctx context.Context, repo store, repoPath, name string) []Issue {
+	var issues []Issue
+	for _, issue := range checkObjectIndexes(ctx, Options{RepoPath: repoPath}, repo) {
+		if issue.Object == name {
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+// FixObjectIndexes removes stale commit-graphs and multi-pack-indexes and
+// writes them again from the objects the repository has. git works without
+// them, so an index that cannot be written again stays removed.
+func FixObjectIndexes(ctx context.Context, opts Options) (int, error) {
+	em := opts.emit()
+
+	issues, err := planned(opts, func() ([]Issue, error) {
+		repo, err := openStore(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open repository: %w", err)
+		}
+		defer repo.Close()
+		issues := checkObjectIndexes(ctx, opts, repo)
+		return issues, ctx.Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	graphs, midx := 0, 0
+	for _, issue := range issues {
+		if opts.DryRun {
+			em.Debugf("[DRY RUN] Would rebuild %s: %s", issue.Object, issue.Message)
+		}
+		if issue.Type == IssueTypeStaleCommitGraph {
+			graphs++
+		} else {
+			midx++
+		}
+	}
+	if opts.DryRun || len(issues) == 0 {
+		return len(issues), nil
+	}
+
+	if graphs > 0 {
+		if err := rebuildCommitGraph(ctx, opts); err != nil {
+			em.Warnf("Removed the stale commit-graph but could not write a new one: %v", err)
+		}
+	}
+	if midx > 0 {
+		if err := rebuildMultiPackIndex(ctx, opts); err != nil {
+			em.Warnf("Removed the stale multi-pack-index but could not write a new one: %v", err)
+		}
+	}
+	opts.Diagnosis.invalidateObjects()
+	return len(issues), nil
+}
+
+// removeCommitGraphs removes the commit-graph and every split layer
+func removeCommitGraphs(opts Options) error {
+	single, chain := commitGraphFiles(opts)
+	if err := os.Remove(single); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove commit-graph: %w", err)
+	}
+	if err := os.RemoveAll(filepath.Dir(chain)); err != nil {
+		return fmt.Errorf("failed to remove commit-graph chain: %w", err)
+	}
+	return nil
+}
+
+// rebuildCommitGraph replaces the commit-graph with one written from the
+// commits reachable from the references
+func rebuildCommitGraph(ctx context.Context, opts Options) error {
+	if err := removeCommitGraphs(opts); err != nil {
+		return err
+	}
+	opts.emit().Debugf("Writing commit-graph...")
+	if output, err := runGitProgress(ctx, opts, "commit-graph", "write", "--reachable"); err != nil {
+		return fmt.Errorf("%s: %w", lastLine(output), err)
+	}
+	return nil
+}
+
+// objectIndexesPresent reports which of the commit-graph and the
+// multi-pack-index the repository has
+func objectIndexesPresent(opts Options) (graph, midx bool) {
+	single, chain := commitGraphFiles(opts)
+	for _, file := range []string{single, chain} {
+		if _, err := os.Stat(file); err == nil {
+			graph = true
+		}
+	}
+	_, err := os.Stat(multiPackIndexFile(opts))
+	return graph, err == nil
+}
+
+// restoreObjectIndexes writes the commit-graph and multi-pack-index again if
+// the repository had them before git gc, then removes whichever is still
+// stale so git does not trust it
+func restoreObjectIndexes(ctx context.Context, opts Options, repo store, hadGraph, hadMidx bool) {
+	em := opts.emit()
+	graph, midx := objectIndexesPresent(opts)
+	if hadGraph && !graph {
+		if err := rebuildCommitGraph(ctx, opts); err != nil {
+			em.Debugf("Warning: Could not write commit-graph: %v", err)
+		}
+	}
+	if hadMidx && !midx {
+		if err := rebuildMultiPackIndex(ctx, opts); err != nil {
+			em.Debugf("Warning: Could not write multi-pack-index: %v", err)
+		}
+	}
+
+	for _, issue := range checkObjectIndexes(ctx, opts, repo) {
+		em.Warnf("Removing %s, which is still stale: %s", issue.Object, issue.Message)
+		if issue.Type == IssueTypeStaleCommitGraph {
+			removeCommitGraphs(opts)
+		} else {
+			removeMultiPackIndex(opts)
+		}
+	}
+}
+
+// lastLine returns the last non-empty line of command output
+func lastLine(output []byte) string {
+	var last string
+	for _, line := range splitLines(string(output)) {
+		if line = strings.TrimSpace(line); line != "" {
+			last = line
+		}
+	}
+	return last
+}
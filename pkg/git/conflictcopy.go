@@ -0,0 +1,501 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rahul/nsha/pkg/events"
+	"github.com/rahul/nsha/pkg/gitdir"
+)
+
+// conflictCopyPattern matches the name a sync tool gives the losing side of a
+// conflict. Strict patterns produce names git never uses; the others are only
+// conflict copies when the file they duplicate exists. tool is empty when
+// the name does not tell which tool made the copy.
+type conflictCopyPattern struct {
+	tool   string
+	re     *regexp.Regexp
+	strict bool
+}
+
+var conflictCopyPatterns = []conflictCopyPattern{
+	{"Dropbox", regexp.MustCompile(`^(.+) \([^()]*conflicted copy[^()]*\)$`), true},
+	// OneDrive, Google Drive, Nextcloud and file managers all number copies
+	{"", regexp.MustCompile(`^(.+) \(\d+\)$`), true},
+	{"iCloud", regexp.MustCompile(`^(.+) \d+$`), true},
+	{"Syncthing", regexp.MustCompile(`^(.+)\.sync-conflict-\d{8}-\d{6}(-[0-9A-Z]{7})?$`), false},
+	{"ownCloud", regexp.MustCompile(`^(.+)_conflict-\d{8}-\d{6}$`), false},
+	{"sync tool", regexp.MustCompile(`^(.+)-conflict-[^/]+$`), false},
+}
+
+// conflictTopLevel lists the files directly in the git directory whose
+// conflict copies are detected
+var conflictTopLevel = []string{"HEAD", "ORIG_HEAD", "FETCH_HEAD", "packed-refs", "index"}
+
+// conflictCopy is a duplicate of a git file created by a sync tool
+type conflictCopy struct {
+	file      string // The copy
+	canonical string // The file it duplicates
+	name      string // Name of the canonical file in the git directory, e.g. "refs/heads/main"
+	tool      string
+}
+
+// conflictCopyOf returns the file name a conflict copy duplicates and the sync
+// tool that named it. Tools put their marker before extensions such as .pack.
+func conflictCopyOf(name string) (canonical string, pattern conflictCopyPattern, ok bool) {
+	ext := filepath.Ext(name)
+	for _, p := range conflictCopyPatterns {
+		if m := p.re.FindStringSubmatch(name); m != nil {
+			return m[1], p, true
+		}
+		if ext != "" {
+			if m := p.re.FindStringSubmatch(strings.TrimSuffix(name, ext)); m != nil {
+				return m[1] + ext, p, true
+			}
+		}
+	}
+	return "", conflictCopyPattern{}, false
+}
+
+// scanConflictCopies finds conflict copies of HEAD, packed-refs and the index,
+// and of files under refs/, logs/ and objects/
+func scanConflictCopies(opts Options) []conflictCopy {
+	d := opts.gitDir()
+	var copies []conflictCopy
+
+	check := func(file, rel string) {
+		base := filepath.Base(file)
+		// Loose objects, the bulk of the files, never match
+		if isHexString(base) {
+			return
+		}
+		canonicalBase, pattern, ok := conflictCopyOf(base)
+		if !ok {
+			return
+		}
+		canonical := filepath.Join(filepath.Dir(file), canonicalBase)
+		name := filepath.ToSlash(filepath.Join(filepath.Dir(rel), canonicalBase))
+		if !pattern.strict {
+			if _, err := os.Stat(canonical); err != nil {
+				if _, packed := packedRef(d, name); !packed {
+					return
+				}
+			}
+		}
+		copies = append(copies, conflictCopy{file: file, canonical: canonical, name: name, tool: pattern.tool})
+	}
+
+	dirs := []string{d.CommonDir}
+	if d.GitDir != d.CommonDir {
+		dirs = append(dirs, d.GitDir)
+	}
+	for _, dir := range dirs {
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			canonical, _, ok := conflictCopyOf(entry.Name())
+			if ok && entry.Type().IsRegular() && containsString(conflictTopLevel, canonical) {
+				check(filepath.Join(dir, entry.Name()), entry.Name())
+			}
+		}
+	}
+
+	for _, top := range []string{"refs", "logs", "objects"} {
+		filepath.WalkDir(d.Path(top), func(path string, entry os.DirEntry, err error) error {
+			if err != nil || !entry.Type().IsRegular() {
+				return nil
+			}
+			if rel, err := filepath.Rel(d.CommonDir, path); err == nil {
+				check(path, rel)
+			}
+			return nil
+		})
+	}
+	return copies
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// issue reports the copy and how it differs from the canonical file
+func (c conflictCopy) issue(d *gitdir.Dir, repoPath string) Issue {
+	return Issue{
+		Type:    IssueTypeConflictCopy,
+		Object:  filepath.ToSlash(filepath.Join(filepath.Dir(c.name), filepath.Base(c.file))),
+		Message: fmt.Sprintf("%s of %s: %s", c.label(), c.name, c.difference(d)),
+		Path:    repoRelative(repoPath, c.file),
+	}
+}
+
+// label names the kind of copy, with the sync tool when its name is known
+func (c conflictCopy) label() string {
+	if c.tool == "" {
+		return "Copy"
+	}
+	return c.tool + " conflict copy"
+}
+
+// difference describes how the copy differs from the canonical file
+func (c conflictCopy) difference(d *gitdir.Dir) string {
+	copied, err := os.ReadFile(c.file)
+	if err != nil {
+		return "cannot be read"
+	}
+	canonical, err := os.ReadFile(c.canonical)
+	if err != nil {
+		hash, packed := packedRef(d, c.name)
+		if !packed {
+			return "the file it duplicates is missing"
+		}
+		canonical = []byte(hash + "\n")
+	}
+	if bytes.Equal(copied, canonical) {
+		return "identical"
+	}
+	if isRefName(c.name) {
+		return fmt.Sprintf("value %s differs from %s", shortValue(string(copied)), shortValue(string(canonical)))
+	}
+	if strings.HasPrefix(c.name, "logs/") {
+		return fmt.Sprintf("%d reflog entries are not in the canonical reflog", len(missingLines(string(canonical), string(copied))))
+	}
+	return "contents differ"
+}
+
+// isRefName reports whether a name in the git directory is a loose reference
+func isRefName(name string) bool {
+	return strings.HasPrefix(name, "refs/") || name == "HEAD" || name == "ORIG_HEAD"
+}
+
+// missingLines returns the lines of other that are not in base
+func missingLines(base, other string) []string {
+	have := make(map[string]bool)
+	for _, line := range splitLines(base) {
+		have[line] = true
+	}
+	var missing []string
+	for _, line := range splitLines(other) {
+		if !have[line] {
+			missing = append(missing, line)
+			have[line] = true
+		}
+	}
+	return missing
+}
+
+// FixConflictCopies merges the newest valid value of every conflict copy
+// into the file it duplicates and moves the copy into quarantine. Branches and
+// tags keep whichever value is the newest readable commit, reflogs and
+// packed-refs get the entries only the copy has, and missing or damaged
+// objects are replaced by their copy.
+func FixConflictCopies(ctx context.Context, opts Options) (int, error) {
+	em := opts.emit()
+
+	copies, _ := planned(opts, func() ([]conflictCopy, error) {
+		return scanConflictCopies(opts), nil
+	})
+	if opts.DryRun {
+		for _, c := range copies {
+			em.Debugf("[DRY RUN] Would merge %s into %s and quarantine it", filepath.Base(c.file), c.name)
+		}
+		return len(copies), nil
+	}
+
+	// git does not run with a HEAD it cannot parse, so HEAD comes first
+	sort.SliceStable(copies, func(i, j int) bool {
+		return copies[i].name == "HEAD" && copies[j].name != "HEAD"
+	})
+
+	var repo store
+	defer func() {
+		if repo != nil {
+			repo.Close()
+		}
+	}()
+
+	fixedCount := 0
+	for _, c := range copies {
+		if err := ctx.Err(); err != nil {
+			return fixedCount, err
+		}
+		if repo == nil && c.name != "HEAD" {
+			var err error
+			if repo, err = openStore(ctx, opts); err != nil {
+				return fixedCount, fmt.Errorf("failed to open repository: %w", err)
+			}
+		}
+
+		var err error
+		switch {
+		case c.name == "HEAD":
+			err = mergeHeadCopy(opts, c, em)
+		case strings.HasPrefix(c.name, "refs/"):
+			err = mergeRefCopy(ctx, opts, repo, c, em)
+		case c.name == "packed-refs":
+			err = mergePackedRefsCopy(ctx, opts, repo, c, em)
+		case strings.HasPrefix(c.name, "logs/"):
+			err = mergeReflogCopy(c, em)
+		case strings.HasPrefix(c.name, "objects/"):
+			err = mergeObjectCopy(opts, c, em)
+		}
+		if err != nil {
+			em.Warnf("Failed to merge %s: %v", filepath.Base(c.file), err)
+			continue
+		}
+		c.invalidate(opts)
+
+		// Merged, or kept in place of a missing file
+		if _, statErr := os.Stat(c.file); os.IsNotExist(statErr) {
+			fixedCount++
+			continue
+		}
+		entry, err := quarantineFile(opts, c.file, "", DamageConflictCopy)
+		if err != nil {
+			em.Warnf("Failed to quarantine %s: %v", filepath.Base(c.file), err)
+			continue
+		}
+		em.Debugf("Quarantined %s as %s", filepath.Base(c.file), entry.ID)
+		fixedCount++
+	}
+
+	return fixedCount, nil
+}
+
+// invalidate marks the copy and what merging it may have changed: the
+// reference it duplicates, or the objects of a loose object or pack put in
+// place. packed-refs records its changed references when it is written.
+func (c conflictCopy) invalidate(opts Options) {
+	d := opts.Diagnosis
+	d.invalidate(subject{subjectPath, repoRelative(opts.RepoPath, c.file)})
+	switch {
+	case c.name == "HEAD" || strings.HasPrefix(c.name, "refs/"):
+		d.InvalidateRef(c.name)
+	case strings.HasPrefix(c.name, "objects/pack/"):
+		idx := strings.TrimSuffix(strings.TrimSuffix(c.canonical, ".pack"), ".idx") + ".idx"
+		if index, err := openPackIndex(idx, opts.objectFormat()); err == nil {
+			d.InvalidateObjects(index.hashes)
+		}
+	case strings.HasPrefix(c.name, "objects/"):
+		d.InvalidateObjects([]string{strings.ReplaceAll(strings.TrimPrefix(c.name, "objects/"), "/", "")})
+	}
+}
+
+// mergeHeadCopy takes the copy's value for HEAD when HEAD cannot be parsed or
+// points at a branch that does not exist and the copy's value can and does
+func mergeHeadCopy(opts Options, c conflictCopy, em events.Emitter) error {
+	d := opts.gitDir()
+	usable := func(content string) bool {
+		if refValueDamage(content, opts.objectFormat(), true) != "" {
+			return false
+		}
+		target, symbolic := strings.CutPrefix(content, "ref:")
+		return !symbolic || refExists(d, strings.TrimSpace(target))
+	}
+
+	current, _ := os.ReadFile(c.canonical)
+	copied, err := os.ReadFile(c.file)
+	if err != nil {
+		return err
+	}
+	if usable(string(current)) || !usable(string(copied)) {
+		return nil
+	}
+	if err := writeLocked(c.canonical, copied); err != nil {
+		return err
+	}
+	em.Detailf("Took HEAD from its conflict copy: %s", strings.TrimSpace(string(copied)))
+	return nil
+}
+
+// mergeRefCopy points a reference at the copy's value when that is a newer
+// readable commit than the reference's own value
+func mergeRefCopy(ctx context.Context, opts Options, repo store, c conflictCopy, em events.Emitter) error {
+	copied, err := os.ReadFile(c.file)
+	if err != nil {
+		return err
+	}
+	copyValue := strings.ToLower(strings.TrimSpace(string(copied)))
+
+	current := ""
+	if content, err := os.ReadFile(c.canonical); err == nil {
+		current = strings.ToLower(strings.TrimSpace(string(content)))
+	} else if hash, ok := packedRef(opts.gitDir(), c.name); ok {
+		current = strings.ToLower(hash)
+	}
+
+	if newestRefValue(ctx, opts, repo, current, copyValue) != copyValue || copyValue == current {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.canonical), 0755); err != nil {
+		return err
+	}
+	if err := writeLocked(c.canonical, []byte(copyValue+"\n")); err != nil {
+		return fmt.Errorf("%s: %w", c.name, err)
+	}
+	em.Detailf("Took %s from its conflict copy -> %s", c.name, copyValue[:8])
+	return nil
+}
+
+// newestRefValue returns the value whose object exists and, for commits, has
+// the newest committer date. Earlier values win ties, so the reference's own
+// value is kept when it is as good as the copy's.
+func newestRefValue(ctx context.Context, opts Options, repo store, values ...string) string {
+	var hashes []string
+	for _, value := range values {
+		if isHash(value) && !isNullHash(value) {
+			hashes = append(hashes, value)
+		}
+	}
+	missing, err := missingObjects(ctx, opts.RepoPath, hashes)
+	if err != nil {
+		return ""
+	}
+
+	best, bestTime := "", time.Time{}
+	for _, hash := range hashes {
+		if missing[hash] {
+			continue
+		}
+		var when time.Time
+		if commit, err := repo.Commit(hash); err == nil {
+			when = commit.Committer.When
+		}
+		if best == "" || when.After(bestTime) {
+			best, bestTime = hash, when
+		}
+	}
+	return best
+}
+
+// mergePackedRefsCopy adds the references only the copy of packed-refs has
+// and takes the copy's value where it is newer. References with a loose file
+// are left alone, as the loose value applies.
+func mergePackedRefsCopy(ctx context.Context, opts Options, repo store, c conflictCopy, em events.Emitter) error {
+	d := opts.gitDir()
+	copied, err := os.ReadFile(c.file)
+	if err != nil {
+		return err
+	}
+	packed, err := ReadPackedRefs(opts)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range parsePackedRefs(string(copied), opts.objectFormat()).Refs {
+		if !packed.ValidHash(ref) {
+			continue
+		}
+		if _, err := os.Stat(d.Path(ref.Name)); err == nil {
+			continue
+		}
+		copyValue := strings.ToLower(ref.Hash)
+		current := ""
+		if own, ok := packed.Lookup(ref.Name); ok {
+			current = strings.ToLower(own.Hash)
+		}
+		if copyValue != current && newestRefValue(ctx, opts, repo, current, copyValue) == copyValue {
+			packed.Set(ref.Name, copyValue, "newer in the conflict copy")
+		}
+	}
+	if len(packed.Changes) == 0 {
+		return nil
+	}
+
+	if err := packed.Peel(ctx, opts.RepoPath); err != nil {
+		em.Debugf("Not peeling packed-refs: %v", err)
+	}
+	if err := packed.Write(); err != nil {
+		return err
+	}
+	for _, change := range packed.Changes {
+		em.Detailf("packed-refs: %s", change)
+		if change.Name != "" {
+			opts.Diagnosis.InvalidateRef(change.Name)
+		}
+	}
+	return nil
+}
+
+// mergeReflogCopy adds the entries only the copy has to the reflog, keeping
+// the entries in date order
+func mergeReflogCopy(c conflictCopy, em events.Emitter) error {
+	copied, err := os.ReadFile(c.file)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(c.canonical)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	added := missingLines(string(content), string(copied))
+	if len(added) == 0 {
+		return nil
+	}
+	lines := append(splitLines(string(content)), added...)
+	sort.SliceStable(lines, func(i, j int) bool {
+		return reflogTime(lines[i]) < reflogTime(lines[j])
+	})
+	if err := os.MkdirAll(filepath.Dir(c.canonical), 0755); err != nil {
+		return err
+	}
+	if err := writeLocked(c.canonical, []byte(strings.Join(lines, "\n")+"\n")); err != nil {
+		return err
+	}
+	em.Detailf("Merged %d reflog entries of %s from its conflict copy", len(added), strings.TrimPrefix(c.name, "logs/"))
+	return nil
+}
+
+// reflogTime returns the Unix time of a reflog entry:
+// <old> <new> <name> <<email>> <timestamp> <tz>\t<message>
+func reflogTime(line string) int64 {
+	entry, _, _ := strings.Cut(line, "\t")
+	if i := strings.LastIndex(entry, "> "); i >= 0 {
+		if fields := strings.Fields(entry[i+2:]); len(fields) > 0 {
+			t, _ := strconv.ParseInt(fields[0], 10, 64)
+			return t
+		}
+	}
+	return 0
+}
+
+// mergeObjectCopy puts a copy in place of a missing or damaged loose object
+// or missing pack file. A damaged object is quarantined first.
+func mergeObjectCopy(opts Options, c conflictCopy, em events.Emitter) error {
+	_, err := os.Stat(c.canonical)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case strings.HasPrefix(c.name, "objects/pack/"):
+		return nil
+	default:
+		damage := looseObjectDamage(c.canonical)
+		if damage == "" || looseObjectDamage(c.file) != "" {
+			return nil
+		}
+		hash := strings.ReplaceAll(strings.TrimPrefix(c.name, "objects/"), "/", "")
+		if _, err := quarantineFile(opts, c.canonical, hash, damage); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(c.file, c.canonical); err != nil {
+		return fmt.Errorf("failed to move %s into place: %w", filepath.Base(c.file), err)
+	}
+	em.Detailf("Restored %s from its conflict copy", c.name)
+	return nil
+}
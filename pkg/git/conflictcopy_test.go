@@ -0,0 +1,26 @@
+package git
+
+import "testing"
+
+func TestConflictCopyOf(t *testing.T) {
+	tests := []struct {
+		name      string
+		canonical string
+		tool      string
+	}{
+		{"main (Alice's conflicted copy 2024-01-01)", "main", "Dropbox"},
+		{"main (1)", "main", ""},
+		{"pack-abc (2).pack", "pack-abc.pack", ""},
+		{"index 2", "index", "iCloud"},
+		{"HEAD.sync-conflict-20240101-120000-ABCDEFG", "HEAD", "Syncthing"},
+	}
+	for _, tt := range tests {
+		canonical, pattern, ok := conflictCopyOf(tt.name)
+		if !ok || canonical != tt.canonical || pattern.tool != tt.tool {
+			t.Errorf("conflictCopyOf(%q) = %q, %q, %v; want %q, %q", tt.name, canonical, pattern.tool, ok, tt.canonical, tt.tool)
+		}
+	}
+	if _, _, ok := conflictCopyOf("main"); ok {
+		t.Error("main is not a conflict copy")
+	}
+}
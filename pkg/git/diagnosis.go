@@ -0,0 +1,490 @@
+package git
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+)
+
+// subjectKind says how the part of the repository an issue concerns is rechecked
+type subjectKind int
+
+const (
+	subjectNone        subjectKind = iota // Only a full fsck can tell whether it is resolved
+	subjectRef                            // A reference, rechecked by reading it
+	subjectObject                         // An object, rechecked by reading it
+	subjectPath                           // A file under .git, resolved once it is gone
+	subjectWorktree                       // A worktree's HEAD, ORIG_HEAD or index, by issue object
+	subjectGitmodules                     // The .gitmodules committed at HEAD
+	subjectRefFile                        // A reference file or packed-refs line, by issue object
+	subjectObjectIndex                    // A commit-graph or multi-pack-index, by issue object
+	subjectMissing                        // An object git fsck found missing, resolved once it can be read
+	subjectPackIndex                      // The index of a pack, by the pack's path
+)
+
+// subject identifies what an issue is about, so it can be rechecked on its own
+type subject struct {
+	kind subjectKind
+	name string
+}
+
+// Diagnosis is the result of a single repository scan. It is shared by the
+// fixers so that git fsck runs once per fix, and it tracks which references
+// and objects the fixers changed so verification only rechecks those.
+type Diagnosis struct {
+	RepoPath string
+	Issues   []Issue
+
+	// Expected holds objects found missing that a shallow or partial clone
+	// lacks by design. They are not issues and no fixer touches them.
+	Expected []Issue
+
+	fsckLines []string
+	subjects  []subject          // Parallel to Issues
+	refs      map[string]string  // Direct reference name -> hash
+	objects   map[string][]int   // Object hash -> indexes into Issues, built lazily
+	dirty     map[subject]bool   // Subjects changed since the scan
+	shadowed  map[string][]Issue // git fsck findings about objects reported as damaged, by hash
+	stale     bool               // History changed, a full rescan is needed
+	absences  *Absences          // Objects missing by design; nil when unknown
+
+	fixer     string             // Fixer making the changes being marked, see SetFixer
+	changedBy map[subject]string // Fixer that first marked each dirty subject; subject{} for InvalidateAll
+	fixedBy   map[string]string  // Issue key -> fixer whose changes resolved it
+}
+
+func newDiagnosis(repoPath string) *Diagnosis {
+	return &Diagnosis{
+		RepoPath:  repoPath,
+		refs:      make(map[string]string),
+		dirty:     make(map[subject]bool),
+		shadowed:  make(map[string][]Issue),
+		changedBy: make(map[subject]string),
+		fixedBy:   make(map[string]string),
+	}
+}
+
+// add records an issue together with what it is about. Expected absences
+// are kept apart from the issues.
+func (d *Diagnosis) add(issue Issue, subj subject) {
+	if d.absences.Expected(issue) {
+		d.Expected = append(d.Expected, issue)
+		return
+	}
+	if issue.Severity == "" {
+		issue.Severity = issue.Type.Severity()
+	}
+	d.Issues = append(d.Issues, issue)
+	d.subjects = append(d.subjects, subj)
+	d.objects = nil
+}
+
+// FsckLines returns the raw git fsck output the diagnosis was built from
+func (d *Diagnosis) FsckLines() []string {
+	return d.fsckLines
+}
+
+// Ref returns the hash a reference pointed to when the repository was scanned
+func (d *Diagnosis) Ref(name string) (string, bool) {
+	hash, ok := d.refs[name]
+	return hash, ok
+}
+
+// ObjectIssues returns the issues that concern the given object or commit
+func (d *Diagnosis) ObjectIssues(hash string) []Issue {
+	if d.objects == nil {
+		d.objects = make(map[string][]int)
+		for i, issue := range d.Issues {
+			if issue.Object != "" {
+				d.objects[issue.Object] = append(d.objects[issue.Object], i)
+			}
+			if issue.Commit != "" && issue.Commit != issue.Object {
+				d.objects[issue.Commit] = append(d.objects[issue.Commit], i)
+			}
+		}
+	}
+
+	var issues []Issue
+	for _, i := range d.objects[hash] {
+		issues = append(issues, d.Issues[i])
+	}
+	return issues
+}
+
+// IssuesOf returns the issues of the given type
+func (d *Diagnosis) IssuesOf(t IssueType) []Issue {
+	var issues []Issue
+	for _, issue := range d.Issues {
+		if issue.Type == t {
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+// diagnosedIssues returns the issues of the given type from the shared
+// diagnosis, or from running check when there is none
+func diagnosedIssues(ctx context.Context, opts Options, t IssueType, check func(context.Context, Options) ([]Issue, error)) ([]Issue, error) {
+	d := opts.Diagnosis
+	if d == nil {
+		issues, err := check(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		d = &Diagnosis{Issues: issues}
+	}
+	return d.IssuesOf(t), nil
+}
+
+// InvalidateRef marks a reference as changed. A nil Diagnosis ignores it.
+func (d *Diagnosis) InvalidateRef(name string) {
+	d.invalidate(subject{subjectRef, name})
+}
+
+// InvalidateObject marks an object as changed or newly written
+func (d *Diagnosis) InvalidateObject(hash string) {
+	d.invalidate(subject{subjectObject, hash})
+}
+
+// InvalidateWorktree marks a per-worktree file such as "worktrees/<name>/HEAD"
+// as changed; name is the Object of the issues about it
+func (d *Diagnosis) InvalidateWorktree(name string) {
+	d.invalidate(subject{subjectWorktree, name})
+}
+
+// InvalidateObjects marks what the diagnosis knows about the given objects
+// as changed: the objects it found issues with and the references that
+// pointed at them. It suits fixers that make many objects readable or
+// unreadable at once, such as a rebuilt pack index.
+func (d *Diagnosis) InvalidateObjects(hashes []string) {
+	if d == nil || len(hashes) == 0 {
+		return
+	}
+	changed := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		changed[hash] = true
+	}
+	for _, subj := range d.subjects {
+		if (subj.kind == subjectObject || subj.kind == subjectMissing) && changed[subj.name] {
+			d.invalidate(subj)
+		}
+	}
+	for name, hash := range d.refs {
+		if changed[hash] {
+			d.invalidate(subject{subjectRef, name})
+		}
+	}
+	for hash := range d.shadowed {
+		if changed[hash] {
+			d.invalidate(subject{subjectMissing, hash})
+		}
+	}
+}
+
+// invalidate marks any subject as changed, e.g. a file under .git by the
+// path its issue reports
+func (d *Diagnosis) invalidate(subj subject) {
+	if d == nil {
+		return
+	}
+	d.dirty[subj] = true
+	if _, ok := d.changedBy[subj]; !ok {
+		d.changedBy[subj] = d.fixer
+	}
+}
+
+// InvalidateAll marks the whole diagnosis as out of date, e.g. after history
+// was rewritten, replace refs changed which commits git sees or objects were
+// lost that anything in the repository may refer to
+func (d *Diagnosis) InvalidateAll() {
+	if d == nil {
+		return
+	}
+	d.stale = true
+	if _, ok := d.changedBy[subject{}]; !ok {
+		d.changedBy[subject{}] = d.fixer
+	}
+}
+
+// invalidateObjects marks every object with an issue as changed, e.g. after
+// git gc may have pruned them
+func (d *Diagnosis) invalidateObjects() {
+	if d == nil {
+		return
+	}
+	for _, subj := range d.subjects {
+		if subj.kind == subjectObject || subj.kind == subjectPath || subj.kind == subjectObjectIndex {
+			d.invalidate(subj)
+		}
+	}
+}
+
+// SetFixer names the fixer making the changes marked from now on, so the
+// issues they resolve are attributed to it. "" stands for changes made
+// outside any fixer.
+func (d *Diagnosis) SetFixer(name string) {
+	if d != nil {
+		d.fixer = name
+	}
+}
+
+// AttributeFixes returns the issues in before, marking those the diagnosis
+// no longer has as resolved. FixedBy names the fixer whose changes resolved
+// an issue, as far as Refresh could tell, and stays empty otherwise.
+func (d *Diagnosis) AttributeFixes(before []Issue) []Issue {
+	remaining := make(map[string]bool, len(d.Issues))
+	for _, issue := range d.Issues {
+		remaining[issue.key()] = true
+	}
+
+	result := make([]Issue, len(before))
+	for i, issue := range before {
+		result[i] = issue
+		if remaining[issue.key()] {
+			continue
+		}
+		result[i].Resolved = true
+		result[i].FixedBy = d.fixedBy[issue.key()]
+	}
+	return result
+}
+
+// Dirty reports whether anything changed since the last scan or refresh
+func (d *Diagnosis) Dirty() bool {
+	return d.stale || len(d.dirty) > 0
+}
+
+// Refresh brings the diagnosis up to date. Subjects with issues and subjects
+// marked as changed are rechecked individually; everything else is assumed
+// unaffected. A full rescan runs when history changed or when an issue can
+// only be rechecked by git fsck, or when a damaged object that was moved
+// away may still be reachable from something the diagnosis does not know.
+func (d *Diagnosis) Refresh(ctx context.Context, opts Options) error {
+	if !d.Dirty() {
+		return nil
+	}
+
+	issues, subjects, changedBy := d.Issues, d.subjects, d.changedBy
+	if err := d.refresh(ctx, opts); err != nil {
+		return err
+	}
+	d.attribute(issues, subjects, changedBy)
+	d.changedBy = make(map[subject]string)
+	return nil
+}
+
+// refresh rechecks what Refresh has to, see there
+func (d *Diagnosis) refresh(ctx context.Context, opts Options) error {
+	em := opts.emit()
+
+	needsFull := d.stale
+	for _, subj := range d.subjects {
+		if subj.kind == subjectNone {
+			needsFull = true
+			break
+		}
+	}
+	if needsFull {
+		return d.rescan(ctx, opts)
+	}
+
+	// Recheck each subject once, in the order it was first seen
+	var pending []subject
+	seen := make(map[subject]bool)
+	for _, subj := range d.subjects {
+		if !seen[subj] {
+			seen[subj] = true
+			pending = append(pending, subj)
+		}
+	}
+	for subj := range d.dirty {
+		if !seen[subj] {
+			seen[subj] = true
+			pending = append(pending, subj)
+		}
+	}
+	em.Debugf("Rechecking %d affected reference(s) and object(s)...", len(pending))
+
+	repo, err := openStore(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	previous := make(map[subject][]Issue)
+	for i, subj := range d.subjects {
+		previous[subj] = append(previous[subj], d.Issues[i])
+	}
+
+	// Missing objects are looked up together
+	var lookup []string
+	for _, subj := range pending {
+		if subj.kind == subjectMissing {
+			lookup = append(lookup, subj.name)
+		}
+	}
+	missing, err := missingObjects(ctx, d.RepoPath, lookup)
+	if err != nil {
+		return err
+	}
+
+	d.Issues, d.Expected, d.subjects, d.objects = nil, nil, nil, nil
+	for _, subj := range pending {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, issue := range d.recheck(ctx, repo, subj, previous[subj], missing) {
+			d.add(issue, subj)
+		}
+	}
+
+	// Damaged objects that were moved away bring back what git fsck said
+	// about them being missing, as long as something still reaches them.
+	// Whether anything else does only a full rescan can tell.
+	for _, subj := range pending {
+		shadowed, ok := d.shadowed[subj.name]
+		if subj.kind != subjectMissing || !ok || !missing[subj.name] {
+			continue
+		}
+		if !d.reaches(subj.name) {
+			return d.rescan(ctx, opts)
+		}
+		delete(d.shadowed, subj.name)
+		for _, issue := range shadowed {
+			d.add(issue, subj)
+		}
+	}
+	d.dirty = make(map[subject]bool)
+	return nil
+}
+
+// rescan replaces the diagnosis with a full scan of the repository
+func (d *Diagnosis) rescan(ctx context.Context, opts Options) error {
+	opts.emit().Debugf("Rescanning the whole repository...")
+	fresh, err := Diagnose(ctx, opts)
+	if err != nil {
+		return err
+	}
+	// Attribution covers the whole fix, not a single scan
+	fresh.fixer, fresh.fixedBy = d.fixer, d.fixedBy
+	*d = *fresh
+	return nil
+}
+
+// attribute records which fixer resolved each of the issues a refresh no
+// longer found. An issue about a subject a fixer marked as changed goes to
+// that fixer; any other goes to the fixer that made all the changes, if a
+// single one did. Issues resolved otherwise stay unattributed.
+func (d *Diagnosis) attribute(issues []Issue, subjects []subject, changedBy map[subject]string) {
+	remaining := make(map[string]bool, len(d.Issues))
+	for _, issue := range d.Issues {
+		remaining[issue.key()] = true
+	}
+
+	fixers := make(map[string]bool)
+	for _, name := range changedBy {
+		fixers[name] = true
+	}
+	only := ""
+	if len(fixers) == 1 {
+		for name := range fixers {
+			only = name
+		}
+	}
+
+	for i, issue := range issues {
+		if remaining[issue.key()] {
+			continue
+		}
+		name := changedBy[subjects[i]]
+		if name == "" {
+			name = only
+		}
+		if name != "" {
+			d.fixedBy[issue.key()] = name
+		}
+	}
+}
+
+// reaches reports whether a reference or an issue refers to the object
+func (d *Diagnosis) reaches(hash string) bool {
+	for _, h := range d.refs {
+		if h == hash {
+			return true
+		}
+	}
+	return len(d.ObjectIssues(hash)) > 0
+}
+
+// recheck returns the issues a subject still has. missing holds the objects
+// of subjectMissing subjects that still cannot be read.
+func (d *Diagnosis) recheck(ctx context.Context, repo store, subj subject, previous []Issue, missing map[string]bool) []Issue {
+	switch subj.kind {
+	case subjectRef:
+		ref, err := repo.Reference(subj.name)
+		if err != nil {
+			// Deleted references have no issues left
+			delete(d.refs, subj.name)
+			return nil
+		}
+		if !ref.Symbolic() {
+			d.refs[subj.name] = ref.Hash
+		}
+		return checkReference(repo, d.RepoPath, ref)
+	case subjectObject:
+		return checkObject(repo, subj.name, previous)
+	case subjectPath:
+		path := subj.name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(d.RepoPath, path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil
+		}
+		return previous
+	case subjectWorktree:
+		return recheckWorktree(ctx, repo, d.RepoPath, subj.name)
+	case subjectGitmodules:
+		return checkGitmodules(repo)
+	case subjectRefFile:
+		return recheckRefFile(d.RepoPath, subj.name)
+	case subjectObjectIndex:
+		return recheckObjectIndex(ctx, repo, d.RepoPath, subj.name)
+	case subjectPackIndex:
+		return recheckPackIndex(d.RepoPath, subj.name)
+	case subjectMissing:
+		// Only a history rewrite, which rescans, stops git from looking for
+		// an object that is still missing
+		if missing[subj.name] {
+			return previous
+		}
+		return nil
+	}
+	return previous
+}
+
+// currentIssues returns the up-to-date issues, refreshing the shared
+// diagnosis when there is one and scanning the repository otherwise
+func currentIssues(ctx context.Context, opts Options) ([]Issue, error) {
+	if opts.Diagnosis == nil {
+		return RunFsck(ctx, opts)
+	}
+	if err := opts.Diagnosis.Refresh(ctx, opts); err != nil {
+		return nil, err
+	}
+	return opts.Diagnosis.Issues, nil
+}
+
+// fsckOutput returns the git fsck output lines, reusing the shared diagnosis
+// when there is one
+func fsckOutput(ctx context.Context, opts Options) ([]string, error) {
+	if opts.Diagnosis != nil {
+		return opts.Diagnosis.FsckLines(), nil
+	}
+
+	output, _ := runGitProgress(ctx, opts, "fsck", "--full", "--progress")
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return splitLines(string(output)), nil
+}
@@ -0,0 +1,114 @@
+package git
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFsckSubject(t *testing.T) {
+	hash := "d00491fd7e5bb6fa28c517a0bb32b8b506539d4d"
+	tests := []struct {
+		line string
+		want subject
+	}{
+		{"missing blob " + hash, subject{subjectMissing, hash}},
+		{"error: " + hash + ": object corrupt or missing: .git/objects/d0/0491", subject{subjectMissing, hash}},
+		{"error: refs/heads/main: missing 0000000000000000000000000000000000000000", subject{subjectRef, "refs/heads/main"}},
+		{"error: HEAD: points to missing " + hash, subject{subjectRef, "HEAD"}},
+		{"error: something is missing", subject{}},
+	}
+	for _, tt := range tests {
+		if got := fsckSubject(tt.line, subjectMissing); got != tt.want {
+			t.Errorf("fsckSubject(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestRefreshAfterPackIndexRebuild(t *testing.T) {
+	dir := newTestRepo(t)
+	commitFile(t, dir, "a.txt", "a\n")
+	commitFile(t, dir, "b.txt", "b\n")
+	runGit(t, dir, "repack", "-q", "-a", "-d")
+	indexes, _ := filepath.Glob(filepath.Join(dir, ".git", "objects", "pack", "pack-*.idx"))
+	if len(indexes) != 1 {
+		t.Fatalf("want one pack index, found %d", len(indexes))
+	}
+	if err := os.Remove(indexes[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	opts := Options{RepoPath: dir}
+	d, err := Diagnose(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := d.IssuesOf(IssueTypeMissingCommit)
+	if len(missing) == 0 {
+		t.Fatalf("want missing objects, got %v", d.Issues)
+	}
+	for i, subj := range d.subjects {
+		if subj.kind == subjectNone {
+			t.Errorf("%s can only be rechecked by git fsck", d.Issues[i].String())
+		}
+	}
+
+	opts.Diagnosis = d
+	if n, err := FixPackIndexes(ctx, opts); err != nil || n != 1 {
+		t.Fatalf("FixPackIndexes = %d, %v", n, err)
+	}
+	if d.stale {
+		t.Fatal("rebuilding a pack index should not need a full rescan")
+	}
+	lines := len(d.FsckLines())
+	if err := d.Refresh(ctx, opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.FsckLines()) != lines {
+		t.Error("Refresh ran git fsck again")
+	}
+	for _, issue := range d.Issues {
+		t.Errorf("issue left after the rebuild: %s", issue.String())
+	}
+}
+
+func TestRefreshAfterQuarantiningUnreferencedObject(t *testing.T) {
+	dir := newTestRepo(t)
+	commitFile(t, dir, "a.txt", "a\n")
+	blob := filepath.Join(dir, "blob.txt")
+	if err := os.WriteFile(blob, []byte("unreferenced\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash := runGit(t, dir, "hash-object", "-w", blob)
+	file := filepath.Join(dir, ".git", "objects", hash[:2], hash[2:])
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, nil, 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	opts := Options{RepoPath: dir}
+	d, err := Diagnose(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.IssuesOf(IssueTypeCorruptObject)) != 1 {
+		t.Fatalf("want the empty object reported, got %v", d.Issues)
+	}
+
+	opts.Diagnosis = d
+	if n, err := FixCorruptLooseObjects(ctx, opts); err != nil || n != 1 {
+		t.Fatalf("FixCorruptLooseObjects = %d, %v", n, err)
+	}
+	if err := d.Refresh(ctx, opts); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing reaches the object, so it being missing is no issue
+	for _, issue := range d.Issues {
+		t.Errorf("issue left after the quarantine: %s", issue.String())
+	}
+}
@@ -0,0 +1,72 @@
+package git
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/rahul/nsha/pkg/gitdir"
+)
+
+// Repository is a git repository found by DiscoverRepositories
+type Repository struct {
+	Path string // Working tree for non-bare repositories, the git directory for bare ones
+	Bare bool
+}
+
+// DiscoverRepositories finds every git repository below root, including root
+// itself. Repositories are not searched for further repositories, so nested
+// clones and submodules inside a working tree are not reported separately.
+// Directories that cannot be read are reported through opts.Events and skipped.
+func DiscoverRepositories(ctx context.Context, root string, opts Options) ([]Repository, error) {
+	em := opts.emit()
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "scan", Path: root, Err: fs.ErrInvalid}
+	}
+
+	var repos []Repository
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			if path == root {
+				return err
+			}
+			em.Warnf("Skipping %s: %v", path, err)
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		switch {
+		case isWorkTree(path):
+			repos = append(repos, Repository{Path: path})
+			return filepath.SkipDir
+		case gitdir.IsGitDir(path):
+			repos = append(repos, Repository{Path: path, Bare: true})
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Path < repos[j].Path })
+	return repos, nil
+}
+
+// isWorkTree reports whether dir has a .git directory or gitfile
+func isWorkTree(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil
+}
@@ -1,24 +1,34 @@
 package git
 
 import (
+	"context"
 	"fmt"
 	"sort"
 
-	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing"
-	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/rahul/nsha/pkg/events"
+	"github.com/rahul/nsha/pkg/progress"
 )
 
 // FilterRepo rewrites repository history to apply replace references permanently
-// This is the equivalent of git filter-repo for our use case
-func FilterRepo(repoPath string, force bool) error {
-	repo, err := git.PlainOpen(repoPath)
+// This is the equivalent of git filter-repo for our use case.
+// Cancelling ctx stops the rewrite between commits, before any reference has
+// been touched; rewritten objects written so far are left unreachable and are
+// removed by the next gc. Once reference updates start they run to completion
+// so refs never point at a mix of old and new history.
+func FilterRepo(ctx context.Context, opts Options, force bool) error {
+	em := opts.emit()
+
+	repo, err := openStore(ctx, opts)
 	if err != nil {
 		return fmt.Errorf("failed to open repository: %w", err)
 	}
+	defer repo.Close()
+
+	// Rewriting history touches every reference
+	opts.Diagnosis.InvalidateAll()
 
 	// Get all replace refs
-	replaceMap, err := getReplaceRefs(repo)
+	replaceMap, err := getReplaceRefs(repo, em)
 	if err != nil {
 		return fmt.Errorf("failed to get replace refs: %w", err)
 	}
@@ -27,48 +37,79 @@ func FilterRepo(repoPath string, force bool) error {
 		return fmt.Errorf("no replace refs found - nothing to rewrite")
 	}
 
-	fmt.Printf("Found %d replace reference(s)\n", len(replaceMap))
+	em.Infof("Found %d replace reference(s)", len(replaceMap))
 
 	// Build commit mapping (old hash -> new hash)
-	commitMap := make(map[plumbing.Hash]plumbing.Hash)
+	commitMap := make(map[string]string)
 	
 	// First, add direct replacements
 	for oldHash, newHash := range replaceMap {
-		commitMap[plumbing.NewHash(oldHash)] = plumbing.NewHash(newHash)
+		commitMap[oldHash] = newHash
 	}
 
 	// Get all commits in topological order
+	collecting := progress.New(em, "Collecting commits", 0).Heartbeat()
 	commits, err := getAllCommitsTopological(repo)
+	collecting.Set(int64(len(commits)), 0)
+	collecting.Finish()
 	if err != nil {
 		return fmt.Errorf("failed to get commits: %w", err)
 	}
 
-	fmt.Printf("Rewriting %d commit(s)...\n", len(commits))
+	em.Infof("Rewriting %d commit(s)...", len(commits))
+
+	// Commits at the shallow boundary must keep their hashes
+	absences, err := LoadAbsences(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to read shallow boundary: %w", err)
+	}
 
 	// Rewrite commits
+	tracker := progress.New(em, "Rewriting commits", int64(len(commits)))
+	defer tracker.Finish()
 	for _, oldHash := range commits {
-		newHash, err := rewriteCommit(repo, oldHash, commitMap)
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("history rewrite interrupted before updating references: %w", err)
+		}
+
+		newHash, err := rewriteCommit(repo, oldHash, commitMap, em)
 		if err != nil {
 			return fmt.Errorf("failed to rewrite commit %s: %w", oldHash, err)
 		}
 		
 		// Only add to map if it changed
 		if newHash != oldHash {
+			if err := absences.checkShallowRewrite([]string{oldHash}); err != nil {
+				return err
+			}
 			commitMap[oldHash] = newHash
 		}
+		tracker.Add(1)
+	}
+	tracker.Finish()
+
+	// Last chance to abort without changing any reference
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("history rewrite interrupted before updating references: %w", err)
 	}
 
 	// Update all references
-	err = updateAllReferences(repo, commitMap)
+	err = updateAllReferences(repo, commitMap, em)
 	if err != nil {
 		return fmt.Errorf("failed to update references: %w", err)
 	}
 
+	// Detached HEADs are per worktree and are not among the references
+	err = updateWorktreeRefs(opts, commitMap, em)
+	if err != nil {
+		return fmt.Errorf("failed to update worktree HEADs: %w", err)
+	}
+
 	return nil
 }
 
 // getReplaceRefs gets all replace references as a map
-func getReplaceRefs(repo *git.Repository) (map[string]string, error) {
+func getReplaceRefs(repo store, em events.Emitter) (map[string]string, error) {
 	refs, err := repo.References()
 	if err != nil {
 		return nil, err
@@ -76,22 +117,21 @@ func getReplaceRefs(repo *git.Repository) (map[string]string, error) {
 
 	replaceMap := make(map[string]string)
 
-	err = refs.ForEach(func(ref *plumbing.Reference) error {
-		refName := ref.Name().String()
+	for _, ref := range refs {
+		refName := ref.Name
 		if len(refName) > 13 && refName[:13] == "refs/replace/" {
 			oldHash := refName[13:]
-			newHash := ref.Hash().String()
+			newHash := ref.Hash
 			replaceMap[oldHash] = newHash
-			fmt.Printf("  Replace: %s -> %s\n", oldHash[:8], newHash[:8])
+			em.Detailf("Replace: %s -> %s", oldHash[:8], newHash[:8])
 		}
-		return nil
-	})
+	}
 
-	return replaceMap, err
+	return replaceMap, nil
 }
 
 // getAllCommitsTopological returns all commits in topological order (parents before children)
-func getAllCommitsTopological(repo *git.Repository) ([]plumbing.Hash, error) {
+func getAllCommitsTopological(repo store) ([]string, error) {
 	// Get all references
 	refs, err := repo.References()
 	if err != nil {
@@ -99,23 +139,18 @@ func getAllCommitsTopological(repo *git.Repository) ([]plumbing.Hash, error) {
 	}
 
 	// Collect all commit hashes
-	commitSet := make(map[plumbing.Hash]bool)
-	var startCommits []plumbing.Hash
+	commitSet := make(map[string]bool)
+	var startCommits []string
 
-	err = refs.ForEach(func(ref *plumbing.Reference) error {
+	for _, ref := range refs {
 		// Skip replace refs
-		if len(ref.Name().String()) > 13 && ref.Name().String()[:13] == "refs/replace/" {
-			return nil
+		if len(ref.Name) > 13 && ref.Name[:13] == "refs/replace/" {
+			continue
 		}
 
-		if ref.Name().IsBranch() || ref.Name().IsTag() {
-			startCommits = append(startCommits, ref.Hash())
+		if (ref.IsBranch() || ref.IsTag()) && !ref.Symbolic() {
+			startCommits = append(startCommits, ref.Hash)
 		}
-		return nil
-	})
-
-	if err != nil {
-		return nil, err
 	}
 
 	// Walk all commits from all refs
@@ -128,7 +163,7 @@ func getAllCommitsTopological(repo *git.Repository) ([]plumbing.Hash, error) {
 	}
 
 	// Convert to slice and sort (simple approach - by hash string for determinism)
-	var commits []plumbing.Hash
+	var commits []string
 	for hash := range commitSet {
 		commits = append(commits, hash)
 	}
@@ -136,45 +171,45 @@ func getAllCommitsTopological(repo *git.Repository) ([]plumbing.Hash, error) {
 	// Sort to ensure parents are processed before children
 	sort.Slice(commits, func(i, j int) bool {
 		// Try to ensure parents come first
-		ci, _ := repo.CommitObject(commits[i])
-		cj, _ := repo.CommitObject(commits[j])
+		ci, _ := repo.Commit(commits[i])
+		cj, _ := repo.Commit(commits[j])
 		
 		if ci != nil && cj != nil {
 			// If i is parent of j, i should come first
-			for _, parent := range cj.ParentHashes {
+			for _, parent := range cj.Parents {
 				if parent == commits[i] {
 					return true
 				}
 			}
 			// If j is parent of i, j should come first
-			for _, parent := range ci.ParentHashes {
+			for _, parent := range ci.Parents {
 				if parent == commits[j] {
 					return false
 				}
 			}
 		}
 		
-		return commits[i].String() < commits[j].String()
+		return commits[i] < commits[j]
 	})
 
 	return commits, nil
 }
 
 // walkCommits recursively walks commit history
-func walkCommits(repo *git.Repository, hash plumbing.Hash, visited map[plumbing.Hash]bool) error {
+func walkCommits(repo store, hash string, visited map[string]bool) error {
 	if visited[hash] {
 		return nil
 	}
 
 	visited[hash] = true
 
-	commit, err := repo.CommitObject(hash)
+	commit, err := repo.Commit(hash)
 	if err != nil {
 		return err
 	}
 
 	// Walk parents
-	for _, parentHash := range commit.ParentHashes {
+	for _, parentHash := range commit.Parents {
 		walkCommits(repo, parentHash, visited)
 	}
 
@@ -182,14 +217,14 @@ func walkCommits(repo *git.Repository, hash plumbing.Hash, visited map[plumbing.
 }
 
 // rewriteCommit rewrites a single commit, updating its parents based on the commit map
-func rewriteCommit(repo *git.Repository, oldHash plumbing.Hash, commitMap map[plumbing.Hash]plumbing.Hash) (plumbing.Hash, error) {
+func rewriteCommit(repo store, oldHash string, commitMap map[string]string, em events.Emitter) (string, error) {
 	// If this commit is directly replaced, return the replacement
 	if newHash, exists := commitMap[oldHash]; exists {
 		return newHash, nil
 	}
 
 	// Get the original commit
-	oldCommit, err := repo.CommitObject(oldHash)
+	oldCommit, err := repo.Commit(oldHash)
 	if err != nil {
 		// If we can't read it, it might be broken - check if it's in replace map
 		return oldHash, nil
@@ -197,9 +232,9 @@ func rewriteCommit(repo *git.Repository, oldHash plumbing.Hash, commitMap map[pl
 
 	// Check if any parents need to be rewritten
 	needsRewrite := false
-	newParents := make([]plumbing.Hash, 0, len(oldCommit.ParentHashes))
+	newParents := make([]string, 0, len(oldCommit.Parents))
 
-	for _, parentHash := range oldCommit.ParentHashes {
+	for _, parentHash := range oldCommit.Parents {
 		if newParentHash, exists := commitMap[parentHash]; exists {
 			newParents = append(newParents, newParentHash)
 			needsRewrite = true
@@ -213,95 +248,87 @@ func rewriteCommit(repo *git.Repository, oldHash plumbing.Hash, commitMap map[pl
 		return oldHash, nil
 	}
 
-	// Create new commit with updated parents
-	newCommit := &object.Commit{
-		Author:       oldCommit.Author,
-		Committer:    oldCommit.Committer,
-		Message:      oldCommit.Message,
-		TreeHash:     oldCommit.TreeHash,
-		ParentHashes: newParents,
+	// Create new commit with updated parents. Its other headers are kept,
+	// except signatures, which no longer match.
+	headers, signed := oldCommit.Unsigned()
+	if signed {
+		em.Warnf("Dropping the signature of commit %s, it does not match the rewritten commit", oldHash[:8])
 	}
-
-	// Store the new commit
-	obj := repo.Storer.NewEncodedObject()
-	obj.SetType(plumbing.CommitObject)
-
-	err = newCommit.Encode(obj)
-	if err != nil {
-		return oldHash, fmt.Errorf("failed to encode commit: %w", err)
+	newCommit := &Commit{
+		Author:    oldCommit.Author,
+		Committer: oldCommit.Committer,
+		Message:   oldCommit.Message,
+		Tree:      oldCommit.Tree,
+		Parents:   newParents,
+		Headers:   headers,
 	}
 
-	newHash, err := repo.Storer.SetEncodedObject(obj)
+	// Store the new commit
+	newHash, err := repo.WriteCommit(newCommit)
 	if err != nil {
-		return oldHash, fmt.Errorf("failed to store commit: %w", err)
+		return oldHash, err
 	}
 
 	return newHash, nil
 }
 
 // updateAllReferences updates all branch and tag references to point to rewritten commits
-func updateAllReferences(repo *git.Repository, commitMap map[plumbing.Hash]plumbing.Hash) error {
+func updateAllReferences(repo store, commitMap map[string]string, em events.Emitter) error {
 	refs, err := repo.References()
 	if err != nil {
 		return err
 	}
 
 	var refsToUpdate []struct {
-		name    plumbing.ReferenceName
-		oldHash plumbing.Hash
-		newHash plumbing.Hash
+		ref     Ref
+		newHash string
 	}
 
 	// Collect refs that need updating
-	err = refs.ForEach(func(ref *plumbing.Reference) error {
+	for _, ref := range refs {
 		// Skip replace refs
-		refName := ref.Name().String()
+		refName := ref.Name
 		if len(refName) > 13 && refName[:13] == "refs/replace/" {
-			return nil
+			continue
 		}
 
 		// Only update branches and tags
-		if !ref.Name().IsBranch() && !ref.Name().IsTag() {
-			return nil
+		if !ref.IsBranch() && !ref.IsTag() || ref.Symbolic() {
+			continue
 		}
 
-		oldHash := ref.Hash()
-
 		// Check if this ref points to a rewritten commit
-		if newHash, exists := commitMap[oldHash]; exists {
+		if newHash, exists := commitMap[ref.Hash]; exists {
 			refsToUpdate = append(refsToUpdate, struct {
-				name    plumbing.ReferenceName
-				oldHash plumbing.Hash
-				newHash plumbing.Hash
-			}{ref.Name(), oldHash, newHash})
+				ref     Ref
+				newHash string
+			}{ref, newHash})
 		}
-
-		return nil
-	})
-
-	if err != nil {
-		return err
 	}
 
 	// Update refs
 	for _, update := range refsToUpdate {
-		newRef := plumbing.NewHashReference(update.name, update.newHash)
-		err = repo.Storer.SetReference(newRef)
+		err = repo.SetReference(update.ref.Name, update.newHash)
 		if err != nil {
-			return fmt.Errorf("failed to update %s: %w", update.name, err)
+			return fmt.Errorf("failed to update %s: %w", update.ref.Name, err)
 		}
-		fmt.Printf("  Updated %s: %s -> %s\n", update.name.Short(), update.oldHash.String()[:8], update.newHash.String()[:8])
+		em.Detailf("Updated %s: %s -> %s", update.ref.Short(), update.ref.Hash[:8], update.newHash[:8])
 	}
 
 	return nil
 }
 
 // GetReplaceRefs returns all replace references (exported for use in commands)
-func GetReplaceRefs(repoPath string) (map[string]string, error) {
-	repo, err := git.PlainOpen(repoPath)
+func GetReplaceRefs(ctx context.Context, opts Options) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	repo, err := openStore(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
-	return getReplaceRefs(repo)
+	defer repo.Close()
+	return getReplaceRefs(repo, opts.emit())
 }
 
@@ -0,0 +1,423 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Fixer repairs one class of repository corruption.
+// New corruption classes are supported by implementing Fixer and registering
+// it with RegisterFixer; the fix command picks it up automatically.
+type Fixer interface {
+	// Name is the stable identifier used by --only, --skip and in reports
+	Name() string
+
+	// Description is a one-line summary shown by --list-fixers
+	Description() string
+
+	// Handles reports whether the fixer resolves issues of the given type
+	Handles(IssueType) bool
+
+	// DependsOn lists fixers that must run before this one when both are selected
+	DependsOn() []string
+
+	// Plan works out what Apply would change without modifying the repository
+	Plan(ctx context.Context, opts Options, d *Diagnosis) (*FixPlan, error)
+
+	// Apply performs the planned changes and returns how many issues were fixed.
+	// It records every reference and object it changes in d.
+	Apply(ctx context.Context, opts Options, d *Diagnosis, plan *FixPlan) (int, error)
+}
+
+// IssueMatcher is implemented by fixers that only handle some issues of a type,
+// e.g. tags but not branches. It refines Handles when attributing fixes.
+type IssueMatcher interface {
+	Matches(Issue) bool
+}
+
+// fixerMatches reports whether f is responsible for the given issue
+func fixerMatches(f Fixer, issue Issue) bool {
+	if !f.Handles(issue.Type) {
+		return false
+	}
+	if m, ok := f.(IssueMatcher); ok {
+		return m.Matches(issue)
+	}
+	return true
+}
+
+// FixPlan describes what a fixer is going to change
+type FixPlan struct {
+	Fixer  string
+	Count  int     // Number of changes Apply would make
+	Issues []Issue // Diagnosed issues the fixer is expected to resolve
+
+	// Changes lists what Apply would change, and what it changed once it
+	// ran, for fixers that report their changes one by one
+	Changes []FixChange
+
+	targets any  // What the fix function found to change, see planned
+	scanned bool // targets holds the result of the scan
+}
+
+// FixChange is a single change made by a fixer, for the run log and the
+// dry-run preview
+type FixChange struct {
+	Object   string // What is changed, e.g. a reference name
+	Action   string // What happens to it and why
+	OldValue string
+	NewValue string // Empty when Object is removed
+}
+
+// recordChange adds a change to the plan being worked out or applied
+func recordChange(opts Options, change FixChange) {
+	if opts.plan != nil {
+		opts.plan.Changes = append(opts.plan.Changes, change)
+	}
+}
+
+// Empty reports whether the plan has nothing to do
+func (p *FixPlan) Empty() bool {
+	return p == nil || p.Count == 0
+}
+
+// Registry holds the set of known fixers
+type Registry struct {
+	mu     sync.RWMutex
+	fixers map[string]Fixer
+	order  []string // Registration order, used to break ordering ties
+}
+
+// NewRegistry creates an empty fixer registry
+func NewRegistry() *Registry {
+	return &Registry{fixers: make(map[string]Fixer)}
+}
+
+// Register adds a fixer to the registry
+func (r *Registry) Register(f Fixer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name := f.Name()
+	if name == "" {
+		return fmt.Errorf("fixer has no name")
+	}
+	if _, exists := r.fixers[name]; exists {
+		return fmt.Errorf("fixer %q is already registered", name)
+	}
+
+	r.fixers[name] = f
+	r.order = append(r.order, name)
+	return nil
+}
+
+// Get returns the fixer with the given name
+func (r *Registry) Get(name string) (Fixer, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	f, ok := r.fixers[name]
+	return f, ok
+}
+
+// Ordered returns every registered fixer so that each one comes after the
+// fixers it depends on. Unrelated fixers keep their registration order.
+func (r *Registry) Ordered() ([]Fixer, error) {
+	return r.Select(nil, nil)
+}
+
+// Select returns the fixers to run in dependency order. When only is
+// non-empty just those fixers are selected; fixers named in skip are removed.
+// Dependencies that are not selected are ignored, they only affect ordering.
+func (r *Registry) Select(only, skip []string) ([]Fixer, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, name := range append(append([]string{}, only...), skip...) {
+		if _, ok := r.fixers[name]; !ok {
+			return nil, fmt.Errorf("unknown fixer %q (available: %s)", name, strings.Join(r.order, ", "))
+		}
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range r.order {
+		selected[name] = len(only) == 0
+	}
+	for _, name := range only {
+		selected[name] = true
+	}
+	for _, name := range skip {
+		selected[name] = false
+	}
+
+	// Depth-first topological sort, visiting fixers in registration order
+	const (
+		visiting = iota + 1
+		done
+	)
+	state := make(map[string]int)
+	var ordered []Fixer
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("fixer dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		}
+
+		f, ok := r.fixers[name]
+		if !ok {
+			return fmt.Errorf("fixer %q depends on unknown fixer %q", path[len(path)-1], name)
+		}
+
+		state[name] = visiting
+		deps := append([]string{}, f.DependsOn()...)
+		sort.SliceStable(deps, func(i, j int) bool { return r.index(deps[i]) < r.index(deps[j]) })
+		for _, dep := range deps {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+
+		if selected[name] {
+			ordered = append(ordered, f)
+		}
+		return nil
+	}
+
+	for _, name := range r.order {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
+
+// index returns the registration position of a fixer
+func (r *Registry) index(name string) int {
+	for i, n := range r.order {
+		if n == name {
+			return i
+		}
+	}
+	return len(r.order)
+}
+
+var defaultRegistry = NewRegistry()
+
+// DefaultRegistry returns the registry holding the built-in fixers
+func DefaultRegistry() *Registry {
+	return defaultRegistry
+}
+
+// RegisterFixer adds a fixer to the default registry. It panics on duplicate
+// names, as registration happens from init functions.
+func RegisterFixer(f Fixer) {
+	if err := defaultRegistry.Register(f); err != nil {
+		panic(err)
+	}
+}
+
+// SuggestedFixer returns the name of the first fixer, in run order, that
+// handles the given issue, or "" when no fixer does
+func (r *Registry) SuggestedFixer(issue Issue) string {
+	return r.Suggester()(issue)
+}
+
+// Suggester works out the run order once and returns a function that does
+// what SuggestedFixer does, for callers that look up many issues
+func (r *Registry) Suggester() func(Issue) string {
+	fixers, err := r.Ordered()
+	if err != nil {
+		fixers = nil
+	}
+	return func(issue Issue) string {
+		for _, f := range fixers {
+			if fixerMatches(f, issue) {
+				return f.Name()
+			}
+		}
+		return ""
+	}
+}
+
+// planned returns what a fix function is going to change. While a plan is
+// worked out it runs scan and keeps the result in the plan; when the plan is
+// applied it returns that result instead of scanning again. Without a plan
+// it just scans.
+func planned[T any](opts Options, scan func() ([]T, error)) ([]T, error) {
+	if p := opts.plan; p != nil && p.scanned {
+		targets, _ := p.targets.([]T)
+		return targets, nil
+	}
+	targets, err := scan()
+	if opts.plan != nil && err == nil {
+		opts.plan.targets = targets
+	}
+	return targets, err
+}
+
+// funcFixer adapts one of the scan-and-fix functions in this package to the
+// Fixer interface. Plan runs the function in dry-run mode and keeps what it
+// found; Apply runs it again on that instead of scanning the repository.
+type funcFixer struct {
+	name        string
+	description string
+	handles     []IssueType
+	dependsOn   []string
+	matches     func(Issue) bool // Optional filter on top of handles
+	fix         func(context.Context, Options) (int, error)
+}
+
+func (f *funcFixer) Name() string        { return f.name }
+func (f *funcFixer) Description() string { return f.description }
+func (f *funcFixer) DependsOn() []string { return f.dependsOn }
+
+func (f *funcFixer) Handles(t IssueType) bool {
+	for _, h := range f.handles {
+		if h == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *funcFixer) Matches(issue Issue) bool {
+	return f.matches == nil || f.matches(issue)
+}
+
+func (f *funcFixer) Plan(ctx context.Context, opts Options, d *Diagnosis) (*FixPlan, error) {
+	plan := &FixPlan{Fixer: f.name}
+	for _, issue := range d.Issues {
+		if fixerMatches(f, issue) {
+			plan.Issues = append(plan.Issues, issue)
+		}
+	}
+
+	opts.DryRun = true
+	opts.Diagnosis = d
+	opts.plan = plan
+	count, err := f.fix(ctx, opts)
+	plan.Count = count
+	plan.scanned = err == nil
+	return plan, err
+}
+
+func (f *funcFixer) Apply(ctx context.Context, opts Options, d *Diagnosis, plan *FixPlan) (int, error) {
+	if opts.DryRun {
+		return plan.Count, nil
+	}
+	opts.Diagnosis = d
+	if plan != nil && plan.Fixer == f.name {
+		plan.Changes = nil
+		opts.plan = plan
+	}
+	return f.fix(ctx, opts)
+}
+
+func init() {
+	RegisterFixer(&funcFixer{
+		name:        "pack-indexes",
+		description: "Rebuild missing and broken pack indexes from their packs",
+		handles:     []IssueType{IssueTypeBadPackIndex},
+		fix:         FixPackIndexes,
+	})
+	RegisterFixer(&funcFixer{
+		name:        "conflict-copies",
+		description: "Merge the newest valid value of cloud-sync conflict copies and quarantine them",
+		handles:     []IssueType{IssueTypeConflictCopy},
+		dependsOn:   []string{"pack-indexes"},
+		fix:         FixConflictCopies,
+	})
+	RegisterFixer(&funcFixer{
+		name:        "malformed-refs",
+		description: "Restore empty or garbage reference files and packed-refs lines from the reflog",
+		handles:     []IssueType{IssueTypeMalformedRef},
+		dependsOn:   []string{"conflict-copies"},
+		fix:         FixMalformedRefs,
+	})
+	RegisterFixer(&funcFixer{
+		name:        "packed-refs",
+		description: "Remove null SHA entries, duplicates and stray lines from packed-refs, restoring null entries from the reflog",
+		dependsOn:   []string{"malformed-refs"},
+		fix:         FixPackedRefs,
+	})
+	RegisterFixer(&funcFixer{
+		name:        "corrupt-objects",
+		description: "Move empty, truncated and undecompressable loose objects into quarantine",
+		handles:     []IssueType{IssueTypeCorruptObject},
+		dependsOn:   []string{"packed-refs"},
+		fix:         FixCorruptLooseObjects,
+	})
+	RegisterFixer(&funcFixer{
+		name:        "corrupt-packs",
+		description: "Salvage the readable objects of damaged packs as loose objects and quarantine the packs",
+		handles:     []IssueType{IssueTypeCorruptPack},
+		dependsOn:   []string{"corrupt-objects"},
+		fix:         FixCorruptPacks,
+	})
+	RegisterFixer(&funcFixer{
+		name:        "hash-path-mismatch",
+		description: "Move objects stored at null SHA paths to their correct location",
+		handles:     []IssueType{IssueTypeHashPathMismatch},
+		dependsOn:   []string{"corrupt-packs"},
+		fix:         FixHashPathMismatch,
+	})
+	RegisterFixer(&funcFixer{
+		name:        "null-refs",
+		description: "Point HEAD and branches with a null SHA at a valid commit",
+		handles:     []IssueType{IssueTypeNullSHA},
+		dependsOn:   []string{"hash-path-mismatch"},
+		matches:     func(issue Issue) bool { return !isTagIssue(issue) && !isWorktreeIssue(issue) },
+		fix:         FixNullSHAReferences,
+	})
+	RegisterFixer(&funcFixer{
+		name:        "null-tags",
+		description: "Repoint or delete tags with a null SHA",
+		handles:     []IssueType{IssueTypeNullSHA},
+		dependsOn:   []string{"null-refs"},
+		matches:     isTagIssue,
+		fix:         FixNullSHATags,
+	})
+	RegisterFixer(&funcFixer{
+		name:        "missing-commits",
+		description: "Repoint or delete references to commits that do not exist",
+		handles:     []IssueType{IssueTypeMissingCommit},
+		dependsOn:   []string{"null-refs", "null-tags"},
+		matches:     func(issue Issue) bool { return !isWorktreeIssue(issue) },
+		fix:         FixMissingCommits,
+	})
+	RegisterFixer(&funcFixer{
+		name:        "worktrees",
+		description: "Repair HEAD, ORIG_HEAD and index of every worktree",
+		handles:     []IssueType{IssueTypeNullSHA, IssueTypeMissingCommit, IssueTypeBadIndex},
+		dependsOn:   []string{"null-refs", "missing-commits"},
+		matches:     isWorktreeIssue,
+		fix:         FixWorktrees,
+	})
+	RegisterFixer(&funcFixer{
+		name:        "tree-null-entries",
+		description: "Rebuild trees without null SHA entries or unreadable entries and replace the commits using them",
+		handles:     []IssueType{IssueTypeNullTreeEntry, IssueTypeMalformedTree},
+		dependsOn:   []string{"hash-path-mismatch"},
+		fix:         FixTreeObjectsWithNullSHA,
+	})
+	RegisterFixer(&funcFixer{
+		name:        "object-indexes",
+		description: "Rebuild or remove commit-graphs and multi-pack-indexes that no longer match the objects",
+		handles:     []IssueType{IssueTypeStaleCommitGraph, IssueTypeStaleMultiPackIndex},
+		dependsOn:   []string{"hash-path-mismatch", "tree-null-entries"},
+		fix:         FixObjectIndexes,
+	})
+}
+
+// isTagIssue reports whether an issue concerns a tag reference
+func isTagIssue(issue Issue) bool {
+	return strings.HasPrefix(issue.Object, "refs/tags/")
+}
@@ -0,0 +1,377 @@
+package git
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rahul/nsha/pkg/gitdir"
+)
+
+// ForensicsVersion is the schema version of the evidence bundle manifest. It
+// changes only when fields are removed or change meaning.
+const ForensicsVersion = "1"
+
+// forensicsReflogTail is how many of the newest reflog entries are kept for
+// every affected reference
+const forensicsReflogTail = 50
+
+// ForensicsManifest describes an evidence bundle. It is stored in the bundle
+// as manifest.json and lists every other file in it with its checksum.
+type ForensicsManifest struct {
+	SchemaVersion string           `json:"schema_version"`
+	Created       time.Time        `json:"created"`
+	Repository    string           `json:"repository"`
+	ObjectFormat  string           `json:"object_format"`
+	GitVersion    string           `json:"git_version"`
+	Issues        []ForensicsIssue `json:"issues"`
+	Files         []ForensicsFile  `json:"files"`
+}
+
+// ForensicsIssue is an issue found when the evidence was collected
+type ForensicsIssue struct {
+	Type     IssueType `json:"type"`
+	Severity Severity  `json:"severity"`
+	Object   string    `json:"object,omitempty"`
+	Commit   string    `json:"commit,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Message  string    `json:"message"`
+}
+
+// ForensicsFile is a file in an evidence bundle. Files copied from the
+// repository keep the metadata they had there; files nsha generated, such
+// as the fsck output, only have a size and checksum.
+type ForensicsFile struct {
+	Name    string     `json:"name"`             // Path inside the bundle
+	Source  string     `json:"source,omitempty"` // Where the bytes came from
+	Size    int64      `json:"size"`
+	SHA256  string     `json:"sha256"`
+	Mode    string     `json:"mode,omitempty"` // Permissions, e.g. -rw-r--r--
+	ModTime *time.Time `json:"mtime,omitempty"`
+	Inode   uint64     `json:"inode,omitempty"` // Zero where the platform has none
+}
+
+// forensicsBundle writes the files of an evidence bundle into a tar archive
+type forensicsBundle struct {
+	tw      *tar.Writer
+	created time.Time
+	files   []ForensicsFile
+	names   map[string]bool
+}
+
+// add writes data to the bundle as name. info is the metadata of the file
+// the data was read from, nil for generated files.
+func (b *forensicsBundle) add(name, source string, data []byte, info os.FileInfo) error {
+	if b.names[name] {
+		return nil
+	}
+	b.names[name] = true
+
+	sum := sha256.Sum256(data)
+	entry := ForensicsFile{Name: name, Source: source, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}
+	modTime := b.created
+	if info != nil {
+		modTime = info.ModTime()
+		entry.Mode = info.Mode().String()
+		entry.ModTime = &modTime
+		entry.Inode = fileInode(info)
+	}
+
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime, Typeflag: tar.TypeReg}
+	if err := b.tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if _, err := b.tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if name != "manifest.json" {
+		b.files = append(b.files, entry)
+	}
+	return nil
+}
+
+// addFile copies a file, or every file directly inside a directory such as
+// the reftable stack, into the bundle under name
+func (b *forensicsBundle) addFile(name, file string) error {
+	info, err := os.Lstat(file)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := os.ReadDir(file)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				if err := b.addFile(name+"/"+entry.Name(), filepath.Join(file, entry.Name())); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return b.add(name, filepath.ToSlash(file), data, info)
+}
+
+// CollectForensics writes an evidence bundle to out, a gzip-compressed tar
+// archive, without changing the repository. It holds the raw bytes of every
+// file and object an issue is about, their file metadata, the git fsck
+// output, the git version, the repository config, the newest reflog entries
+// of every affected reference and a manifest with SHA-256 checksums.
+func CollectForensics(ctx context.Context, opts Options, out string) (*ForensicsManifest, error) {
+	em := opts.emit()
+	d := opts.gitDir()
+	format := opts.objectFormat()
+
+	issues, err := currentIssues(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := fsckOutput(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &ForensicsManifest{
+		SchemaVersion: ForensicsVersion,
+		Created:       time.Now(),
+		Repository:    opts.RepoPath,
+		ObjectFormat:  string(format),
+	}
+	for _, issue := range issues {
+		severity := issue.Severity
+		if severity == "" {
+			severity = issue.Type.Severity()
+		}
+		manifest.Issues = append(manifest.Issues, ForensicsIssue{
+			Type:     issue.Type,
+			Severity: severity,
+			Object:   issue.Object,
+			Commit:   issue.Commit,
+			Path:     issue.Path,
+			Message:  issue.Message,
+		})
+	}
+	if abs, err := filepath.Abs(opts.RepoPath); err == nil {
+		manifest.Repository = abs
+	}
+	if version, err := gitCommand(ctx, opts.RepoPath, "--version").Output(); err == nil {
+		manifest.GitVersion = strings.TrimSpace(string(version))
+	}
+
+	// Write next to the destination so a failed run never leaves a partial bundle
+	tmp := out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create evidence bundle: %w", err)
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	bundle := &forensicsBundle{tw: tar.NewWriter(gz), created: manifest.Created, names: make(map[string]bool)}
+
+	if err := bundle.add("fsck.txt", "git fsck --full", []byte(strings.Join(lines, "\n")+"\n"), nil); err != nil {
+		return nil, err
+	}
+	if err := bundle.add("git-version.txt", "git --version", []byte(manifest.GitVersion+"\n"), nil); err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"config", "config.worktree"} {
+		if err := bundle.addFile(name, d.Path(name)); err != nil && !os.IsNotExist(err) {
+			em.Debugf("Could not capture %s: %v", name, err)
+		}
+	}
+
+	files, objects, refs := issueSubjects(d, opts.RepoPath, issues)
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := bundle.addFile(forensicsName(d, file), file); err != nil {
+			em.Debugf("Could not capture %s: %v", file, err)
+		}
+	}
+	for _, hash := range objects {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := addForensicsObject(ctx, bundle, d, format, hash); err != nil {
+			em.Debugf("Could not capture object %s: %v", shortHash(hash), err)
+		}
+	}
+	for _, ref := range refs {
+		if err := addForensicsReflog(ctx, bundle, d, opts.RepoPath, ref); err != nil {
+			em.Debugf("Could not capture the reflog of %s: %v", ref, err)
+		}
+	}
+
+	manifest.Files = bundle.files
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := bundle.add("manifest.json", "", append(data, '\n'), nil); err != nil {
+		return nil, err
+	}
+	if err := bundle.tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write evidence bundle: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write evidence bundle: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write evidence bundle: %w", err)
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		return nil, fmt.Errorf("failed to write evidence bundle: %w", err)
+	}
+
+	em.Debugf("Captured %d file(s) for %d issue(s) in %s", len(manifest.Files), len(issues), out)
+	return manifest, nil
+}
+
+// issueSubjects returns the files, objects and references the issues are
+// about, each sorted and without duplicates
+func issueSubjects(d *gitdir.Dir, repoPath string, issues []Issue) (files, objects, refs []string) {
+	seen := make(map[string]bool)
+	add := func(list *[]string, value string) {
+		if value != "" && !seen[value] {
+			seen[value] = true
+			*list = append(*list, value)
+		}
+	}
+
+	for _, issue := range issues {
+		file := ""
+		if issue.Path != "" {
+			file = filepath.FromSlash(issue.Path)
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(repoPath, file)
+			}
+			add(&files, file)
+		}
+
+		for _, hash := range []string{strings.ToLower(issue.Object), strings.ToLower(issue.Commit)} {
+			if isHash(hash) && !isNullHash(hash) {
+				add(&objects, hash)
+			}
+		}
+
+		switch {
+		case issue.Object == "HEAD" || issue.Object == "ORIG_HEAD" || issue.Object == "FETCH_HEAD",
+			strings.HasPrefix(issue.Object, "refs/"),
+			strings.HasPrefix(issue.Object, "worktrees/"),
+			strings.HasPrefix(issue.Object, "main-worktree/"):
+			add(&refs, issue.Object)
+		case file != "":
+			// Missing commits of references are reported by their file
+			if rel := filepath.ToSlash(relativeToCommonDir(d, file)); strings.HasPrefix(rel, "refs/") {
+				add(&refs, rel)
+			}
+		}
+	}
+
+	sort.Strings(files)
+	sort.Strings(objects)
+	sort.Strings(refs)
+	return files, objects, refs
+}
+
+// forensicsName returns where a repository file is stored in the bundle
+func forensicsName(d *gitdir.Dir, file string) string {
+	rel := filepath.ToSlash(relativeToCommonDir(d, file))
+	if filepath.IsAbs(rel) || strings.HasPrefix(rel, "../") {
+		return "files/external/" + filepath.Base(file)
+	}
+	return "files/" + rel
+}
+
+// addForensicsObject adds the raw bytes of an object: its loose file as
+// stored, or, for packed and quarantined objects, the object as git hashes
+// it ("<type> <size>\0<content>") or the undecodable bytes of its entry
+func addForensicsObject(ctx context.Context, bundle *forensicsBundle, d *gitdir.Dir, format ObjectFormat, hash string) error {
+	loose := d.ObjectPath(hash)
+	if _, err := os.Stat(loose); err == nil {
+		return bundle.addFile(forensicsName(d, loose), loose)
+	}
+
+	obj, err := readRawObject(ctx, d, format, hash, 0)
+	if err != nil {
+		return err
+	}
+	data := obj.Stored
+	if data == nil {
+		data = append([]byte(fmt.Sprintf("%s %d\x00", obj.Type, len(obj.Data))), obj.Data...)
+	}
+	return bundle.add("objects/"+hash, obj.Source, data, nil)
+}
+
+// addForensicsReflog adds the newest entries of a reference's reflog. Files
+// backend reflogs are copied as stored; reftable reflogs come from git.
+func addForensicsReflog(ctx context.Context, bundle *forensicsBundle, d *gitdir.Dir, repoPath, ref string) error {
+	name := "reflogs/" + ref
+	file := reflogFile(d, ref)
+	info, err := os.Stat(file)
+	if err == nil {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		return bundle.add(name, filepath.ToSlash(file), reflogTail(data, forensicsReflogTail), info)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	output, err := gitCommand(ctx, repoPath, "reflog", "show", "--no-abbrev", "-n", fmt.Sprint(forensicsReflogTail), ref).Output()
+	if err != nil || len(output) == 0 {
+		// References without a reflog have nothing to capture
+		return nil
+	}
+	return bundle.add(name, "git reflog show "+ref, output, nil)
+}
+
+// reflogFile returns where the files backend keeps a reference's reflog
+func reflogFile(d *gitdir.Dir, ref string) string {
+	switch {
+	case strings.HasPrefix(ref, "main-worktree/"):
+		return filepath.Join(d.CommonDir, "logs", filepath.FromSlash(strings.TrimPrefix(ref, "main-worktree/")))
+	case strings.HasPrefix(ref, "worktrees/"):
+		worktree, name, _ := strings.Cut(strings.TrimPrefix(ref, "worktrees/"), "/")
+		return filepath.Join(d.CommonDir, "worktrees", worktree, "logs", filepath.FromSlash(name))
+	case isPerWorktreeRef(ref):
+		return filepath.Join(d.GitDir, "logs", filepath.FromSlash(ref))
+	}
+	return filepath.Join(d.CommonDir, "logs", filepath.FromSlash(ref))
+}
+
+// reflogTail returns the last n lines of a reflog
+func reflogTail(data []byte, n int) []byte {
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return bytes.Join(lines, nil)
+}
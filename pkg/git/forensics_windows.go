@@ -0,0 +1,10 @@
+//go:build windows
+
+package git
+
+import "os"
+
+// fileInode returns zero, as os.FileInfo has no file index on Windows
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -1,169 +1,432 @@
 package git
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
 	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/rahul/nsha/pkg/events"
+	"github.com/rahul/nsha/pkg/gitdir"
+	"github.com/rahul/nsha/pkg/progress"
 )
 
 // RunFsck performs a full repository check similar to git fsck
-func RunFsck(repoPath string, verbose bool) ([]Issue, error) {
-	var issues []Issue
+func RunFsck(ctx context.Context, opts Options) ([]Issue, error) {
+	d, err := Diagnose(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return d.Issues, nil
+}
 
-	// First, run the actual git fsck command to catch hash-path mismatches and other issues
-	cmd := exec.Command("git", "fsck", "--full")
-	cmd.Dir = repoPath
-	output, err := cmd.CombinedOutput()
+// Diagnose scans the repository with git fsck and go-git. The result is
+// shared by the fixers through Options.Diagnosis.
+func Diagnose(ctx context.Context, opts Options) (*Diagnosis, error) {
+	em := opts.emit()
 
-	// Parse git fsck output
-	if len(output) > 0 {
-		lines := strings.Split(string(output), "\n")
-		for _, line := range lines {
-			line = strings.TrimSpace(line)
-			if line == "" {
-				continue
-			}
+	d := newDiagnosis(opts.RepoPath)
 
-			// Parse different types of errors
-			if strings.Contains(line, "hash-path mismatch") {
-				// Extract the hash and path
-				parts := strings.Split(line, ":")
-				if len(parts) >= 2 {
-					hash := strings.TrimSpace(parts[1])
-					hash = strings.Split(hash, " ")[0]
-
-					// Check if it's stored at null SHA path
-					if strings.Contains(line, "objects/00/0000000000000000000000000000000000000") {
-						issues = append(issues, Issue{
-							Type:    IssueTypeNullSHA,
-							Object:  hash,
-							Message: "Object stored at null SHA path (hash-path mismatch)",
-						})
-					}
-				}
-			} else if strings.Contains(line, "null sha1") || strings.Contains(line, "null SHA") {
-				issues = append(issues, Issue{
-					Type:    IssueTypeNullSHA,
-					Object:  "",
-					Message: line,
-				})
-			} else if strings.Contains(line, "missing") {
-				issues = append(issues, Issue{
-					Type:    IssueTypeMissingCommit,
-					Object:  "",
-					Message: line,
-				})
-			} else if strings.HasPrefix(line, "error:") || strings.HasPrefix(line, "warning:") {
-				// Generic error/warning
-				if verbose {
-					fmt.Printf("  Git fsck: %s\n", line)
-				}
+	// Shallow and partial clones miss some objects on purpose
+	absences, err := LoadAbsences(ctx, opts)
+	if err != nil {
+		em.Debugf("Cannot tell expected absences apart: %v", err)
+	}
+	d.absences = absences
+
+	// Sync tools' conflict copies race with the files they duplicate
+	reported := make(map[string]bool)
+	for _, c := range scanConflictCopies(opts) {
+		issue := c.issue(opts.gitDir(), opts.RepoPath)
+		d.add(issue, subject{subjectPath, issue.Path})
+		reported[issue.Object] = true
+	}
+
+	// git and go-git stop at or skip reference files they cannot parse
+	for _, problem := range scanRefFiles(opts) {
+		issue := problem.issue(opts.RepoPath)
+		d.add(issue, subject{subjectRefFile, issue.Object})
+		reported[issue.Object] = true
+	}
+
+	// Damaged loose objects make git fsck stop at the first one it reads
+	looseIssues, err := checkLooseObjects(ctx, opts)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if err != nil {
+		em.Debugf("Skipping loose object check: %v", err)
+	}
+	corrupt := make(map[string]bool)
+	for _, issue := range looseIssues {
+		d.add(issue, subject{subjectPath, issue.Path})
+		corrupt[issue.Object] = true
+	}
+
+	// git fsck reports every object it cannot unpack from a damaged pack
+	packIssues, err := checkPacks(ctx, opts)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if err != nil {
+		em.Debugf("Skipping pack check: %v", err)
+	}
+	for _, issue := range packIssues {
+		// A missing index is tracked through its pack
+		if issue.Type == IssueTypeBadPackIndex {
+			d.add(issue, subject{subjectPackIndex, strings.TrimSuffix(issue.Path, ".idx") + ".pack"})
+		} else {
+			d.add(issue, subject{subjectPath, issue.Path})
+		}
+	}
+
+	// Then run the actual git fsck command to catch hash-path mismatches and other issues
+	output, _ := runGitProgress(ctx, opts, "fsck", "--full", "--progress")
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+
+	// Parse git fsck output
+	d.fsckLines = splitLines(string(output))
+	for _, line := range d.fsckLines {
+		if hash := missingHash(Issue{Message: line}); corrupt[hash] {
+			// Already reported as a corrupt loose object. Once it is moved
+			// away, it is missing if no pack has it.
+			em.Debugf("Git fsck: %s", line)
+			if issue, _, ok := parseFsckLine(line); ok {
+				d.shadowed[hash] = append(d.shadowed[hash], issue)
 			}
+		} else if issue, subj, ok := parseFsckLine(line); ok {
+			d.add(issue, subj)
+		} else if strings.HasPrefix(line, "error:") || strings.HasPrefix(line, "warning:") {
+			// Generic error/warning
+			em.Debugf("Git fsck: %s", line)
 		}
 	}
 
-	// Now also check using go-git for additional checks
-	repo, err := git.PlainOpen(repoPath)
+	// Now also check references and objects directly for additional checks
+	repo, err := openStore(ctx, opts)
 	if err != nil {
-		return issues, nil // Return what we found from git fsck
+		return d, nil // Return what we found from git fsck
 	}
+	defer repo.Close()
 
 	// Check all references
 	refs, err := repo.References()
 	if err != nil {
-		return issues, nil
+		return d, nil
 	}
 
-	err = refs.ForEach(func(ref *plumbing.Reference) error {
-		if verbose {
-			fmt.Printf("Checking ref: %s\n", ref.Name())
+	for _, ref := range refs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		em.Debugf("Checking ref: %s", ref.Name)
+
+		// Already reported as a conflict copy or malformed reference, or made
+		// up by go-git from a packed-refs line that is not a reference
+		if reported[ref.Name] || ref.Name != "HEAD" && !strings.HasPrefix(ref.Name, "refs/") {
+			continue
 		}
 
 		// Skip symbolic references (like HEAD when it points to a branch)
 		// They will be checked through their target
-		if ref.Type() == plumbing.SymbolicReference {
-			if verbose {
-				fmt.Printf("  Skipping symbolic reference: %s -> %s\n", ref.Name(), ref.Target())
-			}
-			return nil
+		if ref.Symbolic() {
+			em.Debugf("Skipping symbolic reference: %s -> %s", ref.Name, ref.Target)
+			continue
 		}
 
-		// Check for null SHA
-		hashStr := ref.Hash().String()
-		if ref.Hash().IsZero() || hashStr == "0000000000000000000000000000000000000000" {
-			issues = append(issues, Issue{
-				Type:    IssueTypeNullSHA,
-				Object:  ref.Name().String(),
-				Message: fmt.Sprintf("Reference has null SHA"),
-			})
-			return nil
+		d.refs[ref.Name] = ref.Hash
+		for _, issue := range checkReference(repo, opts.RepoPath, ref) {
+			d.add(issue, subject{subjectRef, ref.Name})
 		}
+	}
 
-		// Try to get the commit
-		commit, err := repo.CommitObject(ref.Hash())
-		if err != nil {
-			issues = append(issues, Issue{
-				Type:    IssueTypeMissingCommit,
-				Object:  ref.Hash().String(),
-				Message: fmt.Sprintf("Cannot read commit: %v", err),
-			})
+	// Per-worktree HEADs, ORIG_HEADs and indexes
+	checkWorktrees(ctx, repo, d, opts)
+
+	// .gitmodules against the gitlinks it describes
+	for _, issue := range checkGitmodules(repo) {
+		d.add(issue, subject{subjectGitmodules, ".gitmodules"})
+	}
+
+	// Commit-graphs and multi-pack-indexes left behind by earlier changes
+	for _, issue := range checkObjectIndexes(ctx, opts, repo) {
+		d.add(issue, subject{subjectObjectIndex, issue.Object})
+	}
+
+	if len(d.Expected) > 0 {
+		em.Infof("Ignoring %d object(s) a shallow or partial clone does not have by design", len(d.Expected))
+		for _, issue := range d.Expected {
+			em.Debugf("Expected absence: %s", issue.String())
+		}
+	}
+
+	return d, nil
+}
+
+// parseFsckLine turns a git fsck output line into an issue
+func parseFsckLine(line string) (Issue, subject, bool) {
+	// Parse different types of errors
+	if strings.Contains(line, "hash-path mismatch") {
+		hash, path, ok := parseHashPathMismatch(line)
+
+		// Check if it's stored at null SHA path
+		if ok && strings.Contains(line, "objects/00/0000000000000000000000000000000000000") {
+			return Issue{
+				Type:    IssueTypeHashPathMismatch,
+				Object:  hash,
+				Message: "Object stored at null SHA path (hash-path mismatch)",
+				Path:    path,
+			}, subject{subjectPath, path}, true
+		}
+	} else if treeHash := fsckTreeHash(line); treeHash != "" && strings.Contains(line, "nullSha1") {
+		// Tree entries pointing to the null SHA
+		return Issue{
+			Type:    IssueTypeNullTreeEntry,
+			Object:  treeHash,
+			Message: line,
+		}, subject{subjectObject, treeHash}, true
+	} else if treeHash != "" && strings.Contains(line, "badTree") {
+		// Trees git cannot parse at all, e.g. with a malformed mode
+		return Issue{
+			Type:    IssueTypeMalformedTree,
+			Object:  treeHash,
+			Message: line,
+		}, subject{subjectObject, treeHash}, true
+	} else if strings.Contains(line, "null sha1") || strings.Contains(line, "null SHA") {
+		return Issue{
+			Type:    IssueTypeNullSHA,
+			Object:  "",
+			Message: line,
+		}, fsckSubject(line, subjectObject), true
+	} else if strings.Contains(line, "missing") {
+		return Issue{
+			Type:    IssueTypeMissingCommit,
+			Object:  "",
+			Message: line,
+		}, fsckSubject(line, subjectMissing), true
+	}
+	return Issue{}, subject{}, false
+}
+
+// fsckSubject returns what a git fsck line is about: the reference in
+// "error: <ref>: ...", otherwise the first object hash in the line as a
+// subject of the given kind. Lines naming neither can only be rechecked by
+// running git fsck again.
+func fsckSubject(line string, kind subjectKind) subject {
+	rest := strings.TrimPrefix(strings.TrimPrefix(line, "error: "), "warning: ")
+	if name, _, ok := strings.Cut(rest, ": "); ok && (name == "HEAD" || strings.HasPrefix(name, "refs/")) {
+		return subject{subjectRef, name}
+	}
+	for _, field := range strings.Fields(line) {
+		if field = strings.Trim(field, ":,()"); isHash(field) && !isNullHash(field) {
+			return subject{kind, field}
+		}
+	}
+	return subject{}
+}
+
+// parseHashPathMismatch extracts the object hash and the path it was found at from
+// "error: <actual-hash>: hash-path mismatch, found at: .git/objects/00/0000..."
+func parseHashPathMismatch(line string) (hash, path string, ok bool) {
+	parts := strings.Split(line, ":")
+	if len(parts) < 3 {
+		return "", "", false
+	}
+
+	hash = strings.Split(strings.TrimSpace(parts[1]), " ")[0]
+
+	// Find the part with "found at"
+	for i, part := range parts {
+		if strings.Contains(part, "found at") {
+			// The path is in the next part after "found at"
+			if i+1 < len(parts) {
+				path = strings.TrimSpace(parts[i+1])
+			} else {
+				// Path might be in the same part after "found at"
+				afterFoundAt := strings.Split(part, "found at")
+				if len(afterFoundAt) > 1 {
+					path = strings.TrimSpace(afterFoundAt[1])
+				}
+			}
+			break
+		}
+	}
+
+	return hash, path, hash != "" && path != ""
+}
+
+// checkReference checks that a reference points at a readable commit
+func checkReference(repo store, repoPath string, ref Ref) []Issue {
+	// Symbolic references are checked through their target
+	if ref.Symbolic() {
+		return nil
+	}
+
+	// Check for null SHA
+	if isNullHash(ref.Hash) {
+		return []Issue{{
+			Type:    IssueTypeNullSHA,
+			Object:  ref.Name,
+			Message: fmt.Sprintf("Reference has null SHA"),
+			Path:    refPath(repoPath, ref.Name),
+		}}
+	}
+
+	// The tree fixer replaces malformed trees that are still in use
+	if strings.HasPrefix(ref.Name, "refs/replace/") {
+		if _, err := repo.Tree(ref.Hash); err == nil {
 			return nil
 		}
+	}
 
-		// Check tree
-		_, err = commit.Tree()
-		if err != nil {
+	// Try to get the commit
+	commit, err := repo.Commit(ref.Hash)
+	if err != nil {
+		return []Issue{{
+			Type:    IssueTypeMissingCommit,
+			Object:  ref.Hash,
+			Message: fmt.Sprintf("Cannot read commit: %v", err),
+			Path:    refPath(repoPath, ref.Name),
+		}}
+	}
+
+	return checkCommit(repo, commit)
+}
+
+// refPath returns where a reference is stored, relative to the repository:
+// its loose ref file, packed-refs when it is only packed, or the reftable
+// directory
+func refPath(repoPath, name string) string {
+	d := gitdir.ResolveOrDefault(repoPath)
+	refs, err := openRefStorage(d, d.GitDir)
+	if err != nil {
+		return repoRelative(repoPath, d.Path(name))
+	}
+
+	return repoRelative(repoPath, refs.Location(name))
+}
+
+// repoRelative returns a file under the git directory relative to the
+// repository. Git directories outside the repository are reported by their
+// full path.
+func repoRelative(repoPath, file string) string {
+	if rel, err := filepath.Rel(repoPath, file); err == nil && !strings.HasPrefix(rel, "..") {
+		file = rel
+	}
+	return filepath.ToSlash(file)
+}
+
+// checkCommit checks a commit's tree and parents
+func checkCommit(repo store, commit *Commit) []Issue {
+	var issues []Issue
+
+	// Check tree
+	_, err := repo.Tree(commit.Tree)
+	if err != nil {
+		issues = append(issues, Issue{
+			Type:    IssueTypeMissingTree,
+			Object:  commit.Tree,
+			Commit:  commit.Hash,
+			Message: fmt.Sprintf("Commit references missing tree"),
+		})
+	}
+
+	// Check parents
+	for _, parentHash := range commit.Parents {
+		if isNullHash(parentHash) {
 			issues = append(issues, Issue{
-				Type:    IssueTypeMissingTree,
-				Object:  commit.TreeHash.String(),
-				Commit:  commit.Hash.String(),
-				Message: fmt.Sprintf("Commit references missing tree"),
+				Type:    IssueTypeBrokenParent,
+				Object:  commit.Hash,
+				Message: fmt.Sprintf("Commit has null parent SHA"),
 			})
 		}
+	}
 
-		// Check parents
-		for _, parentHash := range commit.ParentHashes {
-			if parentHash.IsZero() || parentHash.String() == "0000000000000000000000000000000000000000" {
-				issues = append(issues, Issue{
-					Type:    IssueTypeBrokenParent,
-					Object:  commit.Hash.String(),
-					Message: fmt.Sprintf("Commit has null parent SHA"),
-				})
+	return issues
+}
+
+// checkObject rechecks a single object. Trees are checked for null entries and
+// commits for their tree and parents; previous holds the issues found for the
+// object by the last scan.
+func checkObject(repo store, hash string, previous []Issue) []Issue {
+	if entries, err := repo.Tree(hash); err == nil {
+		for _, entry := range entries {
+			if isNullHash(entry.Hash) {
+				for _, issue := range previous {
+					if issue.Type == IssueTypeNullTreeEntry {
+						return previous
+					}
+				}
+				return []Issue{{
+					Type:    IssueTypeNullTreeEntry,
+					Object:  hash,
+					Message: fmt.Sprintf("tree %s: nullSha1: contains entries pointing to null sha1", hash),
+				}}
 			}
 		}
-
 		return nil
-	})
+	}
+	if commit, err := repo.Commit(hash); err == nil {
+		return checkCommit(repo, commit)
+	}
+	// Objects that are gone (e.g. pruned) have no issues left
+	return nil
+}
 
-	if err != nil {
-		return issues, nil
+// splitLines splits command output into trimmed, non-empty lines
+func splitLines(output string) []string {
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
 	}
+	return lines
+}
 
-	return issues, nil
+// fsckTreeHash extracts the tree hash from fsck lines such as
+// "warning in tree <hash>: nullSha1: contains entries pointing to null sha1"
+func fsckTreeHash(line string) string {
+	parts := strings.Fields(line)
+	for i, part := range parts {
+		if part == "tree" && i+1 < len(parts) {
+			treeHash := strings.TrimSuffix(parts[i+1], ":")
+			if isHash(treeHash) {
+				return treeHash
+			}
+			break
+		}
+	}
+	return ""
 }
 
 // FindBadCommits identifies all commits that need to be fixed
-func FindBadCommits(repoPath string) ([]BadCommit, error) {
-	issues, err := RunFsck(repoPath, false)
+func FindBadCommits(ctx context.Context, opts Options) ([]BadCommit, error) {
+	issues, err := currentIssues(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	repo, err := git.PlainOpen(repoPath)
+	repo, err := openStore(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
+	defer repo.Close()
 
 	badCommitsMap := make(map[string]*BadCommit)
 
 	for _, issue := range issues {
 		// Handle ALL issue types including null SHA references
+		if isWorktreeIssue(issue) {
+			continue
+		}
 		if issue.Type == IssueTypeMissingTree || issue.Type == IssueTypeBrokenParent || issue.Type == IssueTypeNullSHA {
 			commitHash := issue.Commit
 			if commitHash == "" {
@@ -171,21 +434,21 @@ func FindBadCommits(repoPath string) ([]BadCommit, error) {
 			}
 
 			// Skip if this is a pure reference issue (no commit to fix)
-			if commitHash == "" || commitHash == "0000000000000000000000000000000000000000" {
+			if commitHash == "" || isNullHash(commitHash) {
 				continue
 			}
 
 			if _, exists := badCommitsMap[commitHash]; !exists {
-				commit, err := repo.CommitObject(plumbing.NewHash(commitHash))
+				commit, err := repo.Commit(commitHash)
 				if err != nil {
 					continue
 				}
 
 				bc := &BadCommit{
 					Hash:     commitHash,
-					TreeHash: commit.TreeHash.String(),
+					TreeHash: commit.Tree,
 					Message:  commit.Message,
-					IsRoot:   len(commit.ParentHashes) == 0,
+					IsRoot:   len(commit.Parents) == 0,
 				}
 
 				if commit.Author.Name != "" {
@@ -200,8 +463,8 @@ func FindBadCommits(repoPath string) ([]BadCommit, error) {
 					bc.CommitterDate = commit.Committer.When.Format("2006-01-02 15:04:05 -0700")
 				}
 
-				if len(commit.ParentHashes) > 0 && !commit.ParentHashes[0].IsZero() {
-					bc.ParentHash = commit.ParentHashes[0].String()
+				if len(commit.Parents) > 0 && !isNullHash(commit.Parents[0]) {
+					bc.ParentHash = commit.Parents[0]
 				}
 
 				badCommitsMap[commitHash] = bc
@@ -218,73 +481,63 @@ func FindBadCommits(repoPath string) ([]BadCommit, error) {
 }
 
 // FixHashPathMismatch fixes objects stored at wrong paths (null SHA paths)
-func FixHashPathMismatch(repoPath string, verbose bool, dryRun bool) (int, error) {
-	fixedCount := 0
-
-	// Run git fsck to find hash-path mismatches
-	cmd := exec.Command("git", "fsck", "--full")
-	cmd.Dir = repoPath
-	output, _ := cmd.CombinedOutput()
+func FixHashPathMismatch(ctx context.Context, opts Options) (int, error) {
+	em := opts.emit()
 
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		if !strings.Contains(line, "hash-path mismatch") {
-			continue
-		}
+	fixedCount := 0
 
-		// Parse: "error: <actual-hash>: hash-path mismatch, found at: .git/objects/00/0000..."
-		parts := strings.Split(line, ":")
-		if len(parts) < 3 {
-			continue
+	// Find hash-path mismatches in the git fsck output
+	mismatches, err := planned(opts, func() ([][2]string, error) {
+		lines, err := fsckOutput(ctx, opts)
+		if err != nil {
+			return nil, err
 		}
-
-		actualHash := strings.TrimSpace(parts[1])
-		wrongPath := ""
-
-		// Find the part with "found at"
-		for i, part := range parts {
-			if strings.Contains(part, "found at") {
-				// The path is in the next part after "found at"
-				if i+1 < len(parts) {
-					wrongPath = strings.TrimSpace(parts[i+1])
-				} else {
-					// Path might be in the same part after "found at"
-					afterFoundAt := strings.Split(part, "found at")
-					if len(afterFoundAt) > 1 {
-						wrongPath = strings.TrimSpace(afterFoundAt[1])
-					}
-				}
-				break
+		var mismatches [][2]string
+		for _, line := range lines {
+			if !strings.Contains(line, "hash-path mismatch") {
+				continue
+			}
+			if hash, path, ok := parseHashPathMismatch(line); ok {
+				mismatches = append(mismatches, [2]string{hash, path})
 			}
 		}
+		return mismatches, nil
+	})
+	if err != nil {
+		return 0, err
+	}
 
-		if actualHash == "" || wrongPath == "" {
-			continue
+	for _, m := range mismatches {
+		// Each object move is atomic; stop between moves when cancelled
+		if err := ctx.Err(); err != nil {
+			return fixedCount, err
 		}
 
-		if verbose {
-			if dryRun {
-				fmt.Printf("  [DRY RUN] Would fix hash-path mismatch: %s at %s\n", actualHash[:8], wrongPath)
-			} else {
-				fmt.Printf("  Found hash-path mismatch: %s at %s\n", actualHash[:8], wrongPath)
-			}
+		actualHash, wrongPath := m[0], m[1]
+		if opts.DryRun {
+			em.Debugf("[DRY RUN] Would fix hash-path mismatch: %s at %s", actualHash[:8], wrongPath)
+		} else {
+			em.Debugf("Found hash-path mismatch: %s at %s", actualHash[:8], wrongPath)
 		}
 
-		if dryRun {
+		if opts.DryRun {
 			fixedCount++
 			continue
 		}
 
 		// Calculate correct path
-		correctPath := filepath.Join(repoPath, ".git", "objects", actualHash[:2], actualHash[2:])
-		wrongFullPath := filepath.Join(repoPath, wrongPath)
+		correctPath := opts.gitDir().ObjectPath(actualHash)
+		// git reports the path relative to the directory it ran in, unless
+		// the object directory was given as an absolute path
+		wrongFullPath := wrongPath
+		if !filepath.IsAbs(wrongPath) {
+			wrongFullPath = filepath.Join(opts.RepoPath, wrongPath)
+		}
 
 		// Create directory for correct path
 		correctDir := filepath.Dir(correctPath)
 		if err := os.MkdirAll(correctDir, 0755); err != nil {
-			if verbose {
-				fmt.Printf("  Failed to create directory %s: %v\n", correctDir, err)
-			}
+			em.Debugf("Failed to create directory %s: %v", correctDir, err)
 			continue
 		}
 
@@ -295,32 +548,28 @@ func FixHashPathMismatch(repoPath string, verbose bool, dryRun bool) (int, error
 			if readErr == nil {
 				if writeErr := os.WriteFile(correctPath, content, 0444); writeErr == nil {
 					os.Remove(wrongFullPath)
-					if verbose {
-						fmt.Printf("  Moved object %s to correct path\n", actualHash[:8])
-					}
+					em.Debugf("Moved object %s to correct path", actualHash[:8])
+					opts.Diagnosis.InvalidateObject(actualHash)
 					fixedCount++
 				}
 			}
 		} else {
-			if verbose {
-				fmt.Printf("  Moved object %s to correct path\n", actualHash[:8])
-			}
+			em.Debugf("Moved object %s to correct path", actualHash[:8])
+			opts.Diagnosis.InvalidateObject(actualHash)
 			fixedCount++
 		}
 	}
 
-	if !dryRun {
+	if !opts.DryRun {
 		// Clean up empty null SHA directories
 		nullDirs := []string{
-			filepath.Join(repoPath, ".git", "objects", "00"),
+			opts.gitDir().Path("objects", "00"),
 		}
 
 		for _, dir := range nullDirs {
 			if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 {
 				os.Remove(dir)
-				if verbose {
-					fmt.Printf("  Removed empty directory: %s\n", dir)
-				}
+				em.Debugf("Removed empty directory: %s", dir)
 			}
 		}
 	}
@@ -329,192 +578,135 @@ func FixHashPathMismatch(repoPath string, verbose bool, dryRun bool) (int, error
 }
 
 // FixNullSHAReferences fixes null SHA in references (HEAD, branches, tags)
-func FixNullSHAReferences(repoPath string, verbose bool, dryRun bool) (int, error) {
-	repo, err := git.PlainOpen(repoPath)
+func FixNullSHAReferences(ctx context.Context, opts Options) (int, error) {
+	em := opts.emit()
+
+	repo, err := openStore(ctx, opts)
 	if err != nil {
 		return 0, fmt.Errorf("failed to open repository: %w", err)
 	}
+	defer repo.Close()
 
-	fixedCount := 0
-	nullSHA := "0000000000000000000000000000000000000000"
-
-	// 1. Check and fix HEAD reference
-	head, err := repo.Head()
+	nullRefs, err := planned(opts, func() ([]nullRef, error) {
+		return scanNullRefs(ctx, opts, repo)
+	})
 	if err != nil {
-		// HEAD might be broken, try to read it directly
-		headPath := filepath.Join(repoPath, ".git", "HEAD")
-		content, readErr := os.ReadFile(headPath)
-		if readErr == nil {
-			headStr := strings.TrimSpace(string(content))
-
-			// Check if HEAD contains null SHA
-			if headStr == nullSHA || strings.Contains(headStr, nullSHA) {
-				if verbose {
-					if dryRun {
-						fmt.Println("  [DRY RUN] Would fix null SHA in HEAD reference")
-					} else {
-						fmt.Println("  Found null SHA in HEAD reference")
-					}
-				}
+		return 0, err
+	}
 
-				if dryRun {
-					fixedCount++
-				} else {
-					// Try to find a valid branch to point to
-					validRef, findErr := findValidReference(repo)
-					if findErr == nil && validRef != "" {
-						// Update HEAD to point to valid branch
-						newContent := fmt.Sprintf("ref: %s\n", validRef)
-						if writeErr := os.WriteFile(headPath, []byte(newContent), 0644); writeErr == nil {
-							if verbose {
-								fmt.Printf("  Fixed HEAD -> %s\n", validRef)
-							}
-							fixedCount++
-						}
-					}
-				}
-			}
-		}
-	} else if head.Hash().String() == nullSHA {
-		if verbose {
-			if dryRun {
-				fmt.Println("  [DRY RUN] Would fix null SHA in HEAD reference")
-			} else {
-				fmt.Println("  Found null SHA in HEAD reference")
-			}
+	fixedCount := 0
+	nullSHA := opts.objectFormat().NullHash()
+	for _, ref := range nullRefs {
+		if err := ctx.Err(); err != nil {
+			return fixedCount, err
 		}
 
-		if dryRun {
-			fixedCount++
-		} else {
-			// Try to find a valid branch
+		// HEAD goes back to a valid branch, a branch to the newest valid commit
+		var change FixChange
+		var update refUpdate
+		if ref.name == "HEAD" {
 			validRef, findErr := findValidReference(repo)
-			if findErr == nil && validRef != "" {
-				headPath := filepath.Join(repoPath, ".git", "HEAD")
-				newContent := fmt.Sprintf("ref: %s\n", validRef)
-				if writeErr := os.WriteFile(headPath, []byte(newContent), 0644); writeErr == nil {
-					if verbose {
-						fmt.Printf("  Fixed HEAD -> %s\n", validRef)
-					}
-					fixedCount++
-				}
+			if findErr != nil || validRef == "" {
+				em.Debugf("No valid branch to point HEAD at")
+				continue
+			}
+			change = FixChange{Object: "HEAD", Action: "point at " + validRef, OldValue: nullSHA, NewValue: "ref: " + validRef}
+			update = refUpdate{Name: "HEAD", Target: validRef}
+		} else {
+			validCommit, findErr := findMostRecentValidCommit(repo)
+			if findErr != nil || validCommit == "" {
+				em.Debugf("No valid commit to point %s at", ref.name)
+				continue
 			}
+			change = FixChange{Object: ref.name, Action: "point at the most recent valid commit", OldValue: nullSHA, NewValue: validCommit}
+			update = refUpdate{Name: ref.name, Hash: validCommit}
 		}
-	}
-
-	// 2. Check and fix branch references
-	refs, err := repo.References()
-	if err == nil {
-		err = refs.ForEach(func(ref *plumbing.Reference) error {
-			if ref.Hash().String() == nullSHA {
-				if verbose {
-					if dryRun {
-						fmt.Printf("  [DRY RUN] Would fix null SHA in reference: %s\n", ref.Name())
-					} else {
-						fmt.Printf("  Found null SHA in reference: %s\n", ref.Name())
-					}
-				}
 
-				if dryRun {
-					fixedCount++
-				} else {
-					// For branches with null SHA, try to find a valid commit
-					if ref.Name().IsBranch() {
-						validCommit, findErr := findMostRecentValidCommit(repo)
-						if findErr == nil && validCommit != "" {
-							// Update the branch reference
-							refPath := filepath.Join(repoPath, ".git", ref.Name().String())
-							if writeErr := os.WriteFile(refPath, []byte(validCommit+"\n"), 0644); writeErr == nil {
-								if verbose {
-									fmt.Printf("  Fixed branch %s -> %s\n", ref.Name().Short(), validCommit[:8])
-								}
-								fixedCount++
-							}
-						}
-					}
-				}
-			}
-			return nil
-		})
+		if opts.DryRun {
+			em.Debugf("[DRY RUN] Would fix null SHA in reference: %s", ref.name)
+			recordChange(opts, change)
+			fixedCount++
+			continue
+		}
+		em.Debugf("Found null SHA in reference: %s", ref.name)
+		if err := updateRefs(opts, update); err != nil {
+			em.Warnf("Failed to fix %s: %v", ref.name, err)
+			continue
+		}
+		em.Debugf("Fixed %s: %s", ref.name, change.Action)
+		opts.Diagnosis.InvalidateRef(ref.name)
+		recordChange(opts, change)
+		fixedCount++
 	}
 
-	// 3. Check and fix packed-refs
-	packedRefsPath := filepath.Join(repoPath, ".git", "packed-refs")
-	if content, err := os.ReadFile(packedRefsPath); err == nil {
-		lines := strings.Split(string(content), "\n")
-		modified := false
-		var newLines []string
-		seenRefs := make(map[string]bool) // Track seen references to avoid duplicates
-
-		for _, line := range lines {
-			trimmedLine := strings.TrimSpace(line)
-
-			// Skip empty lines in dry-run mode
-			if dryRun && trimmedLine == "" {
-				continue
-			}
-
-			// Skip lines with null SHA
-			if strings.Contains(line, nullSHA) {
-				if verbose {
-					if dryRun {
-						fmt.Printf("  [DRY RUN] Would remove null SHA in packed-refs: %s\n", line)
-					} else {
-						fmt.Printf("  Found null SHA in packed-refs: %s\n", line)
-					}
-				}
-				modified = true
-				fixedCount++
-				continue // Skip this line (both in dry-run and actual fix)
-			}
+	return fixedCount, nil
+}
 
-			// Extract reference name to check for duplicates
-			if trimmedLine != "" && !strings.HasPrefix(trimmedLine, "#") && !strings.HasPrefix(trimmedLine, "^") {
-				parts := strings.Fields(trimmedLine)
-				if len(parts) >= 2 {
-					refName := parts[1]
-					if seenRefs[refName] {
-						// Duplicate reference found
-						if verbose {
-							if dryRun {
-								fmt.Printf("  [DRY RUN] Would remove duplicate in packed-refs: %s\n", line)
-							} else {
-								fmt.Printf("  Found duplicate in packed-refs: %s\n", line)
-							}
-						}
-						modified = true
-						continue // Skip duplicate
-					}
-					seenRefs[refName] = true
-				}
-			}
+// nullRef is HEAD or a branch holding a null SHA
+type nullRef struct {
+	name string
+}
 
-			if !dryRun {
-				newLines = append(newLines, line)
-			}
+// scanNullRefs finds HEAD and the branches that hold a null SHA. Null entries
+// of packed-refs are left to the packed-refs fixer, malformed reference files
+// to malformed-refs and other references to their own fixers.
+func scanNullRefs(ctx context.Context, opts Options, repo store) ([]nullRef, error) {
+	var found []nullRef
+	nullSHA := opts.objectFormat().NullHash()
+	malformed := malformedRefs(opts)
+
+	// 1. HEAD
+	head, err := resolveReference(repo, "HEAD")
+	switch {
+	case malformed["HEAD"]:
+	case err != nil:
+		// HEAD might be broken, try to read it directly
+		if rawHead, readErr := readRawRef(opts, "HEAD"); readErr == nil && strings.Contains(rawHead.Hash, nullSHA) {
+			found = append(found, nullRef{name: "HEAD"})
 		}
+	case isNullHash(head.Hash):
+		found = append(found, nullRef{name: "HEAD"})
+	}
 
-		if modified && !dryRun {
-			newContent := strings.Join(newLines, "\n")
-			if err := os.WriteFile(packedRefsPath, []byte(newContent), 0644); err == nil {
-				if verbose {
-					fmt.Println("  Fixed packed-refs file")
-				}
+	// 2. Branches
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if refs, err := repo.References(); err == nil {
+		for _, ref := range refs {
+			if ref.IsBranch() && !ref.Symbolic() && isNullHash(ref.Hash) && !malformed[ref.Name] {
+				found = append(found, nullRef{name: ref.Name})
 			}
 		}
 	}
+	return found, nil
+}
 
-	return fixedCount, nil
+// malformedRefs returns the references with a malformed file or packed-refs
+// line. Only malformed-refs repairs those; one it could not restore from the
+// reflog is left for manual recovery rather than pointed elsewhere.
+func malformedRefs(opts Options) map[string]bool {
+	names := make(map[string]bool)
+	if opts.Diagnosis != nil {
+		for _, issue := range opts.Diagnosis.IssuesOf(IssueTypeMalformedRef) {
+			names[issue.Object] = true
+		}
+		return names
+	}
+	for _, p := range scanRefFiles(opts) {
+		names[p.name] = true
+	}
+	return names
 }
 
 // findValidReference finds a valid branch reference to point HEAD to
-func findValidReference(repo *git.Repository) (string, error) {
+func findValidReference(repo store) (string, error) {
 	// Try common branch names first
 	commonBranches := []string{"refs/heads/main", "refs/heads/master", "refs/heads/develop"}
 
 	for _, branchName := range commonBranches {
-		ref, err := repo.Reference(plumbing.ReferenceName(branchName), true)
-		if err == nil && ref.Hash().String() != "0000000000000000000000000000000000000000" {
+		ref, err := resolveReference(repo, branchName)
+		if err == nil && !isNullHash(ref.Hash) {
 			return branchName, nil
 		}
 	}
@@ -525,54 +717,46 @@ func findValidReference(repo *git.Repository) (string, error) {
 		return "", err
 	}
 
-	var validRef string
-	refs.ForEach(func(ref *plumbing.Reference) error {
-		if ref.Name().IsBranch() && ref.Hash().String() != "0000000000000000000000000000000000000000" {
-			validRef = ref.Name().String()
-			return fmt.Errorf("found") // Stop iteration
+	for _, ref := range refs {
+		if ref.IsBranch() && !ref.Symbolic() && !isNullHash(ref.Hash) {
+			return ref.Name, nil
 		}
-		return nil
-	})
-
-	if validRef != "" {
-		return validRef, nil
 	}
 
 	return "", fmt.Errorf("no valid branch found")
 }
 
 // findMostRecentValidCommit finds the most recent valid commit in the repository
-func findMostRecentValidCommit(repo *git.Repository) (string, error) {
+func findMostRecentValidCommit(repo store) (string, error) {
 	// Try to get commits from all branches
 	refs, err := repo.References()
 	if err != nil {
 		return "", err
 	}
 
-	var mostRecentCommit *object.Commit
+	var mostRecentCommit *Commit
 
-	refs.ForEach(func(ref *plumbing.Reference) error {
-		if ref.Name().IsBranch() && ref.Hash().String() != "0000000000000000000000000000000000000000" {
-			commit, err := repo.CommitObject(ref.Hash())
+	for _, ref := range refs {
+		if ref.IsBranch() && !ref.Symbolic() && !isNullHash(ref.Hash) {
+			commit, err := repo.Commit(ref.Hash)
 			if err == nil {
 				if mostRecentCommit == nil || commit.Committer.When.After(mostRecentCommit.Committer.When) {
 					mostRecentCommit = commit
 				}
 			}
 		}
-		return nil
-	})
+	}
 
 	if mostRecentCommit != nil {
-		return mostRecentCommit.Hash.String(), nil
+		return mostRecentCommit.Hash, nil
 	}
 
 	return "", fmt.Errorf("no valid commit found")
 }
 
 // VerifyRepository checks if the repository is healthy
-func VerifyRepository(repoPath string) error {
-	issues, err := RunFsck(repoPath, false)
+func VerifyRepository(ctx context.Context, opts Options) error {
+	issues, err := currentIssues(ctx, opts)
 	if err != nil {
 		return err
 	}
@@ -589,222 +773,173 @@ func VerifyRepository(repoPath string) error {
 }
 
 // FixNullSHATags fixes all tags that point to null SHA
-func FixNullSHATags(repoPath string, verbose bool, dryRun bool) (int, error) {
-	repo, err := git.PlainOpen(repoPath)
+func FixNullSHATags(ctx context.Context, opts Options) (int, error) {
+	em := opts.emit()
+
+	repo, err := openStore(ctx, opts)
 	if err != nil {
 		return 0, fmt.Errorf("failed to open repository: %w", err)
 	}
+	defer repo.Close()
 
 	fixedCount := 0
-	nullSHA := "0000000000000000000000000000000000000000"
 
 	// Get all tag references
-	refs, err := repo.References()
-	if err != nil {
-		return 0, err
-	}
-
-	var tagsToFix []string
-
-	err = refs.ForEach(func(ref *plumbing.Reference) error {
-		if ref.Name().IsTag() && ref.Hash().String() == nullSHA {
-			tagsToFix = append(tagsToFix, ref.Name().String())
+	tagsToFix, err := planned(opts, func() ([]string, error) {
+		refs, err := repo.References()
+		if err != nil {
+			return nil, err
 		}
-		return nil
+		var tags []string
+		malformed := malformedRefs(opts)
+		for _, ref := range refs {
+			if ref.IsTag() && !ref.Symbolic() && isNullHash(ref.Hash) && !malformed[ref.Name] {
+				tags = append(tags, ref.Name)
+			}
+		}
+		return tags, nil
 	})
-
 	if err != nil {
 		return 0, err
 	}
 
 	// Fix each tag
+	nullSHA := opts.objectFormat().NullHash()
 	for _, tagName := range tagsToFix {
-		if verbose {
-			if dryRun {
-				fmt.Printf("  [DRY RUN] Would fix null SHA tag: %s\n", tagName)
-			} else {
-				fmt.Printf("  Found null SHA tag: %s\n", tagName)
-			}
+		if err := ctx.Err(); err != nil {
+			return fixedCount, err
+		}
+
+		// Point the tag at a valid commit, or delete it when there is none
+		change := FixChange{Object: tagName, Action: "delete, no valid commit found", OldValue: nullSHA}
+		validCommit, findErr := findMostRecentValidCommit(repo)
+		if findErr == nil && validCommit != "" {
+			change.Action, change.NewValue = "point at the most recent valid commit", validCommit
 		}
 
-		if dryRun {
+		if opts.DryRun {
+			em.Debugf("[DRY RUN] Would fix null SHA tag: %s", tagName)
+			recordChange(opts, change)
 			fixedCount++
 			continue
 		}
+		em.Debugf("Found null SHA tag: %s", tagName)
+		opts.Diagnosis.InvalidateRef(tagName)
 
-		// Option 1: Try to find a valid commit to point the tag to
-		validCommit, findErr := findMostRecentValidCommit(repo)
-		if findErr == nil && validCommit != "" {
-			// Update the tag to point to valid commit
-			tagPath := filepath.Join(repoPath, ".git", tagName)
-			if writeErr := os.WriteFile(tagPath, []byte(validCommit+"\n"), 0644); writeErr == nil {
-				if verbose {
-					fmt.Printf("  Fixed tag %s -> %s\n", filepath.Base(tagName), validCommit[:8])
-				}
-				fixedCount++
-			} else {
-				// If writing fails, try to delete the tag
-				if verbose {
-					fmt.Printf("  Could not fix tag %s, deleting it\n", filepath.Base(tagName))
-				}
-				os.Remove(tagPath)
+		if change.NewValue != "" {
+			if writeErr := updateRefs(opts, refUpdate{Name: tagName, Hash: validCommit}); writeErr == nil {
+				em.Debugf("Fixed tag %s -> %s", filepath.Base(tagName), validCommit[:8])
+				recordChange(opts, change)
 				fixedCount++
+				continue
 			}
+			// If writing fails, try to delete the tag
+			em.Debugf("Could not fix tag %s, deleting it", filepath.Base(tagName))
+			change.Action, change.NewValue = "delete, it could not be repointed", ""
 		} else {
-			// If no valid commit found, delete the tag
-			if verbose {
-				fmt.Printf("  No valid commit found, deleting tag %s\n", filepath.Base(tagName))
-			}
-			tagPath := filepath.Join(repoPath, ".git", tagName)
-			os.Remove(tagPath)
-			fixedCount++
+			em.Debugf("No valid commit found, deleting tag %s", filepath.Base(tagName))
 		}
+		updateRefs(opts, refUpdate{Name: tagName, Delete: true})
+		recordChange(opts, change)
+		fixedCount++
 	}
 
 	return fixedCount, nil
 }
 
 // FixTreeObjectsWithNullSHA fixes tree objects that contain null SHA entries
-func FixTreeObjectsWithNullSHA(repoPath string, verbose bool, dryRun bool) (int, error) {
+func FixTreeObjectsWithNullSHA(ctx context.Context, opts Options) (int, error) {
 	// Use the git commands approach for actual fixing
-	return FixTreeCorruptionWithGitCommands(repoPath, verbose, dryRun)
+	return FixTreeCorruptionWithGitCommands(ctx, opts)
 }
 
 // RunGarbageCollection runs git gc to clean up orphaned objects
-func RunGarbageCollection(repoPath string, verbose bool) error {
-	// First, clean up any remaining bad references that might block GC
-	if verbose {
-		fmt.Println("  Cleaning up any remaining bad references...")
+func RunGarbageCollection(ctx context.Context, opts Options) error {
+	em := opts.emit()
+
+	// Commit-graphs and multi-pack-indexes listing objects the fixes removed
+	// make prune and gc fail; they are written again once gc is done
+	if hadGraph, hadMidx := objectIndexesPresent(opts); hadGraph || hadMidx {
+		em.Debugf("Removing commit-graphs and multi-pack-index before gc...")
+		if err := removeCommitGraphs(opts); err != nil {
+			em.Debugf("Warning: %v", err)
+		}
+		if err := removeMultiPackIndex(opts); err != nil {
+			em.Debugf("Warning: %v", err)
+		}
+		defer func() {
+			if ctx.Err() != nil {
+				return
+			}
+			if repo, err := openStore(ctx, opts); err == nil {
+				restoreObjectIndexes(ctx, opts, repo, hadGraph, hadMidx)
+				repo.Close()
+			}
+		}()
 	}
-	CleanupPackedRefs(repoPath, verbose)
 
 	// Try to prune unreachable objects
-	if verbose {
-		fmt.Println("  Running git prune to remove unreachable objects...")
+	em.Debugf("Running git prune to remove unreachable objects...")
+	pruneOutput, pruneErr := runGitProgress(ctx, opts, "prune", "--expire=now", "--progress")
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	pruneCmd := exec.Command("git", "prune", "--expire=now")
-	pruneCmd.Dir = repoPath
-	pruneOutput, pruneErr := pruneCmd.CombinedOutput()
 	if pruneErr != nil {
-		if verbose {
-			fmt.Printf("  Warning: git prune failed: %v\n", pruneErr)
-			if len(pruneOutput) > 0 {
-				fmt.Printf("  Output: %s\n", string(pruneOutput))
-			}
+		em.Debugf("Warning: git prune failed: %v", pruneErr)
+		if len(pruneOutput) > 0 {
+			em.Debugf("Output: %s", string(pruneOutput))
 		}
-		// Try to clean up again and retry
-		CleanupPackedRefs(repoPath, verbose)
-		pruneCmd = exec.Command("git", "prune", "--expire=now")
-		pruneCmd.Dir = repoPath
-		pruneOutput, pruneErr = pruneCmd.CombinedOutput()
-		if pruneErr != nil && verbose {
-			fmt.Printf("  Prune still failing after cleanup, continuing anyway...\n")
-		}
-	} else if verbose && len(pruneOutput) > 0 {
-		fmt.Printf("  Prune output: %s\n", string(pruneOutput))
+		em.Debugf("Continuing with git gc anyway...")
+	} else if len(pruneOutput) > 0 {
+		em.Debugf("Prune output: %s", string(pruneOutput))
 	}
 
-	// Then run garbage collection
-	if verbose {
-		fmt.Println("  Running git gc to compact repository...")
-	}
-	cmd := exec.Command("git", "gc", "--prune=now", "--aggressive")
-	cmd.Dir = repoPath
+	// Then run garbage collection. git gc only reports progress on a terminal,
+	// so keep showing that it is still running.
+	em.Debugf("Running git gc to compact repository...")
+	tracker := progress.New(em, "Garbage collection", 0).Heartbeat()
+	defer tracker.Finish()
 
-	output, err := cmd.CombinedOutput()
+	output, err := runGitProgress(ctx, opts, "gc", "--prune=now", "--aggressive")
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
 	if err != nil {
-		if verbose {
-			fmt.Printf("  Warning: Garbage collection failed: %v\n", err)
-			if len(output) > 0 {
-				fmt.Printf("  Output: %s\n", string(output))
-			}
+		em.Debugf("Warning: Garbage collection failed: %v", err)
+		if len(output) > 0 {
+			em.Debugf("Output: %s", string(output))
 		}
 		// Try one more time with basic gc
-		if verbose {
-			fmt.Println("  Retrying with basic gc...")
+		em.Debugf("Retrying with basic gc...")
+		output, err = runGitProgress(ctx, opts, "gc", "--prune=now")
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
 		}
-		cmd = exec.Command("git", "gc", "--prune=now")
-		cmd.Dir = repoPath
-		output, err = cmd.CombinedOutput()
-		if err != nil && verbose {
-			fmt.Printf("  GC still failing: %v\n", err)
+		if err != nil {
+			em.Debugf("GC still failing: %v", err)
 		}
 		return err
 	}
 
-	if verbose && len(output) > 0 {
-		fmt.Printf("  GC output: %s\n", string(output))
+	if len(output) > 0 {
+		em.Debugf("GC output: %s", string(output))
 	}
 
-	return nil
-}
-
-// CleanupPackedRefs removes any remaining bad references from packed-refs
-func CleanupPackedRefs(repoPath string, verbose bool) {
-	// Clean up packed-refs one more time
-	packedRefsPath := filepath.Join(repoPath, ".git", "packed-refs")
-	if content, err := os.ReadFile(packedRefsPath); err == nil {
-		lines := strings.Split(string(content), "\n")
-		var newLines []string
-		seenRefs := make(map[string]bool)
-		modified := false
+	// Objects with issues may have been pruned
+	opts.Diagnosis.invalidateObjects()
 
-		for _, line := range lines {
-			trimmedLine := strings.TrimSpace(line)
-
-			// Skip lines that start with null-like SHA (all zeros or mostly zeros)
-			if trimmedLine != "" && !strings.HasPrefix(trimmedLine, "#") && !strings.HasPrefix(trimmedLine, "^") {
-				parts := strings.Fields(trimmedLine)
-				if len(parts) >= 2 {
-					sha := parts[0]
-					refName := parts[1]
-
-					// Check if SHA starts with many zeros (likely a null SHA variant)
-					if strings.HasPrefix(sha, "000000000000000000000000000000000000000") {
-						if verbose {
-							fmt.Printf("    Removing null-like SHA: %s\n", line)
-						}
-						modified = true
-						continue
-					}
-
-					// Check for duplicates
-					if seenRefs[refName] {
-						if verbose {
-							fmt.Printf("    Removing duplicate: %s\n", line)
-						}
-						modified = true
-						continue
-					}
-					seenRefs[refName] = true
-				}
-			}
-
-			newLines = append(newLines, line)
-		}
-
-		if modified {
-			newContent := strings.Join(newLines, "\n")
-			os.WriteFile(packedRefsPath, []byte(newContent), 0644)
-			if verbose {
-				fmt.Println("    Cleaned up packed-refs")
-			}
-		}
-	}
+	return nil
 }
 
 // createFixedTree creates a new tree object without null SHA entries
-func createFixedTree(repo *git.Repository, tree *object.Tree, verbose bool) (bool, error) {
-	nullSHA := plumbing.NewHash("0000000000000000000000000000000000000000")
+func createFixedTree(repo *git.Repository, tree *object.Tree, em events.Emitter) (bool, error) {
 	hasNullEntries := false
 
 	// Check if tree has null entries
 	for _, entry := range tree.Entries {
-		if entry.Hash == nullSHA {
+		if entry.Hash.IsZero() {
 			hasNullEntries = true
-			if verbose {
-				fmt.Printf("    Found null SHA entry: %s\n", entry.Name)
-			}
+			em.Debugf("Found null SHA entry: %s", entry.Name)
 		}
 	}
 
@@ -814,97 +949,99 @@ func createFixedTree(repo *git.Repository, tree *object.Tree, verbose bool) (boo
 
 	// For tree corruption, we need to use git plumbing commands
 	// because go-git doesn't support creating tree objects directly
-	if verbose {
-		fmt.Printf("    Tree has null SHA entries - will be fixed via git commands\n")
-	}
+	em.Debugf("Tree has null SHA entries - will be fixed via git commands")
 
 	return true, nil
 }
 
 // FixTreeCorruptionWithGitCommands uses git plumbing to fix tree corruption
-func FixTreeCorruptionWithGitCommands(repoPath string, verbose bool, dryRun bool) (int, error) {
-	fixedCount := 0
-
-	// Run git fsck to find corrupted trees
-	cmd := exec.Command("git", "fsck", "--full")
-	cmd.Dir = repoPath
-	output, _ := cmd.CombinedOutput()
+func FixTreeCorruptionWithGitCommands(ctx context.Context, opts Options) (int, error) {
+	em := opts.emit()
 
-	lines := strings.Split(string(output), "\n")
-	var corruptedTrees []string
+	fixedCount := 0
 
-	for _, line := range lines {
-		if strings.Contains(line, "nullSha1") || strings.Contains(line, "null sha1") {
-			// Extract tree hash
-			parts := strings.Fields(line)
-			for i, part := range parts {
-				if part == "tree" && i+1 < len(parts) {
-					treeHash := strings.TrimSuffix(parts[i+1], ":")
-					if len(treeHash) == 40 {
-						corruptedTrees = append(corruptedTrees, treeHash)
-					}
-					break
+	// Find corrupted trees in the git fsck output
+	corruptedTrees, err := planned(opts, func() ([]string, error) {
+		lines, err := fsckOutput(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		var trees []string
+		for _, line := range lines {
+			if strings.Contains(line, "nullSha1") || strings.Contains(line, "null sha1") || strings.Contains(line, "badTree") {
+				if treeHash := fsckTreeHash(line); treeHash != "" {
+					trees = append(trees, treeHash)
 				}
 			}
 		}
+		return trees, nil
+	})
+	if err != nil {
+		return 0, err
 	}
 
 	if len(corruptedTrees) == 0 {
 		return 0, nil
 	}
 
-	if verbose {
-		if dryRun {
-			fmt.Printf("  [DRY RUN] Found %d corrupted tree(s) that would be fixed\n", len(corruptedTrees))
-		} else {
-			fmt.Printf("  Found %d corrupted tree(s), attempting to fix...\n", len(corruptedTrees))
-		}
+	if opts.DryRun {
+		em.Debugf("[DRY RUN] Found %d corrupted tree(s) that would be fixed", len(corruptedTrees))
+	} else {
+		em.Debugf("Found %d corrupted tree(s), attempting to fix...", len(corruptedTrees))
 	}
 
+	gitlinks := &gitlinkResolver{ctx: ctx, opts: opts}
+
 	// For each corrupted tree, create a fixed version
 	for _, treeHash := range corruptedTrees {
-		if verbose {
-			if dryRun {
-				fmt.Printf("  [DRY RUN] Would process tree %s...\n", treeHash[:8])
-			} else {
-				fmt.Printf("  Processing tree %s...\n", treeHash[:8])
-			}
+		if err := ctx.Err(); err != nil {
+			return fixedCount, err
+		}
+
+		if opts.DryRun {
+			em.Debugf("[DRY RUN] Would process tree %s...", treeHash[:8])
+		} else {
+			em.Debugf("Processing tree %s...", treeHash[:8])
 		}
 
-		if dryRun {
+		if opts.DryRun {
 			fixedCount++
 			continue
 		}
 
 		// Use git cat-file to read the raw tree object (works even with corruption)
-		catFileCmd := exec.Command("git", "cat-file", "-p", treeHash)
-		catFileCmd.Dir = repoPath
+		catFileCmd := gitCommand(ctx, opts.RepoPath, "cat-file", "-p", treeHash)
 		treeOutput, err := catFileCmd.CombinedOutput()
 
 		// If cat-file fails, try ls-tree with --full-tree (more permissive)
 		if err != nil {
-			if verbose {
-				fmt.Printf("    cat-file failed, trying ls-tree...\n")
-			}
-			lsTreeCmd := exec.Command("git", "ls-tree", "--full-tree", treeHash)
-			lsTreeCmd.Dir = repoPath
+			em.Debugf("cat-file failed, trying ls-tree...")
+			lsTreeCmd := gitCommand(ctx, opts.RepoPath, "ls-tree", "--full-tree", treeHash)
 			treeOutput, err = lsTreeCmd.CombinedOutput()
 			if err != nil {
-				if verbose {
-					fmt.Printf("    Could not read tree (both methods failed): %v\n", err)
-					fmt.Printf("    Attempting to create empty tree as replacement...\n")
-				}
+				em.Debugf("Could not read tree (both methods failed): %v", err)
+			}
+		}
+
+		// Decode the raw tree leniently and keep the entries git can store
+		droppedEntries := 0
+		salvaged := err != nil
+		if salvaged {
+			entries, dropped, salvageErr := salvageTree(ctx, opts, treeHash)
+			if salvageErr != nil || len(entries) == 0 {
+				em.Debugf("Attempting to create empty tree as replacement...")
 				// If we can't read the tree at all, replace it with empty tree
-				newTreeHash := EmptyTreeHash
-				updated, updateErr := updateCommitsWithNewTree(repoPath, treeHash, newTreeHash, verbose)
+				newTreeHash := opts.objectFormat().EmptyTree()
+				updated, _, updateErr := updateCommitsWithNewTree(ctx, opts, treeHash, newTreeHash)
 				if updateErr == nil && updated > 0 {
 					fixedCount++
-					if verbose {
-						fmt.Printf("    Replaced corrupted tree with empty tree, updated %d commit(s)\n", updated)
-					}
+					em.Debugf("Replaced corrupted tree with empty tree, updated %d commit(s)", updated)
 				}
 				continue
 			}
+			em.Debugf("Salvaged %d entries of tree %s, dropping %d that git cannot store", len(entries), treeHash[:8], dropped)
+			treeOutput = []byte(strings.Join(entries, "\n"))
+			droppedEntries = dropped
 		}
 
 		// Parse tree entries and filter out null SHA
@@ -919,13 +1056,24 @@ func FixTreeCorruptionWithGitCommands(repoPath string, verbose bool, dryRun bool
 			}
 
 			// Format: "100644 blob <hash>\t<name>"
-			if strings.Contains(line, "0000000000000000000000000000000000000000") {
+			meta, _, _ := strings.Cut(line, "\t")
+			if fields := strings.Fields(meta); len(fields) == 3 && isNullHash(fields[2]) {
 				nullEntriesFound++
-				if verbose {
-					parts := strings.Split(line, "\t")
-					if len(parts) > 1 {
-						fmt.Printf("    Removing null SHA entry: %s\n", parts[1])
+				parts := strings.Split(line, "\t")
+
+				// Dropping a gitlink removes the submodule from the commit, so
+				// look for the commit it should point at first
+				if strings.HasPrefix(line, "160000 ") && len(parts) > 1 {
+					if hash := gitlinks.resolve(treeHash, parts[1]); hash != "" {
+						em.Debugf("Restoring submodule entry: %s -> %s", parts[1], hash[:8])
+						validEntries = append(validEntries, "160000 commit "+hash+"\t"+parts[1])
+						continue
 					}
+					em.Warnf("No commit found for submodule %s in tree %s, removing it", parts[1], treeHash[:8])
+				}
+
+				if len(parts) > 1 {
+					em.Debugf("Removing null SHA entry: %s", parts[1])
 				}
 				continue // Skip null SHA entries
 			}
@@ -933,10 +1081,8 @@ func FixTreeCorruptionWithGitCommands(repoPath string, verbose bool, dryRun bool
 			validEntries = append(validEntries, line)
 		}
 
-		if nullEntriesFound == 0 {
-			if verbose {
-				fmt.Printf("    No null entries found in tree (may have been fixed already)\n")
-			}
+		if nullEntriesFound == 0 && droppedEntries == 0 {
+			em.Debugf("No null entries found in tree (may have been fixed already)")
 			continue
 		}
 
@@ -945,83 +1091,100 @@ func FixTreeCorruptionWithGitCommands(repoPath string, verbose bool, dryRun bool
 		// Create a new tree object without null SHA entries
 		if len(validEntries) == 0 {
 			// All entries were null, use empty tree
-			newTreeHash = EmptyTreeHash
-			if verbose {
-				fmt.Printf("    All entries were null, using empty tree: %s\n", newTreeHash[:8])
-			}
+			newTreeHash = opts.objectFormat().EmptyTree()
+			em.Debugf("All entries were null, using empty tree: %s", newTreeHash[:8])
 		} else {
 			// Create new tree with valid entries using git mktree
-			mkTreeCmd := exec.Command("git", "mktree")
-			mkTreeCmd.Dir = repoPath
+			mkTreeCmd := gitCommand(ctx, opts.RepoPath, "mktree")
 			mkTreeCmd.Stdin = strings.NewReader(strings.Join(validEntries, "\n") + "\n")
 			newTreeOutput, err := mkTreeCmd.CombinedOutput()
 			if err != nil {
-				if verbose {
-					fmt.Printf("    Could not create new tree: %v\n", err)
-					fmt.Printf("    Output: %s\n", string(newTreeOutput))
-				}
+				em.Debugf("Could not create new tree: %v", err)
+				em.Debugf("Output: %s", string(newTreeOutput))
 				continue
 			}
 
 			newTreeHash = strings.TrimSpace(string(newTreeOutput))
-			if verbose {
-				fmt.Printf("    Created new tree: %s (removed %d null entries)\n", newTreeHash[:8], nullEntriesFound)
-			}
+			em.Debugf("Created new tree: %s (fixed %d null entries)", newTreeHash[:8], nullEntriesFound)
 		}
 
 		// Find and update all commits that reference this tree
-		updated, err := updateCommitsWithNewTree(repoPath, treeHash, newTreeHash, verbose)
+		updated, complete, err := updateCommitsWithNewTree(ctx, opts, treeHash, newTreeHash)
 		if err != nil {
-			if verbose {
-				fmt.Printf("    Could not update commits: %v\n", err)
-			}
+			em.Debugf("Could not update commits: %v", err)
 			continue
 		}
 
 		if updated > 0 {
 			fixedCount++
-			if verbose {
-				fmt.Printf("    Updated %d commit(s) to use new tree\n", updated)
-			}
+			em.Debugf("Updated %d commit(s) to use new tree", updated)
 		} else {
-			if verbose {
-				fmt.Printf("    No commits reference this tree\n")
-				fmt.Printf("    Warning: No commits found referencing this tree\n")
-				fmt.Printf("    The tree may be dangling (not referenced by any commit)\n")
-			}
+			em.Debugf("No commits reference this tree")
+			em.Debugf("Warning: No commits found referencing this tree")
+			em.Debugf("The tree may be dangling (not referenced by any commit)")
 			// Still count it as fixed since we created the clean tree
 			fixedCount++
 		}
+
+		// Nothing can read the malformed tree. It can only go once nothing
+		// uses it any more: every commit using it was replaced and no other
+		// tree holds it. Otherwise git is told to read the salvaged tree in
+		// its place.
+		if salvaged {
+			if updated > 0 && complete && !gitlinks.index().nested(treeHash) {
+				if err := quarantineMalformedTree(ctx, opts, treeHash); err != nil {
+					em.Debugf("Could not quarantine tree %s: %v", treeHash[:8], err)
+				}
+			} else if err := replaceTree(ctx, opts, treeHash, newTreeHash); err != nil {
+				em.Warnf("Could not replace tree %s: %v", treeHash[:8], err)
+			} else {
+				em.Debugf("Tree %s is still in use, replaced it with %s", treeHash[:8], newTreeHash[:8])
+			}
+		}
 	}
 
 	return fixedCount, nil
 }
 
-// updateCommitsWithNewTree updates all commits that reference an old tree to use a new tree
-func updateCommitsWithNewTree(repoPath, oldTreeHash, newTreeHash string, verbose bool) (int, error) {
+// replaceTree points git at a new tree wherever it reads the old one. The
+// replace ref is written directly, since git replace refuses objects it
+// cannot read.
+func replaceTree(ctx context.Context, opts Options, oldTreeHash, newTreeHash string) error {
+	output, err := gitCommand(ctx, opts.RepoPath, "update-ref", "refs/replace/"+oldTreeHash, newTreeHash).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git update-ref: %s", strings.TrimSpace(string(output)))
+	}
+	// Replace refs change which objects git sees
+	opts.Diagnosis.InvalidateAll()
+	return nil
+}
+
+// updateCommitsWithNewTree updates all commits that reference an old tree to
+// use a new tree. It also reports whether every such commit was updated.
+func updateCommitsWithNewTree(ctx context.Context, opts Options, oldTreeHash, newTreeHash string) (int, bool, error) {
+	em := opts.emit()
+
 	updatedCount := 0
 
 	// Find commits using this tree
 	var commitsToFix []string
 
-	// Use git for-each-ref to get all valid refs first
-	refsCmd := exec.Command("git", "for-each-ref", "--format=%(refname)", "refs/heads/", "refs/tags/")
-	refsCmd.Dir = repoPath
+	// Use git for-each-ref to get all valid refs first. Every ref but the
+	// replace refs counts, since remotes, stashes and notes keep trees too.
+	refsCmd := gitCommand(ctx, opts.RepoPath, "for-each-ref", "--format=%(refname)")
 	refsOutput, err := refsCmd.CombinedOutput()
 	if err != nil {
 		// If we can't get refs, try to find commits directly
-		if verbose {
-			fmt.Printf("    Could not list refs, trying alternative method\\n")
-		}
+		em.Debugf("Could not list refs, trying alternative method")
 	}
 
 	// Get all valid commit hashes
-	var validRefs []string
+	validRefs := []string{"HEAD"}
 	if err == nil {
 		refLines := strings.Split(string(refsOutput), "\n")
 		for _, ref := range refLines {
 			ref = strings.TrimSpace(ref)
-			if ref != "" {
+			if ref != "" && !strings.HasPrefix(ref, "refs/replace/") {
 				validRefs = append(validRefs, ref)
 			}
 		}
@@ -1029,8 +1192,7 @@ func updateCommitsWithNewTree(repoPath, oldTreeHash, newTreeHash string, verbose
 
 	// For each valid ref, walk the commit history
 	for _, ref := range validRefs {
-		logCmd := exec.Command("git", "log", ref, "--format=%H %T")
-		logCmd.Dir = repoPath
+		logCmd := gitCommand(ctx, opts.RepoPath, "log", ref, "--format=%H %T")
 		logOutput, err := logCmd.CombinedOutput()
 		if err != nil {
 			continue // Skip bad refs
@@ -1061,30 +1223,37 @@ func updateCommitsWithNewTree(repoPath, oldTreeHash, newTreeHash string, verbose
 	}
 
 	if len(commitsToFix) == 0 {
-		if verbose {
-			fmt.Printf("    No commits reference this tree\n")
-		}
-		return 0, nil
+		em.Debugf("No commits reference this tree")
+		return 0, true, nil
 	}
 
-	if verbose {
-		fmt.Printf("    Found %d commit(s) using this tree\n", len(commitsToFix))
+	em.Debugf("Found %d commit(s) using this tree", len(commitsToFix))
+
+	// A replacement for a shallow boundary commit would point at parents the
+	// repository does not have
+	absences, err := LoadAbsences(ctx, opts)
+	if err != nil {
+		return 0, false, fmt.Errorf("cannot tell where the shallow boundary is: %w", err)
 	}
 
 	// For each commit, create a replace reference with the new tree
 	for _, commitHash := range commitsToFix {
-		if verbose {
-			fmt.Printf("    Creating replace for commit %s...\n", commitHash[:8])
+		if err := ctx.Err(); err != nil {
+			return updatedCount, false, err
 		}
 
+		if absences.AtShallowBoundary(commitHash) {
+			em.Warnf("Not replacing commit %s: it is at the shallow boundary, fetch more history first", commitHash[:8])
+			continue
+		}
+
+		em.Debugf("Creating replace for commit %s...", commitHash[:8])
+
 		// Read the commit object
-		catFileCmd := exec.Command("git", "cat-file", "commit", commitHash)
-		catFileCmd.Dir = repoPath
+		catFileCmd := gitCommand(ctx, opts.RepoPath, "cat-file", "commit", commitHash)
 		commitData, err := catFileCmd.CombinedOutput()
 		if err != nil {
-			if verbose {
-				fmt.Printf("    Could not read commit: %v\n", err)
-			}
+			em.Debugf("Could not read commit: %v", err)
 			continue
 		}
 
@@ -1104,139 +1273,160 @@ func updateCommitsWithNewTree(repoPath, oldTreeHash, newTreeHash string, verbose
 		newCommitData := strings.Join(newCommitLines, "\n")
 
 		// Create new commit object using git hash-object
-		hashObjCmd := exec.Command("git", "hash-object", "-t", "commit", "-w", "--stdin")
-		hashObjCmd.Dir = repoPath
+		hashObjCmd := gitCommand(ctx, opts.RepoPath, "hash-object", "-t", "commit", "-w", "--stdin")
 		hashObjCmd.Stdin = strings.NewReader(newCommitData)
 		newCommitOutput, err := hashObjCmd.CombinedOutput()
 		if err != nil {
-			if verbose {
-				fmt.Printf("    Could not create new commit: %v\n", err)
-			}
+			em.Debugf("Could not create new commit: %v", err)
 			continue
 		}
 
 		newCommitHash := strings.TrimSpace(string(newCommitOutput))
 
 		// Create replace reference
-		replaceCmd := exec.Command("git", "replace", commitHash, newCommitHash)
-		replaceCmd.Dir = repoPath
+		replaceCmd := gitCommand(ctx, opts.RepoPath, "replace", commitHash, newCommitHash)
 		err = replaceCmd.Run()
 		if err != nil {
-			if verbose {
-				fmt.Printf("    Could not create replace ref: %v\n", err)
-			}
+			em.Debugf("Could not create replace ref: %v", err)
 			continue
 		}
 
-		if verbose {
-			fmt.Printf("    Created replace: %s -> %s\n", commitHash[:8], newCommitHash[:8])
-		}
+		em.Debugf("Created replace: %s -> %s", commitHash[:8], newCommitHash[:8])
+		// Replace refs change which commits git sees, so only a full scan can verify them
+		opts.Diagnosis.InvalidateAll()
 		updatedCount++
 	}
 
-	return updatedCount, nil
+	return updatedCount, updatedCount == len(commitsToFix), nil
 }
 
 // FixMissingCommits handles missing commit objects
-func FixMissingCommits(repoPath string, verbose bool, dryRun bool) (int, error) {
-	repo, err := git.PlainOpen(repoPath)
+func FixMissingCommits(ctx context.Context, opts Options) (int, error) {
+	em := opts.emit()
+
+	repo, err := openStore(ctx, opts)
 	if err != nil {
 		return 0, fmt.Errorf("failed to open repository: %w", err)
 	}
+	defer repo.Close()
 
 	fixedCount := 0
 
 	// Find all references that point to missing commits
-	refs, err := repo.References()
-	if err != nil {
-		return 0, err
-	}
-
-	var refsToFix []string
+	refsToFix, err := planned(opts, func() ([]string, error) {
+		refs, err := repo.References()
+		if err != nil {
+			return nil, err
+		}
 
-	err = refs.ForEach(func(ref *plumbing.Reference) error {
-		// Try to get the commit
-		_, err := repo.CommitObject(ref.Hash())
+		// History beyond a shallow boundary is missing on purpose
+		absences, err := LoadAbsences(ctx, opts)
 		if err != nil {
-			// Commit is missing
-			if verbose {
-				if dryRun {
-					fmt.Printf("  [DRY RUN] Found reference to missing commit: %s -> %s\n", ref.Name().Short(), ref.Hash().String()[:8])
-				} else {
-					fmt.Printf("  Found reference to missing commit: %s -> %s\n", ref.Name().Short(), ref.Hash().String()[:8])
-				}
+			return nil, fmt.Errorf("cannot tell where the shallow boundary is: %w", err)
+		}
+
+		var names []string
+		malformed := malformedRefs(opts)
+		for _, ref := range refs {
+			// Symbolic references are fixed through their target
+			if ref.Symbolic() || malformed[ref.Name] {
+				continue
+			}
+			if absences.BeyondShallow(ref.Hash) {
+				em.Debugf("Skipping %s: %s is beyond the shallow boundary", ref.Short(), ref.Hash[:8])
+				continue
+			}
+
+			// Try to get the commit
+			if !hasCommit(repo, ref.Hash) {
+				em.Debugf("Found reference to missing commit: %s -> %s", ref.Short(), ref.Hash[:8])
+				names = append(names, ref.Name)
 			}
-			refsToFix = append(refsToFix, ref.Name().String())
 		}
-		return nil
+		return names, nil
 	})
-
 	if err != nil {
 		return 0, err
 	}
 
 	// Fix each reference
 	for _, refName := range refsToFix {
-		if verbose {
-			if dryRun {
-				fmt.Printf("  [DRY RUN] Would fix reference: %s\n", refName)
-			} else {
-				fmt.Printf("  Fixing reference: %s\n", refName)
-			}
+		if err := ctx.Err(); err != nil {
+			return fixedCount, err
 		}
 
-		if dryRun {
-			fixedCount++
-			continue
+		var old string
+		if ref, err := repo.Reference(refName); err == nil {
+			old = ref.Hash
 		}
 
-		// Special handling for HEAD - never delete it
+		// HEAD is never deleted: it goes back to a valid branch, or is
+		// detached at the newest valid commit
 		if refName == "HEAD" {
-			// Try to find a valid branch to point to
-			validRef, findErr := findValidReference(repo)
-			if findErr == nil && validRef != "" {
-				headPath := filepath.Join(repoPath, ".git", "HEAD")
-				newContent := fmt.Sprintf("ref: %s\n", validRef)
-				if writeErr := os.WriteFile(headPath, []byte(newContent), 0644); writeErr == nil {
-					if verbose {
-						fmt.Printf("  Fixed HEAD -> %s\n", validRef)
-					}
-					fixedCount++
-				}
+			change := FixChange{Object: "HEAD", OldValue: old}
+			update := refUpdate{Name: "HEAD"}
+			if validRef, findErr := findValidReference(repo); findErr == nil && validRef != "" {
+				change.Action, change.NewValue = "point at "+validRef, "ref: "+validRef
+				update.Target = validRef
+			} else if validCommit, findErr := findMostRecentValidCommit(repo); findErr == nil && validCommit != "" {
+				change.Action, change.NewValue = "detach at the most recent valid commit", validCommit
+				update.Hash = validCommit
 			} else {
-				// If no valid branch found, try to find any valid commit
-				validCommit, findErr := findMostRecentValidCommit(repo)
-				if findErr == nil && validCommit != "" {
-					headPath := filepath.Join(repoPath, ".git", "HEAD")
-					if writeErr := os.WriteFile(headPath, []byte(validCommit+"\n"), 0644); writeErr == nil {
-						if verbose {
-							fmt.Printf("  Fixed HEAD (detached) -> %s\n", validCommit[:8])
-						}
-						fixedCount++
-					}
-				}
+				em.Debugf("No valid branch or commit to point HEAD at")
+				continue
+			}
+
+			if opts.DryRun {
+				em.Debugf("[DRY RUN] Would fix reference: %s", refName)
+				recordChange(opts, change)
+				fixedCount++
+				continue
+			}
+			em.Debugf("Fixing reference: %s", refName)
+			opts.Diagnosis.InvalidateRef("HEAD")
+			if writeErr := updateRefs(opts, update); writeErr == nil {
+				em.Debugf("Fixed HEAD: %s", change.Action)
+				recordChange(opts, change)
+				fixedCount++
 			}
 			continue
 		}
 
-		// Try to find a valid commit
-		validCommit, findErr := findMostRecentValidCommit(repo)
-		if findErr == nil && validCommit != "" {
+		// Prefer the reference's own history, then any valid commit, and
+		// delete the reference when there is none
+		change := FixChange{Object: refName, Action: "delete, no valid commit found", OldValue: old}
+		var validCommit string
+		if refs, err := opts.refs(); err == nil {
+			validCommit = reflogCommit(repo, refs.Reflog(refName))
+		}
+		if validCommit != "" {
+			change.Action, change.NewValue = "restore from its reflog", validCommit
+		} else if commit, findErr := findMostRecentValidCommit(repo); findErr == nil && commit != "" {
+			validCommit = commit
+			change.Action, change.NewValue = "point at the most recent valid commit", validCommit
+		}
+
+		if opts.DryRun {
+			em.Debugf("[DRY RUN] Would fix reference: %s", refName)
+			recordChange(opts, change)
+			fixedCount++
+			continue
+		}
+		em.Debugf("Fixing reference: %s", refName)
+		opts.Diagnosis.InvalidateRef(refName)
+
+		if validCommit != "" {
 			// Update the reference to point to valid commit
-			refPath := filepath.Join(repoPath, ".git", refName)
-			if writeErr := os.WriteFile(refPath, []byte(validCommit+"\n"), 0644); writeErr == nil {
-				if verbose {
-					fmt.Printf("  Fixed reference %s -> %s\n", filepath.Base(refName), validCommit[:8])
-				}
+			if writeErr := updateRefs(opts, refUpdate{Name: refName, Hash: validCommit}); writeErr == nil {
+				em.Debugf("Fixed reference %s -> %s", filepath.Base(refName), validCommit[:8])
+				recordChange(opts, change)
 				fixedCount++
 			}
 		} else {
 			// If no valid commit found, delete the reference (but not HEAD)
-			if verbose {
-				fmt.Printf("  No valid commit found, deleting reference %s\n", filepath.Base(refName))
-			}
-			refPath := filepath.Join(repoPath, ".git", refName)
-			os.Remove(refPath)
+			em.Debugf("No valid commit found, deleting reference %s", filepath.Base(refName))
+			updateRefs(opts, refUpdate{Name: refName, Delete: true})
+			recordChange(opts, change)
 			fixedCount++
 		}
 	}
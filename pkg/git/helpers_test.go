@@ -0,0 +1,69 @@
+package git
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testGitEnv gives the commits tests create a fixed identity and keeps the
+// user's and system's git configuration out
+var testGitEnv = []string{
+	"GIT_AUTHOR_NAME=Test",
+	"GIT_AUTHOR_EMAIL=test@example.com",
+	"GIT_AUTHOR_DATE=2024-01-01T00:00:00Z",
+	"GIT_COMMITTER_NAME=Test",
+	"GIT_COMMITTER_EMAIL=test@example.com",
+	"GIT_COMMITTER_DATE=2024-01-01T00:00:00Z",
+	"GIT_CONFIG_NOSYSTEM=1",
+	"GIT_CONFIG_GLOBAL=" + os.DevNull,
+}
+
+// runGit runs git in dir and returns its trimmed output, failing the test
+// when git fails
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, err := tryGit(dir, args...)
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return out
+}
+
+// tryGit runs git in dir and returns its trimmed output and error
+func tryGit(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), testGitEnv...)
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
+
+// newTestRepo creates an empty repository, skipping the test when git is
+// not installed
+func newTestRepo(t *testing.T, initArgs ...string) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	runGit(t, dir, append([]string{"init", "-q"}, initArgs...)...)
+	return dir
+}
+
+// commitFile writes a file and commits it
+func commitFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "add", name)
+	runGit(t, dir, "commit", "-q", "-m", "Change "+name)
+	return runGit(t, dir, "rev-parse", "HEAD")
+}
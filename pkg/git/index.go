@@ -0,0 +1,680 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/rahul/nsha/pkg/events"
+)
+
+const (
+	indexSignature = "DIRC"
+
+	indexEntryExtended  = 0x4000 // Entry has a second flags field (version 3+)
+	indexEntryStage     = 0x3000
+	indexEntryNameMask  = 0x0fff
+	indexSkipWorktree   = 0x4000 // Extended flag: path is outside the sparse checkout
+	indexEntryFixedSize = 40     // Stat data and mode before the object hash
+)
+
+var errTruncatedIndex = errors.New("index is truncated")
+
+// indexFile is a decoded index file, with the extensions nsha checks
+type indexFile struct {
+	version     uint32
+	entries     []indexEntry
+	cacheTree   []cacheTreeEntry
+	resolveUndo []resolveUndoEntry
+	split       bool // Entries are shared with a split index and listed by git instead
+}
+
+// indexEntry is one path staged in the index
+type indexEntry struct {
+	name     string
+	mode     filemode.FileMode
+	hash     string
+	stage    int
+	flags    uint16   // Flags other than the stage and name length, e.g. assume-valid
+	extended uint16   // Extended flags, e.g. skip-worktree
+	stat     [40]byte // ctime, mtime, dev, ino, mode, uid, gid and size as stored
+}
+
+// cacheTreeEntry is a directory in the cache-tree extension (TREE). Entries
+// that git has invalidated have no tree hash.
+type cacheTreeEntry struct {
+	path    string // Directory path; empty for the top of the worktree
+	entries int    // Number of index entries covered; -1 when invalidated
+	hash    string
+}
+
+// resolveUndoEntry records the conflicted stages of a resolved path in the
+// resolve-undo extension (REUC). Stages without a mode are absent.
+type resolveUndoEntry struct {
+	path   string
+	modes  [3]filemode.FileMode
+	hashes [3]string
+}
+
+// displayPath names a cache-tree directory, "." for the top of the worktree
+func (c cacheTreeEntry) displayPath() string {
+	if c.path == "" {
+		return "."
+	}
+	return c.path
+}
+
+// readIndexFile decodes an index file of the given object format
+func readIndexFile(file string, format ObjectFormat) (*indexFile, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return decodeIndex(data, format)
+}
+
+// decodeIndex decodes index versions 2 to 4. go-git only decodes SHA-1
+// indexes and stops at the first problem, so nsha parses the format itself.
+func decodeIndex(data []byte, format ObjectFormat) (*indexFile, error) {
+	hashSize := format.HexSize() / 2
+	if len(data) < 12+hashSize || string(data[:4]) != indexSignature {
+		return nil, errors.New("not an index file")
+	}
+	idx := &indexFile{version: binary.BigEndian.Uint32(data[4:8])}
+	if idx.version < 2 || idx.version > 4 {
+		return nil, fmt.Errorf("unsupported index version %d", idx.version)
+	}
+
+	body, trailer := data[:len(data)-hashSize], data[len(data)-hashSize:]
+	// An all-zero checksum means index.skipHash is set
+	if strings.Trim(hex.EncodeToString(trailer), "0") != "" && !bytes.Equal(indexChecksum(format, body), trailer) {
+		return nil, errors.New("index checksum mismatch")
+	}
+
+	pos := 12
+	previous := ""
+	count := binary.BigEndian.Uint32(data[8:12])
+	for i := uint32(0); i < count; i++ {
+		entry, next, err := decodeIndexEntry(body, pos, idx.version, hashSize, previous)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		idx.entries = append(idx.entries, entry)
+		previous, pos = entry.name, next
+	}
+
+	for pos+8 <= len(body) {
+		signature := string(body[pos : pos+4])
+		start := pos + 8
+		end := start + int(binary.BigEndian.Uint32(body[pos+4:pos+8]))
+		if end < start || end > len(body) {
+			return nil, fmt.Errorf("%s extension: %w", signature, errTruncatedIndex)
+		}
+
+		var err error
+		switch signature {
+		case "TREE":
+			idx.cacheTree, err = decodeCacheTree(body[start:end], hashSize)
+		case "REUC":
+			idx.resolveUndo, err = decodeResolveUndo(body[start:end], hashSize)
+		case "link":
+			idx.split = true
+		default:
+			// Extensions starting with an uppercase letter are optional
+			if signature[0] < 'A' || signature[0] > 'Z' {
+				err = errors.New("unsupported required extension")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s extension: %w", signature, err)
+		}
+		pos = end
+	}
+	if pos != len(body) {
+		return nil, errTruncatedIndex
+	}
+	return idx, nil
+}
+
+// decodeIndexEntry decodes the entry at pos and returns the position of the
+// next one. Version 4 stores names relative to the previous entry's name.
+func decodeIndexEntry(data []byte, pos int, version uint32, hashSize int, previous string) (indexEntry, int, error) {
+	var entry indexEntry
+	p := pos + indexEntryFixedSize + hashSize + 2
+	if p > len(data) {
+		return entry, 0, errTruncatedIndex
+	}
+	copy(entry.stat[:], data[pos:pos+indexEntryFixedSize])
+	entry.mode = filemode.FileMode(binary.BigEndian.Uint32(data[pos+24 : pos+28]))
+	entry.hash = hex.EncodeToString(data[pos+indexEntryFixedSize : pos+indexEntryFixedSize+hashSize])
+
+	flags := binary.BigEndian.Uint16(data[p-2 : p])
+	entry.stage = int(flags&indexEntryStage) >> 12
+	entry.flags = flags &^ (indexEntryStage | indexEntryNameMask | indexEntryExtended)
+	if flags&indexEntryExtended != 0 {
+		if version < 3 || p+2 > len(data) {
+			return entry, 0, errors.New("unexpected extended flags")
+		}
+		entry.extended = binary.BigEndian.Uint16(data[p : p+2])
+		p += 2
+	}
+
+	if version == 4 {
+		strip, n := decodeIndexVarint(data[p:])
+		if n == 0 || strip > len(previous) {
+			return entry, 0, errors.New("bad name prefix")
+		}
+		p += n
+		end := bytes.IndexByte(data[p:], 0)
+		if end < 0 {
+			return entry, 0, errTruncatedIndex
+		}
+		entry.name = previous[:len(previous)-strip] + string(data[p:p+end])
+		return entry, p + end + 1, nil
+	}
+
+	end := bytes.IndexByte(data[p:], 0)
+	if end < 0 {
+		return entry, 0, errTruncatedIndex
+	}
+	entry.name = string(data[p : p+end])
+	// Entries are padded with 1 to 8 NULs to a multiple of 8 bytes
+	next := pos + (p+end-pos+8)&^7
+	if next > len(data) {
+		return entry, 0, errTruncatedIndex
+	}
+	return entry, next, nil
+}
+
+// decodeIndexVarint decodes git's offset varint and returns the value and the
+// number of bytes read, 0 when data ends early
+func decodeIndexVarint(data []byte) (int, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	c := data[0]
+	value, n := int(c&0x7f), 1
+	for c&0x80 != 0 {
+		if n >= len(data) {
+			return 0, 0
+		}
+		c = data[n]
+		n++
+		value = (value+1)<<7 | int(c&0x7f)
+	}
+	return value, n
+}
+
+// decodeCacheTree decodes the TREE extension, a pre-order walk of
+// "<name>\0<entry count> <subtree count>\n<hash>" records
+func decodeCacheTree(data []byte, hashSize int) ([]cacheTreeEntry, error) {
+	var entries []cacheTreeEntry
+	pos := 0
+
+	var walk func(prefix string) error
+	walk = func(prefix string) error {
+		end := bytes.IndexByte(data[pos:], 0)
+		if end < 0 {
+			return errTruncatedIndex
+		}
+		entry := cacheTreeEntry{path: prefix + string(data[pos:pos+end])}
+		pos += end + 1
+
+		end = bytes.IndexByte(data[pos:], '\n')
+		if end < 0 {
+			return errTruncatedIndex
+		}
+		var subtrees int
+		if _, err := fmt.Sscanf(string(data[pos:pos+end]), "%d %d", &entry.entries, &subtrees); err != nil {
+			return fmt.Errorf("bad counts for %q", entry.path)
+		}
+		pos += end + 1
+
+		if entry.entries >= 0 {
+			if pos+hashSize > len(data) {
+				return errTruncatedIndex
+			}
+			entry.hash = hex.EncodeToString(data[pos : pos+hashSize])
+			pos += hashSize
+		}
+		entries = append(entries, entry)
+
+		if entry.path != "" {
+			prefix = entry.path + "/"
+		}
+		for i := 0; i < subtrees; i++ {
+			if err := walk(prefix); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(data) > 0 {
+		if err := walk(""); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// decodeResolveUndo decodes the REUC extension: for every path three octal
+// modes followed by the hashes of the stages with a mode
+func decodeResolveUndo(data []byte, hashSize int) ([]resolveUndoEntry, error) {
+	var entries []resolveUndoEntry
+	for pos := 0; pos < len(data); {
+		end := bytes.IndexByte(data[pos:], 0)
+		if end < 0 {
+			return nil, errTruncatedIndex
+		}
+		entry := resolveUndoEntry{path: string(data[pos : pos+end])}
+		pos += end + 1
+
+		for i := range entry.modes {
+			end := bytes.IndexByte(data[pos:], 0)
+			if end < 0 {
+				return nil, errTruncatedIndex
+			}
+			mode, err := strconv.ParseUint(string(data[pos:pos+end]), 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad mode for %q", entry.path)
+			}
+			entry.modes[i] = filemode.FileMode(mode)
+			pos += end + 1
+		}
+		for i, mode := range entry.modes {
+			if mode == 0 {
+				continue
+			}
+			if pos+hashSize > len(data) {
+				return nil, errTruncatedIndex
+			}
+			entry.hashes[i] = hex.EncodeToString(data[pos : pos+hashSize])
+			pos += hashSize
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// encodeIndex encodes entries as an index without extensions. Version 3 is
+// only used when an entry has extended flags, as git does.
+func encodeIndex(entries []indexEntry, format ObjectFormat) []byte {
+	version := uint32(2)
+	for _, entry := range entries {
+		if entry.extended != 0 {
+			version = 3
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(indexSignature)
+	binary.Write(&buf, binary.BigEndian, version)
+	binary.Write(&buf, binary.BigEndian, uint32(len(entries)))
+
+	for _, entry := range entries {
+		start := buf.Len()
+		stat := entry.stat
+		binary.BigEndian.PutUint32(stat[24:28], uint32(entry.mode))
+		buf.Write(stat[:])
+		hash, _ := hex.DecodeString(entry.hash)
+		buf.Write(hash)
+
+		flags := entry.flags | uint16(entry.stage)<<12
+		if len(entry.name) < indexEntryNameMask {
+			flags |= uint16(len(entry.name))
+		} else {
+			flags |= indexEntryNameMask
+		}
+		if entry.extended != 0 {
+			flags |= indexEntryExtended
+		}
+		binary.Write(&buf, binary.BigEndian, flags)
+		if entry.extended != 0 {
+			binary.Write(&buf, binary.BigEndian, entry.extended)
+		}
+
+		buf.WriteString(entry.name)
+		buf.Write(make([]byte, 8-(buf.Len()-start)%8))
+	}
+
+	buf.Write(indexChecksum(format, buf.Bytes()))
+	return buf.Bytes()
+}
+
+// indexChecksum returns the trailing checksum of an index
+func indexChecksum(format ObjectFormat, data []byte) []byte {
+	if format == ObjectFormatSHA256 {
+		sum := sha256.Sum256(data)
+		return sum[:]
+	}
+	sum := sha1.Sum(data)
+	return sum[:]
+}
+
+// loadIndex reads a worktree's index. The entries of a split index are
+// spread over two files, so they are listed by git.
+func loadIndex(ctx context.Context, format ObjectFormat, wt Worktree) (*indexFile, error) {
+	idx, err := readIndexFile(filepath.Join(wt.GitDir, "index"), format)
+	if err != nil || !idx.split {
+		return idx, err
+	}
+	idx.entries, err = listIndexEntries(ctx, wt)
+	return idx, err
+}
+
+// listIndexEntries returns the entries of a worktree's index as git lists them
+func listIndexEntries(ctx context.Context, wt Worktree) ([]indexEntry, error) {
+	output, err := gitCommand(ctx, wt.Path, "ls-files", "--stage", "-z").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-files: %w", err)
+	}
+	var entries []indexEntry
+	for _, record := range strings.Split(string(output), "\x00") {
+		// "<mode> <hash> <stage>\t<path>"
+		meta, name, ok := strings.Cut(record, "\t")
+		fields := strings.Fields(meta)
+		if !ok || len(fields) != 3 {
+			continue
+		}
+		mode, _ := filemode.New(fields[0])
+		stage, _ := strconv.Atoi(fields[2])
+		entries = append(entries, indexEntry{name: name, mode: mode, hash: fields[1], stage: stage})
+	}
+	return entries, nil
+}
+
+// checkIndex checks that a worktree's index can be read and that its entries,
+// cache-tree and resolve-undo records point at objects the repository has
+func checkIndex(ctx context.Context, opts Options, wt Worktree) []Issue {
+	file := filepath.Join(wt.GitDir, "index")
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil
+	}
+	idx, err := loadIndex(ctx, opts.objectFormat(), wt)
+	issue := Issue{
+		Type:   IssueTypeBadIndex,
+		Object: wt.RefName("index"),
+		Path:   repoRelative(opts.RepoPath, file),
+	}
+	if err != nil {
+		issue.Message = fmt.Sprintf("Index cannot be read: %v", err)
+		return []Issue{issue}
+	}
+
+	if problems := indexProblems(ctx, opts, idx); len(problems) > 0 {
+		issue.Message = "Index has " + strings.Join(problems, "; ")
+		return []Issue{issue}
+	}
+	return nil
+}
+
+// indexObject is an object an index refers to, named by the path it is
+// recorded for
+type indexObject struct {
+	name string
+	hash string
+}
+
+// indexProblems describes the null and missing objects an index refers to
+func indexProblems(ctx context.Context, opts Options, idx *indexFile) []string {
+	var nullEntries, nullTrees, nullUndo []string
+	var entries, trees, undo []indexObject
+
+	for _, entry := range idx.entries {
+		switch {
+		case isNullHash(entry.hash):
+			nullEntries = append(nullEntries, entry.name)
+		case entry.mode != filemode.Submodule && entry.extended&indexSkipWorktree == 0:
+			// Gitlinks point into the submodule's repository, and paths
+			// outside a sparse checkout may never have been fetched
+			entries = append(entries, indexObject{entry.name, entry.hash})
+		}
+	}
+	for _, tree := range idx.cacheTree {
+		switch {
+		case tree.entries < 0:
+		case isNullHash(tree.hash):
+			nullTrees = append(nullTrees, tree.displayPath())
+		default:
+			trees = append(trees, indexObject{tree.displayPath(), tree.hash})
+		}
+	}
+	for _, entry := range idx.resolveUndo {
+		for i, mode := range entry.modes {
+			switch {
+			case mode == 0 || mode == filemode.Submodule:
+			case isNullHash(entry.hashes[i]):
+				nullUndo = append(nullUndo, entry.path)
+			default:
+				undo = append(undo, indexObject{entry.path, entry.hashes[i]})
+			}
+		}
+	}
+
+	var problems []string
+	report := func(format string, names []string) {
+		if len(names) > 0 {
+			problems = append(problems, fmt.Sprintf(format, len(names), names[0]))
+		}
+	}
+	report("%d entries with a null SHA (first: %s)", nullEntries)
+
+	// Objects of a partial clone are fetched on demand, so absent ones are expected
+	if absences, _ := LoadAbsences(ctx, opts); absences.IsPartial() {
+		report("%d cache-tree entries with a null SHA (first: %s)", nullTrees)
+		report("%d resolve-undo entries with a null SHA (first: %s)", nullUndo)
+		return problems
+	}
+
+	var hashes []string
+	for _, objects := range [][]indexObject{entries, trees, undo} {
+		for _, object := range objects {
+			hashes = append(hashes, object.hash)
+		}
+	}
+	missing, err := missingObjects(ctx, opts.RepoPath, hashes)
+	if err != nil {
+		opts.emit().Debugf("Skipping missing object check of the index: %v", err)
+	}
+	missingNames := func(objects []indexObject) []string {
+		var names []string
+		for _, object := range objects {
+			if missing[object.hash] {
+				names = append(names, object.name)
+			}
+		}
+		return names
+	}
+
+	report("%d entries pointing to missing objects (first: %s)", missingNames(entries))
+	report("%d cache-tree entries with a null SHA (first: %s)", nullTrees)
+	report("%d cache-tree entries pointing to missing trees (first: %s)", missingNames(trees))
+	report("%d resolve-undo entries with a null SHA (first: %s)", nullUndo)
+	report("%d resolve-undo entries pointing to missing objects (first: %s)", missingNames(undo))
+	return problems
+}
+
+// missingObjects returns which of the hashes are not in the object store.
+// Lazy fetching is turned off so partial clones do not go to the network.
+func missingObjects(ctx context.Context, repoPath string, hashes []string) (map[string]bool, error) {
+	missing := make(map[string]bool)
+	if len(hashes) == 0 {
+		return missing, nil
+	}
+
+	cmd := gitCommand(ctx, repoPath, "cat-file", "--batch-check")
+	cmd.Env = append(cmd.Env, "GIT_NO_REPLACE_OBJECTS=1", "GIT_NO_LAZY_FETCH=1")
+	cmd.Stdin = strings.NewReader(strings.Join(hashes, "\n") + "\n")
+	output, err := cmd.Output()
+	if err != nil {
+		return missing, fmt.Errorf("git cat-file: %w", err)
+	}
+	for _, line := range splitLines(string(output)) {
+		if hash, ok := strings.CutSuffix(line, " missing"); ok {
+			missing[hash] = true
+		}
+	}
+	return missing, nil
+}
+
+// rebuildIndex rebuilds a worktree's index from its HEAD. Entries matching
+// HEAD keep their stat data so git does not rehash those files, and files
+// whose entries had a null SHA are rehashed from the working tree.
+func rebuildIndex(ctx context.Context, opts Options, wt Worktree, em events.Emitter) error {
+	format := opts.objectFormat()
+	file := filepath.Join(wt.GitDir, "index")
+
+	previous := make(map[string]indexEntry)
+	var sparseDirs, nullNames []string
+	if idx, err := loadIndex(ctx, format, wt); err == nil {
+		for _, entry := range idx.entries {
+			if entry.stage != 0 {
+				continue
+			}
+			previous[entry.name] = entry
+			switch {
+			case isNullHash(entry.hash):
+				nullNames = append(nullNames, entry.name)
+			case entry.mode == filemode.Dir:
+				// Directory entries of a sparse index, named "<dir>/"
+				sparseDirs = append(sparseDirs, entry.name)
+			}
+		}
+	} else {
+		em.Debugf("Rebuilding unreadable index of %s: %v", wt.Path, err)
+	}
+
+	head, err := headTreeEntries(ctx, wt)
+	if err != nil {
+		return err
+	}
+	rehashed := rehashFiles(ctx, wt, nullNames, previous, em)
+
+	var entries []indexEntry
+	kept := 0
+	for _, h := range head {
+		entry := indexEntry{name: h.Name, mode: h.Mode, hash: h.Hash}
+		if old, ok := previous[h.Name]; ok && old.hash == h.Hash && old.mode == h.Mode {
+			entry = old
+			kept++
+		} else if r, ok := rehashed[h.Name]; ok {
+			entry.mode, entry.hash = r.Mode, r.Hash
+			delete(rehashed, h.Name)
+		}
+		if old, ok := previous[h.Name]; ok {
+			entry.extended |= old.extended & indexSkipWorktree
+		}
+		for _, dir := range sparseDirs {
+			if strings.HasPrefix(h.Name, dir) {
+				entry.extended |= indexSkipWorktree
+			}
+		}
+		entries = append(entries, entry)
+	}
+	// Null entries of files that are not in HEAD, e.g. new files
+	for _, r := range rehashed {
+		entries = append(entries, indexEntry{name: r.Name, mode: r.Mode, hash: r.Hash})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	if err := writeLocked(file, encodeIndex(entries, format)); err != nil {
+		return err
+	}
+
+	// Fill in stat data of the entries that did not keep theirs
+	gitCommand(ctx, wt.Path, "update-index", "-q", "--refresh").Run()
+	em.Debugf("Rebuilt index of %s from HEAD (%d entries kept their stat data, %d rehashed)", wt.Path, kept, len(nullNames))
+	return nil
+}
+
+// headTreeEntries lists the files of a worktree's HEAD commit. A branch
+// without commits yet has none.
+func headTreeEntries(ctx context.Context, wt Worktree) ([]TreeEntry, error) {
+	if gitCommand(ctx, wt.Path, "rev-parse", "-q", "--verify", "HEAD").Run() != nil {
+		branch, err := gitCommand(ctx, wt.Path, "symbolic-ref", "-q", "HEAD").Output()
+		if err == nil && gitCommand(ctx, wt.Path, "show-ref", "-q", "--verify", strings.TrimSpace(string(branch))).Run() != nil {
+			return nil, nil
+		}
+	}
+
+	output, err := gitCommand(ctx, wt.Path, "ls-tree", "-r", "-z", "--full-tree", "HEAD").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list HEAD: %w", err)
+	}
+	var entries []TreeEntry
+	for _, record := range strings.Split(string(output), "\x00") {
+		// "<mode> <type> <hash>\t<path>"
+		meta, name, ok := strings.Cut(record, "\t")
+		fields := strings.Fields(meta)
+		if !ok || len(fields) != 3 {
+			continue
+		}
+		mode, _ := filemode.New(fields[0])
+		entries = append(entries, TreeEntry{Name: name, Mode: mode, Hash: fields[2]})
+	}
+	return entries, nil
+}
+
+// rehashFiles writes the working tree files of the named entries to the
+// object store and returns their new entries. Files that no longer exist are
+// left out.
+func rehashFiles(ctx context.Context, wt Worktree, names []string, previous map[string]indexEntry, em events.Emitter) map[string]TreeEntry {
+	rehashed := make(map[string]TreeEntry)
+	for _, name := range names {
+		path := filepath.Join(wt.Path, filepath.FromSlash(name))
+		info, err := os.Lstat(path)
+		if err != nil {
+			em.Debugf("Cannot rehash %s: %v", name, err)
+			continue
+		}
+
+		var entry TreeEntry
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				continue
+			}
+			cmd := gitCommand(ctx, wt.Path, "hash-object", "-w", "--stdin", "--no-filters")
+			cmd.Stdin = strings.NewReader(target)
+			output, err := cmd.Output()
+			if err != nil {
+				continue
+			}
+			entry = TreeEntry{Mode: filemode.Symlink, Hash: strings.TrimSpace(string(output))}
+		case info.IsDir():
+			// A checked out submodule; its HEAD is the gitlink
+			output, err := gitCommand(ctx, path, "rev-parse", "--verify", "HEAD").Output()
+			if err != nil {
+				continue
+			}
+			entry = TreeEntry{Mode: filemode.Submodule, Hash: strings.TrimSpace(string(output))}
+		default:
+			output, err := gitCommand(ctx, wt.Path, "hash-object", "-w", "--", name).Output()
+			if err != nil {
+				em.Debugf("Cannot rehash %s: %v", name, err)
+				continue
+			}
+			entry = TreeEntry{Mode: filemode.Regular, Hash: strings.TrimSpace(string(output))}
+			// Keep the recorded executable bit where the filesystem has none, e.g. on Windows
+			if mode := previous[name].mode; mode == filemode.Executable || mode == 0 && info.Mode()&0111 != 0 {
+				entry.Mode = filemode.Executable
+			}
+		}
+		entry.Name = name
+		rehashed[name] = entry
+	}
+	return rehashed
+}
@@ -0,0 +1,606 @@
+package git
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rahul/nsha/pkg/gitdir"
+)
+
+// ErrObjectNotFound is returned when inspecting an object that is neither
+// loose, in a pack nor in quarantine
+var ErrObjectNotFound = errors.New("object not found")
+
+// maxDeltaChain bounds how many deltas are followed to reach a base, which
+// also stops cycles in a damaged pack
+const maxDeltaChain = 10000
+
+// RawObject is an object as stored, decoded as far as its bytes allow.
+// Nothing is rejected: every problem found is recorded instead.
+type RawObject struct {
+	Hash     string         `json:"hash"`
+	Source   string         `json:"source"` // Loose file, or pack and offset
+	Type     string         `json:"type,omitempty"`
+	Size     int64          `json:"size"` // Size the header gives
+	Data     []byte         `json:"-"`    // Content after the header, as far as it inflates
+	Stored   []byte         `json:"-"`    // Bytes as stored, when they could not be inflated
+	Problems []string       `json:"problems,omitempty"`
+	Entries  []RawTreeEntry `json:"entries,omitempty"` // Trees only
+	Damaged  []RawRegion    `json:"damaged,omitempty"`
+}
+
+// RawTreeEntry is a tree entry as stored. Mode is the mode git would use
+// for it, empty when the stored mode has no meaning.
+type RawTreeEntry struct {
+	Offset     int      `json:"offset"`
+	StoredMode string   `json:"stored_mode"`
+	Mode       string   `json:"mode,omitempty"`
+	Type       string   `json:"type,omitempty"`
+	Hash       string   `json:"hash"`
+	Name       string   `json:"name"`
+	Problems   []string `json:"problems,omitempty"`
+}
+
+// RawRegion is a byte range that could not be decoded, in the content or,
+// when Stored is set, in the bytes as stored
+type RawRegion struct {
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+	Reason string `json:"reason"`
+	Stored bool   `json:"stored,omitempty"`
+}
+
+// Bytes returns the bytes the region covers
+func (o *RawObject) Bytes(r RawRegion) []byte {
+	data := o.Data
+	if r.Stored {
+		data = o.Stored
+	}
+	return data[min(r.Start, len(data)):min(r.End, len(data))]
+}
+
+// InspectObject reads an object without trusting it to be well-formed. name
+// is a full or abbreviated object ID, or the path of a loose object file.
+// Objects are looked up loose, then in packs, then in quarantine.
+func InspectObject(ctx context.Context, opts Options, name string) (*RawObject, error) {
+	d := opts.gitDir()
+	format := opts.objectFormat()
+
+	for _, file := range []string{name, filepath.Join(opts.RepoPath, name)} {
+		if info, err := os.Stat(file); err == nil && !info.IsDir() {
+			return inspectLooseFile(d, format, file, looseFileHash(file, format))
+		}
+	}
+
+	hash, err := resolveObjectName(d, format, name)
+	if err != nil {
+		return nil, err
+	}
+	return readRawObject(ctx, d, format, hash, 0)
+}
+
+// readRawObject finds an object by hash and decodes it leniently
+func readRawObject(ctx context.Context, d *gitdir.Dir, format ObjectFormat, hash string, depth int) (*RawObject, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if depth > maxDeltaChain {
+		return nil, fmt.Errorf("delta chain of %s is too long", hash)
+	}
+	if len(hash) != format.HexSize() || !isHexString(hash) {
+		return nil, fmt.Errorf("%q is not a %s object ID", hash, format)
+	}
+
+	loose := d.Path("objects", hash[:2], hash[2:])
+	if _, err := os.Stat(loose); err == nil {
+		return inspectLooseFile(d, format, loose, hash)
+	}
+	for _, pack := range packFiles(d) {
+		idx, err := openPackIndex(strings.TrimSuffix(pack, ".pack")+".idx", format)
+		if err != nil {
+			continue
+		}
+		if offset, ok := idx.offsets[hash]; ok {
+			return inspectPackedObject(ctx, d, format, pack, idx, int(offset), hash, depth)
+		}
+	}
+
+	entries, _ := readQuarantineManifest(d)
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Hash == hash {
+			obj, err := inspectLooseFile(d, format, quarantinePath(d, "objects", entries[i].ID), hash)
+			if obj != nil {
+				obj.Source = "quarantine: " + entries[i].ID
+			}
+			return obj, err
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", hash, ErrObjectNotFound)
+}
+
+// resolveObjectName expands an abbreviated object ID using the loose
+// objects, pack indexes and quarantine
+func resolveObjectName(d *gitdir.Dir, format ObjectFormat, name string) (string, error) {
+	if len(name) < 4 || len(name) > format.HexSize() || !isHexString(strings.ToLower(name)) {
+		return "", fmt.Errorf("%q is neither an object ID nor a file", name)
+	}
+	name = strings.ToLower(name)
+	if len(name) == format.HexSize() {
+		return name, nil
+	}
+
+	matches := make(map[string]bool)
+	if files, err := os.ReadDir(d.Path("objects", name[:2])); err == nil {
+		for _, f := range files {
+			if hash := name[:2] + f.Name(); strings.HasPrefix(hash, name) && len(hash) == format.HexSize() {
+				matches[hash] = true
+			}
+		}
+	}
+	for _, pack := range packFiles(d) {
+		idx, err := openPackIndex(strings.TrimSuffix(pack, ".pack")+".idx", format)
+		if err != nil {
+			continue
+		}
+		at := sort.SearchStrings(idx.hashes, name)
+		for ; at < len(idx.hashes) && strings.HasPrefix(idx.hashes[at], name); at++ {
+			matches[idx.hashes[at]] = true
+		}
+	}
+	entries, _ := readQuarantineManifest(d)
+	for _, entry := range entries {
+		if entry.Hash != "" && strings.HasPrefix(entry.Hash, name) {
+			matches[entry.Hash] = true
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("%s: %w", name, ErrObjectNotFound)
+	case 1:
+		for hash := range matches {
+			return hash, nil
+		}
+	}
+	return "", fmt.Errorf("%s is ambiguous, it matches %d objects", name, len(matches))
+}
+
+// looseFileHash returns the object ID a loose object's path names, or ""
+func looseFileHash(file string, format ObjectFormat) string {
+	hash := filepath.Base(filepath.Dir(file)) + filepath.Base(file)
+	if len(hash) == format.HexSize() && isHexString(hash) {
+		return hash
+	}
+	return ""
+}
+
+// inspectLooseFile decodes a loose object file as far as it inflates
+func inspectLooseFile(d *gitdir.Dir, format ObjectFormat, file, hash string) (*RawObject, error) {
+	stored, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object: %w", err)
+	}
+	obj := &RawObject{Hash: hash, Source: file}
+	if rel := relativeToCommonDir(d, file); !strings.HasPrefix(rel, "..") {
+		obj.Source = filepath.ToSlash(rel)
+	}
+
+	content, err := inflatePartial(stored)
+	if err != nil {
+		obj.Problems = append(obj.Problems, fmt.Sprintf("Decompression stopped after %d byte(s): %v", len(content), err))
+		if len(content) == 0 {
+			obj.Stored = stored
+			obj.Damaged = append(obj.Damaged, RawRegion{Start: 0, End: len(stored), Reason: "cannot be decompressed", Stored: true})
+			return obj, nil
+		}
+	}
+
+	// "<type> <size>\0" followed by the content
+	header, data, ok := bytes.Cut(content, []byte{0})
+	kind, sizeField, _ := strings.Cut(string(header), " ")
+	size, sizeErr := strconv.ParseInt(sizeField, 10, 64)
+	if !ok || len(header) > 32 || sizeErr != nil {
+		obj.Problems = append(obj.Problems, "Object header is missing or invalid")
+		obj.Data = content
+		obj.Damaged = append(obj.Damaged, RawRegion{Start: 0, End: min(len(content), 32), Reason: "invalid header"})
+		return obj, nil
+	}
+	obj.Type, obj.Size, obj.Data = kind, size, data
+	decodeRawObject(obj, format)
+	return obj, nil
+}
+
+// inflatePartial inflates zlib data, returning what it could inflate when
+// the stream is damaged
+func inflatePartial(stored []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	_, err = io.Copy(&out, zr)
+	return out.Bytes(), err
+}
+
+// inspectPackedObject decodes the entry at offset of a pack, applying
+// deltas from their bases
+func inspectPackedObject(ctx context.Context, d *gitdir.Dir, format ObjectFormat, pack string, idx *packIndex, offset int, hash string, depth int) (*RawObject, error) {
+	obj := &RawObject{Hash: hash, Source: fmt.Sprintf("%s at offset %d", filepath.Base(pack), offset)}
+	entry, entryErr := readPackedEntry(pack, idx, offset, format)
+	// A damaged entry is still worth decoding when its type is known and,
+	// for a delta, its base could be read
+	_, whole := packObjectKinds[entry.kind]
+	delta := entry.kind == packOfsDelta && entry.baseOffset > 0 ||
+		entry.kind == packRefDelta && entry.baseHash != ""
+	if entryErr != nil && !whole && !delta {
+		return nil, fmt.Errorf("failed to read %s: %w", obj.Source, entryErr)
+	}
+	if entryErr != nil {
+		obj.Problems = append(obj.Problems, fmt.Sprintf("Pack entry is damaged: %v", entryErr))
+	}
+
+	if kind, ok := packObjectKinds[entry.kind]; ok {
+		obj.Type, obj.Data = kind, entry.data
+		obj.Size = int64(len(entry.data))
+		decodeRawObject(obj, format)
+		return obj, nil
+	}
+
+	// Deltas need their whole base and the whole delta
+	var base *RawObject
+	var err error
+	if entry.kind == packOfsDelta {
+		obj.Source += fmt.Sprintf(", delta against offset %d", entry.baseOffset)
+		base, err = inspectPackedObject(ctx, d, format, pack, idx, entry.baseOffset, "", depth+1)
+	} else {
+		obj.Source += ", delta against " + entry.baseHash
+		base, err = readRawObject(ctx, d, format, entry.baseHash, depth+1)
+	}
+	if err == nil && !base.Healthy() {
+		err = fmt.Errorf("base %s is damaged", shortHash(base.Hash))
+	}
+	if err == nil {
+		err = entryErr
+	}
+	if err == nil {
+		obj.Data, err = applyDelta(base.Data, entry.data)
+		obj.Type = base.Type
+	}
+	if err != nil {
+		obj.Problems = append(obj.Problems, fmt.Sprintf("Delta cannot be applied: %v", err))
+		obj.Stored = entry.data
+		obj.Damaged = append(obj.Damaged, RawRegion{Start: 0, End: len(entry.data), Reason: "undecodable delta", Stored: true})
+		return obj, nil
+	}
+	obj.Size = int64(len(obj.Data))
+	if obj.Hash == "" {
+		obj.Hash = hashObject(format, obj.Type, obj.Data)
+	}
+	decodeRawObject(obj, format)
+	return obj, nil
+}
+
+// readPackedEntry reads one entry of a pack, which ends where the next
+// entry the index lists starts
+func readPackedEntry(pack string, idx *packIndex, offset int, format ObjectFormat) (packEntry, error) {
+	f, err := os.Open(pack)
+	if err != nil {
+		return packEntry{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return packEntry{}, err
+	}
+
+	end := int(info.Size()) - format.HexSize()/2
+	for _, o := range idx.offsets {
+		if int(o) > offset && int(o) < end {
+			end = int(o)
+		}
+	}
+	if offset < 12 || offset >= end {
+		return packEntry{}, fmt.Errorf("offset %d is outside the pack", offset)
+	}
+	return decodePackEntry(f, offset, end, format.HexSize()/2)
+}
+
+// decodeRawObject checks the content against the header and hash and
+// decodes trees, commits and tags
+func decodeRawObject(obj *RawObject, format ObjectFormat) {
+	if int64(len(obj.Data)) != obj.Size {
+		obj.Problems = append(obj.Problems, fmt.Sprintf("Header says %d byte(s), content has %d", obj.Size, len(obj.Data)))
+	}
+	if _, ok := map[string]bool{"commit": true, "tree": true, "blob": true, "tag": true}[obj.Type]; !ok {
+		obj.Problems = append(obj.Problems, fmt.Sprintf("Unknown object type %q", obj.Type))
+	} else if actual := hashObject(format, obj.Type, obj.Data); obj.Hash != "" && actual != obj.Hash {
+		obj.Problems = append(obj.Problems, "Content hashes to "+actual)
+	}
+
+	switch obj.Type {
+	case "tree":
+		obj.Entries, obj.Damaged = decodeTreeLenient(obj.Data, format)
+	case "commit", "tag":
+		obj.Damaged = decodeHeaderLenient(obj, format)
+	}
+}
+
+// Healthy reports whether nothing is wrong with the object
+func (o *RawObject) Healthy() bool {
+	if len(o.Problems) > 0 || len(o.Damaged) > 0 {
+		return false
+	}
+	for _, e := range o.Entries {
+		if len(e.Problems) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeTreeLenient reads tree entries, keeping entries with odd modes,
+// bad names, duplicates or the wrong order and noting what is wrong with
+// them. Bytes that do not form an entry are skipped up to the next place a
+// plausible entry starts.
+func decodeTreeLenient(data []byte, format ObjectFormat) ([]RawTreeEntry, []RawRegion) {
+	hs := format.HexSize() / 2
+	var entries []RawTreeEntry
+	var damaged []RawRegion
+	seen := make(map[string]bool)
+	prev := ""
+
+	for pos := 0; pos < len(data); {
+		entry, next, err := parseTreeEntry(data, pos, hs)
+		if err != nil {
+			resume := len(data)
+			for at := pos + 1; at < len(data); at++ {
+				if e, _, err := parseTreeEntry(data, at, hs); err == nil && e.Type != "" && validTreeName(e.Name) {
+					resume = at
+					break
+				}
+			}
+			damaged = append(damaged, RawRegion{Start: pos, End: resume, Reason: err.Error()})
+			pos = resume
+			continue
+		}
+
+		if entry.Mode == "" {
+			entry.Problems = append(entry.Problems, "mode "+entry.StoredMode+" has no meaning")
+		} else if entry.Mode != entry.StoredMode {
+			entry.Problems = append(entry.Problems, "non-standard mode "+entry.StoredMode+", git uses "+entry.Mode)
+		}
+		if isNullHash(entry.Hash) {
+			entry.Problems = append(entry.Problems, "points to the null SHA")
+		}
+		if !validTreeName(entry.Name) {
+			entry.Problems = append(entry.Problems, "invalid name")
+		}
+		if seen[entry.Name] {
+			entry.Problems = append(entry.Problems, "duplicate name")
+		}
+		key := treeSortKey(entry)
+		if prev != "" && key <= prev && !seen[entry.Name] {
+			entry.Problems = append(entry.Problems, "out of order")
+		}
+		seen[entry.Name] = true
+		prev = key
+		entries = append(entries, entry)
+		pos = next
+	}
+	return entries, damaged
+}
+
+// parseTreeEntry reads "<mode> <name>\0<hash>" at pos
+func parseTreeEntry(data []byte, pos, hashSize int) (RawTreeEntry, int, error) {
+	entry := RawTreeEntry{Offset: pos}
+	sp := bytes.IndexByte(data[pos:min(pos+8, len(data))], ' ')
+	if sp <= 0 {
+		return entry, 0, fmt.Errorf("have no entry mode")
+	}
+	entry.StoredMode = string(data[pos : pos+sp])
+	mode, err := strconv.ParseUint(entry.StoredMode, 8, 32)
+	if err != nil {
+		return entry, 0, fmt.Errorf("have a mode that is not octal")
+	}
+	entry.Mode, entry.Type = canonicalTreeMode(uint32(mode))
+
+	nameAt := pos + sp + 1
+	nul := bytes.IndexByte(data[nameAt:], 0)
+	if nul < 0 {
+		return entry, 0, fmt.Errorf("have no end of entry name")
+	}
+	entry.Name = string(data[nameAt : nameAt+nul])
+	hashAt := nameAt + nul + 1
+	if hashAt+hashSize > len(data) {
+		return entry, 0, fmt.Errorf("end in the middle of an entry")
+	}
+	entry.Hash = fmt.Sprintf("%x", data[hashAt:hashAt+hashSize])
+	return entry, hashAt + hashSize, nil
+}
+
+// canonicalTreeMode returns the mode and object type git uses for a stored
+// mode, judged by its file type bits like git fsck does
+func canonicalTreeMode(mode uint32) (string, string) {
+	switch mode & 0170000 {
+	case 0040000:
+		return "40000", "tree"
+	case 0100000:
+		if mode&0111 != 0 {
+			return "100755", "blob"
+		}
+		return "100644", "blob"
+	case 0120000:
+		return "120000", "blob"
+	case 0160000:
+		return "160000", "commit"
+	}
+	return "", ""
+}
+
+// validTreeName reports whether git accepts a tree entry name
+func validTreeName(name string) bool {
+	return name != "" && name != "." && name != ".." && name != ".git" && !strings.ContainsAny(name, "/\n")
+}
+
+// treeSortKey orders entries like git: trees sort as if their name ended in "/"
+func treeSortKey(e RawTreeEntry) string {
+	if e.Type == "tree" {
+		return e.Name + "/"
+	}
+	return e.Name
+}
+
+// headerLine matches one header line of a commit or tag
+var headerLine = regexp.MustCompile(`^([a-z]+) (.*)$`)
+
+// signatureLine matches the value of author, committer and tagger lines
+var signatureLine = regexp.MustCompile(`^[^<>\n]*<[^<>\n]*> -?[0-9]+ [+-][0-9]{4}$`)
+
+// decodeHeaderLenient checks the header lines of a commit or tag. Lines
+// that cannot be read are returned as damaged regions.
+func decodeHeaderLenient(obj *RawObject, format ObjectFormat) []RawRegion {
+	var damaged []RawRegion
+	found := make(map[string]bool)
+	at := 0
+	for at < len(obj.Data) {
+		end := bytes.IndexByte(obj.Data[at:], '\n')
+		if end < 0 {
+			obj.Problems = append(obj.Problems, "Header does not end")
+			break
+		}
+		line := string(obj.Data[at : at+end])
+		lineAt := at
+		at += end + 1
+		if line == "" {
+			break // The message follows
+		}
+		if strings.HasPrefix(line, " ") {
+			continue // Continues a multi-line value such as gpgsig
+		}
+
+		m := headerLine.FindStringSubmatch(line)
+		if m == nil || strings.ContainsRune(line, 0) {
+			damaged = append(damaged, RawRegion{Start: lineAt, End: lineAt + end, Reason: "are not a header line"})
+			continue
+		}
+		key, value := m[1], m[2]
+		found[key] = true
+		switch key {
+		case "tree", "parent", "object":
+			if len(value) != format.HexSize() || !isHexString(value) {
+				damaged = append(damaged, RawRegion{Start: lineAt, End: lineAt + end, Reason: "have an invalid " + key + " hash"})
+			} else if isNullHash(value) {
+				obj.Problems = append(obj.Problems, fmt.Sprintf("%s is the null SHA", key))
+			}
+		case "author", "committer", "tagger":
+			if !signatureLine.MatchString(value) {
+				damaged = append(damaged, RawRegion{Start: lineAt, End: lineAt + end, Reason: "have a malformed " + key})
+			}
+		}
+	}
+
+	required := []string{"tree", "author", "committer"}
+	if obj.Type == "tag" {
+		required = []string{"object", "type", "tag"}
+	}
+	for _, key := range required {
+		if !found[key] {
+			obj.Problems = append(obj.Problems, fmt.Sprintf("Header has no %s line", key))
+		}
+	}
+	return damaged
+}
+
+// salvageTreeLines returns git mktree input for the entries of a decoded
+// tree that git can store: known modes, valid names and the first of
+// duplicates. It also returns how many entries were left out.
+func salvageTreeLines(obj *RawObject) ([]string, int) {
+	var lines []string
+	seen := make(map[string]bool)
+	dropped := 0
+	for _, e := range obj.Entries {
+		if e.Mode == "" || !validTreeName(e.Name) || seen[e.Name] {
+			dropped++
+			continue
+		}
+		seen[e.Name] = true
+		lines = append(lines, fmt.Sprintf("%s %s %s\t%s", e.Mode, e.Type, e.Hash, e.Name))
+	}
+	return lines, dropped + len(obj.Damaged)
+}
+
+// DamageMalformedTree marks a tree git cannot parse, moved to quarantine
+// once the tree fixer has salvaged its entries
+const DamageMalformedTree LooseObjectDamage = "malformed-tree"
+
+// quarantineMalformedTree moves the loose file of a salvaged tree into
+// quarantine. Packed trees stay in place.
+func quarantineMalformedTree(ctx context.Context, opts Options, hash string) error {
+	em := opts.emit()
+
+	file := opts.gitDir().ObjectPath(hash)
+	if _, err := os.Stat(file); err != nil {
+		em.Debugf("Tree %s is not a loose object, leaving it in place", hash[:8])
+		return nil
+	}
+	if _, err := quarantineFile(opts, file, hash, DamageMalformedTree); err != nil {
+		return err
+	}
+	opts.Diagnosis.InvalidateObjects([]string{hash})
+	em.Debugf("Moved tree %s to quarantine", hash[:8])
+
+	// Commits the history rewrite leaves behind may still use the tree
+	return ExpireBrokenReflogs(ctx, opts)
+}
+
+// salvageTree decodes a tree git cannot parse and returns git mktree input
+// for the entries it can store, and how many it left out
+func salvageTree(ctx context.Context, opts Options, hash string) ([]string, int, error) {
+	obj, err := InspectObject(ctx, opts, hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	if obj.Type != "tree" {
+		return nil, 0, fmt.Errorf("%s is a %s, not a tree", hash, obj.Type)
+	}
+	lines, dropped := salvageTreeLines(obj)
+	return lines, dropped, nil
+}
+
+// Hexdump formats bytes like hexdump -C, numbering lines from offset
+func Hexdump(data []byte, offset int) string {
+	var b strings.Builder
+	for i := 0; i < len(data); i += 16 {
+		line := data[i:min(i+16, len(data))]
+		fmt.Fprintf(&b, "%08x  ", offset+i)
+		for j := 0; j < 16; j++ {
+			if j < len(line) {
+				fmt.Fprintf(&b, "%02x ", line[j])
+			} else {
+				b.WriteString("   ")
+			}
+			if j == 7 {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(" |")
+		for _, c := range line {
+			if c < 0x20 || c > 0x7e {
+				c = '.'
+			}
+			b.WriteByte(c)
+		}
+		b.WriteString("|\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,256 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LooseObjectDamage says why a loose object file cannot be read
+type LooseObjectDamage string
+
+const (
+	DamageEmpty            LooseObjectDamage = "empty"
+	DamageZeroFilled       LooseObjectDamage = "zero-filled"
+	DamageTruncated        LooseObjectDamage = "truncated"
+	DamageUndecompressable LooseObjectDamage = "undecompressable"
+	DamageBadHeader        LooseObjectDamage = "bad-header"
+
+	// DamageConflictCopy marks a sync tool's duplicate of a git file in quarantine
+	DamageConflictCopy LooseObjectDamage = "conflict-copy"
+)
+
+// Description returns a short explanation of the damage
+func (d LooseObjectDamage) Description() string {
+	switch d {
+	case DamageEmpty:
+		return "file is empty"
+	case DamageZeroFilled:
+		return "file contains only NUL bytes"
+	case DamageTruncated:
+		return "file ends before the object does"
+	case DamageUndecompressable:
+		return "file cannot be decompressed"
+	case DamageBadHeader:
+		return "object header is invalid"
+	case DamageConflictCopy:
+		return "file is a cloud-sync conflict copy"
+	case DamageCorruptPack:
+		return "file belongs to a damaged pack"
+	case DamageBadPackIndex:
+		return "pack index was rebuilt from its pack"
+	case DamageMalformedTree:
+		return "tree cannot be parsed, its entries were salvaged"
+	}
+	return string(d)
+}
+
+// checkLooseObjects finds loose object files that are empty, zero-filled,
+// truncated or cannot be decompressed. Any of them makes git commands that
+// read the object fail, typically after a power loss.
+func checkLooseObjects(ctx context.Context, opts Options) ([]Issue, error) {
+	d := opts.gitDir()
+	format := opts.objectFormat()
+
+	dirs, err := os.ReadDir(d.Path("objects"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var issues []Issue
+	for _, dir := range dirs {
+		if err := ctx.Err(); err != nil {
+			return issues, err
+		}
+		if !dir.IsDir() || len(dir.Name()) != 2 || !isHexString(dir.Name()) {
+			continue
+		}
+
+		files, err := os.ReadDir(d.Path("objects", dir.Name()))
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			hash := dir.Name() + file.Name()
+			// Skips git's temporary files such as tmp_obj_*
+			if file.IsDir() || len(hash) != format.HexSize() || !isHexString(hash) {
+				continue
+			}
+
+			path := d.Path("objects", dir.Name(), file.Name())
+			damage := looseObjectDamage(path)
+			if damage == "" {
+				continue
+			}
+			issues = append(issues, Issue{
+				Type:    IssueTypeCorruptObject,
+				Object:  hash,
+				Message: "Loose object " + string(damage) + ": " + damage.Description(),
+				Path:    repoRelative(opts.RepoPath, path),
+			})
+		}
+	}
+	return issues, nil
+}
+
+// looseObjectDamage returns why a loose object file cannot be read, or ""
+// when it decompresses to a well-formed object
+func looseObjectDamage(file string) LooseObjectDamage {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && info.Size() == 0 {
+		return DamageEmpty
+	}
+
+	r, err := zlib.NewReader(bufio.NewReader(f))
+	if err != nil {
+		if zeroFilled(file) {
+			return DamageZeroFilled
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return DamageTruncated
+		}
+		return DamageUndecompressable
+	}
+	defer r.Close()
+
+	// "<type> <size>\0" followed by size bytes of content
+	br := bufio.NewReader(r)
+	header, err := br.ReadString(0)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return DamageTruncated
+		}
+		return DamageUndecompressable
+	}
+	kind, sizeField, ok := strings.Cut(strings.TrimSuffix(header, "\x00"), " ")
+	size, sizeErr := strconv.ParseInt(sizeField, 10, 64)
+	if !ok || sizeErr != nil || size < 0 {
+		return DamageBadHeader
+	}
+	switch kind {
+	case "commit", "tree", "blob", "tag":
+	default:
+		return DamageBadHeader
+	}
+
+	n, err := io.Copy(io.Discard, br)
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return DamageTruncated
+	case err != nil:
+		if zeroFilled(file) {
+			return DamageZeroFilled
+		}
+		return DamageUndecompressable
+	case n < size:
+		return DamageTruncated
+	case n > size:
+		return DamageBadHeader
+	}
+	return ""
+}
+
+// zeroFilled reports whether a file consists of NUL bytes only
+func zeroFilled(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		if bytes.Count(buf[:n], []byte{0}) != n {
+			return false
+		}
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+// isHexString reports whether s only has lowercase hex digits
+func isHexString(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// FixCorruptLooseObjects moves damaged loose objects into the quarantine
+// directory. When a pack also has the object, git uses that copy again;
+// otherwise the object is missing and the reference fixers take over.
+func FixCorruptLooseObjects(ctx context.Context, opts Options) (int, error) {
+	em := opts.emit()
+
+	issues, err := planned(opts, func() ([]Issue, error) {
+		return diagnosedIssues(ctx, opts, IssueTypeCorruptObject, checkLooseObjects)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	fixedCount := 0
+	var moved []string
+	for _, issue := range issues {
+		if err := ctx.Err(); err != nil {
+			return fixedCount, err
+		}
+		if opts.DryRun {
+			em.Debugf("[DRY RUN] Would quarantine %s: %s", issue.Path, issue.Message)
+			fixedCount++
+			continue
+		}
+
+		file := filepath.FromSlash(issue.Path)
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(opts.RepoPath, file)
+		}
+		damage := looseObjectDamage(file)
+		if damage == "" {
+			continue
+		}
+		entry, err := quarantineFile(opts, file, issue.Object, damage)
+		if err != nil {
+			em.Warnf("Failed to quarantine %s: %v", issue.Path, err)
+			continue
+		}
+		em.Debugf("Quarantined %s as %s", issue.Object[:8], entry.ID)
+		opts.Diagnosis.invalidate(subject{subjectPath, issue.Path})
+		moved = append(moved, issue.Object)
+		fixedCount++
+	}
+
+	if len(moved) > 0 {
+		// Objects reachable from refs may now be missing
+		opts.Diagnosis.InvalidateObjects(moved)
+		missing, _ := missingObjects(ctx, opts.RepoPath, moved)
+		for _, hash := range moved {
+			if !missing[hash] {
+				em.Detailf("Object %s is still available from a pack", hash[:8])
+			}
+		}
+	}
+	return fixedCount, nil
+}
@@ -0,0 +1,193 @@
+package git
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// multiPackIndexMagic starts every multi-pack-index
+const multiPackIndexMagic = "MIDX"
+
+// multiPackIndex is a parsed multi-pack-index: which pack holds each object
+// and where
+type multiPackIndex struct {
+	packs   []string // Names of the pack indexes it covers
+	objects []midxObject
+}
+
+// midxObject is an object a multi-pack-index lists
+type midxObject struct {
+	hash   string
+	pack   int
+	offset uint64
+}
+
+// multiPackIndexFile returns the multi-pack-index of the repository
+func multiPackIndexFile(opts Options) string {
+	return opts.gitDir().Path("objects", "pack", "multi-pack-index")
+}
+
+// parseMultiPackIndex parses a multi-pack-index
+func parseMultiPackIndex(data []byte, format ObjectFormat) (*multiPackIndex, error) {
+	if len(data) < 12 || string(data[:4]) != multiPackIndexMagic {
+		return nil, fmt.Errorf("not a multi-pack-index")
+	}
+	if data[4] != 1 && data[4] != 2 {
+		return nil, fmt.Errorf("unsupported multi-pack-index version %d", data[4])
+	}
+	if want := graphHashVersion(format); data[5] != want {
+		return nil, fmt.Errorf("hash version %d does not match the %s repository", data[5], format)
+	}
+	if data[7] != 0 {
+		return nil, fmt.Errorf("incremental multi-pack-indexes are not supported")
+	}
+	numPacks := int(binary.BigEndian.Uint32(data[8:]))
+	chunks, err := parseChunkFile(data, 12, int(data[6]), format)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &multiPackIndex{}
+	for _, name := range strings.Split(string(chunks["PNAM"]), "\x00") {
+		if name != "" {
+			m.packs = append(m.packs, name)
+		}
+	}
+	if len(m.packs) != numPacks {
+		return nil, fmt.Errorf("PNAM chunk names %d packs, the header says %d", len(m.packs), numPacks)
+	}
+
+	hs := format.HexSize() / 2
+	fanout, oids, offsets, large := chunks["OIDF"], chunks["OIDL"], chunks["OOFF"], chunks["LOFF"]
+	if len(fanout) != 256*4 {
+		return nil, fmt.Errorf("OIDF chunk is missing or has the wrong size")
+	}
+	count, err := readFanout(fanout, 0, len(fanout))
+	if err != nil {
+		return nil, err
+	}
+	if len(oids) != count*hs || len(offsets) != count*8 {
+		return nil, fmt.Errorf("OIDL or OOFF chunk does not hold %d objects", count)
+	}
+
+	var hashes []string
+	for i := 0; i < count; i++ {
+		obj := midxObject{hash: hex.EncodeToString(oids[i*hs : (i+1)*hs])}
+		if i > 0 && hashes[i-1] >= obj.hash {
+			return nil, fmt.Errorf("OIDL chunk is not sorted at %s", obj.hash)
+		}
+		hashes = append(hashes, obj.hash)
+
+		obj.pack = int(binary.BigEndian.Uint32(offsets[i*8:]))
+		if obj.pack >= numPacks {
+			return nil, fmt.Errorf("object %s is in pack %d of %d", obj.hash, obj.pack, numPacks)
+		}
+		offset := binary.BigEndian.Uint32(offsets[i*8+4:])
+		obj.offset = uint64(offset)
+		if offset&0x80000000 != 0 {
+			at := int(offset&^0x80000000) * 8
+			if at+8 > len(large) {
+				return nil, fmt.Errorf("object %s has a large offset past the LOFF chunk", obj.hash)
+			}
+			obj.offset = binary.BigEndian.Uint64(large[at:])
+		}
+		m.objects = append(m.objects, obj)
+	}
+	if err := checkFanout(fanout, hashes); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// checkMultiPackIndex validates the multi-pack-index against the packs it
+// covers. Every pack must still exist and hold each object at the offset the
+// index records; a pack that was rewritten or quarantined leaves git reading
+// objects from the wrong place.
+func checkMultiPackIndex(opts Options) []Issue {
+	file := multiPackIndexFile(opts)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	format := opts.objectFormat()
+	m, err := parseMultiPackIndex(data, format)
+	if err != nil {
+		return []Issue{multiPackIndexIssue(opts, file, fmt.Sprintf("Cannot read multi-pack-index: %v", err))}
+	}
+
+	dir := filepath.Dir(file)
+	indexes := make([]*packIndex, len(m.packs))
+	for i, name := range m.packs {
+		base := strings.TrimSuffix(strings.TrimSuffix(name, ".idx"), ".pack")
+		if _, err := os.Stat(filepath.Join(dir, base+".pack")); err != nil {
+			return []Issue{multiPackIndexIssue(opts, file, fmt.Sprintf("Lists %s.pack, which does not exist", base))}
+		}
+		idx, err := openPackIndex(filepath.Join(dir, base+".idx"), format)
+		if err != nil {
+			return []Issue{multiPackIndexIssue(opts, file, fmt.Sprintf("Cannot read %s.idx: %v", base, err))}
+		}
+		indexes[i] = idx
+	}
+
+	stale, example := 0, ""
+	for _, obj := range m.objects {
+		offset, ok := indexes[obj.pack].offsets[obj.hash]
+		if ok && offset == obj.offset {
+			continue
+		}
+		if stale == 0 {
+			pack := strings.TrimSuffix(m.packs[obj.pack], ".idx")
+			example = fmt.Sprintf("%s is not in %s.pack", shortHash(obj.hash), pack)
+			if ok {
+				example = fmt.Sprintf("%s is at offset %d of %s.pack, the index records %d", shortHash(obj.hash), offset, pack, obj.offset)
+			}
+		}
+		stale++
+	}
+	if stale > 0 {
+		return []Issue{multiPackIndexIssue(opts, file,
+			fmt.Sprintf("%d of %d object(s) are not where the multi-pack-index says, e.g. %s", stale, len(m.objects), example))}
+	}
+	return nil
+}
+
+// multiPackIndexIssue reports a stale multi-pack-index
+func multiPackIndexIssue(opts Options, file, message string) Issue {
+	return Issue{
+		Type:    IssueTypeStaleMultiPackIndex,
+		Object:  filepath.ToSlash(relativeToCommonDir(opts.gitDir(), file)),
+		Message: message,
+		Path:    repoRelative(opts.RepoPath, file),
+	}
+}
+
+// removeMultiPackIndex removes the multi-pack-index with its reverse index
+// and bitmap, which are only valid together
+func removeMultiPackIndex(opts Options) error {
+	file := multiPackIndexFile(opts)
+	matches, _ := filepath.Glob(file + "-*")
+	for _, f := range append([]string{file}, matches...) {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove multi-pack-index: %w", err)
+		}
+	}
+	return nil
+}
+
+// rebuildMultiPackIndex replaces the multi-pack-index with one covering the
+// packs the repository has now
+func rebuildMultiPackIndex(ctx context.Context, opts Options) error {
+	if err := removeMultiPackIndex(opts); err != nil {
+		return err
+	}
+	opts.emit().Debugf("Writing multi-pack-index...")
+	if output, err := runGitProgress(ctx, opts, "multi-pack-index", "write"); err != nil {
+		return fmt.Errorf("%s: %w", lastLine(output), err)
+	}
+	return nil
+}
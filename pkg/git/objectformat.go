@@ -0,0 +1,98 @@
+package git
+
+import (
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/rahul/nsha/pkg/gitdir"
+)
+
+// ObjectFormat is the hash algorithm a repository names its objects with,
+// set by extensions.objectFormat in the repository config
+type ObjectFormat string
+
+const (
+	ObjectFormatSHA1   ObjectFormat = "sha1"
+	ObjectFormatSHA256 ObjectFormat = "sha256"
+)
+
+// DetectObjectFormat reads the object format of the repository at repoPath.
+// Repositories without extensions.objectFormat use SHA-1.
+func DetectObjectFormat(repoPath string) ObjectFormat {
+	return objectFormat(gitdir.ResolveOrDefault(repoPath))
+}
+
+// objectFormat reads extensions.objectFormat from the common directory's config
+func objectFormat(d *gitdir.Dir) ObjectFormat {
+	f, err := os.Open(d.Path("config"))
+	if err != nil {
+		return ObjectFormatSHA1
+	}
+	defer f.Close()
+
+	cfg := config.New()
+	if err := config.NewDecoder(f).Decode(cfg); err != nil {
+		return ObjectFormatSHA1
+	}
+	if format := strings.ToLower(cfg.Section("extensions").Option("objectformat")); format == string(ObjectFormatSHA256) {
+		return ObjectFormatSHA256
+	}
+	return ObjectFormatSHA1
+}
+
+// HexSize returns the length of an object hash in hex characters
+func (f ObjectFormat) HexSize() int {
+	if f == ObjectFormatSHA256 {
+		return 64
+	}
+	return 40
+}
+
+// NullHash returns the all-zero hash git uses for "no object"
+func (f ObjectFormat) NullHash() string {
+	return strings.Repeat("0", f.HexSize())
+}
+
+// EmptyTree returns the hash of the empty tree
+func (f ObjectFormat) EmptyTree() string {
+	if f == ObjectFormatSHA256 {
+		return EmptyTreeHashSHA256
+	}
+	return EmptyTreeHash
+}
+
+// EmptyBlob returns the hash of the empty blob
+func (f ObjectFormat) EmptyBlob() string {
+	if f == ObjectFormatSHA256 {
+		return EmptyBlobHashSHA256
+	}
+	return EmptyBlobHash
+}
+
+// objectFormat returns the object format of the repository
+func (o Options) objectFormat() ObjectFormat {
+	return objectFormat(o.gitDir())
+}
+
+// isNullHash reports whether s is the null hash of either object format
+func isNullHash(s string) bool {
+	if len(s) != ObjectFormatSHA1.HexSize() && len(s) != ObjectFormatSHA256.HexSize() {
+		return false
+	}
+	return strings.Trim(s, "0") == ""
+}
+
+// isHash reports whether s is a full lowercase hex object hash of either
+// object format
+func isHash(s string) bool {
+	if len(s) != ObjectFormatSHA1.HexSize() && len(s) != ObjectFormatSHA256.HexSize() {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
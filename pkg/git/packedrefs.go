@@ -0,0 +1,403 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rahul/nsha/pkg/gitdir"
+)
+
+// packedRefsHeader starts the first line of packed-refs, followed by traits
+// saying how the file was written
+const packedRefsHeader = "# pack-refs with:"
+
+// PackedRef is a reference stored in packed-refs
+type PackedRef struct {
+	Name   string
+	Hash   string // As written, which may not be a valid hash
+	Peeled string // Object an annotated tag peels to, from the "^" line after it
+	Line   int    // Line it was read from, counting from 1; 0 when added since
+}
+
+// PackedRefsLine is a line of packed-refs that is neither a reference nor
+// the peeled value of one
+type PackedRefsLine struct {
+	Line   int
+	Text   string
+	Ref    string // Reference a malformed peeled value follows
+	Reason string
+}
+
+// PackedRefChange is a change to packed-refs and the reason for it
+type PackedRefChange struct {
+	Name    string // Reference changed; empty for lines that are not references
+	Line    int    // Line the entry was read from; 0 for references added
+	OldHash string
+	NewHash string // Empty when the entry is removed
+	Reason  string
+}
+
+func (c PackedRefChange) String() string {
+	switch {
+	case c.Name == "":
+		return fmt.Sprintf("removed line %d: %s", c.Line, c.Reason)
+	case c.NewHash == "":
+		return fmt.Sprintf("removed %s (%s): %s", c.Name, shortHash(c.OldHash), c.Reason)
+	case c.OldHash == "":
+		return fmt.Sprintf("added %s -> %s: %s", c.Name, shortHash(c.NewHash), c.Reason)
+	}
+	return fmt.Sprintf("updated %s %s -> %s: %s", c.Name, shortHash(c.OldHash), shortHash(c.NewHash), c.Reason)
+}
+
+// shortHash shortens a hash for messages
+func shortHash(hash string) string {
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
+}
+
+// PackedRefs is the parsed packed-refs file of a repository. Changes are made
+// in memory, recorded in Changes and written at once by Write.
+type PackedRefs struct {
+	Traits  []string // From the header, e.g. "peeled", "fully-peeled" and "sorted"
+	Refs    []PackedRef
+	Invalid []PackedRefsLine
+	Changes []PackedRefChange
+
+	format   ObjectFormat
+	file     string
+	unpeeled bool // Some reference's peeled value is no longer known
+}
+
+// ReadPackedRefs parses the repository's packed-refs. A repository without
+// one has no packed references.
+func ReadPackedRefs(opts Options) (*PackedRefs, error) {
+	return readPackedRefs(opts.gitDir(), opts.objectFormat())
+}
+
+// readPackedRefs parses the packed-refs of a git directory
+func readPackedRefs(d *gitdir.Dir, format ObjectFormat) (*PackedRefs, error) {
+	file := d.Path("packed-refs")
+	content, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read packed-refs: %w", err)
+	}
+	p := parsePackedRefs(string(content), format)
+	p.file = file
+	return p, nil
+}
+
+// parsePackedRefs parses packed-refs: an optional header, "<hash> <refname>"
+// lines and "^<hash>" lines holding what the reference before them peels to
+func parsePackedRefs(content string, format ObjectFormat) *PackedRefs {
+	p := &PackedRefs{format: format}
+	if content == "" {
+		return p
+	}
+
+	last := -1 // Reference on the previous line, which a peeled value belongs to
+	for i, line := range strings.Split(strings.TrimSuffix(content, "\n"), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		n := i + 1
+		invalid := PackedRefsLine{Line: n, Text: line}
+
+		switch {
+		case i == 0 && strings.HasPrefix(line, packedRefsHeader):
+			p.Traits = strings.Fields(strings.TrimPrefix(line, packedRefsHeader))
+			continue
+		case strings.HasPrefix(line, "^"):
+			switch {
+			case last < 0:
+				invalid.Reason = "peeled value without a reference"
+			case !isRefHash(line[1:], format):
+				invalid.Ref, invalid.Reason = p.Refs[last].Name, "malformed peeled value"
+			default:
+				p.Refs[last].Peeled = line[1:]
+			}
+			last = -1
+		default:
+			last = -1
+			hash, name, ok := strings.Cut(line, " ")
+			if !ok || !strings.HasPrefix(name, "refs/") || !validRefName(name) {
+				invalid.Reason = "not a reference"
+				break
+			}
+			p.Refs = append(p.Refs, PackedRef{Name: name, Hash: hash, Line: n})
+			last = len(p.Refs) - 1
+		}
+
+		if invalid.Reason != "" {
+			p.Invalid = append(p.Invalid, invalid)
+		}
+	}
+	return p
+}
+
+// Lookup returns the first entry of a reference
+func (p *PackedRefs) Lookup(name string) (PackedRef, bool) {
+	for _, ref := range p.Refs {
+		if ref.Name == name {
+			return ref, true
+		}
+	}
+	return PackedRef{}, false
+}
+
+// ValidHash reports whether a reference's hash is a hash of the repository's
+// object format
+func (p *PackedRefs) ValidHash(ref PackedRef) bool {
+	return isRefHash(ref.Hash, p.format)
+}
+
+// Set points a reference at hash, adding it when it is not packed. A peeled
+// value belonged to the old hash and is dropped.
+func (p *PackedRefs) Set(name, hash, reason string) {
+	for i, ref := range p.Refs {
+		if ref.Name != name {
+			continue
+		}
+		if ref.Hash == hash {
+			return
+		}
+		p.Changes = append(p.Changes, PackedRefChange{Name: name, Line: ref.Line, OldHash: ref.Hash, NewHash: hash, Reason: reason})
+		p.Refs[i].Hash, p.Refs[i].Peeled = hash, ""
+		p.unpeeled = true
+		return
+	}
+	p.Changes = append(p.Changes, PackedRefChange{Name: name, NewHash: hash, Reason: reason})
+	p.Refs = append(p.Refs, PackedRef{Name: name, Hash: hash})
+	p.unpeeled = true
+}
+
+// Remove drops every entry of a reference and reports whether there was one
+func (p *PackedRefs) Remove(name, reason string) bool {
+	kept := p.Refs[:0]
+	for _, ref := range p.Refs {
+		if ref.Name == name {
+			p.Changes = append(p.Changes, PackedRefChange{Name: name, Line: ref.Line, OldHash: ref.Hash, Reason: reason})
+			continue
+		}
+		kept = append(kept, ref)
+	}
+	removed := len(kept) < len(p.Refs)
+	p.Refs = kept
+	return removed
+}
+
+// DropInvalid drops the lines that are neither references nor peeled values
+func (p *PackedRefs) DropInvalid() {
+	for _, line := range p.Invalid {
+		p.Changes = append(p.Changes, PackedRefChange{Name: line.Ref, Line: line.Line, Reason: line.Reason})
+		if line.Ref != "" {
+			p.unpeeled = true
+		}
+	}
+	p.Invalid = nil
+}
+
+// Clean removes the entries git cannot use: references with a null or
+// null-like hash, later duplicates of a reference, and lines that are not
+// references. References with a malformed hash are kept so they can be
+// restored from their reflog. It returns the changes it made.
+func (p *PackedRefs) Clean() []PackedRefChange {
+	start := len(p.Changes)
+
+	seen := make(map[string]int)
+	kept := p.Refs[:0]
+	for _, ref := range p.Refs {
+		reason := ""
+		if nullLikeHash(ref.Hash) {
+			reason = "null SHA"
+		} else if line, ok := seen[ref.Name]; ok {
+			reason = fmt.Sprintf("duplicate of line %d", line)
+		}
+		if reason != "" {
+			p.Changes = append(p.Changes, PackedRefChange{Name: ref.Name, Line: ref.Line, OldHash: ref.Hash, Reason: reason})
+			continue
+		}
+		seen[ref.Name] = ref.Line
+		kept = append(kept, ref)
+	}
+	p.Refs = kept
+	p.DropInvalid()
+
+	return p.Changes[start:]
+}
+
+// nullLikeHash reports whether hash is the null hash or one of the variants
+// with only the last digit set that some tools write
+func nullLikeHash(hash string) bool {
+	if len(hash) != ObjectFormatSHA1.HexSize() && len(hash) != ObjectFormatSHA256.HexSize() {
+		return false
+	}
+	return len(strings.TrimLeft(hash, "0")) <= 1
+}
+
+// Peel records what every reference peels to so the file can claim to be
+// fully peeled again. Only annotated tags get a peeled value.
+func (p *PackedRefs) Peel(ctx context.Context, repoPath string) error {
+	var queries []string
+	var refs []int
+	for i, ref := range p.Refs {
+		if p.ValidHash(ref) {
+			queries = append(queries, ref.Hash+"^{}")
+			refs = append(refs, i)
+		}
+	}
+	if len(refs) < len(p.Refs) {
+		return fmt.Errorf("packed-refs has malformed hashes")
+	}
+	if len(queries) == 0 {
+		p.unpeeled = false
+		return nil
+	}
+
+	cmd := gitCommand(ctx, repoPath, "cat-file", "--batch-check=%(objectname)")
+	cmd.Env = append(cmd.Env, "GIT_NO_REPLACE_OBJECTS=1", "GIT_NO_LAZY_FETCH=1")
+	cmd.Stdin = strings.NewReader(strings.Join(queries, "\n") + "\n")
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to peel references: %w", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(output), "\n"), "\n")
+	if len(lines) != len(queries) {
+		return fmt.Errorf("failed to peel references: unexpected output")
+	}
+
+	peeled := make([]string, len(lines))
+	for i, line := range lines {
+		if strings.HasSuffix(line, " missing") {
+			return fmt.Errorf("failed to peel %s: object is missing", p.Refs[refs[i]].Name)
+		}
+		peeled[i] = line
+	}
+	for i, line := range peeled {
+		ref := &p.Refs[refs[i]]
+		ref.Peeled = ""
+		if !strings.EqualFold(line, ref.Hash) {
+			ref.Peeled = line
+		}
+	}
+	p.unpeeled = false
+	if !containsString(p.Traits, "fully-peeled") {
+		p.Traits = append(p.Traits, "peeled", "fully-peeled")
+	}
+	return nil
+}
+
+// Write replaces packed-refs through packed-refs.lock, sorted by name. Lines
+// that are not references are dropped. The header only claims the references
+// are peeled while every peeled value is still known.
+func (p *PackedRefs) Write() error {
+	p.DropInvalid()
+	sort.SliceStable(p.Refs, func(i, j int) bool { return p.Refs[i].Name < p.Refs[j].Name })
+
+	var traits []string
+	if !p.unpeeled {
+		for _, trait := range []string{"peeled", "fully-peeled"} {
+			if containsString(p.Traits, trait) {
+				traits = append(traits, trait)
+			}
+		}
+	}
+	p.Traits = append(traits, "sorted")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s \n", packedRefsHeader, strings.Join(p.Traits, " "))
+	for _, ref := range p.Refs {
+		fmt.Fprintf(&b, "%s %s\n", ref.Hash, ref.Name)
+		if ref.Peeled != "" {
+			fmt.Fprintf(&b, "^%s\n", ref.Peeled)
+		}
+	}
+	return writeLocked(p.file, []byte(b.String()))
+}
+
+// FixPackedRefs removes null SHA entries, duplicates and lines that are not
+// references from packed-refs. A null entry whose reflog still has a readable
+// commit is restored to that commit instead. Every change is recorded in the
+// plan, so it can be logged and previewed.
+func FixPackedRefs(ctx context.Context, opts Options) (int, error) {
+	em := opts.emit()
+
+	// Reftable repositories have no packed-refs
+	if refStorageFormat(opts.gitDir()) == RefStorageReftable {
+		return 0, nil
+	}
+
+	p, err := ReadPackedRefs(opts)
+	if err != nil {
+		return 0, err
+	}
+	if len(p.Refs) == 0 && len(p.Invalid) == 0 {
+		return 0, nil
+	}
+
+	repo, err := openStore(ctx, opts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open repository: %w", err)
+	}
+	defer repo.Close()
+
+	d := opts.gitDir()
+	for _, ref := range p.Refs {
+		if !nullLikeHash(ref.Hash) {
+			continue
+		}
+		if hash := reflogCommit(repo, reflogHashes(d.Path("logs", ref.Name))); hash != "" {
+			p.Set(ref.Name, hash, "null SHA, restored from its reflog")
+		}
+	}
+	p.Clean()
+	if len(p.Changes) == 0 {
+		return 0, nil
+	}
+
+	if opts.DryRun {
+		for _, change := range p.Changes {
+			em.Debugf("[DRY RUN] Would clean up packed-refs: %s", change)
+		}
+		recordPackedRefChanges(opts, p.Changes)
+		return len(p.Changes), nil
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := p.Write(); err != nil {
+		return 0, err
+	}
+	for _, change := range p.Changes {
+		em.Detailf("packed-refs: %s", change)
+		switch {
+		case change.Name == "":
+			opts.Diagnosis.invalidate(subject{subjectRefFile, "packed-refs"})
+		case change.Line > 0 && change.OldHash == "" && change.NewHash == "":
+			// A broken peeled value
+			opts.Diagnosis.invalidate(subject{subjectRefFile, change.Name + "^{}"})
+		default:
+			opts.Diagnosis.InvalidateRef(change.Name)
+		}
+	}
+	recordPackedRefChanges(opts, p.Changes)
+	return len(p.Changes), nil
+}
+
+// recordPackedRefChanges records changes to packed-refs in the plan
+func recordPackedRefChanges(opts Options, changes []PackedRefChange) {
+	for _, change := range changes {
+		c := FixChange{Object: change.Name, OldValue: change.OldHash, NewValue: change.NewHash}
+		switch {
+		case change.Name == "":
+			c.Object, c.Action = "packed-refs", change.String()
+		case change.NewHash == "":
+			c.Action = "remove from packed-refs: " + change.Reason
+		default:
+			c.Action = "set in packed-refs: " + change.Reason
+		}
+		recordChange(opts, c)
+	}
+}
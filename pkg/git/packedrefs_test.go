@@ -0,0 +1,40 @@
+package git
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFixPackedRefsRestoresFromReflog(t *testing.T) {
+	dir := newTestRepo(t)
+	head := commitFile(t, dir, "a.txt", "a\n")
+	runGit(t, dir, "branch", "feature")
+	runGit(t, dir, "tag", "v1")
+	runGit(t, dir, "pack-refs", "--all")
+
+	// The branch has a reflog, the tag does not
+	file := filepath.Join(dir, ".git", "packed-refs")
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	null := strings.Repeat("0", 40)
+	packed := strings.NewReplacer(head+" refs/heads/feature", null+" refs/heads/feature", head+" refs/tags/v1", null+" refs/tags/v1").Replace(string(content))
+	if err := os.WriteFile(file, []byte(packed), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := FixPackedRefs(context.Background(), Options{RepoPath: dir})
+	if err != nil || n != 2 {
+		t.Fatalf("FixPackedRefs = %d, %v", n, err)
+	}
+	if got := runGit(t, dir, "rev-parse", "refs/heads/feature"); got != head {
+		t.Errorf("feature = %s, want %s from its reflog", got, head)
+	}
+	if _, err := tryGit(dir, "rev-parse", "--verify", "-q", "refs/tags/v1"); err == nil {
+		t.Error("null tag without a reflog was not removed")
+	}
+}
@@ -0,0 +1,288 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// packIndexMagic starts version 2 and later pack indexes; version 1 starts
+// directly with the fanout table
+var packIndexMagic = []byte{0xff, 't', 'O', 'c'}
+
+// packIndex is the parsed .idx of a pack: every object it holds and where
+type packIndex struct {
+	version int
+	hashes  []string // Sorted
+	offsets map[string]uint64
+	packSum string // Checksum of the .pack the index belongs to
+}
+
+// openPackIndex reads and validates a pack index of either object format
+func openPackIndex(file string, format ObjectFormat) (*packIndex, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pack index: %w", err)
+	}
+	return parsePackIndex(data, format)
+}
+
+// parsePackIndex parses a version 1 or 2 pack index
+func parsePackIndex(data []byte, format ObjectFormat) (*packIndex, error) {
+	hs := format.HexSize() / 2
+	if len(data) < 2*hs {
+		return nil, fmt.Errorf("pack index is truncated")
+	}
+	if err := verifyTrailer(data, format); err != nil {
+		return nil, fmt.Errorf("pack index %w", err)
+	}
+	end := len(data) - 2*hs
+	idx := &packIndex{version: 1, offsets: make(map[string]uint64)}
+	idx.packSum = hex.EncodeToString(data[end : end+hs])
+
+	fanoutAt := 0
+	if bytes.HasPrefix(data, packIndexMagic) {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("pack index is truncated")
+		}
+		idx.version = int(binary.BigEndian.Uint32(data[4:]))
+		if idx.version != 2 {
+			return nil, fmt.Errorf("unsupported pack index version %d", idx.version)
+		}
+		fanoutAt = 8
+	}
+	count, err := readFanout(data, fanoutAt, end)
+	if err != nil {
+		return nil, err
+	}
+	at := fanoutAt + 256*4
+
+	if idx.version == 1 {
+		// Each entry is a 4-byte offset followed by the hash
+		if at+count*(4+hs) != end {
+			return nil, fmt.Errorf("pack index has the wrong size for %d objects", count)
+		}
+		for i := 0; i < count; i++ {
+			entry := data[at+i*(4+hs):]
+			h := hex.EncodeToString(entry[4 : 4+hs])
+			idx.hashes = append(idx.hashes, h)
+			idx.offsets[h] = uint64(binary.BigEndian.Uint32(entry))
+		}
+		return idx, idx.checkSorted(data, fanoutAt)
+	}
+
+	// Hashes, CRC-32s and 4-byte offsets, then 8-byte offsets for large packs
+	hashesAt, crcAt := at, at+count*hs
+	offsetsAt := crcAt + count*4
+	largeAt := offsetsAt + count*4
+	if largeAt > end || (end-largeAt)%8 != 0 {
+		return nil, fmt.Errorf("pack index has the wrong size for %d objects", count)
+	}
+	large := (end - largeAt) / 8
+	for i := 0; i < count; i++ {
+		h := hex.EncodeToString(data[hashesAt+i*hs : hashesAt+(i+1)*hs])
+		offset := uint64(binary.BigEndian.Uint32(data[offsetsAt+i*4:]))
+		if offset&0x80000000 != 0 {
+			n := int(offset &^ 0x80000000)
+			if n >= large {
+				return nil, fmt.Errorf("object %s has a large offset past the table", h)
+			}
+			offset = binary.BigEndian.Uint64(data[largeAt+n*8:])
+		}
+		idx.hashes = append(idx.hashes, h)
+		idx.offsets[h] = offset
+	}
+	return idx, idx.checkSorted(data, fanoutAt)
+}
+
+// checkSorted checks that the hashes are sorted and match the fanout table
+func (idx *packIndex) checkSorted(data []byte, fanoutAt int) error {
+	for i, h := range idx.hashes {
+		if i > 0 && idx.hashes[i-1] >= h {
+			return fmt.Errorf("pack index is not sorted at %s", h)
+		}
+	}
+	return checkFanout(data[fanoutAt:], idx.hashes)
+}
+
+// readFanout reads the object count from a 256-entry fanout table, checking
+// that its entries never decrease and the table fits before end
+func readFanout(data []byte, at, end int) (int, error) {
+	if at+256*4 > end {
+		return 0, fmt.Errorf("fanout table is truncated")
+	}
+	var prev uint32
+	for i := 0; i < 256; i++ {
+		n := binary.BigEndian.Uint32(data[at+i*4:])
+		if n < prev {
+			return 0, fmt.Errorf("fanout table decreases at %02x", i)
+		}
+		prev = n
+	}
+	return int(prev), nil
+}
+
+// checkFanout checks that a fanout table counts the hashes under each first byte
+func checkFanout(fanout []byte, hashes []string) error {
+	var counts [256]uint32
+	for _, h := range hashes {
+		b, _ := hex.DecodeString(h[:2])
+		counts[b[0]]++
+	}
+	var total uint32
+	for i := 0; i < 256; i++ {
+		total += counts[i]
+		if binary.BigEndian.Uint32(fanout[i*4:]) != total {
+			return fmt.Errorf("fanout table does not match the hashes at %02x", i)
+		}
+	}
+	return nil
+}
+
+// newObjectHash returns the hash function of an object format
+func newObjectHash(format ObjectFormat) hash.Hash {
+	if format == ObjectFormatSHA256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+// verifyTrailer checks the checksum git appends to pack indexes,
+// commit-graphs and multi-pack-indexes: a hash of everything before it
+func verifyTrailer(data []byte, format ObjectFormat) error {
+	hs := format.HexSize() / 2
+	if len(data) < hs {
+		return fmt.Errorf("file is truncated")
+	}
+	h := newObjectHash(format)
+	h.Write(data[:len(data)-hs])
+	if !bytes.Equal(h.Sum(nil), data[len(data)-hs:]) {
+		return fmt.Errorf("checksum mismatch")
+	}
+	return nil
+}
+
+// DamageBadPackIndex marks a pack index that was replaced by a rebuilt one
+const DamageBadPackIndex LooseObjectDamage = "bad-pack-index"
+
+// checkPackIndex checks the index of an intact pack with the given object
+// count and checksum: it must exist, pass its own checksum and describe this
+// pack with the same number of objects. Without a usable index every object
+// in the pack is invisible to git.
+func checkPackIndex(opts Options, packFile string, count int, packSum string) *Issue {
+	format := opts.objectFormat()
+	file := strings.TrimSuffix(packFile, ".pack") + ".idx"
+
+	message := ""
+	idx, err := openPackIndex(file, format)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		message = fmt.Sprintf("Pack has no index, its %d object(s) are invisible to git", count)
+	case err != nil:
+		message = fmt.Sprintf("Index cannot be used: %v", err)
+	case idx.packSum != packSum:
+		message = fmt.Sprintf("Index belongs to pack %s, not this one", shortHash(idx.packSum))
+	case len(idx.hashes) != count:
+		message = fmt.Sprintf("Index lists %d object(s), the pack has %d", len(idx.hashes), count)
+	default:
+		return nil
+	}
+	return &Issue{
+		Type:    IssueTypeBadPackIndex,
+		Object:  filepath.Base(file),
+		Message: message,
+		Path:    repoRelative(opts.RepoPath, file),
+	}
+}
+
+// recheckPackIndex checks the index of a single pack again. A pack that is
+// gone or damaged has no index issue of its own.
+func recheckPackIndex(repoPath, packPath string) []Issue {
+	opts := Options{RepoPath: repoPath}
+	file := filepath.FromSlash(packPath)
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(repoPath, file)
+	}
+	count, sum, err := verifyPackFile(file, opts.objectFormat())
+	if err != nil {
+		return nil
+	}
+	if issue := checkPackIndex(opts, file, count, sum); issue != nil {
+		return []Issue{*issue}
+	}
+	return nil
+}
+
+// FixPackIndexes rebuilds missing and broken pack indexes from their packs
+// with git index-pack, so that the objects in them are visible again before
+// any reference is judged missing. A broken index is quarantined first and
+// put back if the rebuild fails.
+func FixPackIndexes(ctx context.Context, opts Options) (int, error) {
+	em := opts.emit()
+
+	issues, err := planned(opts, func() ([]Issue, error) {
+		return diagnosedIssues(ctx, opts, IssueTypeBadPackIndex, checkPacks)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	fixedCount := 0
+	for _, issue := range issues {
+		if err := ctx.Err(); err != nil {
+			return fixedCount, err
+		}
+		if opts.DryRun {
+			em.Debugf("[DRY RUN] Would rebuild %s from its pack: %s", issue.Path, issue.Message)
+			fixedCount++
+			continue
+		}
+
+		file := filepath.FromSlash(issue.Path)
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(opts.RepoPath, file)
+		}
+		var quarantined *QuarantinedObject
+		if _, err := os.Stat(file); err == nil {
+			entry, err := quarantineFile(opts, file, "", DamageBadPackIndex)
+			if err != nil {
+				em.Warnf("Failed to quarantine %s: %v", issue.Object, err)
+				continue
+			}
+			quarantined = &entry
+		}
+
+		em.Debugf("Rebuilding %s...", issue.Object)
+		pack := strings.TrimSuffix(file, ".idx") + ".pack"
+		output, err := runGitProgress(ctx, opts, "index-pack", pack)
+		var idx *packIndex
+		if err == nil {
+			idx, err = openPackIndex(file, opts.objectFormat())
+		}
+		if err != nil {
+			em.Warnf("Failed to rebuild %s: %s", issue.Object, lastLine(output))
+			os.Remove(file)
+			if quarantined != nil {
+				if _, err := RestoreQuarantine(opts, []string{quarantined.ID}, true); err != nil {
+					em.Warnf("Failed to put back %s: %v", issue.Object, err)
+				}
+			}
+			continue
+		}
+		em.Debugf("Rebuilt %s", issue.Object)
+		fixedCount++
+		// Objects that were invisible may resolve many issues at once
+		opts.Diagnosis.invalidate(subject{subjectPackIndex, strings.TrimSuffix(issue.Path, ".idx") + ".pack"})
+		opts.Diagnosis.InvalidateObjects(idx.hashes)
+	}
+	return fixedCount, nil
+}
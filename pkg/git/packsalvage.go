@@ -0,0 +1,790 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rahul/nsha/pkg/gitdir"
+)
+
+// Pack object types as stored in pack entry headers
+const (
+	packCommit   = 1
+	packTree     = 2
+	packBlob     = 3
+	packTag      = 4
+	packOfsDelta = 6
+	packRefDelta = 7
+)
+
+// packObjectKinds names the pack object types that are not deltas
+var packObjectKinds = map[int]string{
+	packCommit: "commit",
+	packTree:   "tree",
+	packBlob:   "blob",
+	packTag:    "tag",
+}
+
+// DamageCorruptPack marks a damaged pack and its companion files in quarantine
+const DamageCorruptPack LooseObjectDamage = "corrupt-pack"
+
+// packEntry is an object read from a pack: its content, or the delta
+// against the base at baseOffset or named baseHash
+type packEntry struct {
+	offset     int
+	end        int // Offset of the next entry
+	kind       int
+	data       []byte
+	baseOffset int
+	baseHash   string
+}
+
+// packRegion is a byte range of a pack that holds no readable entry
+type packRegion struct {
+	start, end int
+}
+
+func (r packRegion) String() string {
+	return fmt.Sprintf("%d-%d", r.start, r.end)
+}
+
+// packWalk is what a sequential read of a pack found
+type packWalk struct {
+	count   int // Object count from the header, -1 if the header is damaged
+	damaged []packRegion
+}
+
+// packObject is an object with its type and content
+type packObject struct {
+	kind string
+	data []byte
+}
+
+// packFiles lists the packs of the repository
+func packFiles(d *gitdir.Dir) []string {
+	files, _ := filepath.Glob(d.Path("objects", "pack", "pack-*.pack"))
+	sort.Strings(files)
+	return files
+}
+
+// checkPacks finds packs whose trailing checksum does not match their
+// content, and intact packs whose index is missing or broken. git fsck stops
+// trusting a damaged pack and every command that reads a damaged object
+// from it fails. Packs are streamed through their checksum; only damaged
+// ones are walked.
+func checkPacks(ctx context.Context, opts Options) ([]Issue, error) {
+	format := opts.objectFormat()
+
+	var issues []Issue
+	for _, file := range packFiles(opts.gitDir()) {
+		if err := ctx.Err(); err != nil {
+			return issues, err
+		}
+		count, sum, err := verifyPackFile(file, format)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			if issue := checkPackIndex(opts, file, count, sum); issue != nil {
+				issues = append(issues, *issue)
+			}
+			continue
+		}
+
+		message := "Pack checksum mismatch"
+		walk, err := walkPackFile(file, format, nil)
+		if err != nil {
+			continue
+		}
+		if walk.count < 0 {
+			message = "Pack header is damaged"
+		}
+		if len(walk.damaged) > 0 {
+			message += fmt.Sprintf(", %d undecodable region(s) at bytes %s", len(walk.damaged), joinRegions(walk.damaged))
+		}
+		issues = append(issues, Issue{
+			Type:    IssueTypeCorruptPack,
+			Object:  filepath.Base(file),
+			Message: message,
+			Path:    repoRelative(opts.RepoPath, file),
+		})
+	}
+	return issues, nil
+}
+
+// verifyPackFile streams a pack through the checksum git appends to it. It
+// returns the object count the header gives and the checksum, or an error
+// when the pack is damaged.
+func verifyPackFile(file string, format ObjectFormat) (int, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+
+	hs := format.HexSize() / 2
+	if info.Size() < int64(12+hs) {
+		return 0, "", fmt.Errorf("file is truncated")
+	}
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, "", err
+	}
+	if string(header[:4]) != "PACK" {
+		return 0, "", fmt.Errorf("pack header is damaged")
+	}
+	h := newObjectHash(format)
+	h.Write(header)
+	if _, err := io.Copy(h, io.LimitReader(f, info.Size()-int64(12+hs))); err != nil {
+		return 0, "", err
+	}
+	sum := make([]byte, hs)
+	if _, err := io.ReadFull(f, sum); err != nil {
+		return 0, "", err
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return 0, "", fmt.Errorf("checksum mismatch")
+	}
+	return int(binary.BigEndian.Uint32(header[8:])), hex.EncodeToString(sum), nil
+}
+
+// joinRegions lists damaged regions, the first few of them when there are many
+func joinRegions(regions []packRegion) string {
+	var parts []string
+	for i, r := range regions {
+		if i == 5 {
+			parts = append(parts, fmt.Sprintf("and %d more", len(regions)-i))
+			break
+		}
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// packIndexOffsets returns the sorted entry offsets from a pack's index, or
+// nil when the index cannot be read. They let the walk skip straight past
+// a damaged entry.
+func packIndexOffsets(packFile string, format ObjectFormat) []int {
+	idx, err := openPackIndex(strings.TrimSuffix(packFile, ".pack")+".idx", format)
+	if err != nil {
+		return nil
+	}
+	offsets := make([]int, 0, len(idx.offsets))
+	for _, offset := range idx.offsets {
+		offsets = append(offsets, int(offset))
+	}
+	sort.Ints(offsets)
+	return offsets
+}
+
+// walkPackFile walks a pack file with the offsets from its index
+func walkPackFile(file string, format ObjectFormat, visit func(packEntry)) (*packWalk, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return walkPack(f, int(info.Size()), format, packIndexOffsets(file, format), visit), nil
+}
+
+// walkPack reads a pack entry by entry without relying on its index, and
+// hands each entry to visit as soon as it is decoded. Entries that cannot
+// be decoded are skipped up to the next offset the index lists, or else the
+// next byte where a complete entry decodes, and the bytes in between are
+// recorded as damaged.
+func walkPack(pack io.ReaderAt, size int, format ObjectFormat, offsets []int, visit func(packEntry)) *packWalk {
+	walk := &packWalk{count: -1}
+	hs := format.HexSize() / 2
+	end := size - hs
+	header := make([]byte, 12)
+	if n, _ := pack.ReadAt(header, 0); n == 12 && string(header[:4]) == "PACK" {
+		if version := binary.BigEndian.Uint32(header[4:]); version == 2 || version == 3 {
+			walk.count = int(binary.BigEndian.Uint32(header[8:]))
+		}
+	}
+	if end < 12 {
+		if size > 0 {
+			walk.damaged = append(walk.damaged, packRegion{0, size})
+		}
+		return walk
+	}
+
+	pos := 12
+	for pos < end {
+		entry, err := decodePackEntry(pack, pos, end, hs)
+		if err == nil {
+			if visit != nil {
+				visit(entry)
+			}
+			pos = entry.end
+			continue
+		}
+
+		next := end
+		for _, offset := range offsets {
+			if offset > pos && offset < end {
+				next = offset
+				break
+			}
+		}
+		if offsets == nil {
+			for at := pos + 1; at < end; at++ {
+				if _, err := decodePackEntry(pack, at, end, hs); err == nil {
+					next = at
+					break
+				}
+			}
+		}
+		walk.damaged = append(walk.damaged, packRegion{pos, next})
+		pos = next
+	}
+	return walk
+}
+
+// countingReader counts the bytes read through it. It is an io.ByteReader,
+// so inflating reads no further than the end of the zlib stream.
+type countingReader struct {
+	r *bufio.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// decodePackEntry decodes the entry at offset pos of a pack, which ends
+// before end: its header, delta base and compressed content, which must
+// inflate to exactly the size the header gives. On inflate errors the entry
+// holds what did inflate.
+func decodePackEntry(pack io.ReaderAt, pos, end, hashSize int) (packEntry, error) {
+	entry := packEntry{offset: pos}
+	if pos >= end {
+		return entry, io.ErrUnexpectedEOF
+	}
+	r := &countingReader{r: bufio.NewReader(io.NewSectionReader(pack, int64(pos), int64(end-pos)))}
+	next := func() (byte, error) {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return c, err
+	}
+
+	c, err := next()
+	if err != nil {
+		return entry, err
+	}
+	entry.kind = int(c>>4) & 7
+	size := uint64(c & 0x0f)
+	for shift := 4; c&0x80 != 0; shift += 7 {
+		if shift > 60 {
+			return entry, fmt.Errorf("object size is too large")
+		}
+		if c, err = next(); err != nil {
+			return entry, err
+		}
+		size |= uint64(c&0x7f) << shift
+	}
+
+	switch entry.kind {
+	case packCommit, packTree, packBlob, packTag:
+	case packOfsDelta:
+		// Big-endian base-128 with an offset added per continuation byte
+		if c, err = next(); err != nil {
+			return entry, err
+		}
+		back := int(c & 0x7f)
+		for c&0x80 != 0 {
+			if c, err = next(); err != nil {
+				return entry, err
+			}
+			if back > (1<<48)>>7 {
+				return entry, fmt.Errorf("delta base offset is too large")
+			}
+			back = (back+1)<<7 | int(c&0x7f)
+		}
+		if back <= 0 || back > pos-12 {
+			return entry, fmt.Errorf("delta base offset %d is outside the pack", back)
+		}
+		entry.baseOffset = pos - back
+	case packRefDelta:
+		base := make([]byte, hashSize)
+		if _, err := io.ReadFull(r, base); err != nil {
+			return entry, io.ErrUnexpectedEOF
+		}
+		entry.baseHash = hex.EncodeToString(base)
+	default:
+		return entry, fmt.Errorf("invalid object type %d", entry.kind)
+	}
+
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return entry, err
+	}
+	content, err := io.ReadAll(io.LimitReader(zr, int64(size)+1))
+	entry.data = content
+	if err != nil {
+		return entry, err
+	}
+	if uint64(len(content)) != size {
+		return entry, fmt.Errorf("object inflates to %d bytes, the header says %d", len(content), size)
+	}
+	// Reading to the end verifies the zlib checksum
+	if _, err := zr.Read(make([]byte, 1)); err != io.EOF {
+		return entry, fmt.Errorf("object does not end where its header says")
+	}
+	entry.end = pos + r.n
+	return entry, nil
+}
+
+// applyDelta rebuilds an object from its delta base and a git delta: the
+// base and result sizes followed by copy and insert instructions
+func applyDelta(base, delta []byte) ([]byte, error) {
+	at := 0
+	size := func() (int, error) {
+		n, shift := 0, 0
+		for {
+			if at >= len(delta) || shift > 56 {
+				return 0, fmt.Errorf("delta is truncated")
+			}
+			c := delta[at]
+			at++
+			n |= int(c&0x7f) << shift
+			shift += 7
+			if c&0x80 == 0 {
+				return n, nil
+			}
+		}
+	}
+
+	baseSize, err := size()
+	if err != nil {
+		return nil, err
+	}
+	if baseSize != len(base) {
+		return nil, fmt.Errorf("delta expects a %d byte base, got %d", baseSize, len(base))
+	}
+	resultSize, err := size()
+	if err != nil {
+		return nil, err
+	}
+	// No instruction adds more than a copy's 64 KiB, so a corrupt size is
+	// caught before it is allocated
+	if resultSize < 0 || resultSize > (len(delta)-at)*0x10000 {
+		return nil, fmt.Errorf("delta result size %d is impossible for a %d byte delta", resultSize, len(delta))
+	}
+
+	result := make([]byte, 0, resultSize)
+	for at < len(delta) {
+		op := delta[at]
+		at++
+		switch {
+		case op&0x80 != 0:
+			// Copy: which offset and size bytes follow is in the low bits
+			var offset, n int
+			for i := 0; i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				if at >= len(delta) {
+					return nil, fmt.Errorf("delta is truncated")
+				}
+				if i < 4 {
+					offset |= int(delta[at]) << (8 * i)
+				} else {
+					n |= int(delta[at]) << (8 * (i - 4))
+				}
+				at++
+			}
+			if n == 0 {
+				n = 0x10000
+			}
+			if offset+n > len(base) {
+				return nil, fmt.Errorf("delta copies past the end of its base")
+			}
+			result = append(result, base[offset:offset+n]...)
+		case op != 0:
+			// Insert the next op bytes
+			if at+int(op) > len(delta) {
+				return nil, fmt.Errorf("delta is truncated")
+			}
+			result = append(result, delta[at:at+int(op)]...)
+			at += int(op)
+		default:
+			return nil, fmt.Errorf("delta has a reserved instruction")
+		}
+		if len(result) > resultSize {
+			return nil, fmt.Errorf("delta produces more than the %d bytes it expects", resultSize)
+		}
+	}
+	if len(result) != resultSize {
+		return nil, fmt.Errorf("delta produced %d bytes, expected %d", len(result), resultSize)
+	}
+	return result, nil
+}
+
+// packSalvage stores the objects recovered from a pack as loose objects as
+// soon as they are decoded. Only deltas whose base has not turned up yet
+// stay in memory; bases are read back from their loose files.
+type packSalvage struct {
+	dir      *gitdir.Dir
+	format   ObjectFormat
+	kinds    map[string]string     // Type of each recovered object
+	external map[string]packObject // Delta bases read from the rest of the repository
+	byOffset map[int]string
+	pending  []packEntry // Deltas whose base is not recovered (yet)
+	result   *packSalvageResult
+	errs     []error
+}
+
+// visit stores a whole object, or a delta once its base is recovered
+func (s *packSalvage) visit(e packEntry) {
+	if kind, ok := packObjectKinds[e.kind]; ok {
+		s.store(e.offset, packObject{kind: kind, data: e.data})
+		return
+	}
+	if !s.apply(e) {
+		s.pending = append(s.pending, e)
+	}
+}
+
+// resolve applies the pending deltas for as long as their bases turn up
+func (s *packSalvage) resolve() {
+	for progress := true; progress; {
+		progress = false
+		var waiting []packEntry
+		for _, e := range s.pending {
+			if s.apply(e) {
+				progress = true
+			} else {
+				waiting = append(waiting, e)
+			}
+		}
+		s.pending = waiting
+	}
+}
+
+// apply rebuilds and stores a delta. It returns false when its base is not
+// recovered; corrupt deltas can never be applied and are dropped.
+func (s *packSalvage) apply(e packEntry) bool {
+	hash := e.baseHash
+	if e.kind == packOfsDelta {
+		hash = s.byOffset[e.baseOffset]
+	}
+	base, ok := s.external[hash]
+	if !ok {
+		kind, recovered := s.kinds[hash]
+		if !recovered {
+			return false
+		}
+		data, err := readLooseObject(s.dir, hash, kind)
+		if err != nil {
+			s.errs = append(s.errs, err)
+			return true
+		}
+		base = packObject{kind: kind, data: data}
+	}
+
+	data, err := applyDelta(base.data, e.data)
+	if err == nil {
+		s.store(e.offset, packObject{kind: base.kind, data: data})
+	}
+	return true
+}
+
+// store writes a recovered object out as a loose object
+func (s *packSalvage) store(offset int, obj packObject) {
+	hash := hashObject(s.format, obj.kind, obj.data)
+	s.byOffset[offset] = hash
+	if _, ok := s.kinds[hash]; ok {
+		return
+	}
+	_, statErr := os.Stat(s.dir.ObjectPath(hash))
+	if _, err := writeLooseObject(s.dir, s.format, obj); err != nil {
+		s.errs = append(s.errs, err)
+		return
+	}
+	if statErr != nil {
+		s.result.Written++
+	}
+	s.result.Recovered++
+	s.result.Objects = append(s.result.Objects, hash)
+	s.kinds[hash] = obj.kind
+}
+
+// hashObject returns the object ID of content of the given type
+func hashObject(format ObjectFormat, kind string, data []byte) string {
+	h := newObjectHash(format)
+	fmt.Fprintf(h, "%s %d\x00", kind, len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readLooseObject returns the content of a loose object of the given type
+func readLooseObject(d *gitdir.Dir, hash, kind string) ([]byte, error) {
+	f, err := os.Open(d.ObjectPath(hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %s: %w", hash, err)
+	}
+	defer f.Close()
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %s: %w", hash, err)
+	}
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %s: %w", hash, err)
+	}
+	header, data, ok := bytes.Cut(content, []byte{0})
+	if !ok || !strings.HasPrefix(string(header), kind+" ") {
+		return nil, fmt.Errorf("object %s is not a %s", hash, kind)
+	}
+	return data, nil
+}
+
+// writeLooseObject stores an object as a loose object unless it already is
+func writeLooseObject(d *gitdir.Dir, format ObjectFormat, obj packObject) (string, error) {
+	hash := hashObject(format, obj.kind, obj.data)
+	dir := d.Path("objects", hash[:2])
+	file := filepath.Join(dir, hash[2:])
+	if _, err := os.Stat(file); err == nil {
+		return hash, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return hash, fmt.Errorf("failed to write object %s: %w", hash, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "tmp_obj_")
+	if err != nil {
+		return hash, fmt.Errorf("failed to write object %s: %w", hash, err)
+	}
+	defer os.Remove(tmp.Name())
+	zw := zlib.NewWriter(tmp)
+	fmt.Fprintf(zw, "%s %d\x00", obj.kind, len(obj.data))
+	zw.Write(obj.data)
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		return hash, fmt.Errorf("failed to write object %s: %w", hash, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return hash, fmt.Errorf("failed to write object %s: %w", hash, err)
+	}
+	os.Chmod(tmp.Name(), 0444)
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return hash, fmt.Errorf("failed to write object %s: %w", hash, err)
+	}
+	return hash, nil
+}
+
+// readObjects reads objects from the repository with git cat-file, leaving
+// out the ones it does not have
+func readObjects(ctx context.Context, repoPath string, hashes []string) (map[string]packObject, error) {
+	objects := make(map[string]packObject)
+	if len(hashes) == 0 {
+		return objects, nil
+	}
+
+	cmd := gitCommand(ctx, repoPath, "cat-file", "--batch")
+	cmd.Env = append(cmd.Env, "GIT_NO_REPLACE_OBJECTS=1", "GIT_NO_LAZY_FETCH=1")
+	cmd.Stdin = strings.NewReader(strings.Join(hashes, "\n") + "\n")
+	output, err := cmd.Output()
+	if err != nil && len(output) == 0 {
+		return objects, fmt.Errorf("git cat-file: %w", err)
+	}
+
+	// "<hash> <type> <size>\n<content>\n", or "<hash> missing\n"
+	r := bufio.NewReader(bytes.NewReader(output))
+	for {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			continue
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			break
+		}
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(r, data); err != nil {
+			break
+		}
+		objects[fields[0]] = packObject{kind: fields[1], data: data[:size]}
+	}
+	return objects, nil
+}
+
+// packSalvageResult says what salvaging a pack recovered and lost
+type packSalvageResult struct {
+	Recovered  int
+	Objects    []string     // Hashes of the recovered objects
+	Written    int          // Recovered objects that were not loose already
+	Lost       []string     // Objects the pack index lists that were not recovered
+	Unresolved int          // Deltas whose base was not recovered
+	Damaged    []packRegion // Byte ranges no entry could be decoded from
+}
+
+// salvagePack writes every object that can still be read from a damaged
+// pack out as a loose object, then moves the pack and its companion files
+// into quarantine. Deltas against objects outside the pack are applied once
+// the pack is out of the way, with bases from the rest of the repository.
+func salvagePack(ctx context.Context, opts Options, file string) (*packSalvageResult, error) {
+	format := opts.objectFormat()
+
+	var listed []string
+	if idx, err := openPackIndex(strings.TrimSuffix(file, ".pack")+".idx", format); err == nil {
+		listed = idx.hashes
+	}
+
+	result := &packSalvageResult{}
+	s := &packSalvage{
+		dir:      opts.gitDir(),
+		format:   format,
+		kinds:    make(map[string]string),
+		byOffset: make(map[int]string),
+		result:   result,
+	}
+	walk, err := walkPackFile(file, format, s.visit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pack: %w", err)
+	}
+	result.Damaged = walk.damaged
+	s.resolve()
+	if err := errors.Join(s.errs...); err != nil {
+		return result, err
+	}
+
+	base := strings.TrimSuffix(file, ".pack")
+	companions, _ := filepath.Glob(base + ".*")
+	for _, f := range companions {
+		if _, err := quarantineFile(opts, f, "", DamageCorruptPack); err != nil {
+			return result, err
+		}
+	}
+
+	// Bases of the remaining deltas may be in other packs or loose
+	var external []string
+	seen := make(map[string]bool)
+	for _, e := range s.pending {
+		if e.kind == packRefDelta && !seen[e.baseHash] {
+			seen[e.baseHash] = true
+			external = append(external, e.baseHash)
+		}
+	}
+	if len(external) > 0 {
+		bases, err := readObjects(ctx, opts.RepoPath, external)
+		if err != nil {
+			opts.emit().Debugf("Cannot read delta bases: %v", err)
+		}
+		s.external = bases
+		s.resolve()
+		s.external = nil
+		if err := errors.Join(s.errs...); err != nil {
+			return result, err
+		}
+	}
+
+	result.Unresolved = len(s.pending)
+	for _, hash := range listed {
+		if _, ok := s.kinds[hash]; !ok {
+			result.Lost = append(result.Lost, hash)
+		}
+	}
+	return result, nil
+}
+
+// FixCorruptPacks salvages the readable objects of damaged packs as loose
+// objects and quarantines the packs. Objects in undecodable regions stay
+// missing and are left to the reference and history fixers.
+func FixCorruptPacks(ctx context.Context, opts Options) (int, error) {
+	em := opts.emit()
+
+	issues, err := planned(opts, func() ([]Issue, error) {
+		return diagnosedIssues(ctx, opts, IssueTypeCorruptPack, checkPacks)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	fixedCount := 0
+	for _, issue := range issues {
+		if err := ctx.Err(); err != nil {
+			return fixedCount, err
+		}
+		if opts.DryRun {
+			em.Debugf("[DRY RUN] Would salvage the readable objects of %s and quarantine it: %s", issue.Path, issue.Message)
+			fixedCount++
+			continue
+		}
+
+		file := filepath.FromSlash(issue.Path)
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(opts.RepoPath, file)
+		}
+		em.Infof("Salvaging objects from %s...", issue.Object)
+		result, err := salvagePack(ctx, opts, file)
+		if result == nil {
+			em.Warnf("Failed to salvage %s: %v", issue.Object, err)
+			continue
+		}
+		for _, r := range result.Damaged {
+			em.Warnf("Bytes %s of %s cannot be decoded", r, issue.Object)
+		}
+		// Recovered objects are readable again. Lost ones are missing, and
+		// only git fsck can tell which trees or tags still refer to them.
+		opts.Diagnosis.invalidate(subject{subjectPath, issue.Path})
+		opts.Diagnosis.InvalidateObjects(result.Objects)
+		if len(result.Lost) > 0 {
+			opts.Diagnosis.InvalidateAll()
+		}
+		if err != nil {
+			em.Warnf("Failed to salvage %s: %v", issue.Object, err)
+			continue
+		}
+
+		em.Successf("Recovered %d object(s) from %s, %d of them not stored elsewhere", result.Recovered, issue.Object, result.Written)
+		if result.Unresolved > 0 {
+			em.Warnf("%d delta(s) in %s have no surviving base", result.Unresolved, issue.Object)
+		}
+		if len(result.Lost) > 0 {
+			em.Warnf("%d object(s) of %s could not be recovered, e.g. %s", len(result.Lost), issue.Object, result.Lost[0])
+			for _, hash := range result.Lost {
+				em.Debugf("Lost object: %s", hash)
+			}
+		}
+		fixedCount++
+	}
+	return fixedCount, nil
+}
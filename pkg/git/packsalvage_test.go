@@ -0,0 +1,462 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rahul/nsha/pkg/gitdir"
+)
+
+// newPackedRepo creates a repository whose history is in a single pack with
+// deltas. With refDeltas the deltas name their base by hash instead of offset.
+func newPackedRepo(t *testing.T, refDeltas bool) (string, string) {
+	t.Helper()
+	dir := newTestRepo(t)
+	var lines []string
+	for i := 0; i < 200; i++ {
+		lines = append(lines, strings.Repeat("line of text ", 4)+string(rune('a'+i%26)))
+	}
+	for i := 0; i < 6; i++ {
+		lines[i*30] = "changed in commit " + string(rune('0'+i))
+		commitFile(t, dir, "file.txt", strings.Join(lines, "\n"))
+		commitFile(t, dir, "dir/other.txt", strings.Join(lines[i:], "\n"))
+	}
+	runGit(t, dir, "tag", "-a", "-m", "Release", "v1")
+	runGit(t, dir, "config", "repack.useDeltaBaseOffset", map[bool]string{true: "false", false: "true"}[refDeltas])
+	runGit(t, dir, "repack", "-q", "-a", "-d", "-f")
+
+	packs, _ := filepath.Glob(filepath.Join(dir, ".git", "objects", "pack", "pack-*.pack"))
+	if len(packs) != 1 {
+		t.Fatalf("want one pack, found %d", len(packs))
+	}
+	return dir, packs[0]
+}
+
+// resolvePack decodes every entry of a pack and applies its deltas. It
+// returns the objects by hash and how many entries were deltas.
+func resolvePack(t *testing.T, pack []byte, format ObjectFormat) (map[string]packObject, *packWalk, int) {
+	t.Helper()
+	var entries []packEntry
+	walk := walkPack(bytes.NewReader(pack), len(pack), format, nil, func(e packEntry) {
+		entries = append(entries, e)
+	})
+
+	objects := make(map[string]packObject)
+	byOffset := make(map[int]string)
+	deltas := 0
+	for _, e := range entries {
+		if e.kind == packOfsDelta || e.kind == packRefDelta {
+			deltas++
+		}
+	}
+	for progress := true; progress; {
+		progress = false
+		for _, e := range entries {
+			if _, done := objects[byOffset[e.offset]]; done && byOffset[e.offset] != "" {
+				continue
+			}
+			obj := packObject{kind: packObjectKinds[e.kind], data: e.data}
+			if obj.kind == "" {
+				base, ok := objects[e.baseHash]
+				if e.kind == packOfsDelta {
+					base, ok = objects[byOffset[e.baseOffset]]
+				}
+				if !ok {
+					continue
+				}
+				data, err := applyDelta(base.data, e.data)
+				if err != nil {
+					t.Fatalf("entry at %d: %v", e.offset, err)
+				}
+				obj = packObject{kind: base.kind, data: data}
+			}
+			hash := hashObject(format, obj.kind, obj.data)
+			objects[hash] = obj
+			byOffset[e.offset] = hash
+			progress = true
+		}
+	}
+	if len(byOffset) != len(entries) {
+		t.Fatalf("resolved %d of %d entries", len(byOffset), len(entries))
+	}
+	return objects, walk, deltas
+}
+
+func TestWalkPackMatchesGit(t *testing.T) {
+	for _, refDeltas := range []bool{false, true} {
+		name := map[bool]string{false: "ofs-delta", true: "ref-delta"}[refDeltas]
+		t.Run(name, func(t *testing.T) {
+			dir, file := newPackedRepo(t, refDeltas)
+			pack, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			objects, walk, deltas := resolvePack(t, pack, ObjectFormatSHA1)
+			if len(walk.damaged) > 0 {
+				t.Errorf("intact pack has damaged regions %v", walk.damaged)
+			}
+			if walk.count != len(objects) {
+				t.Errorf("header counts %d objects, walked %d", walk.count, len(objects))
+			}
+			if deltas == 0 {
+				t.Fatal("pack has no deltas to test")
+			}
+
+			// Every object git lists must decode to the content git has
+			idx, err := openPackIndex(strings.TrimSuffix(file, ".pack")+".idx", ObjectFormatSHA1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(idx.hashes) != len(objects) {
+				t.Errorf("index lists %d objects, decoded %d", len(idx.hashes), len(objects))
+			}
+			for _, hash := range idx.hashes {
+				obj, ok := objects[hash]
+				if !ok {
+					t.Errorf("object %s was not decoded", hash)
+					continue
+				}
+				if kind := runGit(t, dir, "cat-file", "-t", hash); kind != obj.kind {
+					t.Errorf("object %s decoded as %s, git says %s", hash, obj.kind, kind)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyPackFile(t *testing.T) {
+	_, file := newPackedRepo(t, false)
+	count, sum, err := verifyPackFile(file, ObjectFormatSHA1)
+	if err != nil {
+		t.Fatalf("intact pack: %v", err)
+	}
+	idx, err := openPackIndex(strings.TrimSuffix(file, ".pack")+".idx", ObjectFormatSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(idx.hashes) || sum != idx.packSum {
+		t.Errorf("got %d objects with checksum %s, index has %d and %s", count, sum, len(idx.hashes), idx.packSum)
+	}
+
+	pack, _ := os.ReadFile(file)
+	pack[len(pack)/2] ^= 0xff
+	damaged := filepath.Join(t.TempDir(), "pack-damaged.pack")
+	if err := os.WriteFile(damaged, pack, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := verifyPackFile(damaged, ObjectFormatSHA1); err == nil {
+		t.Error("damaged pack passed its checksum")
+	}
+}
+
+func TestWalkPackTruncated(t *testing.T) {
+	_, file := newPackedRepo(t, false)
+	pack, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, _, _ := resolvePack(t, pack, ObjectFormatSHA1)
+
+	for size := 0; size < len(pack); size += 7 {
+		// Entries and damaged regions must cover everything up to the trailer
+		var regions []packRegion
+		walk := walkPack(bytes.NewReader(pack[:size]), size, ObjectFormatSHA1, nil, func(e packEntry) {
+			regions = append(regions, packRegion{e.offset, e.end})
+		})
+		if len(regions) > len(objects) {
+			t.Fatalf("%d bytes: decoded %d entries from a pack of %d", size, len(regions), len(objects))
+		}
+		regions = append(regions, walk.damaged...)
+		sort.Slice(regions, func(i, j int) bool { return regions[i].start < regions[j].start })
+		pos, end := 12, size-20
+		if end < 12 {
+			pos, end = 0, size
+		}
+		for _, r := range regions {
+			if r.start != pos {
+				t.Fatalf("%d bytes: bytes %d-%d are not accounted for", size, pos, r.start)
+			}
+			pos = r.end
+		}
+		if pos != end {
+			t.Fatalf("%d bytes: walk stopped at %d, the pack ends at %d", size, pos, end)
+		}
+	}
+}
+
+func TestWalkPackSkipsDamage(t *testing.T) {
+	_, file := newPackedRepo(t, false)
+	pack, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, _, _ := resolvePack(t, pack, ObjectFormatSHA1)
+	offsets := packIndexOffsets(file, ObjectFormatSHA1)
+
+	// Overwrite the middle of the largest entry
+	start, end := 0, 0
+	for i, offset := range offsets {
+		next := len(pack) - 20
+		if i+1 < len(offsets) {
+			next = offsets[i+1]
+		}
+		if next-offset > end-start {
+			start, end = offset, next
+		}
+	}
+	for i := start + (end-start)/2; i < end-1; i++ {
+		pack[i] = 0xaa
+	}
+
+	for _, index := range []struct {
+		name    string
+		offsets []int
+	}{{"with index", offsets}, {"without index", nil}} {
+		t.Run(index.name, func(t *testing.T) {
+			decoded := 0
+			walk := walkPack(bytes.NewReader(pack), len(pack), ObjectFormatSHA1, index.offsets, func(e packEntry) {
+				decoded++
+			})
+			if len(walk.damaged) == 0 || walk.damaged[0].start != start {
+				t.Fatalf("want damage from %d, got %v", start, walk.damaged)
+			}
+			if decoded != len(objects)-1 {
+				t.Errorf("decoded %d entries, want all %d but the damaged one", decoded, len(objects)-1)
+			}
+		})
+	}
+}
+
+func TestSalvagePack(t *testing.T) {
+	dir, file := newPackedRepo(t, false)
+	pack, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := openPackIndex(strings.TrimSuffix(file, ".pack")+".idx", ObjectFormatSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Damage the last entry, which nothing else in the pack is a delta of
+	offsets := packIndexOffsets(file, ObjectFormatSHA1)
+	last := offsets[len(offsets)-1]
+	pack[last+(len(pack)-20-last)/2] ^= 0xff
+	if err := os.WriteFile(file, pack, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := salvagePack(context.Background(), Options{RepoPath: dir}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Damaged) == 0 {
+		t.Error("no damaged region reported")
+	}
+	if result.Recovered+len(result.Lost) != len(idx.hashes) || len(result.Lost) != 1 {
+		t.Errorf("recovered %d and lost %v of %d objects", result.Recovered, result.Lost, len(idx.hashes))
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Error("damaged pack was not moved into quarantine")
+	}
+	for _, hash := range idx.hashes {
+		if len(result.Lost) > 0 && hash == result.Lost[0] {
+			continue
+		}
+		if _, err := tryGit(dir, "cat-file", "-e", hash); err != nil {
+			t.Errorf("salvaged object %s cannot be read by git", hash)
+		}
+	}
+}
+
+func TestFixCorruptPacksReportsLostObjects(t *testing.T) {
+	dir := newTestRepo(t)
+	commitFile(t, dir, "old.txt", "only in the first commit\n")
+	runGit(t, dir, "rm", "-q", "old.txt")
+	runGit(t, dir, "commit", "-q", "-m", "Remove old.txt")
+	commitFile(t, dir, "new.txt", "new\n")
+	lost := runGit(t, dir, "rev-parse", "HEAD~2:old.txt")
+	runGit(t, dir, "repack", "-q", "-a", "-d", "-f", "--window=0")
+	packs, _ := filepath.Glob(filepath.Join(dir, ".git", "objects", "pack", "pack-*.pack"))
+	if len(packs) != 1 {
+		t.Fatalf("want one pack, found %d", len(packs))
+	}
+
+	// Damage the entry of a blob that only an old tree refers to
+	offset, size := -1, 0
+	for _, line := range strings.Split(runGit(t, dir, "verify-pack", "-v", packs[0]), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 5 && fields[0] == lost {
+			size, _ = strconv.Atoi(fields[3])
+			offset, _ = strconv.Atoi(fields[4])
+		}
+	}
+	if offset < 0 {
+		t.Fatalf("%s is not in the pack", lost)
+	}
+	pack, err := os.ReadFile(packs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack[offset+size/2] ^= 0xff
+	if err := os.WriteFile(packs[0], pack, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	opts := Options{RepoPath: dir}
+	d, err := Diagnose(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.IssuesOf(IssueTypeCorruptPack)) != 1 {
+		t.Fatalf("want the damaged pack reported, got %v", d.Issues)
+	}
+
+	opts.Diagnosis = d
+	if n, err := FixCorruptPacks(ctx, opts); err != nil || n != 1 {
+		t.Fatalf("FixCorruptPacks = %d, %v", n, err)
+	}
+	if err := d.Refresh(ctx, opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.IssuesOf(IssueTypeCorruptPack)) != 0 {
+		t.Errorf("damaged pack still reported: %v", d.Issues)
+	}
+	// Only git fsck knows that an old tree still refers to the lost blob
+	found := false
+	for _, issue := range d.Issues {
+		found = found || strings.Contains(issue.String(), lost)
+	}
+	if !found {
+		t.Errorf("lost object %s not reported, got %v", lost, d.Issues)
+	}
+}
+
+func TestDecodePackEntryDamaged(t *testing.T) {
+	hash := bytes.Repeat([]byte{0xab}, 20)
+	tests := []struct {
+		name  string
+		entry []byte
+	}{
+		{"invalid type 5", []byte{0x55, 0x78, 0x9c}},
+		{"size overflow", append([]byte{0x9f}, bytes.Repeat([]byte{0xff}, 10)...)},
+		{"truncated size", []byte{0x9f, 0x80}},
+		{"truncated ofs-delta", []byte{0x65, 0x80}},
+		{"ofs-delta before the pack", []byte{0x65, 0x7f}},
+		{"truncated ref-delta", append([]byte{0x75}, hash[:5]...)},
+		{"ref-delta without content", append([]byte{0x75}, hash...)},
+		{"content shorter than its size", []byte{0x35, 0x78, 0x9c, 0x03, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pack := append([]byte("PACK\x00\x00\x00\x02\x00\x00\x00\x01"), tt.entry...)
+			if _, err := decodePackEntry(bytes.NewReader(pack), 12, len(pack), 20); err == nil {
+				t.Error("damaged entry decoded without error")
+			}
+		})
+	}
+}
+
+// deltaSize encodes a size the way git deltas do
+func deltaSize(n int) []byte {
+	return binary.AppendUvarint(nil, uint64(n))
+}
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("The quick brown fox jumps over the lazy dog")
+	concat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	t.Run("copy and insert", func(t *testing.T) {
+		// Copy "The quick ", insert "red", copy " fox"
+		delta := concat(deltaSize(len(base)), deltaSize(17),
+			[]byte{0x90, 10}, []byte{3}, []byte("red"), []byte{0x91, 15, 4})
+		got, err := applyDelta(base, delta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "The quick red fox" {
+			t.Errorf("got %q", got)
+		}
+	})
+
+	tests := []struct {
+		name  string
+		delta []byte
+	}{
+		{"empty", nil},
+		{"wrong base size", concat(deltaSize(len(base)+1), deltaSize(3), []byte{3}, []byte("abc"))},
+		{"huge result size", concat(deltaSize(len(base)), deltaSize(1<<40), []byte{3}, []byte("abc"))},
+		{"result size overflows", concat(deltaSize(len(base)), bytes.Repeat([]byte{0xff}, 10), []byte{0x01})},
+		{"copy past the base", concat(deltaSize(len(base)), deltaSize(10), []byte{0x91, 40, 10})},
+		{"truncated copy", concat(deltaSize(len(base)), deltaSize(10), []byte{0x91, 40})},
+		{"truncated insert", concat(deltaSize(len(base)), deltaSize(10), []byte{10}, []byte("abc"))},
+		{"reserved instruction", concat(deltaSize(len(base)), deltaSize(1), []byte{0})},
+		{"longer than its size", concat(deltaSize(len(base)), deltaSize(2), []byte{3}, []byte("abc"))},
+		{"shorter than its size", concat(deltaSize(len(base)), deltaSize(4), []byte{3}, []byte("abc"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := applyDelta(base, tt.delta); err == nil {
+				t.Errorf("corrupt delta applied: %q", got)
+			}
+		})
+	}
+}
+
+func TestInspectPackedObjectDamaged(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry []byte
+	}{
+		{"invalid type 5", []byte{0x55, 0x78, 0x9c, 0x03, 0x00}},
+		{"truncated ref-delta", []byte{0x75, 0xab, 0xcd}},
+		{"ofs-delta before the pack", []byte{0x65, 0x7f}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gitDir := t.TempDir()
+			pack := filepath.Join(gitDir, "pack-test.pack")
+			data := append([]byte("PACK\x00\x00\x00\x02\x00\x00\x00\x01"), tt.entry...)
+			data = append(data, make([]byte, 20)...)
+			if err := os.WriteFile(pack, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			d := &gitdir.Dir{GitDir: gitDir, CommonDir: gitDir}
+			idx := &packIndex{offsets: map[string]uint64{}}
+			if _, err := inspectPackedObject(context.Background(), d, ObjectFormatSHA1, pack, idx, 12, "", 0); err == nil {
+				t.Error("damaged entry inspected without error")
+			}
+		})
+	}
+}
+
+func TestInspectPackedObjects(t *testing.T) {
+	dir, file := newPackedRepo(t, true)
+	d, err := gitdir.Resolve(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := openPackIndex(strings.TrimSuffix(file, ".pack")+".idx", ObjectFormatSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := append([]string{}, idx.hashes...)
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		obj, err := readRawObject(context.Background(), d, ObjectFormatSHA1, hash, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", hash, err)
+		}
+		if !obj.Healthy() {
+			t.Errorf("%s: intact object has problems %v", hash, obj.Problems)
+		}
+	}
+}
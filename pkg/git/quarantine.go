@@ -0,0 +1,203 @@
+package git
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rahul/nsha/pkg/gitdir"
+)
+
+// QuarantineDir is the directory in the common git directory that damaged
+// objects are moved to. Nothing in it is ever deleted by nsha.
+const QuarantineDir = "nsha-quarantine"
+
+// quarantineManifest lists the quarantined files in QuarantineDir
+const quarantineManifest = "manifest.json"
+
+// ErrNotQuarantined is returned when restoring an object that is not in quarantine
+var ErrNotQuarantined = errors.New("not in quarantine")
+
+// QuarantinedObject is a damaged object file or conflict copy kept in quarantine
+type QuarantinedObject struct {
+	ID     string            `json:"id"`   // File name in the quarantine directory
+	Hash   string            `json:"hash"` // Object the file was stored as; empty for conflict copies
+	Path   string            `json:"path"` // Original location, relative to the common git directory
+	Damage LooseObjectDamage `json:"damage"`
+	Size   int64             `json:"size"`
+	Moved  time.Time         `json:"moved"`
+}
+
+// quarantinePath returns the quarantine directory of a repository. Objects
+// are shared by all worktrees, so it lives in the common directory.
+func quarantinePath(d *gitdir.Dir, elem ...string) string {
+	return filepath.Join(append([]string{d.CommonDir, QuarantineDir}, elem...)...)
+}
+
+// ListQuarantine returns the objects in quarantine, oldest first
+func ListQuarantine(opts Options) ([]QuarantinedObject, error) {
+	return readQuarantineManifest(opts.gitDir())
+}
+
+// readQuarantineManifest reads the manifest; a missing manifest is empty
+func readQuarantineManifest(d *gitdir.Dir) ([]QuarantinedObject, error) {
+	data, err := os.ReadFile(quarantinePath(d, quarantineManifest))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quarantine manifest: %w", err)
+	}
+	var entries []QuarantinedObject
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse quarantine manifest: %w", err)
+	}
+	return entries, nil
+}
+
+// writeQuarantineManifest replaces the manifest through a temporary file
+func writeQuarantineManifest(d *gitdir.Dir, entries []QuarantinedObject) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := quarantinePath(d, quarantineManifest)
+	if err := os.WriteFile(file+".tmp", append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write quarantine manifest: %w", err)
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return fmt.Errorf("failed to write quarantine manifest: %w", err)
+	}
+	return nil
+}
+
+// quarantineFile moves a damaged object file into quarantine and records it
+// in the manifest. Files without a hash are named after the file. A name
+// quarantined before gets a numbered ID.
+func quarantineFile(opts Options, file, hash string, damage LooseObjectDamage) (QuarantinedObject, error) {
+	d := opts.gitDir()
+	entry := QuarantinedObject{Hash: hash, Damage: damage, Moved: time.Now()}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return entry, err
+	}
+	entry.Size = info.Size()
+	entry.Path = filepath.ToSlash(relativeToCommonDir(d, file))
+
+	entries, err := readQuarantineManifest(d)
+	if err != nil {
+		return entry, err
+	}
+	if err := os.MkdirAll(quarantinePath(d, "objects"), 0755); err != nil {
+		return entry, fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+
+	base := hash
+	if base == "" {
+		base = quarantineName(filepath.Base(file))
+	}
+	entry.ID = base
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(quarantinePath(d, "objects", entry.ID)); os.IsNotExist(err) {
+			break
+		}
+		entry.ID = base + "." + strconv.Itoa(n)
+	}
+
+	if err := os.Rename(file, quarantinePath(d, "objects", entry.ID)); err != nil {
+		return entry, fmt.Errorf("failed to move object into quarantine: %w", err)
+	}
+	if err := writeQuarantineManifest(d, append(entries, entry)); err != nil {
+		// Put the object back rather than lose track of it
+		os.Rename(quarantinePath(d, "objects", entry.ID), file)
+		return entry, err
+	}
+	return entry, nil
+}
+
+// quarantineName turns a file name into an ID that needs no quoting
+func quarantineName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// relativeToCommonDir returns file relative to the common git directory
+func relativeToCommonDir(d *gitdir.Dir, file string) string {
+	if rel, err := filepath.Rel(d.CommonDir, file); err == nil {
+		return rel
+	}
+	return file
+}
+
+// RestoreQuarantine moves quarantined objects back to where they were found
+// and removes them from the manifest. Objects are named by ID or hash. An
+// object that exists again at its original location, e.g. after a fetch, is
+// only overwritten with force.
+func RestoreQuarantine(opts Options, names []string, force bool) ([]QuarantinedObject, error) {
+	d := opts.gitDir()
+	em := opts.emit()
+
+	entries, err := readQuarantineManifest(d)
+	if err != nil {
+		return nil, err
+	}
+
+	restore := make(map[int]bool)
+	for _, name := range names {
+		found := false
+		for i, entry := range entries {
+			if entry.ID == name || entry.Hash == name {
+				restore[i] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: %w", name, ErrNotQuarantined)
+		}
+	}
+
+	var restored, kept []QuarantinedObject
+	var errs []error
+	for i, entry := range entries {
+		if !restore[i] {
+			kept = append(kept, entry)
+			continue
+		}
+
+		target := filepath.Join(d.CommonDir, filepath.FromSlash(entry.Path))
+		if _, err := os.Lstat(target); err == nil && !force {
+			errs = append(errs, fmt.Errorf("%s: %s exists, not overwriting", entry.ID, entry.Path))
+			kept = append(kept, entry)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", entry.ID, err))
+			kept = append(kept, entry)
+			continue
+		}
+		if err := os.Rename(quarantinePath(d, "objects", entry.ID), target); err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore %s: %w", entry.ID, err))
+			kept = append(kept, entry)
+			continue
+		}
+		em.Debugf("Restored %s to %s", entry.ID, entry.Path)
+		restored = append(restored, entry)
+	}
+
+	if len(restored) > 0 {
+		if err := writeQuarantineManifest(d, kept); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return restored, errors.Join(errs...)
+}
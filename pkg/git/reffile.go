@@ -0,0 +1,598 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rahul/nsha/pkg/events"
+	"github.com/rahul/nsha/pkg/gitdir"
+)
+
+// RefFileDamage says why a reference file or packed-refs line cannot be parsed
+type RefFileDamage string
+
+const (
+	RefDamageEmpty     RefFileDamage = "empty"
+	RefDamageGarbage   RefFileDamage = "garbage"
+	RefDamageBadTarget RefFileDamage = "bad-target"
+	RefDamageBadLine   RefFileDamage = "bad-line"
+
+	RefDamageCorruptTable RefFileDamage = "corrupt-table"
+)
+
+// Description returns a short explanation of the damage
+func (d RefFileDamage) Description() string {
+	switch d {
+	case RefDamageEmpty:
+		return "file has no content"
+	case RefDamageGarbage:
+		return "content is neither an object hash nor a symbolic reference"
+	case RefDamageBadTarget:
+		return "symbolic reference points at an invalid name"
+	case RefDamageBadLine:
+		return "line is not a packed reference"
+	case RefDamageCorruptTable:
+		return "reftable stack cannot be read"
+	}
+	return string(d)
+}
+
+// refFileProblem is a malformed reference file or packed-refs line
+type refFileProblem struct {
+	name   string // How the reference is reported, e.g. "worktrees/<name>/HEAD"; "packed-refs" for lines without a name
+	ref    string // Name of the reference in its git directory, e.g. "HEAD" or "refs/heads/main"
+	file   string
+	gitDir string // Directory holding the reference's reflog
+	line   int    // Line in packed-refs, counting from 1; 0 for loose files
+	peeled bool   // A "^<hash>" line following a packed tag
+	damage RefFileDamage
+	value  string // The offending content, shortened
+}
+
+// issue reports the problem. ORIG_HEAD and FETCH_HEAD are conveniences
+// git rewrites, so they are only warnings.
+func (p refFileProblem) issue(repoPath string) Issue {
+	message := fmt.Sprintf("Malformed reference (%s): %s", p.damage, p.damage.Description())
+	if p.line > 0 {
+		message += fmt.Sprintf(" at line %d", p.line)
+	}
+	if p.value != "" {
+		message += fmt.Sprintf(": %q", p.value)
+	}
+	issue := Issue{
+		Type:    IssueTypeMalformedRef,
+		Object:  p.name,
+		Message: message,
+		Path:    repoRelative(repoPath, p.file),
+	}
+	if p.ref == "ORIG_HEAD" || p.ref == "FETCH_HEAD" {
+		issue.Severity = SeverityWarning
+	}
+	return issue
+}
+
+// scanRefFiles parses every loose reference, the HEAD, ORIG_HEAD and
+// FETCH_HEAD of every worktree and every packed-refs line without git or
+// go-git, which both stop at or skip what they cannot parse
+func scanRefFiles(opts Options) []refFileProblem {
+	d := opts.gitDir()
+	format := opts.objectFormat()
+	var problems []refFileProblem
+
+	worktrees, err := ListWorktrees(opts)
+	if err != nil {
+		worktrees = []Worktree{{GitDir: d.GitDir, Current: true}}
+	}
+	if refStorageFormat(d) == RefStorageReftable {
+		return scanReftables(d, format, worktrees)
+	}
+	for _, wt := range worktrees {
+		for _, ref := range []string{"HEAD", "ORIG_HEAD", "FETCH_HEAD"} {
+			file := filepath.Join(wt.GitDir, ref)
+			content, err := os.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			var damage RefFileDamage
+			if ref == "FETCH_HEAD" {
+				damage = fetchHeadDamage(string(content), format)
+			} else {
+				damage = refValueDamage(string(content), format, ref == "HEAD")
+			}
+			if damage != "" {
+				problems = append(problems, refFileProblem{
+					name: wt.RefName(ref), ref: ref, file: file, gitDir: wt.GitDir,
+					damage: damage, value: shortValue(string(content)),
+				})
+			}
+		}
+	}
+
+	filepath.WalkDir(d.Path("refs"), func(path string, entry os.DirEntry, err error) error {
+		// Lock files belong to updates in progress
+		if err != nil || !entry.Type().IsRegular() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.CommonDir, path)
+		if err != nil {
+			return nil
+		}
+		// git ignores files whose names are not references, e.g. conflict copies
+		name := filepath.ToSlash(rel)
+		if !validRefName(name) {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		if damage := refValueDamage(string(content), format, false); damage != "" {
+			problems = append(problems, refFileProblem{
+				name: name, ref: name, file: path, gitDir: d.CommonDir,
+				damage: damage, value: shortValue(string(content)),
+			})
+		}
+		return nil
+	})
+
+	return append(problems, scanPackedRefs(d, format)...)
+}
+
+// scanReftables reads every reftable stack and the FETCH_HEAD of every
+// worktree, which stays a file. The HEAD file and refs/heads of a reftable
+// repository are stubs that keep older git from using it.
+func scanReftables(d *gitdir.Dir, format ObjectFormat, worktrees []Worktree) []refFileProblem {
+	var problems []refFileProblem
+	for _, wt := range worktrees {
+		file := filepath.Join(wt.GitDir, "FETCH_HEAD")
+		if content, err := os.ReadFile(file); err == nil {
+			if damage := fetchHeadDamage(string(content), format); damage != "" {
+				problems = append(problems, refFileProblem{
+					name: wt.RefName("FETCH_HEAD"), ref: "FETCH_HEAD", file: file, gitDir: wt.GitDir,
+					damage: damage, value: shortValue(string(content)),
+				})
+			}
+		}
+
+		// The main worktree's references are in the shared stack
+		name, dir := "reftable", filepath.Join(d.CommonDir, "reftable")
+		if !wt.Main() {
+			name, dir = "worktrees/"+wt.Name+"/reftable", filepath.Join(wt.GitDir, "reftable")
+		}
+		if _, err := readReftableStack(dir, format); err != nil {
+			problems = append(problems, refFileProblem{
+				name: name, ref: "reftable", file: dir, gitDir: wt.GitDir,
+				damage: RefDamageCorruptTable, value: err.Error(),
+			})
+		}
+	}
+	return problems
+}
+
+// scanPackedRefs reports the packed-refs lines git cannot parse and the
+// references in it with malformed hashes, in file order
+func scanPackedRefs(d *gitdir.Dir, format ObjectFormat) []refFileProblem {
+	packed, err := readPackedRefs(d, format)
+	if err != nil {
+		return nil
+	}
+
+	var problems []refFileProblem
+	for _, ref := range packed.Refs {
+		if !packed.ValidHash(ref) {
+			problems = append(problems, refFileProblem{
+				name: ref.Name, ref: ref.Name, file: packed.file, gitDir: d.CommonDir, line: ref.Line,
+				damage: RefDamageGarbage, value: shortValue(ref.Hash + " " + ref.Name),
+			})
+		}
+	}
+	for _, line := range packed.Invalid {
+		problem := refFileProblem{
+			name: "packed-refs", file: packed.file, gitDir: d.CommonDir, line: line.Line,
+			damage: RefDamageBadLine, value: shortValue(line.Text),
+		}
+		if line.Ref != "" {
+			problem.name, problem.ref, problem.peeled = line.Ref+"^{}", line.Ref, true
+			problem.damage = RefDamageGarbage
+		}
+		problems = append(problems, problem)
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].line < problems[j].line })
+	return problems
+}
+
+// refValueDamage checks a loose reference the way git parses it: either
+// "ref: <refname>" or an object hash followed by whitespace or nothing. A
+// symbolic HEAD must point into refs/.
+func refValueDamage(content string, format ObjectFormat, head bool) RefFileDamage {
+	if strings.TrimSpace(content) == "" {
+		return RefDamageEmpty
+	}
+	if target, ok := strings.CutPrefix(content, "ref:"); ok {
+		target = strings.TrimSpace(target)
+		if head && !strings.HasPrefix(target, "refs/") || !validRefName(target) {
+			return RefDamageBadTarget
+		}
+		return ""
+	}
+	n := format.HexSize()
+	if len(content) < n || !isRefHash(content[:n], format) || len(content) > n && !strings.ContainsRune(" \t\r\n", rune(content[n])) {
+		return RefDamageGarbage
+	}
+	return ""
+}
+
+// fetchHeadDamage checks FETCH_HEAD, one "<hash>\t<flags>\t<description>"
+// line per fetched ref. It is empty after fetching nothing.
+func fetchHeadDamage(content string, format ObjectFormat) RefFileDamage {
+	n := format.HexSize()
+	for _, line := range splitLines(content) {
+		if len(line) <= n || !isRefHash(line[:n], format) || line[n] != '\t' {
+			return RefDamageGarbage
+		}
+	}
+	return ""
+}
+
+// isRefHash reports whether s is a full hex object hash of the given format.
+// Git accepts both cases of hex digits.
+func isRefHash(s string, format ObjectFormat) bool {
+	return len(s) == format.HexSize() && isHexString(strings.ToLower(s))
+}
+
+// validRefName applies git's refname rules (git check-ref-format)
+func validRefName(name string) bool {
+	if name == "" || name == "@" || strings.HasSuffix(name, ".") ||
+		strings.Contains(name, "..") || strings.Contains(name, "@{") {
+		return false
+	}
+	for _, component := range strings.Split(name, "/") {
+		if component == "" || strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") {
+			return false
+		}
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// shortValue returns the start of a malformed value for messages
+func shortValue(content string) string {
+	content = strings.TrimSpace(content)
+	if len(content) > 48 {
+		return content[:48] + "..."
+	}
+	return content
+}
+
+// recheckRefFile rechecks a malformed reference named by an issue's Object
+func recheckRefFile(repoPath, name string) []Issue {
+	var issues []Issue
+	for _, p := range scanRefFiles(Options{RepoPath: repoPath}) {
+		if p.name == name {
+			issues = append(issues, p.issue(repoPath))
+		}
+	}
+	return issues
+}
+
+// FixMalformedRefs repairs malformed reference files and packed-refs lines
+// instead of ignoring or deleting them. A HEAD git cannot parse points at
+// the branch its reflog last checked out; other references are restored to
+// the newest readable commit in their reflog. ORIG_HEAD and FETCH_HEAD are
+// rewritten by git as needed and are removed.
+func FixMalformedRefs(ctx context.Context, opts Options) (int, error) {
+	em := opts.emit()
+	d := opts.gitDir()
+
+	problems, _ := planned(opts, func() ([]refFileProblem, error) {
+		return scanRefFiles(opts), nil
+	})
+	if opts.DryRun {
+		count := 0
+		for _, p := range problems {
+			if p.ref == "reftable" {
+				continue
+			}
+			em.Debugf("[DRY RUN] Would repair %s: %s", p.name, p.damage.Description())
+			count++
+		}
+		return count, nil
+	}
+
+	// git refuses to work in a repository whose HEAD it cannot parse, so
+	// HEADs are repaired before anything that needs git
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].ref == "HEAD" && problems[j].ref != "HEAD"
+	})
+
+	var repo store
+	defer func() {
+		if repo != nil {
+			repo.Close()
+		}
+	}()
+
+	fixedCount := 0
+	var packed []refFileProblem
+	for _, p := range problems {
+		if err := ctx.Err(); err != nil {
+			return fixedCount, err
+		}
+		if p.line > 0 {
+			packed = append(packed, p)
+			continue
+		}
+		if repo == nil && p.ref != "HEAD" {
+			repo, _ = openStore(ctx, opts)
+		}
+
+		var err error
+		switch p.ref {
+		case "reftable":
+			// Tables hold the only copy of their references
+			em.Warnf("Cannot repair %s automatically: %s", p.name, p.value)
+			continue
+		case "HEAD":
+			err = repairHeadFile(d, p, em)
+		case "ORIG_HEAD", "FETCH_HEAD":
+			if err = os.Remove(p.file); err == nil {
+				em.Detailf("Removed malformed %s", p.name)
+			}
+		default:
+			err = repairLooseRef(repo, d, p, em)
+		}
+		if err != nil {
+			em.Warnf("Failed to repair %s: %v", p.name, err)
+			continue
+		}
+		p.invalidate(opts.Diagnosis)
+		fixedCount++
+	}
+
+	if len(packed) > 0 {
+		if repo == nil {
+			repo, _ = openStore(ctx, opts)
+		}
+		n, err := repairPackedRefs(ctx, opts, repo, packed, em)
+		fixedCount += n
+		if err != nil {
+			em.Warnf("Failed to repair packed-refs: %v", err)
+		}
+		if n > 0 {
+			for _, p := range packed {
+				p.invalidate(opts.Diagnosis)
+			}
+		}
+	}
+	return fixedCount, nil
+}
+
+// invalidate marks a repaired reference file as changed. The scan could not
+// see past it, so the reference it holds is checked again as well.
+func (p refFileProblem) invalidate(d *Diagnosis) {
+	d.invalidate(subject{subjectRefFile, p.name})
+	switch {
+	case p.ref == "" || p.ref == "reftable":
+	case p.name != p.ref || p.ref == "ORIG_HEAD":
+		d.InvalidateWorktree(p.name)
+	default:
+		d.InvalidateRef(p.ref)
+	}
+}
+
+// repairHeadFile points a malformed HEAD at the branch its reflog last
+// checked out. Otherwise the main worktree gets main or master, and a HEAD
+// last detached or one of a linked worktree, whose branch may be checked out
+// elsewhere, is detached at the newest commit in its reflog. Objects cannot
+// be read yet, as git does not run with a broken HEAD.
+func repairHeadFile(d *gitdir.Dir, p refFileProblem, em events.Emitter) error {
+	content, _ := os.ReadFile(filepath.Join(p.gitDir, "logs", "HEAD"))
+	lines := splitLines(string(content))
+	linked := p.gitDir != d.CommonDir
+
+	value := ""
+	for i := len(lines) - 1; i >= 0 && value == ""; i-- {
+		// <old> <new> <committer> <timestamp> <tz>\t<message>
+		_, message, _ := strings.Cut(lines[i], "\t")
+		target, ok := strings.CutPrefix(message, "checkout: moving from ")
+		if !ok {
+			continue
+		}
+		if _, to, ok := strings.Cut(target, " to "); ok {
+			switch {
+			case refExists(d, "refs/heads/"+to):
+				value = "ref: refs/heads/" + to
+			case len(strings.Fields(lines[i])) > 1 && !isNullHash(strings.Fields(lines[i])[1]):
+				// Checked out a commit or a branch that is gone
+				value = strings.Fields(lines[i])[1]
+			}
+		}
+	}
+	for _, branch := range []string{"main", "master"} {
+		if value == "" && !linked && refExists(d, "refs/heads/"+branch) {
+			value = "ref: refs/heads/" + branch
+		}
+	}
+	for i := len(lines) - 1; i >= 0 && value == ""; i-- {
+		if fields := strings.Fields(lines[i]); len(fields) > 1 && isHash(fields[1]) && !isNullHash(fields[1]) {
+			value = fields[1]
+		}
+	}
+	if value == "" {
+		return fmt.Errorf("no branch or reflog entry to point HEAD at")
+	}
+
+	if err := writeLocked(p.file, []byte(value+"\n")); err != nil {
+		return err
+	}
+	em.Detailf("Restored %s: %s", p.name, value)
+	return nil
+}
+
+// repairLooseRef restores a malformed loose reference from its reflog. When
+// the reflog has no readable commit but packed-refs has the reference, the
+// loose file is removed so the packed value applies again.
+func repairLooseRef(repo store, d *gitdir.Dir, p refFileProblem, em events.Emitter) error {
+	if repo != nil && p.damage != RefDamageBadTarget {
+		if hash := reflogCommit(repo, reflogHashes(d.Path("logs", p.ref))); hash != "" {
+			if err := writeLocked(p.file, []byte(hash+"\n")); err != nil {
+				return fmt.Errorf("%s: %w", p.ref, err)
+			}
+			em.Detailf("Restored %s from its reflog -> %s", p.name, hash[:8])
+			return nil
+		}
+	}
+
+	if hash, ok := packedRef(d, p.ref); ok {
+		if err := os.Remove(p.file); err != nil {
+			return err
+		}
+		em.Detailf("Removed malformed loose %s; its packed value %s applies", p.name, hash[:8])
+		return nil
+	}
+	return fmt.Errorf("no reflog entry to restore it from")
+}
+
+// repairPackedRefs rewrites packed-refs without its malformed lines.
+// References with malformed hashes are restored from their reflog, or
+// dropped when a loose file of the same reference takes precedence anyway.
+// Peeled values are recomputed when every object can be read; otherwise the
+// header stops claiming the file is peeled. It returns how many lines were
+// repaired.
+func repairPackedRefs(ctx context.Context, opts Options, repo store, problems []refFileProblem, em events.Emitter) (int, error) {
+	d := opts.gitDir()
+	packed, err := ReadPackedRefs(opts)
+	if err != nil {
+		return 0, err
+	}
+
+	fixedCount := 0
+	for _, p := range problems {
+		if p.ref == "" || p.peeled {
+			// Dropped when the file is written
+			fixedCount++
+			continue
+		}
+		hash := ""
+		if repo != nil {
+			hash = reflogCommit(repo, reflogHashes(d.Path("logs", p.ref)))
+		}
+		switch _, err := os.Stat(d.Path(p.ref)); {
+		case hash != "":
+			packed.Set(p.ref, hash, "restored from its reflog")
+		case err == nil:
+			packed.Remove(p.ref, "malformed; its loose file applies")
+		default:
+			em.Warnf("Failed to repair packed %s: no reflog entry to restore it from", p.ref)
+			continue
+		}
+		fixedCount++
+	}
+	if fixedCount == 0 {
+		return 0, nil
+	}
+
+	packed.DropInvalid()
+	if err := packed.Peel(ctx, opts.RepoPath); err != nil {
+		em.Debugf("Not peeling packed-refs: %v", err)
+	}
+	if err := packed.Write(); err != nil {
+		return 0, err
+	}
+	for _, change := range packed.Changes {
+		em.Detailf("packed-refs: %s", change)
+	}
+	return fixedCount, nil
+}
+
+// refExists reports whether a reference has a loose file or a packed line
+func refExists(d *gitdir.Dir, name string) bool {
+	if info, err := os.Stat(d.Path(name)); err == nil && info.Mode().IsRegular() {
+		return true
+	}
+	_, ok := packedRef(d, name)
+	return ok
+}
+
+// packedRef returns the hash packed-refs holds for a reference
+func packedRef(d *gitdir.Dir, name string) (string, bool) {
+	packed, err := readPackedRefs(d, objectFormat(d))
+	if err != nil {
+		return "", false
+	}
+	ref, ok := packed.Lookup(name)
+	if !ok || !packed.ValidHash(ref) {
+		return "", false
+	}
+	return ref.Hash, true
+}
+
+// fileLock is <file>.lock, held while the file is replaced. It also keeps
+// git and other writers out, the way git's own lock files do.
+type fileLock struct {
+	file string
+	f    *os.File
+}
+
+// lockFile creates <file>.lock, failing when someone else holds it
+func lockFile(file string) (*fileLock, error) {
+	f, err := os.OpenFile(file+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock %s: %w", filepath.Base(file), err)
+	}
+	return &fileLock{file: file, f: f}, nil
+}
+
+// commit writes the new content to the lock file and renames it over the
+// file once it is on disk. A crash leaves either the old or the new file.
+// The lock is given up either way.
+func (l *fileLock) commit(data []byte) error {
+	name := filepath.Base(l.file)
+	if _, err := l.f.Write(data); err != nil {
+		l.release()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := l.f.Sync(); err != nil {
+		l.release()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	f := l.f
+	l.f = nil
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := os.Rename(f.Name(), l.file); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to replace %s: %w", name, err)
+	}
+	return nil
+}
+
+// release gives the lock up without changing the file. It does nothing
+// once the lock is committed, so it can be deferred.
+func (l *fileLock) release() {
+	if l.f == nil {
+		return
+	}
+	l.f.Close()
+	os.Remove(l.f.Name())
+	l.f = nil
+}
+
+// writeLocked replaces a file the way git does, through <file>.lock
+func writeLocked(file string, data []byte) error {
+	l, err := lockFile(file)
+	if err != nil {
+		return err
+	}
+	return l.commit(data)
+}
@@ -0,0 +1,476 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/rahul/nsha/pkg/gitdir"
+)
+
+// RefStorage is how a repository stores its references, set by
+// extensions.refStorage in the repository config
+type RefStorage string
+
+const (
+	RefStorageFiles    RefStorage = "files"
+	RefStorageReftable RefStorage = "reftable"
+)
+
+// DetectRefStorage reads the ref storage format of the repository at
+// repoPath. Repositories without extensions.refStorage use files.
+func DetectRefStorage(repoPath string) RefStorage {
+	return refStorageFormat(gitdir.ResolveOrDefault(repoPath))
+}
+
+// refStorageFormat reads extensions.refStorage from the common directory's config
+func refStorageFormat(d *gitdir.Dir) RefStorage {
+	f, err := os.Open(d.Path("config"))
+	if err != nil {
+		return RefStorageFiles
+	}
+	defer f.Close()
+
+	cfg := config.New()
+	if err := config.NewDecoder(f).Decode(cfg); err != nil {
+		return RefStorageFiles
+	}
+	if format := strings.ToLower(cfg.Section("extensions").Option("refstorage")); format == string(RefStorageReftable) {
+		return RefStorageReftable
+	}
+	return RefStorageFiles
+}
+
+// refUpdate is a change to one reference: pointing it at Hash or Target, or
+// deleting it
+type refUpdate struct {
+	Name    string
+	Hash    string
+	Target  string
+	Delete  bool
+	Message string // Reflog message, "nsha: repair" when empty
+}
+
+// message returns the reflog message of an update
+func (u refUpdate) message() string {
+	if u.Message == "" {
+		return "nsha: repair"
+	}
+	return u.Message
+}
+
+// Who reference updates made by nsha are logged as
+const (
+	reflogName  = "NSHA Tool"
+	reflogEmail = "nsha@fix.local"
+)
+
+// reflogLine formats a reflog entry the way git writes it to a log file
+func reflogLine(oldHash, newHash, message string, when time.Time) string {
+	return fmt.Sprintf("%s %s %s <%s> %d %s\t%s\n", oldHash, newHash, reflogName, reflogEmail, when.Unix(), when.Format("-0700"), message)
+}
+
+// refStorage reads and writes the references of one worktree, whose
+// per-worktree references such as HEAD come from its own git directory and
+// whose other references are shared. Values are returned as stored, so
+// malformed hashes are left for the caller to judge.
+type refStorage interface {
+	Format() RefStorage
+	// References returns HEAD followed by every reference under refs/ by name
+	References() ([]Ref, error)
+	// Reference returns plumbing.ErrReferenceNotFound for missing references
+	Reference(name string) (Ref, error)
+	Update(updates ...refUpdate) error
+	// Reflog returns the hashes a reference was set to, oldest first
+	Reflog(name string) []string
+	// Location returns the file or directory a reference is stored in
+	Location(name string) string
+}
+
+// openRefStorage opens the references seen from the worktree whose git
+// directory is gitDir
+func openRefStorage(d *gitdir.Dir, gitDir string) (refStorage, error) {
+	format := objectFormat(d)
+	if refStorageFormat(d) == RefStorageFiles {
+		return &filesRefStorage{dir: d, gitDir: gitDir, format: format}, nil
+	}
+
+	shared, err := readReftableStack(filepath.Join(d.CommonDir, "reftable"), format)
+	if err != nil {
+		return nil, err
+	}
+	s := &reftableRefStorage{shared: shared, worktree: shared}
+	if !sameDir(gitDir, d.CommonDir) {
+		if s.worktree, err = readReftableStack(filepath.Join(gitDir, "reftable"), format); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// refs opens the references of the worktree the options name
+func (o Options) refs() (refStorage, error) {
+	d := o.gitDir()
+	return openRefStorage(d, d.GitDir)
+}
+
+// sameDir reports whether two paths name the same directory
+func sameDir(a, b string) bool {
+	a, _ = filepath.Abs(a)
+	b, _ = filepath.Abs(b)
+	return a == b
+}
+
+// isPerWorktreeRef reports whether each worktree has its own copy of a
+// reference: HEAD and the other pseudo-refs, and refs/bisect/,
+// refs/worktree/ and refs/rewritten/
+func isPerWorktreeRef(name string) bool {
+	if !strings.HasPrefix(name, "refs/") {
+		return true
+	}
+	for _, prefix := range []string{"refs/bisect/", "refs/worktree/", "refs/rewritten/"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filesRefStorage stores references as loose files and in packed-refs
+type filesRefStorage struct {
+	dir    *gitdir.Dir
+	gitDir string
+	format ObjectFormat
+}
+
+func (s *filesRefStorage) Format() RefStorage {
+	return RefStorageFiles
+}
+
+// file returns the loose file of a reference
+func (s *filesRefStorage) file(name string) string {
+	if isPerWorktreeRef(name) {
+		return filepath.Join(s.gitDir, filepath.FromSlash(name))
+	}
+	return filepath.Join(s.dir.CommonDir, filepath.FromSlash(name))
+}
+
+// References lists the shared references, loose references taking
+// precedence over packed ones like they do for git
+func (s *filesRefStorage) References() ([]Ref, error) {
+	refs := make(map[string]Ref)
+	if packed, err := readPackedRefs(s.dir, s.format); err == nil {
+		for _, ref := range packed.Refs {
+			if _, ok := refs[ref.Name]; !ok {
+				refs[ref.Name] = Ref{Name: ref.Name, Hash: ref.Hash}
+			}
+		}
+	}
+
+	root := filepath.Join(s.dir.CommonDir, "refs")
+	err := filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir.CommonDir, path)
+		if err != nil {
+			return nil
+		}
+		if ref, ok := readLooseRef(filepath.ToSlash(rel), path); ok {
+			refs[ref.Name] = ref
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list references: %w", err)
+	}
+
+	var list []Ref
+	if head, ok := readLooseRef("HEAD", s.file("HEAD")); ok {
+		list = append(list, head)
+	}
+	return append(list, sortedRefs(refs)...), nil
+}
+
+func (s *filesRefStorage) Reference(name string) (Ref, error) {
+	if ref, ok := readLooseRef(name, s.file(name)); ok {
+		return ref, nil
+	}
+	if packed, err := readPackedRefs(s.dir, s.format); err == nil {
+		if ref, ok := packed.Lookup(name); ok {
+			return Ref{Name: name, Hash: ref.Hash}, nil
+		}
+	}
+	return Ref{}, plumbing.ErrReferenceNotFound
+}
+
+// Update writes loose files through <file>.lock like git, and logs every
+// change of hash in the reflogs. Deleting a reference also removes it from
+// packed-refs.
+func (s *filesRefStorage) Update(updates ...refUpdate) error {
+	var packed *PackedRefs
+	for _, u := range updates {
+		file := s.file(u.Name)
+		old := s.format.NullHash()
+		if ref, err := s.Reference(u.Name); err == nil && len(ref.Hash) == s.format.HexSize() && isHash(ref.Hash) {
+			old = ref.Hash
+		}
+
+		if u.Delete {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to delete %s: %w", u.Name, err)
+			}
+			// Like git, the reflog goes with the reference, so that a later
+			// reference of the same name does not inherit its history
+			if err := s.removeLog(u.Name); err != nil {
+				return err
+			}
+			if packed == nil {
+				var err error
+				if packed, err = readPackedRefs(s.dir, s.format); err != nil {
+					return err
+				}
+			}
+			packed.Remove(u.Name, "deleted")
+			continue
+		}
+
+		content := u.Hash + "\n"
+		if u.Target != "" {
+			content = fmt.Sprintf("ref: %s\n", u.Target)
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return fmt.Errorf("failed to write %s: %w", u.Name, err)
+		}
+		if err := writeLocked(file, []byte(content)); err != nil {
+			return fmt.Errorf("%s: %w", u.Name, err)
+		}
+		if u.Hash == "" {
+			continue
+		}
+
+		// Like git, a branch HEAD points at is logged in HEAD's reflog too
+		logged := []string{u.Name}
+		if head, err := s.Reference("HEAD"); err == nil && u.Name != "HEAD" && head.Target == u.Name {
+			logged = append(logged, "HEAD")
+		}
+		for _, name := range logged {
+			if err := s.logUpdate(name, old, u.Hash, u.message()); err != nil {
+				return err
+			}
+		}
+	}
+	if packed != nil && len(packed.Changes) > 0 {
+		return packed.Write()
+	}
+	return nil
+}
+
+func (s *filesRefStorage) Reflog(name string) []string {
+	return reflogHashes(s.logFile(name))
+}
+
+// logFile returns the reflog file of a reference
+func (s *filesRefStorage) logFile(name string) string {
+	logs := filepath.Join(s.dir.CommonDir, "logs")
+	if isPerWorktreeRef(name) {
+		logs = filepath.Join(s.gitDir, "logs")
+	}
+	return filepath.Join(logs, filepath.FromSlash(name))
+}
+
+// removeLog deletes the reflog of a reference and the directories it leaves
+// empty below logs/refs/<kind>, e.g. logs/refs/heads/feature for
+// refs/heads/feature/x
+func (s *filesRefStorage) removeLog(name string) error {
+	file := s.logFile(name)
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete the reflog of %s: %w", name, err)
+	}
+	parts := strings.Split(name, "/")
+	for i := len(parts) - 1; i > 2; i-- {
+		dir := s.logFile(strings.Join(parts[:i], "/"))
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// logUpdate appends a reflog entry the way git does with its default
+// core.logAllRefUpdates: to a reflog that exists, or to a new one for HEAD,
+// branches, remote-tracking branches and notes outside bare repositories
+func (s *filesRefStorage) logUpdate(name, oldHash, newHash, message string) error {
+	file := s.logFile(name)
+	if _, err := os.Stat(file); err != nil {
+		if s.dir.Bare() || !autoLoggedRef(name) {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return fmt.Errorf("failed to log %s: %w", name, err)
+		}
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to log %s: %w", name, err)
+	}
+	if _, err := f.WriteString(reflogLine(oldHash, newHash, message, time.Now())); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to log %s: %w", name, err)
+	}
+	return f.Close()
+}
+
+// autoLoggedRef reports whether git creates a reflog for a reference by default
+func autoLoggedRef(name string) bool {
+	for _, prefix := range []string{"refs/heads/", "refs/remotes/", "refs/notes/"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return name == "HEAD"
+}
+
+// Location returns the loose file of a reference, or packed-refs when it is
+// only packed
+func (s *filesRefStorage) Location(name string) string {
+	file := s.file(name)
+	if _, err := os.Stat(file); err != nil {
+		if _, err := os.Stat(s.dir.Path("packed-refs")); err == nil {
+			file = s.dir.Path("packed-refs")
+		}
+	}
+	return file
+}
+
+// readLooseRef reads a reference file
+func readLooseRef(name, file string) (Ref, bool) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return Ref{}, false
+	}
+	value := strings.TrimSpace(string(content))
+	if target, ok := strings.CutPrefix(value, "ref:"); ok {
+		return Ref{Name: name, Target: strings.TrimSpace(target)}, true
+	}
+	return Ref{Name: name, Hash: value}, true
+}
+
+// sortedRefs returns references sorted by name
+func sortedRefs(refs map[string]Ref) []Ref {
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]Ref, 0, len(names))
+	for _, name := range names {
+		list = append(list, refs[name])
+	}
+	return list
+}
+
+// reftableRefStorage stores references in reftable stacks: the shared one
+// under the common directory, and one per linked worktree for its
+// per-worktree references. The main worktree keeps its own in the shared stack.
+type reftableRefStorage struct {
+	shared   *reftableStack
+	worktree *reftableStack
+}
+
+func (s *reftableRefStorage) Format() RefStorage {
+	return RefStorageReftable
+}
+
+// stack returns the stack a reference is stored in
+func (s *reftableRefStorage) stack(name string) *reftableStack {
+	if isPerWorktreeRef(name) {
+		return s.worktree
+	}
+	return s.shared
+}
+
+// References lists the shared references under refs/ and the worktree's HEAD
+func (s *reftableRefStorage) References() ([]Ref, error) {
+	refs := make(map[string]Ref)
+	for _, rec := range s.shared.refs() {
+		if strings.HasPrefix(rec.name, "refs/") && !isPerWorktreeRef(rec.name) {
+			refs[rec.name] = rec.ref()
+		}
+	}
+
+	var list []Ref
+	if head, err := s.Reference("HEAD"); err == nil {
+		list = append(list, head)
+	}
+	return append(list, sortedRefs(refs)...), nil
+}
+
+func (s *reftableRefStorage) Reference(name string) (Ref, error) {
+	rec, ok := s.stack(name).lookup(name)
+	if !ok {
+		return Ref{}, plumbing.ErrReferenceNotFound
+	}
+	return rec.ref(), nil
+}
+
+// Update writes one new table on each stack the updates touch, logging
+// every change of hash
+func (s *reftableRefStorage) Update(updates ...refUpdate) error {
+	records := make(map[*reftableStack][]reftableRecord)
+	for _, u := range updates {
+		rec := reftableRecord{name: u.Name, valueType: reftableHash, hash: u.Hash, message: u.message()}
+		switch {
+		case u.Delete:
+			rec = reftableRecord{name: u.Name, valueType: reftableDeletion}
+		case u.Target != "":
+			rec = reftableRecord{name: u.Name, valueType: reftableSymref, target: u.Target}
+		}
+		stack := s.stack(u.Name)
+		records[stack] = append(records[stack], rec)
+	}
+	for _, stack := range []*reftableStack{s.shared, s.worktree} {
+		if err := stack.add(records[stack]); err != nil {
+			return fmt.Errorf("failed to update references: %w", err)
+		}
+		delete(records, stack)
+	}
+	return nil
+}
+
+func (s *reftableRefStorage) Reflog(name string) []string {
+	var hashes []string
+	for _, log := range s.stack(name).reflog(name) {
+		hashes = append(hashes, log.newHash)
+	}
+	return hashes
+}
+
+func (s *reftableRefStorage) Location(name string) string {
+	return s.stack(name).dir
+}
+
+// updateRefs applies reference updates through the repository's ref storage
+func updateRefs(opts Options, updates ...refUpdate) error {
+	refs, err := opts.refs()
+	if err != nil {
+		return err
+	}
+	return refs.Update(updates...)
+}
+
+// readRawRef reads a reference as stored, without judging its value
+func readRawRef(opts Options, name string) (Ref, error) {
+	refs, err := opts.refs()
+	if err != nil {
+		return Ref{}, err
+	}
+	return refs.Reference(name)
+}
@@ -0,0 +1,43 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilesRefStorageDeleteRemovesReflog(t *testing.T) {
+	dir := newTestRepo(t)
+	first := commitFile(t, dir, "a.txt", "a")
+	second := commitFile(t, dir, "a.txt", "b")
+	runGit(t, dir, "branch", "feature/x", first)
+	runGit(t, dir, "branch", "-f", "feature/x", second)
+
+	refs, err := Options{RepoPath: dir}.refs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := refs.Reflog("refs/heads/feature/x"); len(got) != 2 {
+		t.Fatalf("want 2 reflog entries before deleting, got %v", got)
+	}
+
+	if err := refs.Update(refUpdate{Name: "refs/heads/feature/x", Delete: true}); err != nil {
+		t.Fatal(err)
+	}
+	logs := filepath.Join(dir, ".git", "logs", "refs", "heads")
+	if _, err := os.Stat(filepath.Join(logs, "feature")); !os.IsNotExist(err) {
+		t.Errorf("reflog of the deleted reference was left behind: %v", err)
+	}
+	if _, err := os.Stat(logs); err != nil {
+		t.Errorf("logs/refs/heads was removed: %v", err)
+	}
+
+	// A new reference of the same name starts its own history
+	if err := refs.Update(refUpdate{Name: "refs/heads/feature/x", Hash: first}); err != nil {
+		t.Fatal(err)
+	}
+	if got := refs.Reflog("refs/heads/feature/x"); len(got) != 1 || got[0] != first {
+		t.Errorf("reflog of the new reference is %v, want [%s]", got, first)
+	}
+	runGit(t, dir, "fsck", "--no-progress")
+}
@@ -0,0 +1,907 @@
+package git
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reftableMagic starts the header and the footer of every reftable
+const reftableMagic = "REFT"
+
+const (
+	reftableHashSHA1   = 0x73686131 // "sha1"
+	reftableHashSHA256 = 0x73323536 // "s256"
+
+	// reftableBlockSize and reftableRestartInterval are what git writes by default
+	reftableBlockSize       = 4096
+	reftableRestartInterval = 16
+)
+
+// Value types of ref records
+const (
+	reftableDeletion = iota
+	reftableHash
+	reftableHashPeeled
+	reftableSymref
+)
+
+// reftableHeader is the header a reftable starts with and its footer repeats
+type reftableHeader struct {
+	version   int
+	blockSize int
+	minUpdate uint64
+	maxUpdate uint64
+	hashID    uint32 // Only written by version 2
+}
+
+// size returns the length of the header
+func (h reftableHeader) size() int {
+	if h.version == 2 {
+		return 28
+	}
+	return 24
+}
+
+// footerSize returns the length of the footer: the header, the positions of
+// the index, obj and log sections and a CRC-32
+func (h reftableHeader) footerSize() int {
+	return h.size() + 5*8 + 4
+}
+
+// reftableRecord is a ref record of a reftable
+type reftableRecord struct {
+	name        string
+	updateIndex uint64
+	valueType   int
+	hash        string
+	peeled      string
+	target      string
+	message     string // Reflog message of a record being written
+}
+
+// ref returns the record as a reference
+func (r reftableRecord) ref() Ref {
+	if r.valueType == reftableSymref {
+		return Ref{Name: r.name, Target: r.target}
+	}
+	return Ref{Name: r.name, Hash: r.hash}
+}
+
+// reftableLog is a log record of a reftable: one reflog entry
+type reftableLog struct {
+	name        string
+	updateIndex uint64
+	deletion    bool
+	oldHash     string
+	newHash     string
+	who         string // Committer name and email
+	email       string
+	time        uint64
+	tzOffset    int16 // Time zone as the decimal digits of e.g. -0700
+	message     string
+}
+
+// reftable is one table of a reftable stack
+type reftable struct {
+	file   string
+	header reftableHeader
+	refs   []reftableRecord
+	logs   []reftableLog
+}
+
+// reftableStack is a directory of reftables, listed oldest first in
+// tables.list. Newer tables override the records of older ones.
+type reftableStack struct {
+	dir    string
+	format ObjectFormat
+	tables []*reftable
+}
+
+// isReftableDir reports whether dir holds a reftable stack
+func isReftableDir(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "tables.list"))
+	return err == nil
+}
+
+// readReftableStack reads every table of the stack in dir
+func readReftableStack(dir string, format ObjectFormat) (*reftableStack, error) {
+	s := &reftableStack{dir: dir, format: format}
+	content, err := os.ReadFile(filepath.Join(dir, "tables.list"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reftable stack: %w", err)
+	}
+
+	var prev *reftable
+	for _, name := range splitLines(string(content)) {
+		if name == "" {
+			continue
+		}
+		if strings.ContainsAny(name, "/\\") {
+			return nil, fmt.Errorf("tables.list names %q outside the stack", name)
+		}
+		t, err := readReftable(filepath.Join(dir, name), format)
+		if err != nil {
+			return nil, err
+		}
+		if prev != nil && t.header.minUpdate <= prev.header.maxUpdate {
+			return nil, fmt.Errorf("%s: update indexes %d-%d overlap %s", name, t.header.minUpdate, t.header.maxUpdate, filepath.Base(prev.file))
+		}
+		s.tables = append(s.tables, t)
+		prev = t
+	}
+	return s, nil
+}
+
+// readReftable reads and validates a reftable: its header and footer, the
+// CRC of the footer, the ref blocks and the log blocks
+func readReftable(file string, format ObjectFormat) (*reftable, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reftable: %w", err)
+	}
+	t, err := parseReftable(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(file), err)
+	}
+	t.file = file
+	return t, nil
+}
+
+// parseReftable parses the contents of a reftable
+func parseReftable(data []byte, format ObjectFormat) (*reftable, error) {
+	h, err := parseReftableHeader(data, format)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < h.size()+h.footerSize() {
+		return nil, fmt.Errorf("truncated table")
+	}
+
+	footer := data[len(data)-h.footerSize():]
+	if !bytes.Equal(footer[:h.size()], data[:h.size()]) {
+		return nil, fmt.Errorf("footer does not repeat the header")
+	}
+	crcAt := len(footer) - 4
+	if crc32.ChecksumIEEE(footer[:crcAt]) != binary.BigEndian.Uint32(footer[crcAt:]) {
+		return nil, fmt.Errorf("footer checksum mismatch")
+	}
+
+	positions := footer[h.size():]
+	refIndex := binary.BigEndian.Uint64(positions[0:])
+	objPos := binary.BigEndian.Uint64(positions[8:]) >> 5
+	objIndex := binary.BigEndian.Uint64(positions[16:])
+	logPos := binary.BigEndian.Uint64(positions[24:])
+	logIndex := binary.BigEndian.Uint64(positions[32:])
+
+	footerAt := uint64(len(data) - h.footerSize())
+	for _, pos := range []uint64{refIndex, objPos, objIndex, logPos, logIndex} {
+		if pos > footerAt {
+			return nil, fmt.Errorf("section offset %d is past the footer", pos)
+		}
+	}
+	// The ref blocks end where the first other section starts
+	refEnd := footerAt
+	for _, pos := range []uint64{refIndex, objPos, objIndex, logPos} {
+		if pos != 0 && pos < refEnd {
+			refEnd = pos
+		}
+	}
+
+	t := &reftable{header: h}
+	if t.refs, err = parseRefBlocks(data[:refEnd], h, format); err != nil {
+		return nil, err
+	}
+	if logPos != 0 {
+		logEnd := footerAt
+		if logIndex != 0 {
+			logEnd = logIndex
+		}
+		if logPos > logEnd {
+			return nil, fmt.Errorf("log section ends before it starts")
+		}
+		if t.logs, err = parseLogBlocks(data[logPos:logEnd], format); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// parseReftableHeader parses the header a reftable starts with
+func parseReftableHeader(data []byte, format ObjectFormat) (reftableHeader, error) {
+	var h reftableHeader
+	if len(data) < 24 || string(data[:4]) != reftableMagic {
+		return h, fmt.Errorf("not a reftable")
+	}
+	h.version = int(data[4])
+	h.blockSize = int(readUint24(data[5:]))
+	h.minUpdate = binary.BigEndian.Uint64(data[8:])
+	h.maxUpdate = binary.BigEndian.Uint64(data[16:])
+
+	switch h.version {
+	case 1:
+		h.hashID = reftableHashSHA1
+	case 2:
+		if len(data) < 28 {
+			return h, fmt.Errorf("truncated header")
+		}
+		h.hashID = binary.BigEndian.Uint32(data[24:])
+	default:
+		return h, fmt.Errorf("unsupported version %d", h.version)
+	}
+
+	want := uint32(reftableHashSHA1)
+	if format == ObjectFormatSHA256 {
+		want = reftableHashSHA256
+	}
+	if h.hashID != want {
+		return h, fmt.Errorf("hash of the table does not match the %s repository", format)
+	}
+	if h.minUpdate > h.maxUpdate {
+		return h, fmt.Errorf("update index range %d-%d is reversed", h.minUpdate, h.maxUpdate)
+	}
+	return h, nil
+}
+
+// parseRefBlocks parses the ref blocks of a table. The first block includes
+// the file header, and blocks may be padded to the table's block size.
+func parseRefBlocks(data []byte, h reftableHeader, format ObjectFormat) ([]reftableRecord, error) {
+	var records []reftableRecord
+	off := 0
+	for off < len(data) {
+		skip := 0
+		if off == 0 {
+			skip = h.size()
+		}
+		if off+skip+4 > len(data) {
+			break
+		}
+		if data[off+skip] != 'r' {
+			if data[off+skip] == 0 {
+				break
+			}
+			return nil, fmt.Errorf("unexpected block type %q at offset %d", data[off+skip], off)
+		}
+		blockLen := int(readUint24(data[off+skip+1:]))
+		if blockLen < skip+4 || off+blockLen > len(data) {
+			return nil, fmt.Errorf("ref block at offset %d has bad length %d", off, blockLen)
+		}
+
+		block := data[off : off+blockLen]
+		err := parseBlockRecords(block, skip+4, func(r *blockReader, name string, kind int) error {
+			rec := reftableRecord{name: name, valueType: kind}
+			delta, err := r.varint()
+			if err != nil {
+				return err
+			}
+			rec.updateIndex = h.minUpdate + delta
+			if rec.updateIndex > h.maxUpdate {
+				return fmt.Errorf("%s: update index %d is outside the table", name, rec.updateIndex)
+			}
+			switch kind {
+			case reftableDeletion:
+			case reftableHash, reftableHashPeeled:
+				if rec.hash, err = r.hash(format); err != nil {
+					return err
+				}
+				if kind == reftableHashPeeled {
+					if rec.peeled, err = r.hash(format); err != nil {
+						return err
+					}
+				}
+			case reftableSymref:
+				target, err := r.sized()
+				if err != nil {
+					return err
+				}
+				rec.target = string(target)
+			default:
+				return fmt.Errorf("%s: unknown value type %d", name, kind)
+			}
+			records = append(records, rec)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("ref block at offset %d: %w", off, err)
+		}
+
+		// Blocks are padded with zeros to the block size unless the table is unaligned
+		next := h.blockSize
+		if h.blockSize == 0 || blockLen > h.blockSize || (off+blockLen < len(data) && data[off+blockLen] != 0) {
+			next = blockLen
+		}
+		off += next
+	}
+
+	for i := 1; i < len(records); i++ {
+		if records[i-1].name >= records[i].name {
+			return nil, fmt.Errorf("ref %s is out of order", records[i].name)
+		}
+	}
+	return records, nil
+}
+
+// parseLogBlocks parses the log blocks of a table. Each is zlib compressed
+// after its header and follows the previous one without padding.
+func parseLogBlocks(data []byte, format ObjectFormat) ([]reftableLog, error) {
+	var logs []reftableLog
+	off := 0
+	for off+4 <= len(data) && data[off] == 'g' {
+		inflated := int(readUint24(data[off+1:]))
+		if inflated < 4 {
+			return nil, fmt.Errorf("log block at offset %d has bad length %d", off, inflated)
+		}
+
+		src := bytes.NewReader(data[off+4:])
+		zr, err := zlib.NewReader(src)
+		if err != nil {
+			return nil, fmt.Errorf("log block at offset %d: %w", off, err)
+		}
+		block := make([]byte, inflated)
+		copy(block, data[off:off+4])
+		if _, err := io.ReadFull(zr, block[4:]); err != nil {
+			return nil, fmt.Errorf("log block at offset %d: %w", off, err)
+		}
+		// The zlib stream must end exactly where the inflated length says,
+		// and reading to its end verifies its checksum
+		if n, err := zr.Read(make([]byte, 1)); n != 0 {
+			return nil, fmt.Errorf("log block at offset %d is longer than its header says", off)
+		} else if err != io.EOF {
+			return nil, fmt.Errorf("log block at offset %d: %w", off, err)
+		}
+		zr.Close()
+		consumed := len(data[off+4:]) - src.Len()
+
+		err = parseBlockRecords(block, 4, func(r *blockReader, key string, kind int) error {
+			name, index, ok := strings.Cut(key, "\x00")
+			if !ok || len(index) != 8 {
+				return fmt.Errorf("malformed log key %q", key)
+			}
+			log := reftableLog{name: name, updateIndex: ^binary.BigEndian.Uint64([]byte(index))}
+			switch kind {
+			case 0:
+				log.deletion = true
+			case 1:
+				var err error
+				if log.oldHash, err = r.hash(format); err != nil {
+					return err
+				}
+				if log.newHash, err = r.hash(format); err != nil {
+					return err
+				}
+				who, err := r.sized()
+				if err != nil {
+					return err
+				}
+				email, err := r.sized()
+				if err != nil {
+					return err
+				}
+				if log.time, err = r.varint(); err != nil {
+					return err
+				}
+				tz, err := r.take(2)
+				if err != nil {
+					return err
+				}
+				log.who, log.email = string(who), string(email)
+				log.tzOffset = int16(binary.BigEndian.Uint16(tz))
+				message, err := r.sized()
+				if err != nil {
+					return err
+				}
+				log.message = string(message)
+			default:
+				return fmt.Errorf("%s: unknown log type %d", name, kind)
+			}
+			logs = append(logs, log)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("log block at offset %d: %w", off, err)
+		}
+		off += 4 + consumed
+	}
+	if off < len(data) && data[off] != 0 {
+		return nil, fmt.Errorf("unexpected block type %q in the log section", data[off])
+	}
+	return logs, nil
+}
+
+// parseBlockRecords walks the prefix-compressed records of a block, which
+// end at its restart table, calling value for each to read what follows the key
+func parseBlockRecords(block []byte, start int, value func(r *blockReader, key string, kind int) error) error {
+	if len(block) < start+2 {
+		return fmt.Errorf("truncated block")
+	}
+	restarts := int(binary.BigEndian.Uint16(block[len(block)-2:]))
+	end := len(block) - 2 - 3*restarts
+	if restarts == 0 || end < start {
+		return fmt.Errorf("bad restart table")
+	}
+	for i := 0; i < restarts; i++ {
+		at := int(readUint24(block[end+3*i:]))
+		if at < start || at >= end {
+			return fmt.Errorf("restart offset %d is outside the records", at)
+		}
+	}
+
+	r := &blockReader{data: block[:end], off: start}
+	var last []byte
+	for r.off < len(r.data) {
+		prefix, err := r.varint()
+		if err != nil {
+			return err
+		}
+		x, err := r.varint()
+		if err != nil {
+			return err
+		}
+		if prefix > uint64(len(last)) {
+			return fmt.Errorf("key prefix %d is longer than the previous key", prefix)
+		}
+		suffix, err := r.take(int(x >> 3))
+		if err != nil {
+			return err
+		}
+		key := append(append([]byte{}, last[:prefix]...), suffix...)
+		if err := value(r, string(key), int(x&7)); err != nil {
+			return err
+		}
+		last = key
+	}
+	return nil
+}
+
+// blockReader reads the fields of records in a block
+type blockReader struct {
+	data []byte
+	off  int
+}
+
+// varint reads a variable-length integer in git's encoding, where each
+// continuation adds one so every value has a single encoding
+func (r *blockReader) varint() (uint64, error) {
+	if r.off >= len(r.data) {
+		return 0, fmt.Errorf("truncated record")
+	}
+	c := r.data[r.off]
+	r.off++
+	val := uint64(c & 0x7f)
+	for c&0x80 != 0 {
+		if r.off >= len(r.data) || val+1 > (1<<57) {
+			return 0, fmt.Errorf("malformed varint")
+		}
+		c = r.data[r.off]
+		r.off++
+		val = (val+1)<<7 | uint64(c&0x7f)
+	}
+	return val, nil
+}
+
+// take reads n bytes
+func (r *blockReader) take(n int) ([]byte, error) {
+	if n < 0 || r.off+n > len(r.data) {
+		return nil, fmt.Errorf("truncated record")
+	}
+	b := r.data[r.off : r.off+n]
+	r.off += n
+	return b, nil
+}
+
+// sized reads a varint length followed by that many bytes
+func (r *blockReader) sized() ([]byte, error) {
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.data)) {
+		return nil, fmt.Errorf("truncated record")
+	}
+	return r.take(int(n))
+}
+
+// hash reads a binary object hash as hex
+func (r *blockReader) hash(format ObjectFormat) (string, error) {
+	b, err := r.take(format.HexSize() / 2)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// readUint24 reads a big-endian 24-bit integer
+func readUint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+// putVarint appends a varint in git's encoding
+func putVarint(b []byte, val uint64) []byte {
+	var buf [10]byte
+	pos := len(buf) - 1
+	buf[pos] = byte(val & 0x7f)
+	for val >>= 7; val != 0; val >>= 7 {
+		val--
+		pos--
+		buf[pos] = 0x80 | byte(val&0x7f)
+	}
+	return append(b, buf[pos:]...)
+}
+
+// refs returns the references of the stack with newer tables overriding
+// older ones and deleted references left out, sorted by name
+func (s *reftableStack) refs() []reftableRecord {
+	merged := make(map[string]reftableRecord)
+	for _, t := range s.tables {
+		for _, rec := range t.refs {
+			merged[rec.name] = rec
+		}
+	}
+	var records []reftableRecord
+	for _, rec := range merged {
+		if rec.valueType != reftableDeletion {
+			records = append(records, rec)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].name < records[j].name })
+	return records
+}
+
+// lookup returns the current record of a reference
+func (s *reftableStack) lookup(name string) (reftableRecord, bool) {
+	for i := len(s.tables) - 1; i >= 0; i-- {
+		for _, rec := range s.tables[i].refs {
+			if rec.name == name {
+				return rec, rec.valueType != reftableDeletion
+			}
+		}
+	}
+	return reftableRecord{}, false
+}
+
+// reflog returns the log entries of a reference, oldest first. Newer tables
+// override and delete the entries of older ones.
+func (s *reftableStack) reflog(name string) []reftableLog {
+	merged := make(map[uint64]reftableLog)
+	for _, t := range s.tables {
+		for _, log := range t.logs {
+			if log.name == name {
+				merged[log.updateIndex] = log
+			}
+		}
+	}
+	var logs []reftableLog
+	for _, log := range merged {
+		if !log.deletion {
+			logs = append(logs, log)
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].updateIndex < logs[j].updateIndex })
+	return logs
+}
+
+// maxUpdateIndex returns the newest update index of the stack
+func (s *reftableStack) maxUpdateIndex() uint64 {
+	if len(s.tables) == 0 {
+		return 0
+	}
+	return s.tables[len(s.tables)-1].header.maxUpdate
+}
+
+// add writes records as a new table on top of the stack, with log records
+// for the references it points at new hashes. Like git it takes
+// tables.list.lock first and reads the stack again under the lock, so
+// tables others added meanwhile are kept and update indexes keep increasing.
+func (s *reftableStack) add(records []reftableRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	list := filepath.Join(s.dir, "tables.list")
+	lock, err := lockFile(list)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	current, err := readReftableStack(s.dir, s.format)
+	if err != nil {
+		return err
+	}
+	index := current.maxUpdateIndex() + 1
+	for i := range records {
+		records[i].updateIndex = index
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].name < records[j].name })
+	// The last update of a reference wins
+	kept := records[:0]
+	for i, rec := range records {
+		if i+1 < len(records) && records[i+1].name == rec.name {
+			continue
+		}
+		kept = append(kept, rec)
+	}
+
+	data, err := encodeReftable(kept, current.logsFor(kept, index, time.Now()), index, s.format)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("0x%012x-0x%012x-%08x.ref", index, index, rand.Uint32())
+	file := filepath.Join(s.dir, name)
+	if err := writeLocked(file, data); err != nil {
+		return fmt.Errorf("failed to write reftable: %w", err)
+	}
+
+	var names []string
+	for _, t := range current.tables {
+		names = append(names, filepath.Base(t.file))
+	}
+	names = append(names, name)
+	if err := lock.commit([]byte(strings.Join(names, "\n") + "\n")); err != nil {
+		os.Remove(file)
+		return err
+	}
+
+	t, err := readReftable(file, s.format)
+	if err != nil {
+		return err
+	}
+	s.tables = append(current.tables, t)
+	return nil
+}
+
+// logsFor returns the log records git writes along with records: the old
+// and new hash of every reference pointed at a hash, also logged for HEAD
+// when it points at that reference
+func (s *reftableStack) logsFor(records []reftableRecord, index uint64, when time.Time) []reftableLog {
+	tz, _ := strconv.Atoi(when.Format("-0700"))
+	head, _ := s.lookup("HEAD")
+	logged := make(map[string]bool)
+	var logs []reftableLog
+	for _, rec := range records {
+		if rec.valueType != reftableHash && rec.valueType != reftableHashPeeled {
+			continue
+		}
+		old := s.format.NullHash()
+		if prev, ok := s.lookup(rec.name); ok && prev.hash != "" {
+			old = prev.hash
+		}
+		message := rec.message
+		if !strings.HasSuffix(message, "\n") {
+			message += "\n"
+		}
+
+		names := []string{rec.name}
+		if head.valueType == reftableSymref && head.target == rec.name {
+			names = append(names, "HEAD")
+		}
+		for _, name := range names {
+			if logged[name] {
+				continue
+			}
+			logged[name] = true
+			logs = append(logs, reftableLog{
+				name:        name,
+				updateIndex: index,
+				oldHash:     old,
+				newHash:     rec.hash,
+				who:         reflogName,
+				email:       reflogEmail,
+				time:        uint64(when.Unix()),
+				tzOffset:    int16(tz),
+				message:     message,
+			})
+		}
+	}
+	// Keys are the name and the reversed update index, which is the same here
+	sort.Slice(logs, func(i, j int) bool { return logs[i].name < logs[j].name })
+	return logs
+}
+
+// encodeReftable encodes ref and log records as a table without index or
+// obj sections. SHA-256 repositories need version 2, which names the hash.
+func encodeReftable(records []reftableRecord, logs []reftableLog, index uint64, format ObjectFormat) ([]byte, error) {
+	h := reftableHeader{version: 1, blockSize: reftableBlockSize, minUpdate: index, maxUpdate: index, hashID: reftableHashSHA1}
+	if format == ObjectFormatSHA256 {
+		h.version, h.hashID = 2, reftableHashSHA256
+	}
+	header := encodeReftableHeader(h)
+
+	refs := make([]blockRecord, len(records))
+	for i, rec := range records {
+		value, err := encodeRefValue(rec, h, format)
+		if err != nil {
+			return nil, err
+		}
+		refs[i] = blockRecord{key: rec.name, kind: rec.valueType, value: value}
+	}
+
+	var out []byte
+	for len(refs) > 0 {
+		skip := 0
+		if len(out) == 0 {
+			skip = len(header)
+		}
+		block, n, err := encodeBlock('r', refs, skip, h.blockSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(out) == 0 {
+			copy(block, header)
+		}
+		refs = refs[n:]
+		// Readers step from ref block to ref block by the block size
+		if len(refs) > 0 || len(logs) > 0 {
+			block = append(block, make([]byte, h.blockSize-len(block))...)
+		}
+		out = append(out, block...)
+	}
+	if len(out) == 0 {
+		out = append(out, header...)
+	}
+
+	logPos := 0
+	if len(logs) > 0 {
+		logPos = len(out)
+		entries := make([]blockRecord, len(logs))
+		for i, log := range logs {
+			value, err := encodeLogValue(log, format)
+			if err != nil {
+				return nil, err
+			}
+			key := binary.BigEndian.AppendUint64([]byte(log.name+"\x00"), ^log.updateIndex)
+			entries[i] = blockRecord{key: string(key), kind: 1, value: value}
+		}
+		for len(entries) > 0 {
+			block, n, err := encodeBlock('g', entries, 0, h.blockSize)
+			if err != nil {
+				return nil, err
+			}
+			entries = entries[n:]
+			// Log blocks are compressed after their header and not padded
+			var compressed bytes.Buffer
+			zw := zlib.NewWriter(&compressed)
+			zw.Write(block[4:])
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+			out = append(append(out, block[:4]...), compressed.Bytes()...)
+		}
+	}
+
+	footer := append([]byte{}, header...)
+	footer = append(footer, make([]byte, 3*8)...)
+	footer = binary.BigEndian.AppendUint64(footer, uint64(logPos))
+	footer = append(footer, make([]byte, 8)...)
+	footer = binary.BigEndian.AppendUint32(footer, crc32.ChecksumIEEE(footer))
+	return append(out, footer...), nil
+}
+
+// encodeReftableHeader encodes the header of a table
+func encodeReftableHeader(h reftableHeader) []byte {
+	b := []byte(reftableMagic)
+	b = append(b, byte(h.version), byte(h.blockSize>>16), byte(h.blockSize>>8), byte(h.blockSize))
+	b = binary.BigEndian.AppendUint64(b, h.minUpdate)
+	b = binary.BigEndian.AppendUint64(b, h.maxUpdate)
+	if h.version == 2 {
+		b = binary.BigEndian.AppendUint32(b, h.hashID)
+	}
+	return b
+}
+
+// encodeRefValue encodes what follows the key of a ref record
+func encodeRefValue(rec reftableRecord, h reftableHeader, format ObjectFormat) ([]byte, error) {
+	b := putVarint(nil, rec.updateIndex-h.minUpdate)
+	switch rec.valueType {
+	case reftableHash, reftableHashPeeled:
+		for _, hash := range []string{rec.hash, rec.peeled}[:rec.valueType] {
+			raw, err := decodeHex(hash, format)
+			if err != nil {
+				return nil, fmt.Errorf("failed to write %s: %w", rec.name, err)
+			}
+			b = append(b, raw...)
+		}
+	case reftableSymref:
+		b = putVarint(b, uint64(len(rec.target)))
+		b = append(b, rec.target...)
+	}
+	return b, nil
+}
+
+// encodeLogValue encodes what follows the key of a log update record
+func encodeLogValue(log reftableLog, format ObjectFormat) ([]byte, error) {
+	var b []byte
+	for _, hash := range []string{log.oldHash, log.newHash} {
+		raw, err := decodeHex(hash, format)
+		if err != nil {
+			return nil, fmt.Errorf("failed to log %s: %w", log.name, err)
+		}
+		b = append(b, raw...)
+	}
+	for _, field := range []string{log.who, log.email} {
+		b = putVarint(b, uint64(len(field)))
+		b = append(b, field...)
+	}
+	b = putVarint(b, log.time)
+	b = binary.BigEndian.AppendUint16(b, uint16(log.tzOffset))
+	b = putVarint(b, uint64(len(log.message)))
+	return append(b, log.message...), nil
+}
+
+// blockRecord is a record as a block stores it: its key and value type,
+// and the encoded value that follows them
+type blockRecord struct {
+	key   string
+	kind  int
+	value []byte
+}
+
+// encodeBlock encodes as many records as fit in one block of the given
+// type, leaving room for skip bytes of file header before it. It returns
+// the block and the number of records it holds.
+func encodeBlock(blockType byte, records []blockRecord, skip, blockSize int) ([]byte, int, error) {
+	block := make([]byte, skip+4)
+	block[skip] = blockType
+	var restarts []int
+	var last string
+	n := 0
+	for _, rec := range records {
+		restart := n%reftableRestartInterval == 0
+		prefix := 0
+		if !restart {
+			for prefix < len(last) && prefix < len(rec.key) && last[prefix] == rec.key[prefix] {
+				prefix++
+			}
+		}
+
+		var b []byte
+		b = putVarint(b, uint64(prefix))
+		b = putVarint(b, uint64(len(rec.key)-prefix)<<3|uint64(rec.kind))
+		b = append(b, rec.key[prefix:]...)
+		b = append(b, rec.value...)
+
+		restartCount := len(restarts)
+		if restart {
+			restartCount++
+		}
+		if len(block)+len(b)+3*restartCount+2 > blockSize {
+			if n == 0 {
+				name, _, _ := strings.Cut(rec.key, "\x00")
+				return nil, 0, fmt.Errorf("reference %s does not fit in a block", name)
+			}
+			break
+		}
+		if restart {
+			restarts = append(restarts, len(block))
+		}
+		block = append(block, b...)
+		last = rec.key
+		n++
+	}
+
+	for _, at := range restarts {
+		block = append(block, byte(at>>16), byte(at>>8), byte(at))
+	}
+	block = binary.BigEndian.AppendUint16(block, uint16(len(restarts)))
+	length := len(block)
+	block[skip+1], block[skip+2], block[skip+3] = byte(length>>16), byte(length>>8), byte(length)
+	return block, n, nil
+}
+
+// decodeHex decodes a hex hash of the object format
+func decodeHex(hash string, format ObjectFormat) ([]byte, error) {
+	if len(hash) != format.HexSize() || !isHash(strings.ToLower(hash)) {
+		return nil, fmt.Errorf("malformed hash %q", hash)
+	}
+	return hex.DecodeString(hash)
+}
@@ -0,0 +1,311 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testHash returns a hash of the object format made of one repeated digit
+func testHash(format ObjectFormat, digit string) string {
+	return strings.Repeat(digit, format.HexSize())
+}
+
+// testReftable returns ref and log records of every kind, as they are
+// read back from a table with the given update index
+func testReftable(format ObjectFormat, index uint64) ([]reftableRecord, []reftableLog) {
+	records := []reftableRecord{
+		{name: "HEAD", updateIndex: index, valueType: reftableSymref, target: "refs/heads/main"},
+		{name: "refs/heads/gone", updateIndex: index, valueType: reftableDeletion},
+		{name: "refs/heads/main", updateIndex: index, valueType: reftableHash, hash: testHash(format, "1")},
+		{name: "refs/tags/v1", updateIndex: index, valueType: reftableHashPeeled, hash: testHash(format, "2"), peeled: testHash(format, "1")},
+	}
+	logs := []reftableLog{
+		{name: "HEAD", updateIndex: index, oldHash: testHash(format, "0"), newHash: testHash(format, "1"),
+			who: "Test", email: "test@example.com", time: 1700000000, tzOffset: -700, message: "commit: first\n"},
+		{name: "refs/heads/main", updateIndex: index, oldHash: testHash(format, "0"), newHash: testHash(format, "1"),
+			who: "Test", email: "test@example.com", time: 1700000000, tzOffset: 130, message: "commit: first\n"},
+	}
+	return records, logs
+}
+
+func TestReftableRoundTrip(t *testing.T) {
+	for _, format := range []ObjectFormat{ObjectFormatSHA1, ObjectFormatSHA256} {
+		t.Run(string(format), func(t *testing.T) {
+			records, logs := testReftable(format, 7)
+			data, err := encodeReftable(records, logs, 7, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			table, err := parseReftable(data, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if table.header.minUpdate != 7 || table.header.maxUpdate != 7 {
+				t.Errorf("update indexes %d-%d, want 7-7", table.header.minUpdate, table.header.maxUpdate)
+			}
+			if !reflect.DeepEqual(table.refs, records) {
+				t.Errorf("refs:\n got %+v\nwant %+v", table.refs, records)
+			}
+			if !reflect.DeepEqual(table.logs, logs) {
+				t.Errorf("logs:\n got %+v\nwant %+v", table.logs, logs)
+			}
+
+			other := ObjectFormatSHA256
+			if format == ObjectFormatSHA256 {
+				other = ObjectFormatSHA1
+			}
+			if _, err := parseReftable(data, other); err == nil {
+				t.Errorf("%s table parsed as %s", format, other)
+			}
+		})
+	}
+}
+
+func TestReftableManyBlocks(t *testing.T) {
+	format := ObjectFormatSHA1
+	var records []reftableRecord
+	var logs []reftableLog
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("refs/heads/feature/%05d-%s", i, strings.Repeat("x", i%40))
+		hash := fmt.Sprintf("%040x", i+1)
+		records = append(records, reftableRecord{name: name, updateIndex: 3, valueType: reftableHash, hash: hash})
+		logs = append(logs, reftableLog{name: name, updateIndex: 3, oldHash: testHash(format, "0"), newHash: hash,
+			who: reflogName, email: reflogEmail, time: uint64(1700000000 + i), message: fmt.Sprintf("branch: created %d\n", i)})
+	}
+
+	data, err := encodeReftable(records, logs, 3, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 3*reftableBlockSize {
+		t.Fatalf("table of %d bytes does not span several blocks", len(data))
+	}
+	table, err := parseReftable(data, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(table.refs, records) {
+		t.Errorf("read back %d refs, wrote %d", len(table.refs), len(records))
+	}
+	if !reflect.DeepEqual(table.logs, logs) {
+		t.Errorf("read back %d logs, wrote %d", len(table.logs), len(logs))
+	}
+}
+
+func TestReftableDamaged(t *testing.T) {
+	format := ObjectFormatSHA1
+	records, logs := testReftable(format, 1)
+	data, err := encodeReftable(records, logs, 1, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		for size := 0; size < len(data); size++ {
+			if _, err := parseReftable(data[:size], format); err == nil {
+				t.Errorf("table truncated to %d of %d bytes parsed", size, len(data))
+			}
+		}
+	})
+
+	t.Run("footer checksum", func(t *testing.T) {
+		damaged := append([]byte{}, data...)
+		damaged[len(damaged)-1] ^= 0xff
+		if _, err := parseReftable(damaged, format); err == nil || !strings.Contains(err.Error(), "checksum") {
+			t.Errorf("got %v, want a checksum mismatch", err)
+		}
+	})
+
+	t.Run("compressed logs", func(t *testing.T) {
+		damaged := append([]byte{}, data...)
+		// The last bytes of the log block are its zlib checksum
+		footer := reftableHeader{version: 1}.footerSize()
+		damaged[len(damaged)-footer-1] ^= 0xff
+		if _, err := parseReftable(damaged, format); err == nil {
+			t.Error("table with a damaged log block parsed")
+		}
+	})
+
+	t.Run("every byte", func(t *testing.T) {
+		// Damage anywhere must be reported or survived, never panic
+		for i := range data {
+			damaged := append([]byte{}, data...)
+			damaged[i] ^= 0xff
+			parseReftable(damaged, format)
+		}
+	})
+}
+
+// newReftableStack creates an empty reftable stack
+func newReftableStack(t *testing.T) *reftableStack {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tables.list"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := readReftableStack(dir, ObjectFormatSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestReftableStackAdd(t *testing.T) {
+	format := ObjectFormatSHA1
+	s := newReftableStack(t)
+	// A second reader of the same stack that does not see the first's tables
+	stale, err := readReftableStack(s.dir, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rec := range []reftableRecord{
+		{name: "HEAD", valueType: reftableSymref, target: "refs/heads/main"},
+		{name: "refs/heads/main", valueType: reftableHash, hash: testHash(format, "1"), message: "first"},
+	} {
+		if err := s.add([]reftableRecord{rec}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.add([]reftableRecord{{name: "refs/heads/main", valueType: reftableHash, hash: testHash(format, "2"), message: "second"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stale.add([]reftableRecord{{name: "refs/heads/other", valueType: reftableHash, hash: testHash(format, "3")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := readReftableStack(s.dir, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.tables) != 4 || read.maxUpdateIndex() != 4 {
+		t.Fatalf("stack has %d tables up to update %d, want 4 up to 4", len(read.tables), read.maxUpdateIndex())
+	}
+	for name, want := range map[string]string{"refs/heads/main": testHash(format, "2"), "refs/heads/other": testHash(format, "3")} {
+		if rec, ok := read.lookup(name); !ok || rec.hash != want {
+			t.Errorf("%s is %q, want %s", name, rec.hash, want)
+		}
+	}
+
+	// HEAD points at main, so both are logged
+	for _, name := range []string{"refs/heads/main", "HEAD"} {
+		log := read.reflog(name)
+		if len(log) != 2 {
+			t.Fatalf("%s has %d log entries, want 2", name, len(log))
+		}
+		if log[0].oldHash != format.NullHash() || log[0].newHash != log[1].oldHash || log[1].newHash != testHash(format, "2") {
+			t.Errorf("%s log does not chain: %+v", name, log)
+		}
+		if log[1].message != "second\n" || log[1].who != reflogName || log[1].email != reflogEmail {
+			t.Errorf("%s log entry is %+v", name, log[1])
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(s.dir, "tables.list.lock")); !os.IsNotExist(err) {
+		t.Error("tables.list.lock was left behind")
+	}
+}
+
+func TestReftableStackAddLocked(t *testing.T) {
+	s := newReftableStack(t)
+	lock := filepath.Join(s.dir, "tables.list.lock")
+	if err := os.WriteFile(lock, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := s.add([]reftableRecord{{name: "refs/heads/main", valueType: reftableHash, hash: testHash(ObjectFormatSHA1, "1")}})
+	if err == nil {
+		t.Fatal("added a table while tables.list is locked")
+	}
+	content, _ := os.ReadFile(filepath.Join(s.dir, "tables.list"))
+	if len(content) != 0 {
+		t.Errorf("tables.list changed under someone else's lock: %q", content)
+	}
+}
+
+// newReftableRepo creates a repository with reftable references, skipping
+// the test when git is missing or too old to create one
+func newReftableRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	if _, err := tryGit(dir, "init", "-q", "--ref-format=reftable"); err != nil {
+		t.Skip("git cannot create reftable repositories")
+	}
+	return dir
+}
+
+func TestReftableWithGit(t *testing.T) {
+	dir := newReftableRepo(t)
+	commitFile(t, dir, "a.txt", "a")
+	second := commitFile(t, dir, "a.txt", "b")
+	runGit(t, dir, "branch", "side", "HEAD~1")
+	runGit(t, dir, "tag", "-a", "-m", "Release", "v1")
+	runGit(t, dir, "tag", "light")
+
+	format := ObjectFormatSHA1
+	stack, err := readReftableStack(filepath.Join(dir, ".git", "reftable"), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make(map[string]string)
+	for _, line := range splitLines(runGit(t, dir, "for-each-ref", "--format=%(refname) %(objectname)")) {
+		name, hash, _ := strings.Cut(line, " ")
+		want[name] = hash
+	}
+	got := make(map[string]string)
+	for _, rec := range stack.refs() {
+		if rec.valueType != reftableSymref {
+			got[rec.name] = rec.hash
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("refs:\n got %v\nwant %v", got, want)
+	}
+	if head, ok := stack.lookup("HEAD"); !ok || head.target != "refs/heads/"+runGit(t, dir, "branch", "--show-current") {
+		t.Errorf("HEAD is %+v", head)
+	}
+	if log := stack.reflog("refs/heads/" + runGit(t, dir, "branch", "--show-current")); len(log) != 2 || log[1].newHash != second {
+		t.Errorf("branch log is %+v", log)
+	}
+
+	// git reads back what nsha writes
+	refs, err := openRefStorage(Options{RepoPath: dir}.gitDir(), filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := runGit(t, dir, "rev-parse", "HEAD~1")
+	if err := refs.Update(refUpdate{Name: "refs/heads/side", Hash: second, Message: "nsha: test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := refs.Update(refUpdate{Name: "refs/tags/light", Delete: true}); err != nil {
+		t.Fatal(err)
+	}
+	if hash := runGit(t, dir, "rev-parse", "refs/heads/side"); hash != second {
+		t.Errorf("git reads side as %s, want %s", hash, second)
+	}
+	if _, err := tryGit(dir, "rev-parse", "--verify", "-q", "refs/tags/light"); err == nil {
+		t.Error("git still sees the deleted tag")
+	}
+	if log := runGit(t, dir, "reflog", "show", "--format=%H %gs", "refs/heads/side"); !strings.HasPrefix(log, second+" nsha: test\n"+first) {
+		t.Errorf("git reflog of side is:\n%s", log)
+	}
+	if out, err := tryGit(dir, "fsck", "--no-progress"); err != nil {
+		t.Errorf("git fsck: %v\n%s", err, out)
+	}
+
+	// Tables git writes after nsha's continue the update indexes
+	commitFile(t, dir, "a.txt", "c")
+	if _, err := readReftableStack(filepath.Join(dir, ".git", "reftable"), format); err != nil {
+		t.Errorf("stack after git wrote again: %v", err)
+	}
+}
@@ -1,107 +1,100 @@
 package git
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"time"
 
-	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
 // CreateEmptyTree creates an empty tree object in the repository
-func CreateEmptyTree(repoPath string) (string, error) {
-	repo, err := git.PlainOpen(repoPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to open repository: %w", err)
-	}
-
-	// Create empty tree
-	tree := &object.Tree{
-		Entries: []object.TreeEntry{},
-	}
-
-	obj := repo.Storer.NewEncodedObject()
-	obj.SetType(plumbing.TreeObject)
-	
-	err = tree.Encode(obj)
-	if err != nil {
-		return "", fmt.Errorf("failed to encode tree: %w", err)
+func CreateEmptyTree(ctx context.Context, opts Options) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
 	}
 
-	hash, err := repo.Storer.SetEncodedObject(obj)
+	// git mktree works for every object format
+	cmd := gitCommand(ctx, opts.RepoPath, "mktree")
+	cmd.Stdin = strings.NewReader("")
+	output, err := cmd.Output()
 	if err != nil {
 		return "", fmt.Errorf("failed to store tree: %w", err)
 	}
 
-	return hash.String(), nil
+	return strings.TrimSpace(string(output)), nil
 }
 
 // ReplaceCommit creates a replace reference for a bad commit
-func ReplaceCommit(repoPath string, badCommit BadCommit) error {
-	repo, err := git.PlainOpen(repoPath)
+func ReplaceCommit(ctx context.Context, opts Options, badCommit BadCommit) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	repo, err := openStore(ctx, opts)
 	if err != nil {
 		return fmt.Errorf("failed to open repository: %w", err)
 	}
+	defer repo.Close()
 
-	// Get the bad commit
-	hash := plumbing.NewHash(badCommit.Hash)
-	oldCommit, err := repo.CommitObject(hash)
-	if err != nil {
-		// If we can't read the commit, create a minimal one
-		return createMinimalReplacement(repo, badCommit)
+	// A fixer that rebuilt the commit's tree, e.g. from a salvaged malformed
+	// tree, has already replaced it with something better than an empty tree
+	if _, err := repo.Reference(fmt.Sprintf("refs/replace/%s", badCommit.Hash)); err == nil {
+		return nil
 	}
 
+	// Replace refs change which commits git sees
+	opts.Diagnosis.InvalidateAll()
+
 	// Get or create empty tree
-	emptyTreeHash := plumbing.NewHash(EmptyTreeHash)
+	emptyTreeHash := opts.objectFormat().EmptyTree()
 	
 	// Try to get the tree, if it doesn't exist, create it
-	_, err = repo.TreeObject(emptyTreeHash)
+	_, err = repo.Tree(emptyTreeHash)
 	if err != nil {
-		emptyTreeStr, err := CreateEmptyTree(repoPath)
+		emptyTreeHash, err = CreateEmptyTree(ctx, opts)
 		if err != nil {
 			return fmt.Errorf("failed to create empty tree: %w", err)
 		}
-		emptyTreeHash = plumbing.NewHash(emptyTreeStr)
 	}
 
-	// Create new commit with valid tree
-	newCommit := &object.Commit{
+	// Get the bad commit
+	oldCommit, err := repo.Commit(badCommit.Hash)
+	if err != nil {
+		// If we can't read the commit, create a minimal one
+		return createMinimalReplacement(repo, badCommit, emptyTreeHash)
+	}
+
+	// Create new commit with valid tree, keeping the headers but signatures
+	headers, signed := oldCommit.Unsigned()
+	if signed {
+		opts.emit().Warnf("Dropping the signature of commit %s, it does not match the replacement", badCommit.Hash[:8])
+	}
+	newCommit := &Commit{
 		Author:    oldCommit.Author,
 		Committer: oldCommit.Committer,
 		Message:   oldCommit.Message,
-		TreeHash:  emptyTreeHash,
+		Tree:      emptyTreeHash,
+		Headers:   headers,
 	}
 
 	// Set parent if exists and is valid
-	if badCommit.ParentHash != "" && badCommit.ParentHash != "0000000000000000000000000000000000000000" {
-		parentHash := plumbing.NewHash(badCommit.ParentHash)
+	if badCommit.ParentHash != "" && !isNullHash(badCommit.ParentHash) {
 		// Verify parent exists
-		_, err := repo.CommitObject(parentHash)
-		if err == nil {
-			newCommit.ParentHashes = []plumbing.Hash{parentHash}
+		if hasCommit(repo, badCommit.ParentHash) {
+			newCommit.Parents = []string{badCommit.ParentHash}
 		}
 	}
 
 	// Store the new commit
-	obj := repo.Storer.NewEncodedObject()
-	obj.SetType(plumbing.CommitObject)
-	
-	err = newCommit.Encode(obj)
-	if err != nil {
-		return fmt.Errorf("failed to encode commit: %w", err)
-	}
-
-	newHash, err := repo.Storer.SetEncodedObject(obj)
+	newHash, err := repo.WriteCommit(newCommit)
 	if err != nil {
-		return fmt.Errorf("failed to store commit: %w", err)
+		return err
 	}
 
 	// Create replace reference
-	refName := plumbing.ReferenceName(fmt.Sprintf("refs/replace/%s", badCommit.Hash))
-	ref := plumbing.NewHashReference(refName, newHash)
-
-	err = repo.Storer.SetReference(ref)
+	err = repo.SetReference(fmt.Sprintf("refs/replace/%s", badCommit.Hash), newHash)
 	if err != nil {
 		return fmt.Errorf("failed to create replace reference: %w", err)
 	}
@@ -110,19 +103,7 @@ func ReplaceCommit(repoPath string, badCommit BadCommit) error {
 }
 
 // createMinimalReplacement creates a minimal commit when the original is unreadable
-func createMinimalReplacement(repo *git.Repository, badCommit BadCommit) error {
-	emptyTreeHash := plumbing.NewHash(EmptyTreeHash)
-	
-	// Create empty tree if it doesn't exist
-	_, err := repo.TreeObject(emptyTreeHash)
-	if err != nil {
-		tree := &object.Tree{Entries: []object.TreeEntry{}}
-		obj := repo.Storer.NewEncodedObject()
-		obj.SetType(plumbing.TreeObject)
-		tree.Encode(obj)
-		emptyTreeHash, _ = repo.Storer.SetEncodedObject(obj)
-	}
-
+func createMinimalReplacement(repo store, badCommit BadCommit, emptyTreeHash string) error {
 	now := time.Now()
 	sig := object.Signature{
 		Name:  "NSHA Tool",
@@ -130,38 +111,53 @@ func createMinimalReplacement(repo *git.Repository, badCommit BadCommit) error {
 		When:  now,
 	}
 
-	newCommit := &object.Commit{
+	newCommit := &Commit{
 		Author:    sig,
 		Committer: sig,
 		Message:   badCommit.Message,
-		TreeHash:  emptyTreeHash,
+		Tree:      emptyTreeHash,
 	}
 
 	if badCommit.ParentHash != "" {
-		newCommit.ParentHashes = []plumbing.Hash{plumbing.NewHash(badCommit.ParentHash)}
+		newCommit.Parents = []string{badCommit.ParentHash}
 	}
 
-	obj := repo.Storer.NewEncodedObject()
-	obj.SetType(plumbing.CommitObject)
-	newCommit.Encode(obj)
-	
-	newHash, err := repo.Storer.SetEncodedObject(obj)
+	newHash, err := repo.WriteCommit(newCommit)
 	if err != nil {
 		return err
 	}
 
-	refName := plumbing.ReferenceName(fmt.Sprintf("refs/replace/%s", badCommit.Hash))
-	ref := plumbing.NewHashReference(refName, newHash)
-	
-	return repo.Storer.SetReference(ref)
+	return repo.SetReference(fmt.Sprintf("refs/replace/%s", badCommit.Hash), newHash)
+}
+
+// ExpireBrokenReflogs drops reflog entries whose commits can no longer be
+// read completely, e.g. ones whose tree was quarantined. git fsck reports
+// them as broken links otherwise.
+func ExpireBrokenReflogs(ctx context.Context, opts Options) error {
+	output, err := gitCommand(ctx, opts.RepoPath, "reflog", "expire", "--stale-fix", "--expire=never", "--expire-unreachable=never", "--all").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to expire broken reflog entries: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	opts.Diagnosis.InvalidateAll()
+	return nil
 }
 
-// CleanupReplaceRefs removes all replace references
-func CleanupReplaceRefs(repoPath string) error {
-	repo, err := git.PlainOpen(repoPath)
+// CleanupReplaceRefs removes all replace references.
+// It is also used to roll back an interrupted fix, so callers may pass a
+// context that is no longer cancellable.
+func CleanupReplaceRefs(ctx context.Context, opts Options) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	repo, err := openStore(ctx, opts)
 	if err != nil {
 		return fmt.Errorf("failed to open repository: %w", err)
 	}
+	defer repo.Close()
+
+	// Replace refs change which commits git sees
+	opts.Diagnosis.InvalidateAll()
 
 	refs, err := repo.References()
 	if err != nil {
@@ -169,19 +165,14 @@ func CleanupReplaceRefs(repoPath string) error {
 	}
 
 	var replaceRefs []string
-	err = refs.ForEach(func(ref *plumbing.Reference) error {
-		if ref.Name().String()[:13] == "refs/replace/" {
-			replaceRefs = append(replaceRefs, ref.Name().String())
+	for _, ref := range refs {
+		if strings.HasPrefix(ref.Name, "refs/replace/") {
+			replaceRefs = append(replaceRefs, ref.Name)
 		}
-		return nil
-	})
-
-	if err != nil {
-		return err
 	}
 
 	for _, refName := range replaceRefs {
-		err = repo.Storer.RemoveReference(plumbing.ReferenceName(refName))
+		err = repo.RemoveReference(refName)
 		if err != nil {
 			return fmt.Errorf("failed to remove %s: %w", refName, err)
 		}
@@ -190,3 +181,21 @@ func CleanupReplaceRefs(repoPath string) error {
 	return nil
 }
 
+
+// RemoveReplaceRef removes the replace reference for a single commit
+func RemoveReplaceRef(ctx context.Context, opts Options, commitHash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	repo, err := openStore(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+	defer repo.Close()
+
+	// Replace refs change which commits git sees
+	opts.Diagnosis.InvalidateAll()
+
+	return repo.RemoveReference(fmt.Sprintf("refs/replace/%s", commitHash))
+}
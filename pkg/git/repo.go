@@ -0,0 +1,50 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/filesystem/dotgit"
+	"github.com/rahul/nsha/pkg/gitdir"
+)
+
+// ErrUnsupportedObjectFormat is returned when go-git is asked to open a
+// repository whose object format it cannot read
+var ErrUnsupportedObjectFormat = errors.New("object format not supported by go-git")
+
+// openRepo opens the repository at repoPath with go-git. Unlike
+// git.PlainOpen it understands every layout gitdir.Resolve does, so bare
+// repositories, gitfiles and GIT_DIR all open the same git data git uses.
+// go-git truncates hashes of other object formats to SHA-1 length, so only
+// SHA-1 repositories are opened; use openStore for the others.
+func openRepo(repoPath string) (*git.Repository, error) {
+	d, err := gitdir.Resolve(repoPath)
+	if err != nil {
+		return nil, git.ErrRepositoryNotExists
+	}
+	if format := objectFormat(d); format != ObjectFormatSHA1 {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedObjectFormat, format)
+	}
+
+	var fs billy.Filesystem = osfs.New(d.GitDir)
+	if d.CommonDir != d.GitDir {
+		fs = dotgit.NewRepositoryFilesystem(fs, osfs.New(d.CommonDir))
+	}
+	storer := filesystem.NewStorage(fs, cache.NewObjectLRUDefault())
+
+	var worktree billy.Filesystem
+	if !d.Bare() {
+		worktree = osfs.New(d.WorkTree)
+	}
+	return git.Open(storer, worktree)
+}
+
+// gitDir resolves where the repository keeps its git data
+func (o Options) gitDir() *gitdir.Dir {
+	return gitdir.ResolveOrDefault(o.RepoPath)
+}
@@ -0,0 +1,217 @@
+package git
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/idxfile"
+)
+
+// ErrShallowBoundary is returned when a history rewrite would change a commit
+// at the shallow boundary. Its parents are not in the repository, so the
+// rewritten commit would point at history git does not have.
+var ErrShallowBoundary = errors.New("history rewrite would cross the shallow boundary")
+
+// Absences describes the objects a repository is missing by design: history
+// beyond the boundary of a shallow clone and objects a partial clone left on
+// its promisor remote
+type Absences struct {
+	Shallow  map[string]bool // Boundary commits listed in .git/shallow
+	beyond   map[string]bool // Parents of boundary commits, which are not fetched
+	promisor []*idxfile.MemoryIndex
+
+	// Objects of promisor packs in repositories go-git cannot decode
+	// pack indexes of, as listed by git show-index
+	promisorObjects map[string]bool
+}
+
+// LoadAbsences reads .git/shallow and the indexes of promisor packs
+func LoadAbsences(ctx context.Context, opts Options) (*Absences, error) {
+	d := opts.gitDir()
+	a := &Absences{Shallow: make(map[string]bool), beyond: make(map[string]bool)}
+
+	if f, err := os.Open(d.Path("shallow")); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if hash := strings.TrimSpace(scanner.Text()); hash != "" {
+				a.Shallow[hash] = true
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read shallow file: %w", err)
+		}
+	}
+
+	if len(a.Shallow) > 0 {
+		if repo, err := openStore(ctx, opts); err == nil {
+			for hash := range a.Shallow {
+				commit, err := repo.Commit(hash)
+				if err != nil {
+					continue
+				}
+				for _, parent := range commit.Parents {
+					a.beyond[parent] = true
+				}
+			}
+			repo.Close()
+		}
+	}
+
+	markers, _ := filepath.Glob(d.Path("objects", "pack", "*.promisor"))
+	for _, marker := range markers {
+		file := strings.TrimSuffix(marker, ".promisor") + ".idx"
+		if opts.objectFormat() != ObjectFormatSHA1 {
+			if err := a.listPackIndex(ctx, opts, file); err != nil {
+				opts.emit().Debugf("Skipping promisor pack %s: %v", filepath.Base(marker), err)
+			}
+			continue
+		}
+		idx, err := readPackIndex(file)
+		if err != nil {
+			opts.emit().Debugf("Skipping promisor pack %s: %v", filepath.Base(marker), err)
+			continue
+		}
+		a.promisor = append(a.promisor, idx)
+	}
+
+	return a, nil
+}
+
+// readPackIndex decodes a pack .idx file
+func readPackIndex(file string) (*idxfile.MemoryIndex, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	idx := idxfile.NewMemoryIndex()
+	if err := idxfile.NewDecoder(bufio.NewReader(f)).Decode(idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// listPackIndex adds the objects of a pack index to promisorObjects
+func (a *Absences) listPackIndex(ctx context.Context, opts Options, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cmd := gitCommand(ctx, opts.RepoPath, "show-index")
+	cmd.Stdin = f
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("git show-index: %w", err)
+	}
+	if a.promisorObjects == nil {
+		a.promisorObjects = make(map[string]bool)
+	}
+	for _, line := range splitLines(string(output)) {
+		// "<offset> <hash> (<crc>)"
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			a.promisorObjects[fields[1]] = true
+		}
+	}
+	return nil
+}
+
+// IsShallow reports whether the repository is a shallow clone
+func (a *Absences) IsShallow() bool {
+	return a != nil && len(a.Shallow) > 0
+}
+
+// IsPartial reports whether the repository has promisor packs, i.e. is a partial clone
+func (a *Absences) IsPartial() bool {
+	return a != nil && (len(a.promisor) > 0 || len(a.promisorObjects) > 0)
+}
+
+// AtShallowBoundary reports whether a commit is listed in .git/shallow, so
+// its parents are missing on purpose
+func (a *Absences) AtShallowBoundary(hash string) bool {
+	return a != nil && a.Shallow[hash]
+}
+
+// BeyondShallow reports whether a commit lies beyond the shallow boundary
+func (a *Absences) BeyondShallow(hash string) bool {
+	return a != nil && a.beyond[hash]
+}
+
+// promised reports whether an object came from a promisor pack. Objects such
+// an object refers to may be missing and are fetched on demand.
+func (a *Absences) promised(hash string) bool {
+	if a == nil {
+		return false
+	}
+	if a.promisorObjects[hash] {
+		return true
+	}
+	h := plumbing.NewHash(hash)
+	for _, idx := range a.promisor {
+		if ok, err := idx.Contains(h); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Expected reports whether an issue is only an object the repository is
+// missing by design
+func (a *Absences) Expected(issue Issue) bool {
+	switch issue.Type {
+	case IssueTypeMissingTree:
+		// Trees filtered out of a partial clone, e.g. with --filter=tree:0
+		return a.promised(issue.Commit)
+	case IssueTypeMissingCommit:
+		return a.BeyondShallow(missingHash(issue))
+	}
+	return false
+}
+
+// missingHash returns the hash of the missing object an issue is about: its
+// Object, or the first full hash in the fsck line for fsck issues
+func missingHash(issue Issue) string {
+	if isHash(issue.Object) {
+		return issue.Object
+	}
+	for _, field := range strings.Fields(issue.Message) {
+		if field = strings.Trim(field, ":,()"); isHash(field) {
+			return field
+		}
+	}
+	return ""
+}
+
+// checkShallowRewrite returns ErrShallowBoundary when any of the commits is a
+// shallow boundary commit or lies beyond the boundary
+func (a *Absences) checkShallowRewrite(hashes []string) error {
+	for _, hash := range hashes {
+		if a.Shallow[hash] || a.BeyondShallow(hash) {
+			return fmt.Errorf("%w: commit %s", ErrShallowBoundary, hash[:8])
+		}
+	}
+	return nil
+}
+
+// CheckShallowRewrite returns ErrShallowBoundary when replacing the given bad
+// commits would rewrite history across the shallow boundary
+func CheckShallowRewrite(ctx context.Context, opts Options, badCommits []BadCommit) error {
+	a, err := LoadAbsences(ctx, opts)
+	if err != nil || !a.IsShallow() {
+		return err
+	}
+	hashes := make([]string, 0, len(badCommits))
+	for _, bc := range badCommits {
+		hashes = append(hashes, bc.Hash)
+	}
+	return a.checkShallowRewrite(hashes)
+}
@@ -0,0 +1,533 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/rahul/nsha/pkg/gitdir"
+)
+
+// Ref is a reference as the repository stores it
+type Ref struct {
+	Name   string
+	Hash   string // Object a direct reference points at
+	Target string // Reference a symbolic reference points at; empty for direct references
+}
+
+// Symbolic reports whether the reference points at another reference
+func (r Ref) Symbolic() bool {
+	return r.Target != ""
+}
+
+// IsBranch reports whether the reference is a branch
+func (r Ref) IsBranch() bool {
+	return plumbing.ReferenceName(r.Name).IsBranch()
+}
+
+// IsTag reports whether the reference is a tag
+func (r Ref) IsTag() bool {
+	return plumbing.ReferenceName(r.Name).IsTag()
+}
+
+// Short returns the reference name without its refs/heads/ or refs/tags/ prefix
+func (r Ref) Short() string {
+	return plumbing.ReferenceName(r.Name).Short()
+}
+
+// Commit is a decoded commit object
+type Commit struct {
+	Hash      string
+	Tree      string
+	Parents   []string
+	Author    object.Signature
+	Committer object.Signature
+	Message   string
+
+	// Headers holds the other header lines, such as encoding, mergetag and
+	// gpgsig, as stored and in order. Each includes its continuation lines.
+	Headers []string
+}
+
+// signatureHeaders are the commit headers that sign the commit's content
+var signatureHeaders = []string{"gpgsig", "gpgsig-sha256"}
+
+// Unsigned returns the headers of a commit without its signatures, which no
+// longer match once anything in the commit changes, and whether it had any
+func (c *Commit) Unsigned() ([]string, bool) {
+	var headers []string
+	signed := false
+	for _, header := range c.Headers {
+		key, _, _ := strings.Cut(header, " ")
+		if slices.Contains(signatureHeaders, key) {
+			signed = true
+			continue
+		}
+		headers = append(headers, header)
+	}
+	return headers, signed
+}
+
+// TreeEntry is one entry of a tree object
+type TreeEntry struct {
+	Name string
+	Mode filemode.FileMode
+	Hash string
+}
+
+// store reads and writes the objects and references of a repository. go-git
+// only understands SHA-1 repositories, so other object formats are read and
+// written through git itself.
+type store interface {
+	References() ([]Ref, error)
+	Reference(name string) (Ref, error)
+	Commit(hash string) (*Commit, error)
+	Tree(hash string) ([]TreeEntry, error)
+	Blob(hash string) ([]byte, error)
+	WriteCommit(c *Commit) (string, error)
+	SetReference(name, hash string) error
+	RemoveReference(name string) error
+	Close() error
+}
+
+// openStore opens the repository with the store matching its object format
+func openStore(ctx context.Context, opts Options) (store, error) {
+	d, err := gitdir.Resolve(opts.RepoPath)
+	if err != nil {
+		return nil, git.ErrRepositoryNotExists
+	}
+	// go-git only reads loose and packed references
+	if format := objectFormat(d); format != ObjectFormatSHA1 || refStorageFormat(d) == RefStorageReftable {
+		return &gitStore{ctx: ctx, repoPath: opts.RepoPath, dir: d, format: format, commits: make(map[string]*Commit)}, nil
+	}
+
+	repo, err := openRepo(opts.RepoPath)
+	if err != nil {
+		return nil, err
+	}
+	return &goGitStore{repo: repo, dir: d}, nil
+}
+
+// symrefMaxDepth is how many symbolic references git follows before giving up
+const symrefMaxDepth = 5
+
+// resolveReference follows symbolic references to the one holding a hash
+func resolveReference(s store, name string) (Ref, error) {
+	for i := 0; i < symrefMaxDepth; i++ {
+		ref, err := s.Reference(name)
+		if err != nil {
+			return Ref{}, err
+		}
+		if !ref.Symbolic() {
+			return ref, nil
+		}
+		name = ref.Target
+	}
+	return Ref{}, fmt.Errorf("too many levels of symbolic references at %s", name)
+}
+
+// hasCommit reports whether hash names a readable commit
+func hasCommit(s store, hash string) bool {
+	_, err := s.Commit(hash)
+	return err == nil
+}
+
+// goGitStore is the store of SHA-1 repositories
+type goGitStore struct {
+	repo *git.Repository
+	dir  *gitdir.Dir
+}
+
+func (s *goGitStore) References() ([]Ref, error) {
+	iter, err := s.repo.References()
+	if err != nil {
+		return nil, err
+	}
+	var refs []Ref
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		refs = append(refs, fromPlumbing(ref))
+		return nil
+	})
+	return refs, err
+}
+
+func (s *goGitStore) Reference(name string) (Ref, error) {
+	ref, err := s.repo.Reference(plumbing.ReferenceName(name), false)
+	if err != nil {
+		return Ref{}, err
+	}
+	return fromPlumbing(ref), nil
+}
+
+// fromPlumbing converts a go-git reference
+func fromPlumbing(ref *plumbing.Reference) Ref {
+	if ref.Type() == plumbing.SymbolicReference {
+		return Ref{Name: ref.Name().String(), Target: ref.Target().String()}
+	}
+	return Ref{Name: ref.Name().String(), Hash: ref.Hash().String()}
+}
+
+// Commit decodes the raw object like gitStore does, as go-git drops headers
+// it does not know
+func (s *goGitStore) Commit(hash string) (*Commit, error) {
+	obj, err := s.repo.Storer.EncodedObject(plumbing.CommitObject, plumbing.NewHash(hash))
+	if err != nil {
+		return nil, err
+	}
+	r, err := obj.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return decodeCommit(obj.Hash().String(), content), nil
+}
+
+func (s *goGitStore) Tree(hash string) ([]TreeEntry, error) {
+	tree, err := s.repo.TreeObject(plumbing.NewHash(hash))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]TreeEntry, len(tree.Entries))
+	for i, entry := range tree.Entries {
+		entries[i] = TreeEntry{Name: entry.Name, Mode: entry.Mode, Hash: entry.Hash.String()}
+	}
+	return entries, nil
+}
+
+func (s *goGitStore) Blob(hash string) ([]byte, error) {
+	blob, err := s.repo.BlobObject(plumbing.NewHash(hash))
+	if err != nil {
+		return nil, err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (s *goGitStore) WriteCommit(c *Commit) (string, error) {
+	obj := s.repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.CommitObject)
+	w, err := obj.Writer()
+	if err != nil {
+		return "", fmt.Errorf("failed to encode commit: %w", err)
+	}
+	if _, err := w.Write(encodeCommit(c)); err != nil {
+		return "", fmt.Errorf("failed to encode commit: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("failed to encode commit: %w", err)
+	}
+	hash, err := s.repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return "", fmt.Errorf("failed to store commit: %w", err)
+	}
+	return hash.String(), nil
+}
+
+// SetReference writes through the ref storage rather than go-git, so the
+// reference is locked while it is written and the update is logged
+func (s *goGitStore) SetReference(name, hash string) error {
+	return updateRefStorage(s.dir, refUpdate{Name: name, Hash: hash})
+}
+
+func (s *goGitStore) RemoveReference(name string) error {
+	return updateRefStorage(s.dir, refUpdate{Name: name, Delete: true})
+}
+
+func (s *goGitStore) Close() error {
+	return nil
+}
+
+// gitStore is the store of repositories go-git cannot read. Objects are read
+// from a long-running git cat-file --batch and references from their files.
+type gitStore struct {
+	ctx      context.Context
+	repoPath string
+	dir      *gitdir.Dir
+	format   ObjectFormat
+	commits  map[string]*Commit // Decoded commits; history walks read them many times
+
+	batch  *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// command builds a git command that sees objects as stored, ignoring replace refs
+func (s *gitStore) command(args ...string) *exec.Cmd {
+	cmd := gitCommand(s.ctx, s.repoPath, args...)
+	cmd.Env = append(cmd.Env, "GIT_NO_REPLACE_OBJECTS=1")
+	return cmd
+}
+
+// readObject returns the type and content of an object. Hashes that are not
+// full hashes of the repository's format are never looked up, so git does
+// not resolve them as revisions.
+func (s *gitStore) readObject(hash string) (string, []byte, error) {
+	if len(hash) != s.format.HexSize() || !isHash(hash) || isNullHash(hash) {
+		return "", nil, plumbing.ErrObjectNotFound
+	}
+
+	if s.batch == nil {
+		cmd := s.command("cat-file", "--batch")
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return "", nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return "", nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return "", nil, fmt.Errorf("failed to start git cat-file: %w", err)
+		}
+		s.batch, s.stdin, s.stdout = cmd, stdin, bufio.NewReader(stdout)
+	}
+
+	if _, err := fmt.Fprintln(s.stdin, hash); err != nil {
+		return "", nil, fmt.Errorf("failed to read object %s: %w", hash, err)
+	}
+	header, err := s.stdout.ReadString('\n')
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read object %s: %w", hash, err)
+	}
+
+	// "<hash> <type> <size>", or "<hash> missing"
+	fields := strings.Fields(header)
+	if len(fields) != 3 {
+		return "", nil, plumbing.ErrObjectNotFound
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return "", nil, fmt.Errorf("unexpected git cat-file output: %q", header)
+	}
+	content := make([]byte, size+1) // Content is followed by a newline
+	if _, err := io.ReadFull(s.stdout, content); err != nil {
+		return "", nil, fmt.Errorf("failed to read object %s: %w", hash, err)
+	}
+	return fields[1], content[:size], nil
+}
+
+// readTyped returns the content of an object of the given type
+func (s *gitStore) readTyped(hash, typ string) ([]byte, error) {
+	objType, content, err := s.readObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	if objType != typ {
+		return nil, plumbing.ErrObjectNotFound
+	}
+	return content, nil
+}
+
+func (s *gitStore) Commit(hash string) (*Commit, error) {
+	if c, ok := s.commits[hash]; ok {
+		return c, nil
+	}
+	content, err := s.readTyped(hash, "commit")
+	if err != nil {
+		return nil, err
+	}
+	c := decodeCommit(hash, content)
+	s.commits[hash] = c
+	return c, nil
+}
+
+// decodeCommit parses a raw commit object. Headers other than tree, parent,
+// author and committer are kept in Headers as they are.
+func decodeCommit(hash string, content []byte) *Commit {
+	c := &Commit{Hash: hash}
+	header, message, _ := bytes.Cut(content, []byte("\n\n"))
+	extra := false // The previous line started a header kept in Headers
+	for _, line := range strings.Split(string(header), "\n") {
+		if strings.HasPrefix(line, " ") {
+			// Continuation of a multi-line header such as gpgsig
+			if extra {
+				c.Headers[len(c.Headers)-1] += "\n" + line
+			}
+			continue
+		}
+		key, value, _ := strings.Cut(line, " ")
+		extra = false
+		switch key {
+		case "tree":
+			c.Tree = value
+		case "parent":
+			c.Parents = append(c.Parents, value)
+		case "author":
+			c.Author.Decode([]byte(value))
+		case "committer":
+			c.Committer.Decode([]byte(value))
+		default:
+			c.Headers = append(c.Headers, line)
+			extra = true
+		}
+	}
+	c.Message = string(message)
+	return c
+}
+
+// encodeCommit writes a commit in git's object format
+func encodeCommit(c *Commit) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "tree %s\n", c.Tree)
+	for _, parent := range c.Parents {
+		fmt.Fprintf(&buf, "parent %s\n", parent)
+	}
+	buf.WriteString("author ")
+	c.Author.Encode(&buf)
+	buf.WriteString("\ncommitter ")
+	c.Committer.Encode(&buf)
+	for _, header := range c.Headers {
+		fmt.Fprintf(&buf, "\n%s", header)
+	}
+	fmt.Fprintf(&buf, "\n\n%s", c.Message)
+	return buf.Bytes()
+}
+
+func (s *gitStore) Tree(hash string) ([]TreeEntry, error) {
+	content, err := s.readTyped(hash, "tree")
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries are "<mode> <name>\0<binary hash>"
+	var entries []TreeEntry
+	size := s.format.HexSize() / 2
+	for len(content) > 0 {
+		mode, rest, ok := bytes.Cut(content, []byte(" "))
+		if !ok {
+			return nil, fmt.Errorf("malformed tree %s", hash)
+		}
+		name, rest, ok := bytes.Cut(rest, []byte{0})
+		if !ok || len(rest) < size {
+			return nil, fmt.Errorf("malformed tree %s", hash)
+		}
+		fm, err := filemode.New(string(mode))
+		if err != nil {
+			return nil, fmt.Errorf("malformed tree %s: %w", hash, err)
+		}
+		entries = append(entries, TreeEntry{Name: string(name), Mode: fm, Hash: hex.EncodeToString(rest[:size])})
+		content = rest[size:]
+	}
+	return entries, nil
+}
+
+func (s *gitStore) Blob(hash string) ([]byte, error) {
+	return s.readTyped(hash, "blob")
+}
+
+func (s *gitStore) WriteCommit(c *Commit) (string, error) {
+	cmd := s.command("hash-object", "-t", "commit", "-w", "--stdin")
+	cmd.Stdin = bytes.NewReader(encodeCommit(c))
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to store commit: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (s *gitStore) SetReference(name, hash string) error {
+	if refStorageFormat(s.dir) == RefStorageReftable {
+		return updateRefStorage(s.dir, refUpdate{Name: name, Hash: hash})
+	}
+	if output, err := s.command("update-ref", "--no-deref", name, hash).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+func (s *gitStore) RemoveReference(name string) error {
+	if refStorageFormat(s.dir) == RefStorageReftable {
+		return updateRefStorage(s.dir, refUpdate{Name: name, Delete: true})
+	}
+	if output, err := s.command("update-ref", "-d", "--no-deref", name).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// updateRefStorage writes a reference update to the repository's ref
+// storage. The reftable stack is always updated this way, as git releases
+// without reftable support cannot update it.
+func updateRefStorage(d *gitdir.Dir, u refUpdate) error {
+	refs, err := openRefStorage(d, d.GitDir)
+	if err != nil {
+		return err
+	}
+	return refs.Update(u)
+}
+
+// References returns HEAD and every reference under refs/ from the
+// repository's ref storage
+func (s *gitStore) References() ([]Ref, error) {
+	refs, err := openRefStorage(s.dir, s.dir.GitDir)
+	if err != nil {
+		return nil, err
+	}
+	list, err := refs.References()
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		list[i] = s.normalize(list[i])
+	}
+	return list, nil
+}
+
+func (s *gitStore) Reference(name string) (Ref, error) {
+	refs, err := openRefStorage(s.dir, s.dir.GitDir)
+	if err != nil {
+		return Ref{}, err
+	}
+	ref, err := refs.Reference(name)
+	if err != nil {
+		return Ref{}, err
+	}
+	return s.normalize(ref), nil
+}
+
+// normalize replaces the hash of a direct reference with the one refHash reads
+func (s *gitStore) normalize(ref Ref) Ref {
+	if !ref.Symbolic() {
+		ref.Hash = s.refHash(ref.Hash)
+	}
+	return ref
+}
+
+// refHash returns the hash a reference value holds. Empty or malformed values
+// read as the null hash, so they are reported and repaired like null references.
+func (s *gitStore) refHash(value string) string {
+	if len(value) != s.format.HexSize() || !isHash(value) {
+		return s.format.NullHash()
+	}
+	return value
+}
+
+// Close stops git cat-file
+func (s *gitStore) Close() error {
+	if s.batch == nil {
+		return nil
+	}
+	s.stdin.Close()
+	err := s.batch.Wait()
+	s.batch = nil
+	return err
+}
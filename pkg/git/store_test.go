@@ -0,0 +1,63 @@
+package git
+
+import (
+	"context"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testCommitHeaders are commit headers the store has no fields for
+var testCommitHeaders = []string{
+	"encoding ISO-8859-1",
+	"mergetag object 1111111111111111111111111111111111111111\n type commit\n tag v1\n tagger Test <test@example.com> 1700000000 +0000\n \n Release",
+	"gpgsig -----BEGIN PGP SIGNATURE-----\n \n iQEzBAABCAAdFiEE\n -----END PGP SIGNATURE-----",
+}
+
+func TestCommitKeepsHeaders(t *testing.T) {
+	for _, initArgs := range [][]string{nil, {"--object-format=sha256"}} {
+		dir := newTestRepo(t, initArgs...)
+		head := commitFile(t, dir, "a.txt", "a")
+		tree := runGit(t, dir, "rev-parse", "HEAD^{tree}")
+
+		raw := "tree " + tree + "\nparent " + head +
+			"\nauthor Test <test@example.com> 1700000000 +0100\ncommitter Test <test@example.com> 1700000000 +0100\n" +
+			strings.Join(testCommitHeaders, "\n") + "\n\nSigned message\n"
+		cmd := exec.Command("git", "hash-object", "-t", "commit", "-w", "--stdin")
+		cmd.Dir = dir
+		cmd.Stdin = strings.NewReader(raw)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git hash-object: %v", err)
+		}
+		hash := strings.TrimSpace(string(out))
+
+		repo, err := openStore(context.Background(), Options{RepoPath: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer repo.Close()
+		c, err := repo.Commit(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.Headers, testCommitHeaders) {
+			t.Errorf("%T read headers %q, want %q", repo, c.Headers, testCommitHeaders)
+		}
+
+		// Writing the commit back unchanged gives the same object
+		written, err := repo.WriteCommit(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if written != hash {
+			t.Errorf("%T wrote the commit back as %s, want %s", repo, written, hash)
+		}
+
+		headers, signed := c.Unsigned()
+		if !signed || !reflect.DeepEqual(headers, testCommitHeaders[:2]) {
+			t.Errorf("Unsigned() = %q, %v", headers, signed)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+)
+
+// Submodule is a submodule declared in .gitmodules
+type Submodule struct {
+	Name   string
+	Path   string // Path of the gitlink, relative to the superproject's working tree
+	URL    string
+	GitDir string // Where git keeps the submodule's repository: .git/modules/<name>
+}
+
+// parseGitmodules reads the submodules declared in a .gitmodules file, in the
+// order they appear. Unlike go-git it keeps entries with invalid paths so
+// they can be reported.
+func parseGitmodules(content []byte) ([]Submodule, error) {
+	cfg := config.New()
+	if err := config.NewDecoder(bytes.NewReader(content)).Decode(cfg); err != nil {
+		return nil, err
+	}
+
+	var submodules []Submodule
+	for _, sub := range cfg.Section("submodule").Subsections {
+		submodules = append(submodules, Submodule{
+			Name: sub.Name,
+			Path: sub.Option("path"),
+			URL:  sub.Option("url"),
+		})
+	}
+	return submodules, nil
+}
+
+// ListSubmodules returns the submodules declared in the working tree's
+// .gitmodules. Bare repositories and repositories without submodules have none.
+func ListSubmodules(opts Options) ([]Submodule, error) {
+	d := opts.gitDir()
+	if d.Bare() {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(filepath.Join(d.WorkTree, ".gitmodules"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .gitmodules: %w", err)
+	}
+
+	submodules, err := parseGitmodules(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse .gitmodules: %w", err)
+	}
+	for i := range submodules {
+		submodules[i].GitDir = d.Path("modules", submodules[i].Name)
+	}
+	return submodules, nil
+}
+
+// Initialized reports whether the submodule is checked out under repoPath.
+// Submodules whose path leaves the working tree never are.
+func (s Submodule) Initialized(repoPath string) bool {
+	if s.Path == "" || filepath.IsAbs(s.Path) || hasDotDot(s.Path) {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(repoPath, s.Path, ".git"))
+	return err == nil
+}
+
+// validate returns what is wrong with a .gitmodules entry, mirroring the
+// gitmodules checks of git fsck
+func (s Submodule) validate() []string {
+	var problems []string
+	switch {
+	case s.Path == "":
+		problems = append(problems, "has no path")
+	case filepath.IsAbs(s.Path) || hasDotDot(s.Path):
+		problems = append(problems, fmt.Sprintf("path %q leaves the working tree", s.Path))
+	case strings.HasPrefix(s.Path, "-"):
+		problems = append(problems, fmt.Sprintf("path %q looks like a command line option", s.Path))
+	}
+	switch {
+	case s.URL == "":
+		problems = append(problems, "has no url")
+	case strings.HasPrefix(s.URL, "-"):
+		problems = append(problems, fmt.Sprintf("url %q looks like a command line option", s.URL))
+	}
+	if hasDotDot(s.Name) {
+		problems = append(problems, "name leaves .git/modules")
+	}
+	return problems
+}
+
+// hasDotDot reports whether a slash or backslash separated path has a ".." component
+func hasDotDot(p string) bool {
+	for _, part := range strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGitmodules validates the .gitmodules committed at HEAD against the
+// gitlinks in HEAD's tree
+func checkGitmodules(repo store) []Issue {
+	head, err := resolveReference(repo, "HEAD")
+	if err != nil {
+		return nil
+	}
+	commit, err := repo.Commit(head.Hash)
+	if err != nil {
+		return nil
+	}
+	entries, err := repo.Tree(commit.Tree)
+	if err != nil {
+		return nil
+	}
+
+	issue := func(msg string, args ...interface{}) Issue {
+		return Issue{
+			Type:    IssueTypeBadGitmodules,
+			Object:  ".gitmodules",
+			Commit:  commit.Hash,
+			Message: fmt.Sprintf(msg, args...),
+			Path:    ".gitmodules",
+		}
+	}
+
+	gitlinks := treeGitlinks(repo, commit.Tree)
+	var submodules []Submodule
+	for _, entry := range entries {
+		if entry.Name != ".gitmodules" || !entry.Mode.IsFile() {
+			continue
+		}
+		content, err := repo.Blob(entry.Hash)
+		if err == nil {
+			submodules, err = parseGitmodules(content)
+		}
+		if err != nil {
+			return []Issue{issue("Cannot parse .gitmodules: %v", err)}
+		}
+	}
+
+	var issues []Issue
+	declared := make(map[string]bool)
+	for _, sub := range submodules {
+		for _, problem := range sub.validate() {
+			issues = append(issues, issue("Submodule %q %s", sub.Name, problem))
+		}
+		if sub.Path == "" {
+			continue
+		}
+		if declared[sub.Path] {
+			issues = append(issues, issue("Submodule %q uses path %s, which is declared more than once", sub.Name, sub.Path))
+		}
+		declared[sub.Path] = true
+		if !gitlinks[sub.Path] {
+			issues = append(issues, issue("Submodule %q path %s is not a gitlink in HEAD", sub.Name, sub.Path))
+		}
+	}
+
+	var undeclared []string
+	for path := range gitlinks {
+		if !declared[path] {
+			undeclared = append(undeclared, path)
+		}
+	}
+	sort.Strings(undeclared)
+	for _, path := range undeclared {
+		issues = append(issues, issue("Gitlink %s has no entry in .gitmodules", path))
+	}
+	return issues
+}
+
+// treeGitlinks returns the paths of every gitlink in a tree. Subtrees that
+// cannot be read are skipped.
+func treeGitlinks(repo store, treeHash string) map[string]bool {
+	gitlinks := make(map[string]bool)
+	var walk func(hash, dir string)
+	walk = func(hash, dir string) {
+		entries, err := repo.Tree(hash)
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			name := entry.Name
+			if dir != "" {
+				name = dir + "/" + entry.Name
+			}
+			switch entry.Mode {
+			case filemode.Submodule:
+				gitlinks[name] = true
+			case filemode.Dir:
+				walk(entry.Hash, name)
+			}
+		}
+	}
+	walk(treeHash, "")
+	return gitlinks
+}
+
+// historyCommit is a commit as listed by git log
+type historyCommit struct {
+	hash    string
+	tree    string
+	parents []string
+	time    int64 // Committer timestamp
+}
+
+// commitHistory lists every commit reachable from branches and tags. Refs
+// git cannot walk are skipped.
+func commitHistory(ctx context.Context, opts Options) ([]historyCommit, error) {
+	refsOutput, err := gitCommand(ctx, opts.RepoPath, "for-each-ref", "--format=%(refname)", "refs/heads/", "refs/tags/").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refs: %w", err)
+	}
+
+	var history []historyCommit
+	seen := make(map[string]bool)
+	for _, ref := range splitLines(string(refsOutput)) {
+		output, err := gitCommand(ctx, opts.RepoPath, "log", ref, "--format=%H %T %ct %P").Output()
+		if err != nil {
+			continue
+		}
+		for _, line := range splitLines(string(output)) {
+			fields := strings.Fields(line)
+			if len(fields) < 3 || seen[fields[0]] {
+				continue
+			}
+			seen[fields[0]] = true
+			ts, _ := strconv.ParseInt(fields[2], 10, 64)
+			history = append(history, historyCommit{hash: fields[0], tree: fields[1], time: ts, parents: fields[3:]})
+		}
+	}
+	return history, ctx.Err()
+}
+
+// gitlinkResolver finds the commit a null gitlink entry should point at
+type gitlinkResolver struct {
+	ctx      context.Context
+	opts     Options
+	history  []historyCommit // Loaded on first use
+	commits  map[string]historyCommit
+	children map[string][]string
+	trees    *treeIndex
+	loaded   bool
+}
+
+// load reads the history and the tree index once
+func (r *gitlinkResolver) load() {
+	if r.loaded {
+		return
+	}
+	r.loaded = true
+	em := r.opts.emit()
+
+	history, err := commitHistory(r.ctx, r.opts)
+	if err != nil {
+		em.Debugf("Cannot look up submodule commits: %v", err)
+	}
+	r.history = history
+	r.commits = make(map[string]historyCommit, len(history))
+	r.children = make(map[string][]string)
+	for _, c := range history {
+		r.commits[c.hash] = c
+		for _, parent := range c.parents {
+			r.children[parent] = append(r.children[parent], c.hash)
+		}
+	}
+
+	if r.trees, err = loadTreeIndex(r.ctx, r.opts); err != nil {
+		em.Debugf("Cannot index trees: %v", err)
+		r.trees = &treeIndex{}
+	}
+}
+
+// index returns the tree index, reading it on first use
+func (r *gitlinkResolver) index() *treeIndex {
+	r.load()
+	return r.trees
+}
+
+// resolve returns the submodule commit for the null gitlink called name in
+// treeHash. It looks at the same path in the parents and children of the
+// commits using the tree, then at the submodule's own reflog. It returns ""
+// when no commit is found.
+func (r *gitlinkResolver) resolve(treeHash, name string) string {
+	em := r.opts.emit()
+	r.load()
+
+	locations := r.trees.locate(treeHash)
+	for _, c := range r.history {
+		if r.ctx.Err() != nil {
+			return ""
+		}
+		dir, ok := locations[c.tree]
+		if !ok {
+			continue
+		}
+		path := name
+		if dir != "" {
+			path = dir + "/" + name
+		}
+
+		// Neighbouring commits usually have the same or a nearby submodule commit
+		for _, neighbour := range r.neighbours(c) {
+			if hash := r.gitlinkAt(neighbour, path); hash != "" {
+				em.Debugf("Found submodule %s at %s in neighbouring commit %s", path, hash[:8], neighbour[:8])
+				return hash
+			}
+		}
+
+		if hash := r.fromReflog(path, c.time); hash != "" {
+			em.Debugf("Found submodule %s at %s in its reflog", path, hash[:8])
+			return hash
+		}
+	}
+	return ""
+}
+
+// neighbours returns the parents of a commit followed by its children
+func (r *gitlinkResolver) neighbours(c historyCommit) []string {
+	return append(append([]string{}, c.parents...), r.children[c.hash]...)
+}
+
+// gitlinkAt returns the non-null gitlink at path in a commit
+func (r *gitlinkResolver) gitlinkAt(commit, path string) string {
+	c, ok := r.commits[commit]
+	if !ok {
+		return ""
+	}
+	return r.trees.gitlink(c.tree, path)
+}
+
+// fromReflog returns the commit the submodule at path had checked out at
+// time ts according to its HEAD reflog, or its newest entry when all are later
+func (r *gitlinkResolver) fromReflog(path string, ts int64) string {
+	submodules, _ := ListSubmodules(r.opts)
+	gitDir := r.opts.gitDir().Path("modules", path)
+	for _, sub := range submodules {
+		if sub.Path == path {
+			gitDir = sub.GitDir
+		}
+	}
+
+	content, err := os.ReadFile(filepath.Join(gitDir, "logs", "HEAD"))
+	if err != nil {
+		return ""
+	}
+
+	var best, newest string
+	for _, line := range splitLines(string(content)) {
+		// <old> <new> <committer> <timestamp> <tz>\t<message>
+		meta, _, _ := strings.Cut(line, "\t")
+		fields := strings.Fields(meta)
+		if len(fields) < 4 || isNullHash(fields[1]) {
+			continue
+		}
+		newest = fields[1]
+		if when, err := strconv.ParseInt(fields[len(fields)-2], 10, 64); err == nil && when <= ts {
+			best = fields[1]
+		}
+	}
+	if best != "" {
+		return best
+	}
+	return newest
+}
@@ -0,0 +1,281 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// timelineReflogEntries is how many of the newest reflog entries of every
+// affected reference go into a timeline
+const timelineReflogEntries = 10
+
+// TimelineEventKind says where the time of a timeline event comes from
+type TimelineEventKind string
+
+const (
+	TimelineModified  TimelineEventKind = "modified"  // Last modification of a damaged file
+	TimelineReflog    TimelineEventKind = "reflog"    // Reflog entry of an affected reference
+	TimelineCommitted TimelineEventKind = "committed" // Committer date of a last good commit
+	TimelineAuthored  TimelineEventKind = "authored"  // Author date of a last good commit
+)
+
+// TimelineEvent is one dated observation about the repository
+type TimelineEvent struct {
+	Time    time.Time         `json:"time"`
+	Kind    TimelineEventKind `json:"kind"`
+	Subject string            `json:"subject"` // File, reference or commit
+	Detail  string            `json:"detail"`
+	Damaged bool              `json:"damaged,omitempty"` // Evidence of the damage rather than of a good state
+}
+
+// IncidentWindow is when the damage most likely happened: after the last
+// activity known to be good and no later than the last damaged write
+type IncidentWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Duration returns how long the window is
+func (w *IncidentWindow) Duration() time.Duration {
+	return w.End.Sub(w.Start)
+}
+
+// Timeline correlates the times of damaged files, reflog entries and last
+// good commits, oldest first
+type Timeline struct {
+	Events []TimelineEvent `json:"events"`
+	Window *IncidentWindow `json:"window,omitempty"` // Nil when nothing dated is damaged
+}
+
+// BuildTimeline dates the issues of a repository: the mtimes of damaged
+// loose objects, ref files and other files, the newest reflog entries of
+// the affected references and the commit and author dates of their last
+// good commits. Reflogs are read from the files backend only.
+func BuildTimeline(ctx context.Context, opts Options) (*Timeline, error) {
+	em := opts.emit()
+	d := opts.gitDir()
+
+	issues, err := currentIssues(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := openStore(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository: %w", err)
+	}
+	defer repo.Close()
+
+	timeline := &Timeline{}
+
+	// Damaged files, with the issues found in each
+	var files []string
+	types := make(map[string][]string)
+	for _, issue := range issues {
+		file := filepath.FromSlash(issue.Path)
+		switch {
+		case issue.Path != "":
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(opts.RepoPath, file)
+			}
+		case isHash(issue.Object):
+			// Objects git reports as bad, e.g. malformed trees, when loose
+			file = d.ObjectPath(issue.Object)
+			if _, err := os.Stat(file); err != nil {
+				continue
+			}
+		default:
+			continue
+		}
+		if _, ok := types[file]; !ok {
+			files = append(files, file)
+		}
+		if t := string(issue.Type); !containsString(types[file], t) {
+			types[file] = append(types[file], t)
+		}
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			em.Debugf("Cannot date %s: %v", file, err)
+			continue
+		}
+		timeline.Events = append(timeline.Events, TimelineEvent{
+			Time:    info.ModTime(),
+			Kind:    TimelineModified,
+			Subject: repoRelative(opts.RepoPath, file),
+			Detail:  strings.Join(types[file], ", "),
+			Damaged: true,
+		})
+	}
+
+	// Reflog entries and the last good commit of every affected reference.
+	// HEAD is always included, so damaged objects are dated against it too.
+	_, _, refs := issueSubjects(d, opts.RepoPath, issues)
+	if !containsString(refs, "HEAD") {
+		refs = append(refs, "HEAD")
+	}
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		content, _ := os.ReadFile(reflogFile(d, ref))
+		lines := splitLines(string(content))
+		for _, line := range lines[max(0, len(lines)-timelineReflogEntries):] {
+			if event, ok := reflogEvent(repo, ref, line); ok {
+				timeline.Events = append(timeline.Events, event)
+			}
+		}
+
+		hash := lastGoodCommit(repo, ref, lines)
+		if hash == "" || seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		commit, err := repo.Commit(hash)
+		if err != nil {
+			continue
+		}
+		subject, _, _ := strings.Cut(strings.TrimSpace(commit.Message), "\n")
+		detail := fmt.Sprintf("Last good commit of %s: %s", ref, subject)
+		timeline.Events = append(timeline.Events,
+			TimelineEvent{Time: commit.Committer.When, Kind: TimelineCommitted, Subject: shortHash(hash), Detail: detail},
+			TimelineEvent{Time: commit.Author.When, Kind: TimelineAuthored, Subject: shortHash(hash), Detail: detail},
+		)
+	}
+
+	sort.SliceStable(timeline.Events, func(i, j int) bool {
+		return timeline.Events[i].Time.Before(timeline.Events[j].Time)
+	})
+	timeline.Window = incidentWindow(timeline.Events)
+	return timeline, nil
+}
+
+// reflogEvent turns a reflog line into an event. Entries that set the
+// reference to the null SHA or to a commit that cannot be read are damage.
+func reflogEvent(repo store, ref, line string) (TimelineEvent, bool) {
+	entry, message, _ := strings.Cut(line, "\t")
+	fields := strings.Fields(entry)
+	seconds := reflogTime(line)
+	if len(fields) < 2 || seconds == 0 {
+		return TimelineEvent{}, false
+	}
+	when := time.Unix(seconds, 0)
+	if tz := fields[len(fields)-1]; len(tz) == 5 {
+		if offset, err := strconv.Atoi(tz[1:]); err == nil {
+			zone := (offset/100*60 + offset%100) * 60
+			if tz[0] == '-' {
+				zone = -zone
+			}
+			when = when.In(time.FixedZone(tz, zone))
+		}
+	}
+
+	newHash := fields[1]
+	event := TimelineEvent{
+		Time:    when,
+		Kind:    TimelineReflog,
+		Subject: ref,
+		Detail:  fmt.Sprintf("%s -> %s", shortHash(fields[0]), shortHash(newHash)),
+		Damaged: isNullHash(newHash) || !hasCommit(repo, newHash),
+	}
+	if message = strings.TrimSpace(message); message != "" {
+		event.Detail += ": " + message
+	}
+	return event, true
+}
+
+// lastGoodCommit returns the newest commit a reference was set to whose
+// tree can be read, from its reflog or, without one, its current value
+func lastGoodCommit(repo store, ref string, reflog []string) string {
+	var hashes []string
+	for _, line := range reflog {
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			hashes = append(hashes, fields[1])
+		}
+	}
+	if len(hashes) == 0 {
+		if r, err := resolveReference(repo, ref); err == nil {
+			hashes = []string{r.Hash}
+		}
+	}
+
+	for i := len(hashes) - 1; i >= 0; i-- {
+		if isNullHash(hashes[i]) {
+			continue
+		}
+		commit, err := repo.Commit(hashes[i])
+		if err != nil {
+			continue
+		}
+		if _, err := repo.Tree(commit.Tree); err == nil {
+			return hashes[i]
+		}
+	}
+	return ""
+}
+
+// incidentWindow spans from the last good event before the first damage to
+// the last damage
+func incidentWindow(events []TimelineEvent) *IncidentWindow {
+	var window *IncidentWindow
+	for _, event := range events {
+		if !event.Damaged {
+			continue
+		}
+		if window == nil {
+			window = &IncidentWindow{Start: event.Time, End: event.Time}
+		}
+		if event.Time.After(window.End) {
+			window.End = event.Time
+		}
+	}
+	if window == nil {
+		return nil
+	}
+
+	first := window.Start
+	for _, event := range events {
+		if !event.Damaged && !event.Time.After(first) {
+			window.Start = event.Time
+		}
+	}
+	return window
+}
+
+// WriteSummary prints the events in order, marking damage with "!", and
+// the incident window
+func (t *Timeline) WriteSummary(w io.Writer) {
+	if len(t.Events) == 0 {
+		fmt.Fprintln(w, "No dated events found.")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, event := range t.Events {
+		mark := " "
+		if event.Damaged {
+			mark = "!"
+		}
+		fmt.Fprintf(tw, "%s %s\t%s\t%s\t%s\n", mark, event.Time.Local().Format("2006-01-02 15:04:05 -0700"), event.Kind, event.Subject, event.Detail)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	if t.Window == nil {
+		fmt.Fprintln(w, "Incident window: unknown, no damaged file or reflog entry has a date")
+		return
+	}
+	fmt.Fprintf(w, "Incident window: %s to %s (%s)\n",
+		t.Window.Start.Local().Format("2006-01-02 15:04:05 -0700"),
+		t.Window.End.Local().Format("2006-01-02 15:04:05 -0700"),
+		t.Window.Duration().Round(time.Second))
+}
@@ -0,0 +1,196 @@
+package git
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// treeLink is a tree entry that names a tree or a submodule commit
+type treeLink struct {
+	name    string
+	hash    string
+	gitlink bool
+}
+
+// treeParent is a tree holding another tree, and the name it gives it
+type treeParent struct {
+	hash string
+	name string
+}
+
+// treeIndex records how the trees of a repository nest. It is read in one
+// pass over every tree, so paths and gitlinks are looked up in memory
+// instead of running git for each commit.
+type treeIndex struct {
+	children map[string][]treeLink   // Subtree and gitlink entries of each tree
+	parents  map[string][]treeParent // Trees holding each tree
+	damaged  []string                // Trees git could not read
+}
+
+// loadTreeIndex reads every tree of the repository, reachable or not.
+// Trees git cannot read are recorded as damaged and skipped.
+func loadTreeIndex(ctx context.Context, opts Options) (*treeIndex, error) {
+	list := gitCommand(ctx, opts.RepoPath, "cat-file", "--batch-all-objects", "--batch-check=%(objectname) %(objecttype)")
+	list.Env = append(list.Env, "GIT_NO_REPLACE_OBJECTS=1")
+	output, err := list.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+	var trees []string
+	for _, line := range splitLines(string(output)) {
+		if hash, kind, ok := strings.Cut(line, " "); ok && kind == "tree" {
+			trees = append(trees, hash)
+		}
+	}
+
+	x := &treeIndex{
+		children: make(map[string][]treeLink),
+		parents:  make(map[string][]treeParent),
+	}
+	// git cat-file exits at the first object it cannot inflate, so carry on
+	// after it with a new process
+	for len(trees) > 0 {
+		read, err := x.read(ctx, opts, trees)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err == nil {
+			break
+		}
+		if read < len(trees) {
+			x.damaged = append(x.damaged, trees[read])
+			read++
+		}
+		trees = trees[read:]
+	}
+	return x, nil
+}
+
+// read adds trees to the index through git cat-file --batch and returns how
+// many it read before git stopped
+func (x *treeIndex) read(ctx context.Context, opts Options, trees []string) (int, error) {
+	format := opts.objectFormat()
+	cmd := gitCommand(ctx, opts.RepoPath, "cat-file", "--batch")
+	cmd.Env = append(cmd.Env, "GIT_NO_REPLACE_OBJECTS=1")
+	cmd.Stdin = strings.NewReader(strings.Join(trees, "\n") + "\n")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start git cat-file: %w", err)
+	}
+
+	// "<hash> <type> <size>\n<content>\n", or "<hash> missing\n"
+	r := bufio.NewReader(stdout)
+	read := 0
+	for read < len(trees) {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			read++
+			continue
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			break
+		}
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(r, data); err != nil {
+			break
+		}
+		if fields[1] == "tree" {
+			x.add(fields[0], data[:size], format)
+		}
+		read++
+	}
+	io.Copy(io.Discard, r)
+	if err := cmd.Wait(); err != nil {
+		return read, fmt.Errorf("git cat-file: %w", err)
+	}
+	if read < len(trees) {
+		return read, fmt.Errorf("git cat-file stopped after %d of %d trees", read, len(trees))
+	}
+	return read, nil
+}
+
+// add records the subtree and gitlink entries of a tree
+func (x *treeIndex) add(hash string, data []byte, format ObjectFormat) {
+	entries, _ := decodeTreeLenient(data, format)
+	for _, e := range entries {
+		switch e.Type {
+		case "tree":
+			x.parents[e.Hash] = append(x.parents[e.Hash], treeParent{hash: hash, name: e.Name})
+		case "commit":
+		default:
+			continue
+		}
+		x.children[hash] = append(x.children[hash], treeLink{name: e.Name, hash: e.Hash, gitlink: e.Type == "commit"})
+	}
+}
+
+// nested reports whether any tree holds the given tree
+func (x *treeIndex) nested(tree string) bool {
+	return len(x.parents[tree]) > 0
+}
+
+// locate returns every tree that holds the given tree, directly or further
+// down, with the directory it is found at. The tree itself is included at
+// "". Where a tree is held at several paths, the first one found is kept.
+func (x *treeIndex) locate(tree string) map[string]string {
+	found := map[string]string{tree: ""}
+	queue := []string{tree}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, p := range x.parents[current] {
+			if _, ok := found[p.hash]; ok {
+				continue
+			}
+			path := p.name
+			if dir := found[current]; dir != "" {
+				path += "/" + dir
+			}
+			found[p.hash] = path
+			queue = append(queue, p.hash)
+		}
+	}
+	return found
+}
+
+// gitlink returns the non-null gitlink at path below a tree, "" when there
+// is none
+func (x *treeIndex) gitlink(tree, path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		var link *treeLink
+		for j, l := range x.children[tree] {
+			if l.name == part {
+				link = &x.children[tree][j]
+				break
+			}
+		}
+		if link == nil {
+			return ""
+		}
+		if i < len(parts)-1 {
+			if link.gitlink {
+				return ""
+			}
+			tree = link.hash
+			continue
+		}
+		if !link.gitlink || isNullHash(link.hash) {
+			return ""
+		}
+		return link.hash
+	}
+	return ""
+}
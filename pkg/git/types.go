@@ -1,15 +1,32 @@
 package git
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/rahul/nsha/pkg/events"
+)
 
 // Issue represents a problem found in the repository
 type Issue struct {
-	Type    IssueType
-	Object  string
-	Message string
-	Commit  string
+	Type     IssueType
+	Object   string
+	Message  string
+	Commit   string
+	Path     string   // File under the repository the issue concerns, if known
+	Severity Severity // How serious the issue is; see IssueType.Severity
+	FixedBy  string   // Name of the fixer that resolved the issue, if known
+	Resolved bool     // The issue was gone after fixing, see FixedBy for what resolved it
 }
 
+// Severity ranks issues, using the levels SARIF understands
+type Severity string
+
+const (
+	SeverityError   Severity = "error"   // History or references are broken
+	SeverityWarning Severity = "warning" // Objects are malformed but history is usable
+	SeverityNote    Severity = "note"    // Informational
+)
+
 type IssueType string
 
 const (
@@ -17,12 +34,105 @@ const (
 	IssueTypeMissingTree  IssueType = "missing-tree"
 	IssueTypeMissingCommit IssueType = "missing-commit"
 	IssueTypeBrokenParent IssueType = "broken-parent"
+	IssueTypeHashPathMismatch IssueType = "hash-path-mismatch"
+	IssueTypeNullTreeEntry IssueType = "null-tree-entry"
+	IssueTypeBadIndex IssueType = "bad-index"
+	IssueTypeBadGitmodules IssueType = "bad-gitmodules"
+	IssueTypeCorruptObject IssueType = "corrupt-object"
+	IssueTypeMalformedRef IssueType = "malformed-ref"
+	IssueTypeConflictCopy IssueType = "conflict-copy"
+	IssueTypeStaleCommitGraph IssueType = "stale-commit-graph"
+	IssueTypeStaleMultiPackIndex IssueType = "stale-multi-pack-index"
+	IssueTypeCorruptPack IssueType = "corrupt-pack"
+	IssueTypeBadPackIndex IssueType = "bad-pack-index"
+	IssueTypeMalformedTree IssueType = "malformed-tree"
 )
 
+// IssueTypes lists every issue type in a stable order, e.g. for report columns
+var IssueTypes = []IssueType{
+	IssueTypeNullSHA,
+	IssueTypeMissingTree,
+	IssueTypeMissingCommit,
+	IssueTypeBrokenParent,
+	IssueTypeHashPathMismatch,
+	IssueTypeNullTreeEntry,
+	IssueTypeBadIndex,
+	IssueTypeBadGitmodules,
+	IssueTypeCorruptObject,
+	IssueTypeMalformedRef,
+	IssueTypeConflictCopy,
+	IssueTypeStaleCommitGraph,
+	IssueTypeStaleMultiPackIndex,
+	IssueTypeCorruptPack,
+	IssueTypeBadPackIndex,
+	IssueTypeMalformedTree,
+}
+
+// Severity returns the default severity of issues of this type
+func (t IssueType) Severity() Severity {
+	switch t {
+	case IssueTypeNullTreeEntry, IssueTypeBadGitmodules, IssueTypeConflictCopy, IssueTypeStaleCommitGraph, IssueTypeStaleMultiPackIndex:
+		return SeverityWarning
+	case IssueTypeNullSHA, IssueTypeMissingTree, IssueTypeMissingCommit, IssueTypeBrokenParent, IssueTypeHashPathMismatch, IssueTypeBadIndex, IssueTypeCorruptObject, IssueTypeMalformedRef, IssueTypeCorruptPack, IssueTypeBadPackIndex, IssueTypeMalformedTree:
+		return SeverityError
+	}
+	return SeverityNote
+}
+
+// Description returns a one-line explanation of the issue type
+func (t IssueType) Description() string {
+	switch t {
+	case IssueTypeNullSHA:
+		return "Reference or object points to the null SHA"
+	case IssueTypeMissingTree:
+		return "Commit references a tree that does not exist"
+	case IssueTypeMissingCommit:
+		return "Reference points to a commit that does not exist"
+	case IssueTypeBrokenParent:
+		return "Commit has a null parent"
+	case IssueTypeHashPathMismatch:
+		return "Object is stored at a null SHA path"
+	case IssueTypeNullTreeEntry:
+		return "Tree contains entries pointing to the null SHA"
+	case IssueTypeBadIndex:
+		return "Worktree index cannot be read or refers to null or missing objects"
+	case IssueTypeBadGitmodules:
+		return ".gitmodules is invalid or does not match the gitlinks in HEAD"
+	case IssueTypeCorruptObject:
+		return "Loose object file is empty, truncated, zero-filled or cannot be decompressed"
+	case IssueTypeMalformedRef:
+		return "Reference file or packed-refs line is empty or cannot be parsed"
+	case IssueTypeConflictCopy:
+		return "Cloud-sync conflict copy of a reference, reflog, object or index file"
+	case IssueTypeStaleCommitGraph:
+		return "Commit-graph lists commits that are missing or differ from the object store"
+	case IssueTypeStaleMultiPackIndex:
+		return "Multi-pack-index lists packs or objects that are no longer where it says"
+	case IssueTypeCorruptPack:
+		return "Pack file fails its checksum or has entries that cannot be decoded"
+	case IssueTypeBadPackIndex:
+		return "Pack index is missing, truncated or does not match its pack"
+	case IssueTypeMalformedTree:
+		return "Tree object cannot be parsed by git"
+	}
+	return string(t)
+}
+
 func (i Issue) String() string {
+	if i.FixedBy != "" {
+		return fmt.Sprintf("[%s] %s: %s (fixed by %s)", i.Type, i.Object, i.Message, i.FixedBy)
+	}
+	if i.Resolved {
+		return fmt.Sprintf("[%s] %s: %s (resolved)", i.Type, i.Object, i.Message)
+	}
 	return fmt.Sprintf("[%s] %s: %s", i.Type, i.Object, i.Message)
 }
 
+// key identifies an issue independently of which fixer resolved it
+func (i Issue) key() string {
+	return string(i.Type) + "\x00" + i.Object + "\x00" + i.Commit + "\x00" + i.Message
+}
+
 // BadCommit represents a commit that needs to be fixed
 type BadCommit struct {
 	Hash        string
@@ -51,6 +161,12 @@ const EmptyTreeHash = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
 // EmptyBlobHash is the standard Git empty blob hash
 const EmptyBlobHash = "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"
 
+// EmptyTreeHashSHA256 is the empty tree hash in SHA-256 repositories
+const EmptyTreeHashSHA256 = "6ef19b41225c5369f1c104d45d8d85efa9b057b53b14b4b9b939dd74decc5321"
+
+// EmptyBlobHashSHA256 is the empty blob hash in SHA-256 repositories
+const EmptyBlobHashSHA256 = "473a0f4c3be8a93681a267e3b1e9a7dcda1185436fe141f7749120a303721813"
+
 // TreeFix represents a tree that was fixed
 type TreeFix struct {
 	OldHash string
@@ -58,3 +174,23 @@ type TreeFix struct {
 	EntriesRemoved int
 }
 
+
+// Options configures a repository operation
+type Options struct {
+	RepoPath string      // Path to the repository
+	DryRun   bool        // Report what would change without modifying anything
+	Events   events.Sink // Receives progress and diagnostic messages; nil discards them
+
+	// Diagnosis is the shared scan result. When set, fixers read it instead of
+	// running git fsck again and record what they change in it.
+	Diagnosis *Diagnosis
+
+	// plan is the plan being worked out or applied by a fixer. Apply hands
+	// it back so the fix functions act on what Plan found.
+	plan *FixPlan
+}
+
+// emit returns an emitter for the configured event sink
+func (o Options) emit() events.Emitter {
+	return events.Emitter{Sink: o.Events}
+}
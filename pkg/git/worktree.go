@@ -0,0 +1,377 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rahul/nsha/pkg/events"
+	"github.com/rahul/nsha/pkg/gitdir"
+)
+
+// Worktree is the main working tree or one of the linked worktrees of a
+// repository. Each has its own HEAD, ORIG_HEAD, index and HEAD reflog.
+type Worktree struct {
+	Name    string // Name under .git/worktrees; empty for the main worktree
+	Path    string // Top of the working tree; empty for bare repositories
+	GitDir  string // Directory holding the worktree's HEAD, index and reflog
+	Current bool   // Whether this is the worktree the repository was opened from
+}
+
+// Main reports whether w is the main worktree
+func (w Worktree) Main() bool {
+	return w.Name == ""
+}
+
+// RefName returns how git names a per-worktree ref such as HEAD from another
+// worktree: "worktrees/<name>/HEAD" or "main-worktree/HEAD". Refs of the
+// current worktree keep their plain name.
+func (w Worktree) RefName(ref string) string {
+	switch {
+	case w.Current:
+		return ref
+	case w.Main():
+		return "main-worktree/" + ref
+	}
+	return "worktrees/" + w.Name + "/" + ref
+}
+
+// Owns reports whether an issue is about one of the worktree's own files
+func (w Worktree) Owns(issue Issue) bool {
+	if w.Current {
+		return issue.Object == "HEAD" || issue.Object == "ORIG_HEAD" || issue.Object == "index"
+	}
+	return strings.HasPrefix(issue.Object, w.RefName(""))
+}
+
+// Head returns the contents of the worktree's HEAD: "ref: <branch>" when a
+// branch is checked out, a commit hash when HEAD is detached
+func (w Worktree) Head() (string, error) {
+	// The HEAD file of a reftable repository is a stub
+	if d, err := gitdir.Resolve(w.GitDir); err == nil && refStorageFormat(d) == RefStorageReftable {
+		refs, err := openRefStorage(d, w.GitDir)
+		if err != nil {
+			return "", err
+		}
+		head, err := refs.Reference("HEAD")
+		if err != nil {
+			return "", err
+		}
+		if head.Symbolic() {
+			return "ref: " + head.Target, nil
+		}
+		return head.Hash, nil
+	}
+
+	content, err := os.ReadFile(filepath.Join(w.GitDir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// ListWorktrees returns the main worktree followed by every linked worktree
+func ListWorktrees(opts Options) ([]Worktree, error) {
+	d := opts.gitDir()
+	current, _ := filepath.Abs(d.GitDir)
+
+	main := Worktree{Path: d.MainWorkTree(), GitDir: d.CommonDir}
+	worktrees := []Worktree{main}
+
+	entries, err := os.ReadDir(d.Path("worktrees"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list worktrees: %w", err)
+	}
+	for _, entry := range entries {
+		gitDir := filepath.Join(d.Path("worktrees"), entry.Name())
+		if _, err := os.Stat(filepath.Join(gitDir, "HEAD")); !entry.IsDir() || err != nil {
+			continue
+		}
+
+		wt := Worktree{Name: entry.Name(), GitDir: gitDir}
+		// gitdir points at the .git file inside the linked working tree
+		if content, err := os.ReadFile(filepath.Join(gitDir, "gitdir")); err == nil {
+			wt.Path = filepath.Dir(strings.TrimSpace(string(content)))
+		}
+		worktrees = append(worktrees, wt)
+	}
+
+	for i := range worktrees {
+		abs, _ := filepath.Abs(worktrees[i].GitDir)
+		worktrees[i].Current = abs == current
+	}
+	return worktrees, nil
+}
+
+// isWorktreeIssue reports whether an issue concerns a per-worktree file that
+// the worktrees fixer repairs rather than a shared reference
+func isWorktreeIssue(issue Issue) bool {
+	return issue.Type == IssueTypeBadIndex ||
+		issue.Object == "ORIG_HEAD" ||
+		strings.HasPrefix(issue.Object, "worktrees/") ||
+		strings.HasPrefix(issue.Object, "main-worktree/")
+}
+
+// checkWorktrees checks the HEAD of every other worktree, and the ORIG_HEAD
+// and index of every worktree. The current HEAD is checked with the refs.
+func checkWorktrees(ctx context.Context, repo store, d *Diagnosis, opts Options) {
+	worktrees, err := ListWorktrees(opts)
+	if err != nil {
+		opts.emit().Debugf("Skipping worktree checks: %v", err)
+		return
+	}
+	for _, wt := range worktrees {
+		opts.emit().Debugf("Checking worktree: %s", wt.GitDir)
+		for _, issue := range checkWorktree(ctx, repo, opts, wt) {
+			d.add(issue, subject{subjectWorktree, issue.Object})
+		}
+	}
+}
+
+// checkWorktree returns the issues of one worktree's HEAD, ORIG_HEAD and index
+func checkWorktree(ctx context.Context, repo store, opts Options, wt Worktree) []Issue {
+	var issues []Issue
+	if !wt.Current {
+		issues = append(issues, checkWorktreeRef(repo, opts, wt, "HEAD")...)
+	}
+	issues = append(issues, checkWorktreeRef(repo, opts, wt, "ORIG_HEAD")...)
+	if wt.Path != "" {
+		issues = append(issues, checkIndex(ctx, opts, wt)...)
+	}
+	return issues
+}
+
+// checkWorktreeRef checks a detached per-worktree ref. Refs pointing at a
+// branch are checked through the branch.
+func checkWorktreeRef(repo store, opts Options, wt Worktree, ref string) []Issue {
+	refs, err := openRefStorage(opts.gitDir(), wt.GitDir)
+	if err != nil {
+		return nil
+	}
+	stored, err := refs.Reference(ref)
+	if err != nil || stored.Symbolic() {
+		return nil
+	}
+	value := stored.Hash
+	file := refs.Location(ref)
+
+	// ORIG_HEAD is only a convenience for undoing the last operation
+	severity := SeverityError
+	if ref == "ORIG_HEAD" {
+		severity = SeverityWarning
+	}
+
+	// Values that cannot be parsed are reported by the ref file scan
+	if !isHash(strings.ToLower(value)) {
+		return nil
+	}
+	if isNullHash(value) {
+		return []Issue{{
+			Type:     IssueTypeNullSHA,
+			Object:   wt.RefName(ref),
+			Message:  "Reference has null SHA",
+			Path:     repoRelative(opts.RepoPath, file),
+			Severity: severity,
+		}}
+	}
+	if _, err := repo.Commit(value); err != nil {
+		return []Issue{{
+			Type:     IssueTypeMissingCommit,
+			Object:   wt.RefName(ref),
+			Message:  fmt.Sprintf("Cannot read commit %s: %v", value, err),
+			Path:     repoRelative(opts.RepoPath, file),
+			Severity: severity,
+		}}
+	}
+	return nil
+}
+
+// recheckWorktree rechecks the per-worktree file an issue named by name is about
+func recheckWorktree(ctx context.Context, repo store, repoPath, name string) []Issue {
+	opts := Options{RepoPath: repoPath}
+	worktrees, err := ListWorktrees(opts)
+	if err != nil {
+		return nil
+	}
+	var issues []Issue
+	for _, wt := range worktrees {
+		for _, issue := range checkWorktree(ctx, repo, opts, wt) {
+			if issue.Object == name {
+				issues = append(issues, issue)
+			}
+		}
+	}
+	return issues
+}
+
+// FixWorktrees repairs the per-worktree files of every worktree. Broken
+// detached HEADs are moved to the newest valid commit in that worktree's
+// reflog, broken ORIG_HEADs are removed and unreadable indexes or indexes
+// with null or missing entries are rebuilt from HEAD.
+func FixWorktrees(ctx context.Context, opts Options) (int, error) {
+	em := opts.emit()
+
+	repo, err := openStore(ctx, opts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open repository: %w", err)
+	}
+	defer repo.Close()
+
+	problems, err := planned(opts, func() ([]worktreeIssue, error) {
+		worktrees, err := ListWorktrees(opts)
+		if err != nil {
+			return nil, err
+		}
+		var problems []worktreeIssue
+		for _, wt := range worktrees {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			for _, issue := range checkWorktree(ctx, repo, opts, wt) {
+				problems = append(problems, worktreeIssue{wt: wt, issue: issue})
+			}
+		}
+		return problems, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	fixedCount := 0
+	for _, p := range problems {
+		if err := ctx.Err(); err != nil {
+			return fixedCount, err
+		}
+		wt, issue := p.wt, p.issue
+		if opts.DryRun {
+			em.Debugf("[DRY RUN] Would fix %s: %s", issue.Object, issue.Message)
+			fixedCount++
+			continue
+		}
+
+		var fixErr error
+		switch {
+		case issue.Type == IssueTypeBadIndex:
+			fixErr = rebuildIndex(ctx, opts, wt, em)
+		case issue.Object == wt.RefName("ORIG_HEAD"):
+			fixErr = updateWorktreeRef(opts, wt, refUpdate{Name: "ORIG_HEAD", Delete: true})
+			if fixErr == nil {
+				em.Debugf("Removed %s", issue.Object)
+			}
+		default:
+			fixErr = repairWorktreeHead(repo, opts, wt, em)
+		}
+		if fixErr != nil {
+			em.Warnf("Failed to fix %s: %v", issue.Object, fixErr)
+			continue
+		}
+		opts.Diagnosis.InvalidateWorktree(issue.Object)
+		fixedCount++
+	}
+
+	return fixedCount, nil
+}
+
+// worktreeIssue is an issue with one of the per-worktree files of wt
+type worktreeIssue struct {
+	wt    Worktree
+	issue Issue
+}
+
+// updateWorktreeRef applies an update to a per-worktree reference of wt
+func updateWorktreeRef(opts Options, wt Worktree, u refUpdate) error {
+	refs, err := openRefStorage(opts.gitDir(), wt.GitDir)
+	if err != nil {
+		return err
+	}
+	return refs.Update(u)
+}
+
+// repairWorktreeHead points a broken detached HEAD at the newest valid commit
+// in the worktree's reflog, or the most recent valid commit of any branch.
+// HEAD stays detached so no branch ends up checked out twice.
+func repairWorktreeHead(repo store, opts Options, wt Worktree, em events.Emitter) error {
+	refs, err := openRefStorage(opts.gitDir(), wt.GitDir)
+	if err != nil {
+		return err
+	}
+	target := reflogCommit(repo, refs.Reflog("HEAD"))
+	if target == "" {
+		var err error
+		target, err = findMostRecentValidCommit(repo)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := refs.Update(refUpdate{Name: "HEAD", Hash: target}); err != nil {
+		return fmt.Errorf("failed to write HEAD: %w", err)
+	}
+	em.Debugf("Fixed %s (detached) -> %s", wt.RefName("HEAD"), target[:8])
+	return nil
+}
+
+// reflogCommit returns the newest commit of a reflog's hashes, oldest first,
+// that can still be read
+func reflogCommit(repo store, hashes []string) string {
+	for i := len(hashes) - 1; i >= 0; i-- {
+		if isNullHash(hashes[i]) {
+			continue
+		}
+		if hasCommit(repo, hashes[i]) {
+			return hashes[i]
+		}
+	}
+	return ""
+}
+
+// reflogHashes reads the hashes a reflog file set its reference to, oldest first
+func reflogHashes(file string) []string {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	var hashes []string
+	for _, line := range splitLines(string(content)) {
+		// <old> <new> <committer> <timestamp> <tz>\t<message>
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			hashes = append(hashes, fields[1])
+		}
+	}
+	return hashes
+}
+
+// updateWorktreeRefs moves detached HEADs and ORIG_HEADs of every worktree
+// that point at rewritten commits to their rewritten versions
+func updateWorktreeRefs(opts Options, commitMap map[string]string, em events.Emitter) error {
+	worktrees, err := ListWorktrees(opts)
+	if err != nil {
+		return err
+	}
+
+	for _, wt := range worktrees {
+		refs, err := openRefStorage(opts.gitDir(), wt.GitDir)
+		if err != nil {
+			return err
+		}
+		for _, ref := range []string{"HEAD", "ORIG_HEAD"} {
+			stored, err := refs.Reference(ref)
+			if err != nil || stored.Symbolic() {
+				continue
+			}
+			value := stored.Hash
+
+			newHash, exists := commitMap[value]
+			if !exists {
+				continue
+			}
+			if err := refs.Update(refUpdate{Name: ref, Hash: newHash}); err != nil {
+				return fmt.Errorf("failed to update %s: %w", wt.RefName(ref), err)
+			}
+			em.Detailf("Updated %s: %s -> %s", wt.RefName(ref), value[:8], newHash[:8])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+// Package gitdir locates the directories a repository keeps its git data in.
+// It handles the layouts git itself supports: a .git directory, a .git
+// gitfile (linked worktrees and submodules), bare repositories, and the
+// GIT_DIR, GIT_WORK_TREE and GIT_COMMON_DIR environment variables.
+package gitdir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+)
+
+// Dir describes where a repository's git data lives
+type Dir struct {
+	WorkTree  string // Top of the working tree; empty for bare repositories
+	GitDir    string // Per-worktree files such as HEAD, index and ORIG_HEAD
+	CommonDir string // Files shared by all worktrees: objects, refs, packed-refs, config
+}
+
+// Bare reports whether the repository has no working tree
+func (d *Dir) Bare() bool {
+	return d.WorkTree == ""
+}
+
+// Path returns the location of a file inside the git directory, e.g.
+// Path("HEAD") or Path("refs", "heads", "main"). Shared files resolve to the
+// common directory and per-worktree files to the git directory, following
+// git's repository layout.
+func (d *Dir) Path(elem ...string) string {
+	name := filepath.ToSlash(filepath.Join(elem...))
+	if isShared(name) {
+		return filepath.Join(d.CommonDir, filepath.FromSlash(name))
+	}
+	return filepath.Join(d.GitDir, filepath.FromSlash(name))
+}
+
+// MainWorkTree returns the working tree of the main worktree, which differs
+// from WorkTree when d is a linked worktree. It is empty for bare repositories.
+func (d *Dir) MainWorkTree() string {
+	if d.GitDir == d.CommonDir {
+		return d.WorkTree
+	}
+	if filepath.Base(d.CommonDir) == ".git" && !isBare(d.CommonDir) {
+		return filepath.Dir(d.CommonDir)
+	}
+	return ""
+}
+
+// ObjectPath returns the location of a loose object
+func (d *Dir) ObjectPath(hash string) string {
+	return d.Path("objects", hash[:2], hash[2:])
+}
+
+// sharedDirs are the entries of the common directory that all worktrees share
+var sharedDirs = map[string]bool{
+	"branches":    true,
+	"common":      true,
+	"config":      true,
+	"description": true,
+	"hooks":       true,
+	"info":        true,
+	"logs":        true,
+	"objects":     true,
+	"packed-refs": true,
+	"refs":        true,
+	"remotes":     true,
+	"shallow":     true,
+	"worktrees":   true,
+}
+
+// isShared reports whether a slash-separated path below the git directory
+// belongs to the common directory
+func isShared(name string) bool {
+	switch {
+	case name == "logs/HEAD",
+		strings.HasPrefix(name, "refs/bisect/"),
+		strings.HasPrefix(name, "refs/worktree/"),
+		strings.HasPrefix(name, "refs/rewritten/"):
+		return false
+	}
+	first, _, _ := strings.Cut(name, "/")
+	return sharedDirs[first]
+}
+
+// Resolve finds the git directories of the repository at path, which is
+// either a working tree or a bare repository. For the top-level repository,
+// the one in the directory nsha runs in, GIT_DIR, GIT_WORK_TREE and
+// GIT_COMMON_DIR take precedence as they do for git; relative values are
+// taken relative to path. Other paths, such as submodules and the
+// repositories found by a scan, are resolved from what is on disk.
+func Resolve(path string) (*Dir, error) {
+	d := &Dir{}
+	top := TopLevel(path)
+
+	if env := os.Getenv("GIT_DIR"); env != "" && top {
+		d.GitDir = relativeTo(path, env)
+		d.CommonDir = commonDir(path, d.GitDir, true)
+		if wt := os.Getenv("GIT_WORK_TREE"); wt != "" {
+			d.WorkTree = relativeTo(path, wt)
+		} else if !isBare(d.CommonDir) {
+			d.WorkTree = path
+		}
+		return d, nil
+	}
+
+	dotGit := filepath.Join(path, ".git")
+	info, err := os.Stat(dotGit)
+	switch {
+	case err == nil && info.IsDir():
+		d.WorkTree, d.GitDir = path, dotGit
+	case err == nil:
+		gitDir, err := readGitFile(dotGit)
+		if err != nil {
+			return nil, err
+		}
+		d.WorkTree, d.GitDir = path, gitDir
+	case IsGitDir(path):
+		d.GitDir = path
+	default:
+		return nil, fmt.Errorf("%s is not a git repository", path)
+	}
+
+	d.CommonDir = commonDir(path, d.GitDir, top)
+	if d.WorkTree == "" && filepath.Base(filepath.Clean(path)) == ".git" && !isBare(d.CommonDir) {
+		// The .git directory of a working tree was given directly
+		d.WorkTree = filepath.Dir(filepath.Clean(path))
+	}
+	return d, nil
+}
+
+// TopLevel reports whether path is the directory nsha runs in, whose
+// repository is the one GIT_DIR and the related variables describe
+func TopLevel(path string) bool {
+	wd, err := os.Getwd()
+	if err != nil {
+		return false
+	}
+	abs, err := filepath.Abs(path)
+	return err == nil && abs == wd
+}
+
+// repoVars are the variables that tell git where a repository is. git
+// commands run for any other repository must not see them.
+var repoVars = []string{"GIT_DIR", "GIT_WORK_TREE", "GIT_COMMON_DIR", "GIT_INDEX_FILE", "GIT_OBJECT_DIRECTORY", "GIT_ALTERNATE_OBJECT_DIRECTORIES"}
+
+// Environ returns the environment for git commands run in path: the
+// environment of nsha, without the variables that locate a repository
+// unless path is the top-level repository
+func Environ(path string) []string {
+	env := os.Environ()
+	if TopLevel(path) {
+		return env
+	}
+	kept := env[:0:0]
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if !slices.Contains(repoVars, name) {
+			kept = append(kept, kv)
+		}
+	}
+	return kept
+}
+
+// ResolveOrDefault is Resolve for callers that report errors later: when path
+// is not a repository it assumes the usual <path>/.git layout, so operations
+// on the result fail the same way they would have without resolution.
+func ResolveOrDefault(path string) *Dir {
+	if d, err := Resolve(path); err == nil {
+		return d
+	}
+	dotGit := filepath.Join(path, ".git")
+	return &Dir{WorkTree: path, GitDir: dotGit, CommonDir: dotGit}
+}
+
+// IsGitDir reports whether dir looks like a git directory: a bare repository,
+// a .git directory or the private directory of a linked worktree
+func IsGitDir(dir string) bool {
+	if info, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil || info.IsDir() {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(dir, "commondir")); err == nil {
+		return true
+	}
+	for _, sub := range []string{"objects", "refs"} {
+		if info, err := os.Stat(filepath.Join(dir, sub)); err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// readGitFile follows a "gitdir: <path>" file
+func readGitFile(file string) (string, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read gitfile: %w", err)
+	}
+	line := strings.TrimSpace(string(content))
+	target, ok := strings.CutPrefix(line, "gitdir:")
+	if !ok {
+		return "", fmt.Errorf("invalid gitfile %s: missing gitdir prefix", file)
+	}
+	return relativeTo(filepath.Dir(file), strings.TrimSpace(target)), nil
+}
+
+// commonDir returns GIT_COMMON_DIR when env is set, the target of
+// gitDir/commondir, or gitDir itself
+func commonDir(path, gitDir string, env bool) string {
+	if dir := os.Getenv("GIT_COMMON_DIR"); dir != "" && env {
+		return relativeTo(path, dir)
+	}
+	if content, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		if dir := strings.TrimSpace(string(content)); dir != "" {
+			return relativeTo(gitDir, dir)
+		}
+	}
+	return gitDir
+}
+
+// isBare reads core.bare from the repository config
+func isBare(commonDir string) bool {
+	f, err := os.Open(filepath.Join(commonDir, "config"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	cfg := config.New()
+	if err := config.NewDecoder(f).Decode(cfg); err != nil {
+		return false
+	}
+	return cfg.Section("core").Option("bare") == "true"
+}
+
+// relativeTo resolves p against base unless it is absolute
+func relativeTo(base, p string) string {
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+	return filepath.Join(base, p)
+}
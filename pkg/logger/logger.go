@@ -7,7 +7,8 @@ import (
 	"time"
 )
 
-// Logger handles detailed logging of all operations
+// Logger handles detailed logging of all operations.
+// A nil *Logger is valid and discards everything, so callers can run without a log file.
 type Logger struct {
 	logFile    *os.File
 	logDir     string
@@ -31,23 +32,39 @@ type Operation struct {
 // New creates a new logger instance
 // The nsha directory is created in the user's home directory
 func New(repoPath string) (*Logger, error) {
+	runDir, err := DefaultRunDir()
+	if err != nil {
+		return nil, err
+	}
+	return NewAt(runDir)
+}
+
+// DefaultRunDir returns a new timestamped run directory under ~/nsha.
+// Only the nsha directory itself is created.
+func DefaultRunDir() (string, error) {
 	// Get user's home directory
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user home directory: %w", err)
+		return "", fmt.Errorf("failed to get user home directory: %w", err)
 	}
 
 	// Create nsha directory in user's home directory
 	nshaDir := filepath.Join(homeDir, "nsha")
 	err = os.MkdirAll(nshaDir, 0755)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create nsha directory: %w", err)
+		return "", fmt.Errorf("failed to create nsha directory: %w", err)
 	}
 
-	// Create timestamped subdirectory for this run
+	// Timestamped subdirectory for this run
 	timestamp := time.Now().Format("20060102-150405")
-	runDir := filepath.Join(nshaDir, timestamp)
-	err = os.MkdirAll(runDir, 0755)
+	return filepath.Join(nshaDir, timestamp), nil
+}
+
+// NewAt creates a new logger that writes into runDir, creating it if needed.
+// Library callers use it to keep logs, reports and backups in a directory
+// of their choice instead of the user's home directory.
+func NewAt(runDir string) (*Logger, error) {
+	err := os.MkdirAll(runDir, 0755)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create run directory: %w", err)
 	}
@@ -89,6 +106,10 @@ Log Directory: %s
 
 // LogStep logs a major step in the process
 func (l *Logger) LogStep(step, description string) {
+	if l == nil {
+		return
+	}
+
 	timestamp := time.Now()
 	msg := fmt.Sprintf("\n[%s] STEP: %s - %s\n",
 		timestamp.Format("15:04:05"), step, description)
@@ -108,6 +129,10 @@ func (l *Logger) LogStep(step, description string) {
 
 // LogAction logs a specific action
 func (l *Logger) LogAction(step, action, details string) {
+	if l == nil {
+		return
+	}
+
 	timestamp := time.Now()
 	msg := fmt.Sprintf("[%s]   ACTION: %s - %s\n",
 		timestamp.Format("15:04:05"), action, details)
@@ -127,6 +152,10 @@ func (l *Logger) LogAction(step, action, details string) {
 
 // LogChange logs a change with before/after values
 func (l *Logger) LogChange(step, action, commitSHA, oldValue, newValue string) {
+	if l == nil {
+		return
+	}
+
 	timestamp := time.Now()
 	msg := fmt.Sprintf("[%s]   CHANGE: %s\n", timestamp.Format("15:04:05"), action)
 	if commitSHA != "" {
@@ -152,6 +181,10 @@ func (l *Logger) LogChange(step, action, commitSHA, oldValue, newValue string) {
 
 // LogError logs an error
 func (l *Logger) LogError(step, action, details, errorMsg string) {
+	if l == nil {
+		return
+	}
+
 	timestamp := time.Now()
 	msg := fmt.Sprintf("[%s]   ERROR: %s - %s\n",
 		timestamp.Format("15:04:05"), action, details)
@@ -173,16 +206,28 @@ func (l *Logger) LogError(step, action, details, errorMsg string) {
 
 // GetLogDir returns the directory where logs and backups are stored
 func (l *Logger) GetLogDir() string {
+	if l == nil {
+		return ""
+	}
+
 	return l.logDir
 }
 
 // GetOperations returns all logged operations
 func (l *Logger) GetOperations() []Operation {
+	if l == nil {
+		return nil
+	}
+
 	return l.operations
 }
 
 // Close closes the log file and writes summary
 func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
 	duration := time.Since(l.startTime)
 
 	footer := fmt.Sprintf(`
@@ -201,6 +246,10 @@ Total Operations: %d
 
 // LogInfo logs informational message
 func (l *Logger) LogInfo(step, message string) {
+	if l == nil {
+		return
+	}
+
 	timestamp := time.Now()
 	msg := fmt.Sprintf("[%s]   INFO: %s\n", timestamp.Format("15:04:05"), message)
 
@@ -210,6 +259,10 @@ func (l *Logger) LogInfo(step, message string) {
 
 // LogWarning logs a warning message
 func (l *Logger) LogWarning(step, message string) {
+	if l == nil {
+		return
+	}
+
 	timestamp := time.Now()
 	msg := fmt.Sprintf("[%s]   WARNING: %s\n", timestamp.Format("15:04:05"), message)
 
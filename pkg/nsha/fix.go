@@ -0,0 +1,688 @@
+package nsha
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rahul/nsha/pkg/backup"
+	"github.com/rahul/nsha/pkg/events"
+	"github.com/rahul/nsha/pkg/git"
+	"github.com/rahul/nsha/pkg/logger"
+	"github.com/rahul/nsha/pkg/report"
+)
+
+// Prompt identifies a question Fix asks before a risky action
+type Prompt string
+
+const (
+	// PromptContinueWithoutBackup is asked when the backup could not be created
+	PromptContinueWithoutBackup Prompt = "continue-without-backup"
+
+	// PromptRewriteHistory is asked before commits are replaced and history is rewritten
+	PromptRewriteHistory Prompt = "rewrite-history"
+)
+
+// HistoryRewriteFixer is recorded in Issue.FixedBy for issues that were
+// resolved by replacing broken commits and rewriting history
+const HistoryRewriteFixer = "history-rewrite"
+
+// FixOptions configures Fix
+type FixOptions struct {
+	RepoPath string // Path to the repository; defaults to the current directory
+	DryRun   bool   // Report what would change without modifying anything
+	Force    bool   // Force the history rewrite even if there are warnings
+	Events   Sink   // Receives progress messages; nil discards them
+
+	// Confirm is called before risky actions and must return true to go ahead.
+	// A nil Confirm declines every prompt, so history is never rewritten
+	// unless the caller explicitly opts in.
+	Confirm func(Prompt) bool
+
+	// LogDir is the directory for the run log, reports and backup. When empty,
+	// a timestamped directory under ~/nsha is created.
+	LogDir string
+
+	// Only restricts the run to the named fixers; Skip excludes fixers.
+	// Names are those reported by Fixer.Name.
+	Only []string
+	Skip []string
+
+	// Registry supplies the fixers to run; nil uses git.DefaultRegistry
+	Registry *git.Registry
+
+	// RecurseSubmodules also fixes every checked out submodule, recursively,
+	// after the repository itself. Their logs go under LogDir/submodules.
+	RecurseSubmodules bool
+
+	// Forensics writes an evidence bundle of everything damaged to
+	// LogDir/forensics.tar.gz before the backup is made and anything changes
+	Forensics bool
+}
+
+// StepResult is the outcome of a single fix step
+type StepResult struct {
+	Name  string
+	Fixer string // Name of the fixer that ran the step
+	Count int    // Number of issues fixed (or that would be fixed in dry-run mode)
+	Err   error  // Non-fatal error reported by the step
+}
+
+// FixResult is the outcome of Fix
+type FixResult struct {
+	RepoPath      string
+	DryRun        bool
+	StartTime     time.Time
+	EndTime       time.Time
+	InitialIssues []Issue
+	FinalIssues   []Issue
+	Steps         []StepResult
+	TotalFixed    int
+	BadCommits    []BadCommit    // Commits that needed (or would need) a history rewrite
+	Rewritten     bool           // Whether history was rewritten
+	Preview       *DryRunDetails // Detailed change preview, only set in dry-run mode
+	Backup        *BackupInfo
+	LogDir        string
+
+	// ForensicsPath is the evidence bundle written when FixOptions.Forensics is set
+	ForensicsPath string
+
+	// Timeline dates the damage as found before anything was changed
+	Timeline *Timeline
+
+	// Submodules holds the results for checked out submodules when
+	// FixOptions.RecurseSubmodules is set
+	Submodules []*FixResult
+}
+
+// Healthy reports whether the repository and its submodules had no issues to begin with
+func (r *FixResult) Healthy() bool {
+	return len(r.AllInitialIssues()) == 0
+}
+
+// Verified reports whether the repository was fixed and passed verification
+func (r *FixResult) Verified() bool {
+	return !r.DryRun && !r.Healthy() && len(r.AllFinalIssues()) == 0
+}
+
+// AllInitialIssues returns the issues found before fixing, including those of
+// submodules, whose Path is prefixed with the submodule's path
+func (r *FixResult) AllInitialIssues() []Issue {
+	issues := append([]Issue{}, r.InitialIssues...)
+	for _, sub := range r.Submodules {
+		issues = append(issues, prefixIssues(r.RepoPath, sub.RepoPath, sub.AllInitialIssues())...)
+	}
+	return issues
+}
+
+// AllFinalIssues returns the issues left after fixing, including those of submodules
+func (r *FixResult) AllFinalIssues() []Issue {
+	issues := append([]Issue{}, r.FinalIssues...)
+	for _, sub := range r.Submodules {
+		issues = append(issues, prefixIssues(r.RepoPath, sub.RepoPath, sub.AllFinalIssues())...)
+	}
+	return issues
+}
+
+// Fix detects and fixes null SHA issues, rewriting history when commits are
+// broken. The returned result is never nil, even when an error is returned,
+// so callers can report how far the run got.
+func Fix(ctx context.Context, opts FixOptions) (*FixResult, error) {
+	opts.RepoPath = repoPathOrDefault(opts.RepoPath)
+	if opts.Registry == nil {
+		opts.Registry = git.DefaultRegistry()
+	}
+
+	run := &fixRun{
+		opts:  opts,
+		gopts: git.Options{RepoPath: opts.RepoPath, DryRun: opts.DryRun, Events: opts.Events},
+		em:    events.Emitter{Sink: opts.Events},
+		result: &FixResult{
+			RepoPath:  opts.RepoPath,
+			DryRun:    opts.DryRun,
+			StartTime: time.Now(),
+		},
+	}
+	defer func() {
+		// Closing writes the log footer, also when the run was aborted
+		run.log.Close()
+	}()
+
+	err := run.execute(ctx)
+	if err == nil && opts.RecurseSubmodules {
+		err = fixSubmodules(ctx, opts, run.result)
+	}
+	run.result.EndTime = time.Now()
+	return run.result, err
+}
+
+// fixRun holds the state of a single Fix invocation
+type fixRun struct {
+	opts    FixOptions
+	gopts   git.Options
+	em      events.Emitter
+	log     *logger.Logger
+	result  *FixResult
+	step    int
+	diag    *git.Diagnosis // Shared scan result, kept up to date by the fixers
+	fixers  []git.Fixer    // Selected fixers in run order
+	changed bool           // Whether any fixer changed the repository
+}
+
+// nextStep announces the next numbered step
+func (r *fixRun) nextStep(msg string) {
+	r.step++
+	r.em.Step(r.step, msg)
+}
+
+// confirm asks the caller whether to go ahead with a risky action
+func (r *fixRun) confirm(p Prompt) bool {
+	return r.opts.Confirm != nil && r.opts.Confirm(p)
+}
+
+// abort records that the run was interrupted. Every step stops at a point
+// where the repository is consistent, so there is nothing left to undo here.
+func (r *fixRun) abort(step string) error {
+	r.em.Warnf("Operation aborted during %s - the repository was left at the last completed step", strings.ToLower(step))
+	r.log.LogError(step, "Abort", "Operation interrupted", context.Canceled.Error())
+	return fmt.Errorf("%w during %s", ErrAborted, strings.ToLower(step))
+}
+
+func (r *fixRun) execute(ctx context.Context) error {
+	fixers, err := r.opts.Registry.Select(r.opts.Only, r.opts.Skip)
+	if err != nil {
+		return fmt.Errorf("invalid fixer selection: %w", err)
+	}
+	r.fixers = fixers
+
+	// First, check if there are any issues
+	r.nextStep("Diagnosing repository...")
+	diag, err := git.Diagnose(ctx, r.gopts)
+	if ctx.Err() != nil {
+		return r.abort("DIAGNOSIS")
+	}
+	if err != nil {
+		return fmt.Errorf("diagnosis failed: %w", err)
+	}
+	r.diag = diag
+	r.gopts.Diagnosis = diag
+	initialIssues := append([]Issue(nil), diag.Issues...)
+	r.result.InitialIssues = initialIssues
+
+	if len(initialIssues) == 0 {
+		r.em.Successf("No issues found! Repository is healthy.")
+		return nil
+	}
+
+	if r.opts.DryRun {
+		// In dry-run mode, just show what would be done. The fixers' plans
+		// fill in the preview.
+		r.result.Preview = &git.DryRunDetails{}
+
+		r.em.Infof("[DRY RUN MODE] No actual changes will be made")
+		r.em.Infof("Found %d issue(s) that would be fixed:", len(initialIssues))
+		for i, issue := range initialIssues {
+			r.em.Detailf("%d. %s", i+1, issue.String())
+		}
+	} else {
+		// Issues found - now initialize logging and backup
+		r.openLog()
+		r.buildTimeline(ctx)
+		if r.opts.Forensics {
+			if err := r.collectForensics(ctx); err != nil {
+				return err
+			}
+		}
+		if err := r.createBackup(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := r.runFixers(ctx); err != nil {
+		return err
+	}
+
+	// Now check for bad commits that need history rewriting
+	r.em.Debugf("Checking for commits that need history rewriting...")
+	r.log.LogAction("FIX", "Check bad commits", "Scanning for commits requiring history rewriting")
+	badCommits, err := git.FindBadCommits(ctx, r.gopts)
+	if ctx.Err() != nil {
+		return r.abort("FIX")
+	}
+	if err != nil {
+		r.log.LogError("FIX", "Find bad commits", "Error occurred", err.Error())
+		return fmt.Errorf("diagnosis failed: %w", err)
+	}
+	r.log.LogInfo("FIX", fmt.Sprintf("Found %d bad commits requiring history rewriting", len(badCommits)))
+	r.result.BadCommits = badCommits
+
+	if len(badCommits) == 0 {
+		// Only references/paths/tags were fixed, no commits to fix
+		if r.result.TotalFixed > 0 {
+			if r.opts.DryRun {
+				r.em.Infof("[DRY RUN] Would fix %d issue(s)!", r.result.TotalFixed)
+			} else {
+				r.em.Successf("Fixed %d issue(s)!", r.result.TotalFixed)
+			}
+		}
+		if r.changed {
+			if err := r.collectGarbage(ctx); err != nil {
+				return err
+			}
+		}
+	} else if err := r.rewriteHistory(ctx, badCommits); err != nil {
+		return err
+	}
+
+	if r.opts.DryRun {
+		r.result.FinalIssues = initialIssues
+		return nil
+	}
+
+	return r.verifyAndReport(ctx)
+}
+
+// openLog initializes the run log. Failing to do so is not fatal.
+func (r *fixRun) openLog() {
+	var err error
+	if r.opts.LogDir != "" {
+		r.log, err = logger.NewAt(r.opts.LogDir)
+	} else {
+		r.log, err = logger.New(r.opts.RepoPath)
+	}
+	if err != nil {
+		r.em.Warnf("Could not initialize logger: %v", err)
+		r.em.Warnf("Continuing without detailed logging...")
+		r.log = nil
+		return
+	}
+
+	r.result.LogDir = r.log.GetLogDir()
+	r.em.Debugf("Logging to: %s", r.log.GetLogDir())
+	r.log.LogStep("INITIALIZATION", "Starting NSHA fix process")
+	r.log.LogInfo("DIAGNOSIS", fmt.Sprintf("Found %d issues requiring fixes", len(r.result.InitialIssues)))
+}
+
+// buildTimeline dates the damage while the damaged files are still in place.
+// The timeline only goes into the report, so failing to build it is not fatal.
+func (r *fixRun) buildTimeline(ctx context.Context) {
+	timeline, err := git.BuildTimeline(ctx, r.gopts)
+	if err != nil {
+		r.em.Debugf("Could not build incident timeline: %v", err)
+		return
+	}
+	r.result.Timeline = timeline
+	if timeline.Window != nil {
+		r.log.LogInfo("DIAGNOSIS", fmt.Sprintf("Incident window: %s to %s", timeline.Window.Start.Local().Format(time.RFC3339), timeline.Window.End.Local().Format(time.RFC3339)))
+	}
+}
+
+// collectForensics captures the damaged files and objects before anything
+// is changed. The evidence was asked for, so failing to collect it stops the run.
+func (r *fixRun) collectForensics(ctx context.Context) error {
+	r.nextStep("Collecting forensic evidence...")
+	r.log.LogStep("FORENSICS", "Collecting evidence of the damage before any repair")
+
+	root := r.log.GetLogDir()
+	if root == "" {
+		tmpDir, err := os.MkdirTemp("", "nsha-forensics-")
+		if err != nil {
+			return fmt.Errorf("failed to create forensics directory: %w", err)
+		}
+		root = tmpDir
+	}
+	out := filepath.Join(root, "forensics.tar.gz")
+
+	manifest, err := git.CollectForensics(ctx, r.gopts, out)
+	if ctx.Err() != nil {
+		return r.abort("FORENSICS")
+	}
+	if err != nil {
+		r.log.LogError("FORENSICS", "Collect evidence", "Failed to write evidence bundle", err.Error())
+		return fmt.Errorf("forensics failed: %w", err)
+	}
+
+	r.result.ForensicsPath = out
+	r.log.LogInfo("FORENSICS", fmt.Sprintf("Evidence bundle written: %s (%d files)", out, len(manifest.Files)))
+	r.em.Successf("Evidence bundle written: %s", out)
+	return nil
+}
+
+// createBackup backs up the repository before any modifications
+func (r *fixRun) createBackup(ctx context.Context) error {
+	r.nextStep("Creating repository backup...")
+	r.log.LogStep("BACKUP", "Creating full repository backup with complete history")
+
+	backupRoot := r.log.GetLogDir()
+	if backupRoot == "" {
+		// Without a log directory the backup still needs a home outside the repository
+		tmpDir, err := os.MkdirTemp("", "nsha-backup-")
+		if err != nil {
+			return fmt.Errorf("failed to create backup directory: %w", err)
+		}
+		backupRoot = tmpDir
+	}
+
+	backupInfo, err := backup.CreateBackup(ctx, r.opts.RepoPath, backupRoot, r.opts.Events)
+	if ctx.Err() != nil {
+		return r.abort("BACKUP")
+	}
+	if err != nil {
+		r.log.LogError("BACKUP", "Create backup", "Failed to create backup", err.Error())
+		r.em.Errorf("Failed to create backup: %v", err)
+		if !r.confirm(PromptContinueWithoutBackup) {
+			return fmt.Errorf("%w: backup failed", ErrCancelled)
+		}
+		return nil
+	}
+
+	r.result.Backup = backupInfo
+	r.log.LogInfo("BACKUP", fmt.Sprintf("Backup created successfully: %s", backupInfo.BackupPath))
+	r.em.Successf("Backup created successfully")
+
+	// Verify backup
+	err = backup.VerifyBackup(ctx, backupInfo, r.opts.Events)
+	if ctx.Err() != nil {
+		return r.abort("BACKUP")
+	}
+	if err != nil {
+		r.log.LogWarning("BACKUP", fmt.Sprintf("Backup verification failed: %v", err))
+		r.em.Warnf("Backup verification failed: %v", err)
+		r.em.Warnf("Continuing anyway - backup may still be usable...")
+	} else {
+		r.log.LogInfo("BACKUP", "Backup verified successfully")
+	}
+	return nil
+}
+
+// runFixers plans and applies every selected fixer in order
+func (r *fixRun) runFixers(ctx context.Context) error {
+	r.nextStep("Fixing null SHA issues...")
+	r.log.LogStep("FIX", "Starting null SHA fixes")
+
+	// Issues resolved in between are attributed to whichever fixer made the changes
+	defer r.diag.SetFixer("")
+	for _, fixer := range r.fixers {
+		name := fixer.Name()
+		r.diag.SetFixer(name)
+		r.em.Debugf("Planning %s...", name)
+		r.log.LogAction("FIX", "Plan "+name, fixer.Description())
+
+		before := append([]git.Issue(nil), r.diag.Issues...)
+		plan, err := fixer.Plan(ctx, r.gopts, r.diag)
+		applied := 0
+		if err == nil && !plan.Empty() {
+			applied, err = fixer.Apply(ctx, r.gopts, r.diag, plan)
+		}
+		if ctx.Err() != nil {
+			return r.abort("FIX")
+		}
+		if err != nil {
+			r.log.LogError("FIX", name, "Error occurred", err.Error())
+			r.em.Debugf("Warning: %s failed: %v", name, err)
+		}
+		if r.opts.DryRun && err == nil {
+			r.result.Preview.AddPlan(plan)
+		}
+		if !r.opts.DryRun && plan != nil {
+			for _, change := range plan.Changes {
+				newValue := change.NewValue
+				if newValue == "" {
+					newValue = "(removed)"
+				}
+				r.log.LogChange("FIX", change.Object+": "+change.Action, "", change.OldValue, newValue)
+			}
+			r.changed = r.changed || applied > 0
+		}
+
+		// Later fixers plan from what this one left behind
+		if r.diag.Dirty() {
+			err := r.diag.Refresh(ctx, r.gopts)
+			if ctx.Err() != nil {
+				return r.abort("FIX")
+			}
+			if err != nil {
+				return fmt.Errorf("diagnosis failed: %w", err)
+			}
+		}
+
+		// A dry run can only count what the fixer planned; a real run counts
+		// the issues its changes actually resolved
+		count := applied
+		if !r.opts.DryRun {
+			count = r.resolvedBy(name, before)
+		}
+		r.result.Steps = append(r.result.Steps, StepResult{Name: fixer.Description(), Fixer: name, Count: count, Err: err})
+		if count > 0 {
+			r.log.LogChange("FIX", "Applied "+name, "", fmt.Sprintf("%d issues", count), "Fixed")
+			if r.opts.DryRun {
+				r.em.Infof("[DRY RUN] %s: would fix %d issue(s)", name, count)
+			} else {
+				r.em.Successf("%s: fixed %d issue(s)", name, count)
+			}
+			r.result.TotalFixed += count
+		} else if applied > 0 {
+			r.em.Debugf("%s: made %d change(s) without resolving an issue", name, applied)
+		}
+	}
+	return nil
+}
+
+// resolvedBy counts the issues in before that are gone and were resolved by
+// the named fixer's changes
+func (r *fixRun) resolvedBy(name string, before []git.Issue) int {
+	count := 0
+	for _, issue := range r.diag.AttributeFixes(before) {
+		if issue.Resolved && issue.FixedBy == name {
+			count++
+		}
+	}
+	return count
+}
+
+// collectGarbage removes objects orphaned by the fixes
+func (r *fixRun) collectGarbage(ctx context.Context) error {
+	r.em.Debugf("Running garbage collection to clean up orphaned objects...")
+	r.log.LogStep("CLEANUP", "Running garbage collection")
+
+	err := git.RunGarbageCollection(ctx, r.gopts)
+	if ctx.Err() != nil {
+		return r.abort("CLEANUP")
+	}
+	if err != nil {
+		r.em.Debugf("Warning: Garbage collection failed: %v", err)
+		r.log.LogWarning("CLEANUP", fmt.Sprintf("Garbage collection failed: %v", err))
+	} else {
+		r.log.LogInfo("CLEANUP", "Garbage collection completed")
+	}
+	return nil
+}
+
+// rewriteHistory replaces broken commits and rewrites history on top of them
+func (r *fixRun) rewriteHistory(ctx context.Context, badCommits []BadCommit) error {
+	r.em.Infof("Found %d bad commit(s):", len(badCommits))
+	for i, commit := range badCommits {
+		r.em.Detailf("%d. %s", i+1, commit.String())
+	}
+
+	// Replacing a boundary commit of a shallow clone would leave it pointing
+	// at parents the repository does not have
+	if err := git.CheckShallowRewrite(ctx, r.gopts, badCommits); err != nil {
+		r.log.LogError("REWRITE", "Check shallow boundary", "History rewrite refused", err.Error())
+		r.em.Warnf("Not rewriting history: %v", err)
+		r.em.Infof("Fetch the missing history first, e.g. with 'git fetch --unshallow', then run 'nsha fix' again")
+		return nil
+	}
+
+	if !r.opts.DryRun && !r.confirm(PromptRewriteHistory) {
+		r.em.Infof("Operation cancelled by user")
+		return fmt.Errorf("%w: history rewrite declined", ErrCancelled)
+	}
+
+	if !r.opts.DryRun {
+		r.nextStep("Creating empty tree object...")
+		r.log.LogStep("REWRITE", "Creating empty tree object")
+		emptyTree, err := git.CreateEmptyTree(ctx, r.gopts)
+		if ctx.Err() != nil {
+			return r.abort("REWRITE")
+		}
+		if err != nil {
+			r.log.LogError("REWRITE", "Create empty tree", "Failed to create empty tree", err.Error())
+			return fmt.Errorf("failed to create empty tree: %w", err)
+		}
+		r.em.Debugf("Empty tree hash: %s", emptyTree)
+		r.log.LogInfo("REWRITE", fmt.Sprintf("Empty tree created: %s", emptyTree))
+		r.em.Successf("Empty tree created")
+	}
+
+	r.nextStep("Replacing broken commits...")
+	r.log.LogStep("REWRITE", fmt.Sprintf("Replacing %d broken commits", len(badCommits)))
+	r.diag.SetFixer(HistoryRewriteFixer)
+	defer r.diag.SetFixer("")
+	var replaced []BadCommit
+	for i, commit := range badCommits {
+		if ctx.Err() != nil {
+			r.rollbackReplaceRefs(replaced)
+			return r.abort("REWRITE")
+		}
+
+		if r.opts.DryRun {
+			r.em.Detailf("[DRY RUN] Would replace: %s", commit.Hash[:8])
+			continue
+		}
+
+		err := git.ReplaceCommit(ctx, r.gopts, commit)
+		if err != nil {
+			r.log.LogError("REWRITE", "Replace commit", commit.Hash, err.Error())
+			r.em.Errorf("Failed to replace %s: %v", commit.Hash[:8], err)
+			continue
+		}
+		replaced = append(replaced, commit)
+		r.log.LogChange("REWRITE", "Replaced commit", commit.Hash, "Broken commit", "Replaced with valid commit")
+		r.em.Detailf("✓ Replaced %d/%d: %s", i+1, len(badCommits), commit.Hash[:8])
+	}
+
+	if r.opts.DryRun {
+		return nil
+	}
+	r.em.Successf("All commits replaced")
+
+	r.nextStep("Rewriting history (this may take a while)...")
+	r.log.LogStep("REWRITE", "Rewriting repository history with git filter-repo")
+	err := git.FilterRepo(ctx, r.gopts, r.opts.Force)
+	if err != nil {
+		// References the rewrite did not reach still point at the original
+		// history, so undoing the replace refs restores their pre-fix view
+		// instead of leaving the replacements in place
+		r.rollbackReplaceRefs(replaced)
+		if ctx.Err() != nil {
+			return r.abort("REWRITE")
+		}
+		r.log.LogError("REWRITE", "Filter repository", "History rewrite failed", err.Error())
+		return fmt.Errorf("history rewrite failed: %w", err)
+	}
+	r.result.Rewritten = true
+	r.log.LogInfo("REWRITE", "History rewritten successfully")
+	r.em.Successf("History rewritten successfully")
+
+	r.nextStep("Cleaning up replace references...")
+	r.log.LogStep("CLEANUP", "Cleaning up replace references")
+	// The rewrite has already updated the references at this point, so
+	// finish the cleanup even if an interrupt arrived in the meantime
+	err = git.CleanupReplaceRefs(context.WithoutCancel(ctx), r.gopts)
+	if err != nil {
+		r.log.LogError("CLEANUP", "Cleanup replace refs", "Cleanup failed", err.Error())
+		return fmt.Errorf("cleanup failed: %w", err)
+	}
+	r.log.LogInfo("CLEANUP", "Replace references cleaned up")
+
+	// The old commits are only in reflogs now; drop the ones fixers had to
+	// quarantine objects of
+	if err := git.ExpireBrokenReflogs(context.WithoutCancel(ctx), r.gopts); err != nil {
+		r.log.LogWarning("CLEANUP", fmt.Sprintf("Reflog cleanup failed: %v", err))
+		r.em.Debugf("Warning: %v", err)
+	}
+	r.em.Successf("Cleanup complete")
+	return nil
+}
+
+// rollbackReplaceRefs removes the replace refs created by this run for commits
+// whose history rewrite never happened, so git sees the original history again
+func (r *fixRun) rollbackReplaceRefs(replaced []BadCommit) {
+	for _, commit := range replaced {
+		err := git.RemoveReplaceRef(context.Background(), r.gopts, commit.Hash)
+		if err != nil {
+			r.em.Warnf("Could not remove replace ref for %s: %v", commit.Hash[:8], err)
+			r.log.LogError("REWRITE", "Rollback replace ref", commit.Hash, err.Error())
+			continue
+		}
+		r.log.LogChange("REWRITE", "Rolled back replace ref", commit.Hash, "Replaced", "Original commit restored")
+	}
+}
+
+// verifyAndReport re-checks the repository and writes the run reports
+func (r *fixRun) verifyAndReport(ctx context.Context) error {
+	r.nextStep("Verifying repository integrity...")
+	r.log.LogStep("VERIFICATION", "Verifying repository integrity")
+
+	// Only what the fixes touched is rechecked, unless history was rewritten
+	err := r.diag.Refresh(ctx, r.gopts)
+	if ctx.Err() != nil {
+		return r.abort("VERIFICATION")
+	}
+	if err != nil {
+		return fmt.Errorf("verification failed: %w", err)
+	}
+	finalIssues := append([]Issue(nil), r.diag.Issues...)
+	r.result.FinalIssues = finalIssues
+	r.result.InitialIssues = r.diag.AttributeFixes(r.result.InitialIssues)
+
+	if len(finalIssues) > 0 {
+		r.log.LogWarning("VERIFICATION", fmt.Sprintf("Verification found %d remaining issue(s)", len(finalIssues)))
+		r.em.Warnf("Verification found remaining issues:")
+		for _, issue := range finalIssues {
+			r.em.Detailf("%s", issue.String())
+		}
+		r.em.Infof("Some issues may require manual intervention or running 'nsha fix' again")
+	} else {
+		r.log.LogInfo("VERIFICATION", "Repository verified successfully")
+		r.em.Successf("Repository verified - all issues fixed!")
+	}
+
+	// Generate comprehensive reports
+	if r.log == nil {
+		return nil
+	}
+	r.log.LogStep("REPORTING", "Generating detailed reports")
+
+	reportData := &report.ReportData{
+		RepoPath:      r.opts.RepoPath,
+		StartTime:     r.result.StartTime,
+		EndTime:       time.Now(),
+		InitialIssues: r.result.InitialIssues,
+		FinalIssues:   finalIssues,
+		Operations:    r.log.GetOperations(),
+		Success:       len(finalIssues) == 0,
+	}
+	if r.result.Backup != nil {
+		reportData.BackupPath = r.result.Backup.BackupPath
+	}
+	reportData.ForensicsPath = r.result.ForensicsPath
+	reportData.Timeline = r.result.Timeline
+	if worktrees, err := git.ListWorktrees(r.gopts); err == nil {
+		reportData.Worktrees = worktrees
+	}
+
+	err = report.GenerateReport(reportData, r.log.GetLogDir())
+	if err != nil {
+		r.log.LogWarning("REPORTING", fmt.Sprintf("Could not generate reports: %v", err))
+		r.em.Warnf("Could not generate reports: %v", err)
+	} else {
+		r.log.LogInfo("REPORTING", "Reports generated successfully")
+		r.em.Infof("Detailed reports saved to: %s", r.log.GetLogDir())
+	}
+	return nil
+}
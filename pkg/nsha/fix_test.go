@@ -0,0 +1,318 @@
+package nsha
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rahul/nsha/pkg/git"
+)
+
+// runGit runs git in dir with a fixed identity, failing the test when git fails
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL="+os.DevNull)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// planRecorder is a fixer that records the issues of the diagnosis it is
+// planned from and changes nothing
+type planRecorder struct {
+	seen []Issue
+}
+
+func (f *planRecorder) Name() string               { return "plan-recorder" }
+func (f *planRecorder) Description() string        { return "Record the planned issues" }
+func (f *planRecorder) Handles(git.IssueType) bool { return true }
+func (f *planRecorder) DependsOn() []string        { return []string{"pack-indexes"} }
+func (f *planRecorder) Apply(context.Context, git.Options, *Diagnosis, *FixPlan) (int, error) {
+	return 0, nil
+}
+
+func (f *planRecorder) Plan(_ context.Context, _ git.Options, d *Diagnosis) (*FixPlan, error) {
+	f.seen = append([]Issue(nil), d.Issues...)
+	return &FixPlan{Fixer: f.Name()}, nil
+}
+
+// overclaimer is a fixer that touches a reference and claims to have fixed
+// every issue without resolving any of them
+type overclaimer struct{}
+
+func (overclaimer) Name() string               { return "overclaimer" }
+func (overclaimer) Description() string        { return "Claim every issue" }
+func (overclaimer) Handles(git.IssueType) bool { return true }
+func (overclaimer) DependsOn() []string        { return nil }
+func (overclaimer) Apply(_ context.Context, _ git.Options, d *Diagnosis, p *FixPlan) (int, error) {
+	d.InvalidateRef("HEAD")
+	return p.Count, nil
+}
+
+func (f overclaimer) Plan(_ context.Context, _ git.Options, d *Diagnosis) (*FixPlan, error) {
+	return &FixPlan{Fixer: f.Name(), Issues: d.Issues, Count: len(d.Issues)}, nil
+}
+
+func TestFixRefreshesDiagnosisBetweenFixers(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	runGit(t, dir, "init", "-q")
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		runGit(t, dir, "add", name)
+		runGit(t, dir, "commit", "-q", "-m", "Add "+name)
+	}
+	head := runGit(t, dir, "rev-parse", "HEAD")
+	runGit(t, dir, "repack", "-q", "-a", "-d")
+
+	// Without its index every object in the pack is missing
+	indexes, _ := filepath.Glob(filepath.Join(dir, ".git", "objects", "pack", "pack-*.idx"))
+	if len(indexes) != 1 {
+		t.Fatalf("want one pack index, found %d", len(indexes))
+	}
+	if err := os.Remove(indexes[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	packIndexes, _ := git.DefaultRegistry().Get("pack-indexes")
+	recorder := &planRecorder{}
+	registry := git.NewRegistry()
+	for _, f := range []Fixer{packIndexes, recorder} {
+		if err := registry.Register(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := Fix(context.Background(), FixOptions{
+		RepoPath: dir,
+		LogDir:   t.TempDir(),
+		Registry: registry,
+		Confirm:  func(Prompt) bool { return true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing := 0
+	for _, issue := range result.InitialIssues {
+		if issue.Type == git.IssueTypeMissingCommit {
+			missing++
+		}
+	}
+	if missing == 0 {
+		t.Fatalf("want missing objects before the fix, got %v", result.InitialIssues)
+	}
+	for _, issue := range recorder.seen {
+		t.Errorf("fixer after pack-indexes planned from a resolved issue: %s", issue.String())
+	}
+	if len(result.FinalIssues) > 0 {
+		t.Errorf("want no issues left, got %v", result.FinalIssues)
+	}
+	if got := runGit(t, dir, "rev-parse", "HEAD"); got != head {
+		t.Errorf("HEAD moved from %s to %s", head, got)
+	}
+}
+
+// newRepoWithNullPackedTag creates a repository whose packed-refs has a tag
+// with a null-like hash, and returns it with the content of packed-refs
+func newRepoWithNullPackedTag(t *testing.T) (string, string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	runGit(t, dir, "init", "-q")
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "add", "a.txt")
+	runGit(t, dir, "commit", "-q", "-m", "Add a.txt")
+	runGit(t, dir, "tag", "v1")
+	runGit(t, dir, "pack-refs", "--all")
+
+	file := filepath.Join(dir, ".git", "packed-refs")
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packed := string(content) + strings.Repeat("0", 39) + "1 refs/tags/null-tag\n"
+	if err := os.WriteFile(file, []byte(packed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, packed
+}
+
+func TestFixLogsPackedRefsCleanup(t *testing.T) {
+	dir, _ := newRepoWithNullPackedTag(t)
+	logDir := t.TempDir()
+	result, err := Fix(context.Background(), FixOptions{
+		RepoPath: dir,
+		LogDir:   logDir,
+		Only:     []string{"packed-refs"},
+		Confirm:  func(Prompt) bool { return true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.InitialIssues) == 0 {
+		t.Fatal("want the null tag reported before the fix")
+	}
+	if len(result.FinalIssues) > 0 {
+		t.Errorf("want no issues left, got %v", result.FinalIssues)
+	}
+	if result.TotalFixed == 0 {
+		t.Error("packed-refs cleanup is not counted")
+	}
+
+	for _, name := range []string{"nsha.log", "changes-summary.txt"} {
+		content, err := os.ReadFile(filepath.Join(logDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(content), "refs/tags/null-tag: remove from packed-refs") {
+			t.Errorf("%s does not record the removed entry:\n%s", name, content)
+		}
+	}
+}
+
+func TestFixOnlySkipsPackedRefsCleanup(t *testing.T) {
+	dir, packed := newRepoWithNullPackedTag(t)
+	_, err := Fix(context.Background(), FixOptions{
+		RepoPath: dir,
+		LogDir:   t.TempDir(),
+		Only:     []string{"pack-indexes"},
+		Confirm:  func(Prompt) bool { return true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, ".git", "packed-refs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != packed {
+		t.Errorf("packed-refs changed although packed-refs was not selected:\n%s", content)
+	}
+}
+
+func TestFixAttributesFixesToTheFixerThatMadeThem(t *testing.T) {
+	dir, _ := newRepoWithNullPackedTag(t)
+	result, err := Fix(context.Background(), FixOptions{
+		RepoPath: dir,
+		LogDir:   t.TempDir(),
+		Confirm:  func(Prompt) bool { return true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.InitialIssues) == 0 {
+		t.Fatal("want the null tag reported before the fix")
+	}
+	for _, issue := range result.InitialIssues {
+		if !issue.Resolved || issue.FixedBy != "packed-refs" {
+			t.Errorf("want %s resolved by packed-refs", issue.String())
+		}
+	}
+}
+
+func TestFixLeavesUnrestorableMalformedRef(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	runGit(t, dir, "init", "-q")
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "add", "a.txt")
+	runGit(t, dir, "commit", "-q", "-m", "Add a.txt")
+
+	// An empty branch file without a reflog cannot be restored
+	file := filepath.Join(dir, ".git", "refs", "heads", "empty-branch")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Fix(context.Background(), FixOptions{
+		RepoPath: dir,
+		LogDir:   t.TempDir(),
+		Confirm:  func(Prompt) bool { return true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(file); err != nil || len(content) > 0 {
+		t.Errorf("empty-branch was changed: %q, %v", content, err)
+	}
+	for _, issue := range result.InitialIssues {
+		if issue.Object == "refs/heads/empty-branch" && issue.Resolved {
+			t.Errorf("%s counted as fixed", issue.String())
+		}
+	}
+	if result.TotalFixed > 0 {
+		t.Errorf("want nothing fixed, got %d", result.TotalFixed)
+	}
+}
+
+func TestFixDryRunPreviewsPackedRefsOnce(t *testing.T) {
+	dir, packed := newRepoWithNullPackedTag(t)
+	result, err := Fix(context.Background(), FixOptions{RepoPath: dir, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []DryRunChange
+	for _, change := range result.Preview.Changes {
+		if change.Object == "refs/tags/null-tag" {
+			found = append(found, change)
+		}
+	}
+	if len(found) != 1 || found[0].Type != "packed-refs" || found[0].Action != "delete" {
+		t.Errorf("want the null tag previewed once as removed by packed-refs, got %+v", found)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, ".git", "packed-refs")); string(content) != packed {
+		t.Error("dry run changed packed-refs")
+	}
+}
+
+func TestFixCountsOnlyResolvedIssues(t *testing.T) {
+	dir, _ := newRepoWithNullPackedTag(t)
+	registry := git.NewRegistry()
+	if err := registry.Register(overclaimer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Fix(context.Background(), FixOptions{
+		RepoPath: dir,
+		LogDir:   t.TempDir(),
+		Registry: registry,
+		Confirm:  func(Prompt) bool { return true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.InitialIssues) == 0 {
+		t.Fatal("want the null tag reported before the fix")
+	}
+	for _, step := range result.Steps {
+		if step.Count > 0 {
+			t.Errorf("%s: want nothing fixed, got %d", step.Fixer, step.Count)
+		}
+	}
+	if result.TotalFixed > 0 {
+		t.Errorf("want nothing fixed, got %d", result.TotalFixed)
+	}
+}
@@ -0,0 +1,43 @@
+package nsha
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rahul/nsha/pkg/git"
+)
+
+// Re-exported types describing an evidence bundle
+type (
+	ForensicsManifest = git.ForensicsManifest
+	ForensicsFile     = git.ForensicsFile
+	ForensicsIssue    = git.ForensicsIssue
+)
+
+// ForensicsOptions configures Forensics
+type ForensicsOptions struct {
+	RepoPath string // Path to the repository; defaults to the current directory
+	Events   Sink   // Receives progress messages; nil discards them
+	Out      string // Path of the .tar.gz bundle to write
+}
+
+// Forensics diagnoses a repository and writes an evidence bundle of what is
+// damaged to opts.Out without changing the repository
+func Forensics(ctx context.Context, opts ForensicsOptions) (*ForensicsManifest, error) {
+	gopts := git.Options{RepoPath: repoPathOrDefault(opts.RepoPath), Events: opts.Events}
+
+	diag, err := git.Diagnose(ctx, gopts)
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("%w during diagnosis", ErrAborted)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("diagnosis failed: %w", err)
+	}
+	gopts.Diagnosis = diag
+
+	manifest, err := git.CollectForensics(ctx, gopts, opts.Out)
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("%w while collecting evidence", ErrAborted)
+	}
+	return manifest, err
+}
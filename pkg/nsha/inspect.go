@@ -0,0 +1,37 @@
+package nsha
+
+import (
+	"context"
+
+	"github.com/rahul/nsha/pkg/git"
+)
+
+// Re-exported types describing an object decoded by Inspect
+type (
+	RawObject    = git.RawObject
+	RawTreeEntry = git.RawTreeEntry
+	RawRegion    = git.RawRegion
+)
+
+// ErrObjectNotFound is returned when inspecting an object the repository
+// does not have, loose, packed or in quarantine
+var ErrObjectNotFound = git.ErrObjectNotFound
+
+// InspectOptions configures Inspect
+type InspectOptions struct {
+	RepoPath string // Path to the repository; defaults to the current directory
+	Events   Sink   // Receives progress messages; nil discards them
+}
+
+// Inspect reads an object, named by full or abbreviated ID or by the path
+// of a loose object file, without requiring it to be well-formed. Problems
+// are recorded in the result rather than returned as errors.
+func Inspect(ctx context.Context, opts InspectOptions, name string) (*RawObject, error) {
+	gopts := git.Options{RepoPath: repoPathOrDefault(opts.RepoPath), Events: opts.Events}
+	return git.InspectObject(ctx, gopts, name)
+}
+
+// Hexdump formats bytes like hexdump -C, numbering lines from offset
+func Hexdump(data []byte, offset int) string {
+	return git.Hexdump(data, offset)
+}
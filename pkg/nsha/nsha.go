@@ -0,0 +1,136 @@
+// Package nsha is the stable library entry point for detecting and fixing
+// null SHA and broken tree issues in Git repositories. The nsha command line
+// tool is built on top of it; other programs can embed it the same way.
+//
+// Operations never write to stdout. Everything they report goes through the
+// events.Sink passed in the options, and the outcome is returned as a typed
+// result.
+package nsha
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rahul/nsha/pkg/backup"
+	"github.com/rahul/nsha/pkg/events"
+	"github.com/rahul/nsha/pkg/git"
+)
+
+// DefaultRegistry returns the registry holding the built-in fixers
+func DefaultRegistry() *Registry {
+	return git.DefaultRegistry()
+}
+
+// IssueTypes lists every issue type in a stable order
+var IssueTypes = git.IssueTypes
+
+// Re-exported types so callers only need to import this package
+type (
+	Issue         = git.Issue
+	IssueType     = git.IssueType
+	BadCommit     = git.BadCommit
+	DryRunChange  = git.DryRunChange
+	DryRunDetails = git.DryRunDetails
+	BackupInfo    = backup.BackupInfo
+	Diagnosis     = git.Diagnosis
+	Fixer         = git.Fixer
+	FixPlan       = git.FixPlan
+	Registry      = git.Registry
+	Event         = events.Event
+	EventType     = events.Type
+	Severity      = git.Severity
+	Sink          = events.Sink
+	SinkFunc      = events.SinkFunc
+)
+
+var (
+	// ErrAborted is returned when an operation stopped early because its
+	// context was cancelled. The repository is left at the last completed step.
+	ErrAborted = errors.New("operation aborted")
+
+	// ErrCancelled is returned when a Confirm callback declined to continue
+	ErrCancelled = errors.New("operation cancelled")
+
+	// ErrShallowBoundary is returned when a history rewrite would change a
+	// commit at the boundary of a shallow clone
+	ErrShallowBoundary = git.ErrShallowBoundary
+)
+
+// DiagnoseOptions configures Diagnose and Verify
+type DiagnoseOptions struct {
+	RepoPath string // Path to the repository; defaults to the current directory
+	Events   Sink   // Receives progress messages; nil discards them
+
+	// RecurseSubmodules also diagnoses every checked out submodule, recursively
+	RecurseSubmodules bool
+}
+
+// DiagnoseResult is the outcome of Diagnose or Verify
+type DiagnoseResult struct {
+	RepoPath  string
+	Issues    []Issue
+	StartTime time.Time
+	Duration  time.Duration
+
+	// Submodules holds the results for checked out submodules when
+	// DiagnoseOptions.RecurseSubmodules is set
+	Submodules []*DiagnoseResult
+}
+
+// Healthy reports whether no issues were found, including in submodules
+func (r *DiagnoseResult) Healthy() bool {
+	return len(r.AllIssues()) == 0
+}
+
+// AllIssues returns the issues of the repository and of its submodules. The
+// Path of submodule issues is prefixed with the submodule's path.
+func (r *DiagnoseResult) AllIssues() []Issue {
+	issues := append([]Issue{}, r.Issues...)
+	for _, sub := range r.Submodules {
+		issues = append(issues, prefixIssues(r.RepoPath, sub.RepoPath, sub.AllIssues())...)
+	}
+	return issues
+}
+
+// Diagnose scans a repository for corrupt objects, null SHA references and broken trees
+func Diagnose(ctx context.Context, opts DiagnoseOptions) (*DiagnoseResult, error) {
+	start := time.Now()
+	gopts := git.Options{RepoPath: repoPathOrDefault(opts.RepoPath), Events: opts.Events}
+
+	issues, err := git.RunFsck(ctx, gopts)
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("%w during diagnosis", ErrAborted)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fsck failed: %w", err)
+	}
+
+	result := &DiagnoseResult{
+		RepoPath:  gopts.RepoPath,
+		Issues:    issues,
+		StartTime: start,
+	}
+	if opts.RecurseSubmodules {
+		if err := diagnoseSubmodules(ctx, opts, result); err != nil {
+			return nil, err
+		}
+	}
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// Verify checks repository integrity. It runs the same checks as Diagnose and
+// exists so callers can express intent, e.g. after a Fix.
+func Verify(ctx context.Context, opts DiagnoseOptions) (*DiagnoseResult, error) {
+	return Diagnose(ctx, opts)
+}
+
+// repoPathOrDefault returns "." for an empty repository path
+func repoPathOrDefault(repoPath string) string {
+	if repoPath == "" {
+		return "."
+	}
+	return repoPath
+}
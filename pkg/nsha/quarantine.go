@@ -0,0 +1,33 @@
+package nsha
+
+import (
+	"github.com/rahul/nsha/pkg/git"
+)
+
+// QuarantinedObject is a damaged loose object or conflict copy that Fix moved
+// into .git/nsha-quarantine
+type QuarantinedObject = git.QuarantinedObject
+
+// ErrNotQuarantined is returned when restoring an object that is not in quarantine
+var ErrNotQuarantined = git.ErrNotQuarantined
+
+// QuarantineOptions configures ListQuarantine and RestoreQuarantine
+type QuarantineOptions struct {
+	RepoPath string // Path to the repository; defaults to the current directory
+	Events   Sink   // Receives progress messages; nil discards them
+
+	// Force overwrites objects that exist again at their original location
+	Force bool
+}
+
+// ListQuarantine returns the objects in a repository's quarantine, oldest first
+func ListQuarantine(opts QuarantineOptions) ([]QuarantinedObject, error) {
+	return git.ListQuarantine(git.Options{RepoPath: repoPathOrDefault(opts.RepoPath), Events: opts.Events})
+}
+
+// RestoreQuarantine moves quarantined objects, named by ID or hash, back into
+// the object store. It returns the objects restored, also when some failed.
+func RestoreQuarantine(opts QuarantineOptions, names []string) ([]QuarantinedObject, error) {
+	gopts := git.Options{RepoPath: repoPathOrDefault(opts.RepoPath), Events: opts.Events}
+	return git.RestoreQuarantine(gopts, names, opts.Force)
+}
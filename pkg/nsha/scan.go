@@ -0,0 +1,222 @@
+package nsha
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/rahul/nsha/pkg/events"
+	"github.com/rahul/nsha/pkg/git"
+	"github.com/rahul/nsha/pkg/logger"
+	"github.com/rahul/nsha/pkg/progress"
+)
+
+// RepoStatus summarizes the outcome for one repository of a Scan
+type RepoStatus string
+
+const (
+	StatusHealthy   RepoStatus = "healthy"   // No issues found
+	StatusIssues    RepoStatus = "issues"    // Issues found and not fixed
+	StatusFixed     RepoStatus = "fixed"     // Every issue was fixed and verified
+	StatusRemaining RepoStatus = "remaining" // Fixed, but verification still reports issues
+	StatusFailed    RepoStatus = "failed"    // The repository could not be scanned or fixed
+	StatusAborted   RepoStatus = "aborted"   // Interrupted, declined or never started
+)
+
+// ScanOptions configures Scan
+type ScanOptions struct {
+	Root   string // Directory searched for repositories; defaults to the current directory
+	Jobs   int    // Repositories processed at once; defaults to the number of CPUs
+	Events Sink   // Receives scan progress; messages of the individual runs are not forwarded
+
+	// Fix runs Fix on every repository with issues, using FixOptions as the
+	// template. RepoPath and Events are set per repository. Each run logs and
+	// backs up into its own directory below FixOptions.LogDir, which defaults
+	// to a timestamped directory under ~/nsha.
+	Fix        bool
+	FixOptions FixOptions
+}
+
+// RepoScan is the outcome of Scan for one repository
+type RepoScan struct {
+	Path     string // Repository path, see git.Repository
+	Name     string // Path relative to the scan root
+	Bare     bool
+	Status   RepoStatus
+	Issues   []Issue    // Issues found before any fix
+	Fix      *FixResult // Only set when the repository was fixed
+	Err      error
+	Duration time.Duration
+}
+
+// ScanResult is the outcome of Scan
+type ScanResult struct {
+	Root      string
+	Repos     []RepoScan // Sorted by path
+	LogDir    string     // Parent of the per-repository log directories, set with Fix
+	StartTime time.Time
+	Duration  time.Duration
+}
+
+// Count returns the number of repositories with the given status
+func (r *ScanResult) Count(status RepoStatus) int {
+	n := 0
+	for _, repo := range r.Repos {
+		if repo.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Scan finds every git repository below a directory and diagnoses, and
+// optionally fixes, them concurrently. Failures of single repositories are
+// recorded in their RepoScan; the returned error is only set when the
+// repositories could not be listed or the scan was interrupted.
+func Scan(ctx context.Context, opts ScanOptions) (*ScanResult, error) {
+	opts.Root = repoPathOrDefault(opts.Root)
+	if opts.Jobs <= 0 {
+		opts.Jobs = runtime.NumCPU()
+	}
+	em := events.Emitter{Sink: opts.Events}
+
+	result := &ScanResult{Root: opts.Root, StartTime: time.Now()}
+	defer func() { result.Duration = time.Since(result.StartTime) }()
+
+	repos, err := git.DiscoverRepositories(ctx, opts.Root, git.Options{Events: opts.Events})
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("%w during discovery", ErrAborted)
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to list repositories: %w", err)
+	}
+	em.Infof("Found %d repositories under %s", len(repos), opts.Root)
+
+	if opts.Fix && opts.FixOptions.LogDir == "" {
+		runDir, err := logger.DefaultRunDir()
+		if err != nil {
+			return result, err
+		}
+		opts.FixOptions.LogDir = runDir
+	}
+	if opts.Fix {
+		result.LogDir = opts.FixOptions.LogDir
+	}
+
+	result.Repos = make([]RepoScan, len(repos))
+	for i, repo := range repos {
+		result.Repos[i] = RepoScan{
+			Path:   repo.Path,
+			Name:   repoName(opts.Root, repo.Path),
+			Bare:   repo.Bare,
+			Status: StatusAborted,
+			Err:    ErrAborted,
+		}
+	}
+
+	tracker := progress.New(em, "Scanning repositories", int64(len(repos)))
+	defer tracker.Finish()
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < opts.Jobs && w < len(repos); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				scanRepo(ctx, opts, &result.Repos[i])
+				tracker.Add(1)
+
+				repo := result.Repos[i]
+				if repo.Err != nil && repo.Status != StatusAborted {
+					em.Warnf("%s: %v", repo.Name, repo.Err)
+				} else {
+					em.Debugf("%s: %s (%d issue(s)) in %s", repo.Name, repo.Status, len(repo.Issues), repo.Duration.Round(time.Millisecond))
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range repos {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("%w during scan", ErrAborted)
+	}
+	return result, nil
+}
+
+// scanRepo diagnoses, or fixes, a single repository and records the outcome
+func scanRepo(ctx context.Context, opts ScanOptions, repo *RepoScan) {
+	start := time.Now()
+	defer func() { repo.Duration = time.Since(start) }()
+	repo.Err = nil
+
+	if !opts.Fix {
+		diag, err := Diagnose(ctx, DiagnoseOptions{RepoPath: repo.Path})
+		switch {
+		case err != nil:
+			repo.Status, repo.Err = errorStatus(err), err
+		case diag.Healthy():
+			repo.Status = StatusHealthy
+		default:
+			repo.Status, repo.Issues = StatusIssues, diag.AllIssues()
+		}
+		return
+	}
+
+	fixOpts := opts.FixOptions
+	fixOpts.RepoPath = repo.Path
+	fixOpts.Events = nil
+	fixOpts.LogDir = filepath.Join(opts.FixOptions.LogDir, repo.Name)
+
+	fix, err := Fix(ctx, fixOpts)
+	repo.Fix = fix
+	repo.Issues = fix.AllInitialIssues()
+	switch {
+	case err != nil:
+		repo.Status, repo.Err = errorStatus(err), err
+	case fix.Healthy():
+		repo.Status = StatusHealthy
+	case fix.DryRun:
+		repo.Status = StatusIssues
+	case len(fix.AllFinalIssues()) > 0:
+		repo.Status = StatusRemaining
+	default:
+		repo.Status = StatusFixed
+	}
+}
+
+// errorStatus tells interruptions apart from failures
+func errorStatus(err error) RepoStatus {
+	if errors.Is(err, ErrAborted) || errors.Is(err, ErrCancelled) {
+		return StatusAborted
+	}
+	return StatusFailed
+}
+
+// repoName returns path relative to root, or root's own name for root itself
+func repoName(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return path
+	}
+	if rel == "." {
+		if abs, err := filepath.Abs(root); err == nil {
+			return filepath.Base(abs)
+		}
+	}
+	return rel
+}
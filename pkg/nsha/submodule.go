@@ -0,0 +1,104 @@
+package nsha
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/rahul/nsha/pkg/events"
+	"github.com/rahul/nsha/pkg/git"
+	"github.com/rahul/nsha/pkg/logger"
+)
+
+// checkedOutSubmodules returns the checked out submodules of a repository
+func checkedOutSubmodules(repoPath string, sink Sink) ([]git.Submodule, error) {
+	submodules, err := git.ListSubmodules(git.Options{RepoPath: repoPath, Events: sink})
+	if err != nil {
+		return nil, err
+	}
+
+	var initialized []git.Submodule
+	for _, sub := range submodules {
+		if sub.Initialized(repoPath) {
+			initialized = append(initialized, sub)
+		}
+	}
+	return initialized, nil
+}
+
+// diagnoseSubmodules diagnoses every checked out submodule of result's repository
+func diagnoseSubmodules(ctx context.Context, opts DiagnoseOptions, result *DiagnoseResult) error {
+	submodules, err := checkedOutSubmodules(result.RepoPath, opts.Events)
+	if err != nil {
+		return err
+	}
+
+	em := events.Emitter{Sink: opts.Events}
+	for _, sub := range submodules {
+		em.Debugf("Diagnosing submodule %s...", sub.Path)
+		subOpts := opts
+		subOpts.RepoPath = filepath.Join(result.RepoPath, sub.Path)
+		subResult, err := Diagnose(ctx, subOpts)
+		if err != nil {
+			return fmt.Errorf("submodule %s: %w", sub.Path, err)
+		}
+		result.Submodules = append(result.Submodules, subResult)
+	}
+	return nil
+}
+
+// fixSubmodules fixes every checked out submodule of result's repository.
+// Each gets its own log directory under the superproject's.
+func fixSubmodules(ctx context.Context, opts FixOptions, result *FixResult) error {
+	submodules, err := checkedOutSubmodules(result.RepoPath, opts.Events)
+	if err != nil {
+		return err
+	}
+	if len(submodules) == 0 {
+		return nil
+	}
+
+	logDir := result.LogDir
+	if logDir == "" {
+		// The superproject was healthy and did not open a log
+		if logDir, err = logger.DefaultRunDir(); err != nil {
+			return err
+		}
+	}
+
+	em := events.Emitter{Sink: opts.Events}
+	for _, sub := range submodules {
+		em.Infof("Fixing submodule %s...", sub.Path)
+		subOpts := opts
+		subOpts.RepoPath = filepath.Join(result.RepoPath, sub.Path)
+		subOpts.LogDir = filepath.Join(logDir, "submodules", filepath.FromSlash(sub.Path))
+		subResult, err := Fix(ctx, subOpts)
+		result.Submodules = append(result.Submodules, subResult)
+		if err != nil {
+			return fmt.Errorf("submodule %s: %w", sub.Path, err)
+		}
+	}
+	return nil
+}
+
+// prefixIssues returns copies of a submodule's issues with their Path made
+// relative to the superproject
+func prefixIssues(repoPath, subPath string, issues []Issue) []Issue {
+	prefix, err := filepath.Rel(repoPath, subPath)
+	if err != nil {
+		prefix = subPath
+	}
+	prefix = filepath.ToSlash(prefix)
+
+	prefixed := make([]Issue, len(issues))
+	for i, issue := range issues {
+		switch {
+		case issue.Path == "":
+			issue.Path = prefix
+		case !filepath.IsAbs(issue.Path):
+			issue.Path = prefix + "/" + issue.Path
+		}
+		prefixed[i] = issue
+	}
+	return prefixed
+}
@@ -0,0 +1,40 @@
+package nsha
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rahul/nsha/pkg/git"
+)
+
+// Re-exported types describing an incident timeline
+type (
+	Timeline          = git.Timeline
+	TimelineEvent     = git.TimelineEvent
+	TimelineEventKind = git.TimelineEventKind
+	IncidentWindow    = git.IncidentWindow
+)
+
+// TimelineOptions configures BuildTimeline
+type TimelineOptions struct {
+	RepoPath string // Path to the repository; defaults to the current directory
+	Events   Sink   // Receives progress messages; nil discards them
+}
+
+// BuildTimeline diagnoses a repository and dates what is damaged against
+// the reflogs and last good commits of the affected references, to narrow
+// down when the damage happened
+func BuildTimeline(ctx context.Context, opts TimelineOptions) (*Timeline, error) {
+	gopts := git.Options{RepoPath: repoPathOrDefault(opts.RepoPath), Events: opts.Events}
+
+	diag, err := git.Diagnose(ctx, gopts)
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("%w during diagnosis", ErrAborted)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("diagnosis failed: %w", err)
+	}
+	gopts.Diagnosis = diag
+
+	return git.BuildTimeline(ctx, gopts)
+}
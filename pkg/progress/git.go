@@ -0,0 +1,104 @@
+package progress
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rahul/nsha/pkg/events"
+)
+
+// gitProgressLine matches git's progress output, e.g.
+// "Checking objects:  45% (123/456)" or "Checking connectivity: 9, done."
+var gitProgressLine = regexp.MustCompile(`^([A-Z][A-Za-z -]*):\s+(?:\d+%\s+\((\d+)/(\d+)\)|(\d+))(.*)$`)
+
+// GitWriter is used as the stdout and stderr of a git command. Progress lines
+// git writes (with --progress) are turned into progress events; everything
+// else is kept and returned by Output, like exec.Cmd.CombinedOutput would.
+type GitWriter struct {
+	mu      sync.Mutex
+	em      events.Emitter
+	output  bytes.Buffer
+	partial []byte
+	tracker *Tracker
+	task    string
+}
+
+// NewGitWriter creates a writer that reports git progress through em
+func NewGitWriter(em events.Emitter) *GitWriter {
+	return &GitWriter{em: em}
+}
+
+// Write splits the stream on carriage returns and newlines
+func (w *GitWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexAny(w.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		w.line(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Output finishes any open progress task and returns the non-progress output
+func (w *GitWriter) Output() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.partial) > 0 {
+		w.line(string(w.partial))
+		w.partial = nil
+	}
+	w.finish()
+	return w.output.Bytes()
+}
+
+// line handles one complete line of output
+func (w *GitWriter) line(line string) {
+	m := gitProgressLine.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		// Blank lines only separate progress updates
+		if strings.TrimSpace(line) != "" {
+			w.output.WriteString(line)
+			w.output.WriteByte('\n')
+		}
+		return
+	}
+
+	task := m[1]
+	var done, total int64
+	if m[4] != "" {
+		done, _ = strconv.ParseInt(m[4], 10, 64)
+	} else {
+		done, _ = strconv.ParseInt(m[2], 10, 64)
+		total, _ = strconv.ParseInt(m[3], 10, 64)
+	}
+
+	if task != w.task {
+		w.finish()
+		w.task = task
+		w.tracker = New(w.em, task, total)
+	}
+	w.tracker.Set(done, total)
+
+	if strings.Contains(m[5], "done") {
+		w.finish()
+	}
+}
+
+// finish completes the current progress task, if any
+func (w *GitWriter) finish() {
+	if w.tracker != nil {
+		w.tracker.Finish()
+	}
+	w.tracker = nil
+	w.task = ""
+}
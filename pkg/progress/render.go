@@ -0,0 +1,218 @@
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rahul/nsha/pkg/events"
+)
+
+// Mode selects how progress is rendered
+type Mode string
+
+const (
+	ModeAuto  Mode = "auto"  // Bar on a terminal, lines otherwise
+	ModeBar   Mode = "bar"   // Redrawn progress bar
+	ModeLines Mode = "lines" // A log line every few seconds
+	ModeJSON  Mode = "json"  // One JSON object per progress event
+	ModeNone  Mode = "none"  // No progress output
+)
+
+// ParseMode validates a --progress flag value
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(strings.ToLower(s)); m {
+	case ModeAuto, ModeBar, ModeLines, ModeJSON, ModeNone:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid progress mode %q (want auto, bar, lines, json or none)", s)
+}
+
+// lineInterval is how often lines mode reports an unfinished task
+const lineInterval = 5 * time.Second
+
+// minVisible is how long a task must run before its progress is kept on
+// screen (bar) or logged (lines); quicker tasks would only add noise
+const minVisible = time.Second
+
+// barWidth is the number of cells in the progress bar
+const barWidth = 30
+
+// Renderer writes progress events to a stream. It is safe for concurrent use.
+type Renderer struct {
+	mu       sync.Mutex
+	w        io.Writer
+	mode     Mode
+	active   bool                 // A bar is drawn on the current line
+	lastLine map[string]time.Time // Last line printed per task in lines mode
+}
+
+// NewRenderer creates a renderer. ModeAuto must be resolved by the caller,
+// which knows whether w is a terminal; it is treated as lines here.
+func NewRenderer(w io.Writer, mode Mode) *Renderer {
+	if mode == ModeAuto {
+		mode = ModeLines
+	}
+	return &Renderer{w: w, mode: mode, lastLine: make(map[string]time.Time)}
+}
+
+// Render draws a progress event
+func (r *Renderer) Render(p events.Progress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch r.mode {
+	case ModeBar:
+		if p.Finished && p.Elapsed < minVisible {
+			fmt.Fprint(r.w, "\r\033[K")
+			r.active = false
+			return
+		}
+		fmt.Fprintf(r.w, "\r\033[K  %s", formatBar(p))
+		r.active = !p.Finished
+		if p.Finished {
+			fmt.Fprintln(r.w)
+		}
+	case ModeLines:
+		last, seen := r.lastLine[p.Task]
+		switch {
+		case p.Finished:
+			delete(r.lastLine, p.Task)
+			if !seen {
+				return
+			}
+		case p.Elapsed < minVisible:
+			return
+		case seen && time.Since(last) < lineInterval:
+			return
+		default:
+			r.lastLine[p.Task] = time.Now()
+		}
+		fmt.Fprintf(r.w, "  %s\n", formatLine(p))
+	case ModeJSON:
+		writeJSON(r.w, p)
+	}
+}
+
+// Clear removes an unfinished bar so other output starts on a clean line.
+// The bar is redrawn by the next progress event.
+func (r *Renderer) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.active {
+		fmt.Fprint(r.w, "\r\033[K")
+		r.active = false
+	}
+}
+
+// jsonProgress is the machine-readable form of a progress event
+type jsonProgress struct {
+	Type       string   `json:"type"`
+	Time       string   `json:"time"`
+	Task       string   `json:"task"`
+	Done       int64    `json:"done"`
+	Total      int64    `json:"total,omitempty"`
+	Percent    *float64 `json:"percent,omitempty"`
+	Rate       float64  `json:"rate"`
+	ElapsedSec float64  `json:"elapsed_seconds"`
+	ETASec     *float64 `json:"eta_seconds,omitempty"`
+	Finished   bool     `json:"finished"`
+}
+
+func writeJSON(w io.Writer, p events.Progress) {
+	out := jsonProgress{
+		Type:       string(events.TypeProgress),
+		Time:       time.Now().Format(time.RFC3339),
+		Task:       p.Task,
+		Done:       p.Done,
+		Total:      p.Total,
+		Rate:       round(p.Rate),
+		ElapsedSec: round(p.Elapsed.Seconds()),
+		Finished:   p.Finished,
+	}
+	if pct := p.Percent(); pct >= 0 {
+		pct = round(pct)
+		out.Percent = &pct
+	}
+	if p.ETA > 0 {
+		eta := round(p.ETA.Seconds())
+		out.ETASec = &eta
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(w, string(data))
+}
+
+// round keeps two decimals, which is plenty for rates and durations
+func round(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+// formatBar renders "Task [=====>    ]  45% 123/456 12/s ETA 0:38"
+func formatBar(p events.Progress) string {
+	pct := p.Percent()
+	if pct < 0 {
+		return fmt.Sprintf("%s %s", p.Task, formatCounts(p))
+	}
+
+	filled := int(pct / 100 * barWidth)
+	if filled > barWidth {
+		filled = barWidth
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < barWidth {
+		bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+	return fmt.Sprintf("%s [%s] %3.0f%% %s", p.Task, bar, pct, formatCounts(p))
+}
+
+// formatLine renders "Task: 123/456 (45%), 12/s, ETA 0:38"
+func formatLine(p events.Progress) string {
+	if pct := p.Percent(); pct >= 0 {
+		return fmt.Sprintf("%s: %d/%d (%.0f%%), %s", p.Task, p.Done, p.Total, pct, formatRate(p))
+	}
+	return fmt.Sprintf("%s: %s", p.Task, formatCounts(p))
+}
+
+// formatCounts renders the item counts, rate and ETA
+func formatCounts(p events.Progress) string {
+	if p.Total > 0 {
+		return fmt.Sprintf("%d/%d %s", p.Done, p.Total, formatRate(p))
+	}
+	if p.Done > 0 {
+		return fmt.Sprintf("%d %s", p.Done, formatRate(p))
+	}
+	if p.Finished {
+		return fmt.Sprintf("done in %s", formatDuration(p.Elapsed))
+	}
+	return fmt.Sprintf("running for %s", formatDuration(p.Elapsed))
+}
+
+// formatRate renders throughput and the remaining time
+func formatRate(p events.Progress) string {
+	s := fmt.Sprintf("%.0f/s", p.Rate)
+	switch {
+	case p.Finished:
+		s += ", done in " + formatDuration(p.Elapsed)
+	case p.ETA > 0:
+		s += ", ETA " + formatDuration(p.ETA)
+	}
+	return s
+}
+
+// formatDuration renders durations as m:ss or h:mm:ss
+func formatDuration(d time.Duration) string {
+	secs := int(d.Round(time.Second).Seconds())
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+	}
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
@@ -0,0 +1,137 @@
+// Package progress tracks long-running tasks and renders their progress as a
+// terminal bar, periodic log lines or JSON events.
+package progress
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rahul/nsha/pkg/events"
+)
+
+// emitInterval limits how often a tracker reports progress
+const emitInterval = 100 * time.Millisecond
+
+// heartbeatInterval is how often a task without updates is reported as still running
+const heartbeatInterval = 2 * time.Second
+
+// Tracker counts completed items of a task and reports them as progress events.
+// It is safe for concurrent use.
+type Tracker struct {
+	mu       sync.Mutex
+	em       events.Emitter
+	task     string
+	done     int64
+	total    int64
+	start    time.Time
+	lastEmit time.Time
+	finished bool
+	stop     chan struct{}
+}
+
+// New starts tracking a task. total may be 0 when it is not known up front.
+func New(em events.Emitter, task string, total int64) *Tracker {
+	t := &Tracker{
+		em:    em,
+		task:  task,
+		total: total,
+		start: time.Now(),
+	}
+	t.emitLocked(true)
+	return t
+}
+
+// Heartbeat keeps reporting the task while it makes no visible progress, so
+// that tasks without item counts (e.g. git gc) still show they are alive.
+// The heartbeat stops when the task finishes.
+func (t *Tracker) Heartbeat() *Tracker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stop != nil || t.finished {
+		return t
+	}
+	t.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.mu.Lock()
+				if time.Since(t.lastEmit) >= heartbeatInterval {
+					t.emitLocked(true)
+				}
+				t.mu.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}(t.stop)
+	return t
+}
+
+// Add marks n more items as done
+func (t *Tracker) Add(n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.done += n
+	t.emitLocked(false)
+}
+
+// Set updates the number of items done and, when non-zero, the total
+func (t *Tracker) Set(done, total int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.done = done
+	if total > 0 {
+		t.total = total
+	}
+	t.emitLocked(false)
+}
+
+// Finish reports the task as complete. Calling it more than once is harmless.
+func (t *Tracker) Finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.finished {
+		return
+	}
+	t.finished = true
+	if t.stop != nil {
+		close(t.stop)
+	}
+	t.emitLocked(true)
+}
+
+// emitLocked reports the current state unless the last report was too recent
+func (t *Tracker) emitLocked(force bool) {
+	now := time.Now()
+	if !force && now.Sub(t.lastEmit) < emitInterval {
+		return
+	}
+	t.lastEmit = now
+	t.em.Progress(t.snapshotLocked(now))
+}
+
+// snapshotLocked computes rate and ETA for the current state
+func (t *Tracker) snapshotLocked(now time.Time) events.Progress {
+	p := events.Progress{
+		Task:     t.task,
+		Done:     t.done,
+		Total:    t.total,
+		Elapsed:  now.Sub(t.start),
+		Finished: t.finished,
+	}
+
+	if secs := p.Elapsed.Seconds(); secs > 0 {
+		p.Rate = float64(t.done) / secs
+	}
+	if p.Rate > 0 && t.total > t.done && !t.finished {
+		p.ETA = time.Duration(float64(t.total-t.done) / p.Rate * float64(time.Second))
+	}
+	return p
+}
@@ -0,0 +1,332 @@
+package report
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rahul/nsha/pkg/git"
+)
+
+// Format selects how command results are written to stdout
+type Format string
+
+const (
+	FormatText  Format = "text"
+	FormatJSON  Format = "json"
+	FormatSARIF Format = "sarif"
+)
+
+// ParseFormat validates an --output flag value
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case FormatText, FormatJSON, FormatSARIF:
+		return f, nil
+	}
+	return "", fmt.Errorf("invalid output format %q (want text, json or sarif)", s)
+}
+
+// SchemaVersion is the version of the JSON output format. It changes only
+// when fields are removed or change meaning; new fields may be added.
+const SchemaVersion = "1"
+
+// Findings is the result of a command, written as JSON or SARIF
+type Findings struct {
+	Command     string // diagnose, verify or fix
+	RepoPath    string
+	ToolVersion string
+	StartTime   time.Time
+	EndTime     time.Time
+	Issues      []git.Issue
+	Remaining   []git.Issue // Issues left after fixing; nil for commands that do not fix
+	DryRun      bool
+
+	// Registry suggests a fixer for every issue; nil uses git.DefaultRegistry
+	Registry *git.Registry
+}
+
+func (f *Findings) registry() *git.Registry {
+	if f.Registry != nil {
+		return f.Registry
+	}
+	return git.DefaultRegistry()
+}
+
+// jsonIssue is the JSON form of an issue
+type jsonIssue struct {
+	Type           git.IssueType `json:"type"`
+	Severity       git.Severity  `json:"severity"`
+	Object         string        `json:"object,omitempty"`
+	Commit         string        `json:"commit,omitempty"`
+	Path           string        `json:"path,omitempty"`
+	Message        string        `json:"message"`
+	SuggestedFixer string        `json:"suggested_fixer,omitempty"`
+	FixedBy        string        `json:"fixed_by,omitempty"`
+	Resolved       bool          `json:"resolved,omitempty"`
+}
+
+// jsonFindings is the top-level JSON document
+type jsonFindings struct {
+	SchemaVersion   string      `json:"schema_version"`
+	Tool            jsonTool    `json:"tool"`
+	Command         string      `json:"command"`
+	Repository      string      `json:"repository"`
+	StartTime       time.Time   `json:"start_time"`
+	EndTime         time.Time   `json:"end_time"`
+	DurationSeconds float64     `json:"duration_seconds"`
+	DryRun          bool        `json:"dry_run,omitempty"`
+	Healthy         bool        `json:"healthy"`
+	IssueCount      int         `json:"issue_count"`
+	Issues          []jsonIssue `json:"issues"`
+	RemainingCount  *int        `json:"remaining_count,omitempty"`
+	Remaining       []jsonIssue `json:"remaining,omitempty"`
+}
+
+type jsonTool struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// WriteJSON writes the findings as a JSON document
+func WriteJSON(w io.Writer, f *Findings) error {
+	suggest := f.registry().Suggester()
+	doc := jsonFindings{
+		SchemaVersion:   SchemaVersion,
+		Tool:            jsonTool{Name: "nsha", Version: f.ToolVersion},
+		Command:         f.Command,
+		Repository:      f.RepoPath,
+		StartTime:       f.StartTime,
+		EndTime:         f.EndTime,
+		DurationSeconds: f.EndTime.Sub(f.StartTime).Seconds(),
+		DryRun:          f.DryRun,
+		Healthy:         len(f.Issues) == 0,
+		IssueCount:      len(f.Issues),
+		Issues:          jsonIssues(f.Issues, suggest),
+	}
+	if f.Remaining != nil || f.Command == "fix" {
+		count := len(f.Remaining)
+		doc.RemainingCount = &count
+		doc.Remaining = jsonIssues(f.Remaining, suggest)
+		doc.Healthy = count == 0
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+func jsonIssues(issues []git.Issue, suggest func(git.Issue) string) []jsonIssue {
+	out := make([]jsonIssue, 0, len(issues))
+	for _, issue := range issues {
+		out = append(out, jsonIssue{
+			Type:           issue.Type,
+			Severity:       severity(issue),
+			Object:         issue.Object,
+			Commit:         issue.Commit,
+			Path:           issue.Path,
+			Message:        issue.Message,
+			SuggestedFixer: suggest(issue),
+			FixedBy:        issue.FixedBy,
+			Resolved:       issue.Resolved,
+		})
+	}
+	return out
+}
+
+// severity returns the issue's severity, falling back to its type's default
+func severity(issue git.Issue) git.Severity {
+	if issue.Severity != "" {
+		return issue.Severity
+	}
+	return issue.Type.Severity()
+}
+
+// SARIF 2.1.0 subset used by WriteSARIF
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool        sarifTool         `json:"tool"`
+	Invocations []sarifInvocation `json:"invocations,omitempty"`
+	Results     []sarifResult     `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version,omitempty"`
+	InformationURI string      `json:"informationUri,omitempty"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string            `json:"id"`
+	Name                 string            `json:"name,omitempty"`
+	ShortDescription     sarifMessage      `json:"shortDescription"`
+	DefaultConfiguration sarifRuleConfig   `json:"defaultConfiguration"`
+	Properties           map[string]string `json:"properties,omitempty"`
+}
+
+type sarifRuleConfig struct {
+	Level string `json:"level"`
+}
+
+type sarifInvocation struct {
+	ExecutionSuccessful bool   `json:"executionSuccessful"`
+	StartTimeUTC        string `json:"startTimeUtc,omitempty"`
+	EndTimeUTC          string `json:"endTimeUtc,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID              string            `json:"ruleId"`
+	RuleIndex           int               `json:"ruleIndex"`
+	Level               string            `json:"level"`
+	Message             sarifMessage      `json:"message"`
+	Locations           []sarifLocation   `json:"locations,omitempty"`
+	PartialFingerprints map[string]string `json:"partialFingerprints,omitempty"`
+	Properties          map[string]string `json:"properties,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation *sarifPhysicalLocation `json:"physicalLocation,omitempty"`
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifLogicalLocation struct {
+	Name string `json:"name"`
+	Kind string `json:"kind,omitempty"`
+}
+
+// WriteSARIF writes the findings as a SARIF 2.1.0 log. For fix runs the
+// results are the issues that remain, so dashboards track what is still broken.
+func WriteSARIF(w io.Writer, f *Findings) error {
+	issues := f.Issues
+	if f.Command == "fix" && !f.DryRun {
+		issues = f.Remaining
+	}
+
+	// One rule per issue type, in a stable order
+	ruleIndex := make(map[git.IssueType]int)
+	var types []git.IssueType
+	for _, issue := range issues {
+		if _, ok := ruleIndex[issue.Type]; !ok {
+			ruleIndex[issue.Type] = -1
+			types = append(types, issue.Type)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	rules := make([]sarifRule, 0, len(types))
+	for i, t := range types {
+		ruleIndex[t] = i
+		rules = append(rules, sarifRule{
+			ID:                   string(t),
+			Name:                 string(t),
+			ShortDescription:     sarifMessage{Text: t.Description()},
+			DefaultConfiguration: sarifRuleConfig{Level: string(t.Severity())},
+		})
+	}
+
+	suggest := f.registry().Suggester()
+	results := make([]sarifResult, 0, len(issues))
+	for _, issue := range issues {
+		result := sarifResult{
+			RuleID:    string(issue.Type),
+			RuleIndex: ruleIndex[issue.Type],
+			Level:     string(severity(issue)),
+			Message:   sarifMessage{Text: issue.Message},
+			PartialFingerprints: map[string]string{
+				"nshaIssue/v1": fingerprint(issue),
+			},
+		}
+
+		var loc sarifLocation
+		if issue.Path != "" {
+			loc.PhysicalLocation = &sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: issue.Path}}
+		}
+		if issue.Object != "" {
+			loc.LogicalLocations = append(loc.LogicalLocations, sarifLogicalLocation{Name: issue.Object, Kind: objectKind(issue.Object)})
+		}
+		if issue.Commit != "" {
+			loc.LogicalLocations = append(loc.LogicalLocations, sarifLogicalLocation{Name: issue.Commit, Kind: "commit"})
+		}
+		if loc.PhysicalLocation != nil || len(loc.LogicalLocations) > 0 {
+			result.Locations = []sarifLocation{loc}
+		}
+
+		props := make(map[string]string)
+		if fixer := suggest(issue); fixer != "" {
+			props["suggestedFixer"] = fixer
+		}
+		if issue.FixedBy != "" {
+			props["fixedBy"] = issue.FixedBy
+		}
+		if issue.Resolved {
+			props["resolved"] = "true"
+		}
+		if len(props) > 0 {
+			result.Properties = props
+		}
+		results = append(results, result)
+	}
+
+	log := sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs: []sarifRun{{
+			Tool: sarifTool{Driver: sarifDriver{
+				Name:           "nsha",
+				Version:        f.ToolVersion,
+				InformationURI: "https://github.com/RahulGS02/nsha-tool",
+				Rules:          rules,
+			}},
+			Invocations: []sarifInvocation{{
+				ExecutionSuccessful: true,
+				StartTimeUTC:        f.StartTime.UTC().Format(time.RFC3339),
+				EndTimeUTC:          f.EndTime.UTC().Format(time.RFC3339),
+			}},
+			Results: results,
+		}},
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(log)
+}
+
+// objectKind tells references apart from object hashes
+func objectKind(object string) string {
+	if object == "HEAD" || strings.HasPrefix(object, "refs/") {
+		return "reference"
+	}
+	return "object"
+}
+
+// fingerprint identifies an issue across runs so dashboards can track it
+func fingerprint(issue git.Issue) string {
+	sum := sha256.Sum256([]byte(string(issue.Type) + "\x00" + issue.Object + "\x00" + issue.Commit + "\x00" + issue.Path))
+	return hex.EncodeToString(sum[:16])
+}
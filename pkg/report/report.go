@@ -20,6 +20,9 @@ type ReportData struct {
 	FinalIssues   []git.Issue
 	Operations    []logger.Operation
 	BackupPath    string
+	ForensicsPath string         // Evidence bundle collected before the fix, if any
+	Timeline      *git.Timeline  // When the damage happened, dated before the fix
+	Worktrees     []git.Worktree // Main worktree first, then linked worktrees
 	Success       bool
 	ErrorMessage  string
 }
@@ -76,8 +79,24 @@ func generateComprehensiveReport(data *ReportData) string {
 	} else {
 		sb.WriteString("Status: ⚠️  No backup created\n")
 	}
+	if data.ForensicsPath != "" {
+		sb.WriteString(fmt.Sprintf("Forensic Evidence: %s\n", data.ForensicsPath))
+	}
 	sb.WriteString("\n")
 
+	// Incident timeline
+	if data.Timeline != nil && len(data.Timeline.Events) > 0 {
+		sb.WriteString("INCIDENT TIMELINE\n")
+		sb.WriteString("═══════════════════════════════════════════════════════════\n")
+		data.Timeline.WriteSummary(&sb)
+		sb.WriteString("\n")
+	}
+
+	// Worktrees
+	if len(data.Worktrees) > 1 {
+		writeWorktrees(&sb, data)
+	}
+
 	// Issues Found
 	sb.WriteString("ISSUES ANALYSIS\n")
 	sb.WriteString("═══════════════════════════════════════════════════════════\n")
@@ -187,6 +206,46 @@ func generateComprehensiveReport(data *ReportData) string {
 	return sb.String()
 }
 
+// writeWorktrees lists every worktree with its HEAD and remaining issues
+func writeWorktrees(sb *strings.Builder, data *ReportData) {
+	sb.WriteString("WORKTREES\n")
+	sb.WriteString("═══════════════════════════════════════════════════════════\n")
+	for _, wt := range data.Worktrees {
+		name := wt.Name
+		if wt.Main() {
+			name = "(main)"
+		}
+		path := wt.Path
+		if path == "" {
+			path = "(bare)"
+		}
+		sb.WriteString(fmt.Sprintf("%s: %s\n", name, path))
+
+		head, err := wt.Head()
+		switch {
+		case err != nil:
+			sb.WriteString(fmt.Sprintf("  HEAD:   unreadable (%v)\n", err))
+		case strings.HasPrefix(head, "ref:"):
+			sb.WriteString(fmt.Sprintf("  HEAD:   %s\n", strings.TrimSpace(strings.TrimPrefix(head, "ref:"))))
+		default:
+			sb.WriteString(fmt.Sprintf("  HEAD:   detached at %s\n", head))
+		}
+
+		remaining := 0
+		for _, issue := range data.FinalIssues {
+			if wt.Owns(issue) {
+				remaining++
+			}
+		}
+		if remaining > 0 {
+			sb.WriteString(fmt.Sprintf("  Status: ⚠️  %d issue(s) remaining\n", remaining))
+		} else {
+			sb.WriteString("  Status: ✅ OK\n")
+		}
+	}
+	sb.WriteString("\n")
+}
+
 // generateChangesReport creates a summary of all changes made
 func generateChangesReport(data *ReportData) string {
 	var sb strings.Builder
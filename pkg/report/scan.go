@@ -0,0 +1,165 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/rahul/nsha/pkg/git"
+)
+
+// RepoFindings is the result for one repository of a scan
+type RepoFindings struct {
+	Name      string // Path relative to the scan root
+	Path      string
+	Bare      bool
+	Status    string
+	Error     string
+	Duration  time.Duration
+	Issues    []git.Issue
+	Fixed     bool        // Whether fix ran on the repository
+	Remaining []git.Issue // Issues left after fixing
+	LogDir    string
+}
+
+// ScanFindings is the result of a scan over many repositories
+type ScanFindings struct {
+	Root        string
+	ToolVersion string
+	StartTime   time.Time
+	EndTime     time.Time
+	Repos       []RepoFindings
+
+	// Registry suggests a fixer for every issue; nil uses git.DefaultRegistry
+	Registry *git.Registry
+}
+
+// jsonRepo is the JSON form of a scanned repository
+type jsonRepo struct {
+	Name            string         `json:"name"`
+	Repository      string         `json:"repository"`
+	Bare            bool           `json:"bare"`
+	Status          string         `json:"status"`
+	Error           string         `json:"error,omitempty"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	IssueCount      int            `json:"issue_count"`
+	IssueCounts     map[string]int `json:"issue_counts"`
+	Issues          []jsonIssue    `json:"issues"`
+	RemainingCount  *int           `json:"remaining_count,omitempty"`
+	Remaining       []jsonIssue    `json:"remaining,omitempty"`
+	LogDir          string         `json:"log_dir,omitempty"`
+}
+
+// jsonScan is the top-level JSON document of a scan
+type jsonScan struct {
+	SchemaVersion   string         `json:"schema_version"`
+	Tool            jsonTool       `json:"tool"`
+	Command         string         `json:"command"`
+	Root            string         `json:"root"`
+	StartTime       time.Time      `json:"start_time"`
+	EndTime         time.Time      `json:"end_time"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	RepositoryCount int            `json:"repository_count"`
+	StatusCounts    map[string]int `json:"status_counts"`
+	Repositories    []jsonRepo     `json:"repositories"`
+}
+
+// WriteScanJSON writes the scan findings as a single JSON document
+func WriteScanJSON(w io.Writer, f *ScanFindings) error {
+	doc := jsonScan{
+		SchemaVersion:   SchemaVersion,
+		Tool:            jsonTool{Name: "nsha", Version: f.ToolVersion},
+		Command:         "scan",
+		Root:            f.Root,
+		StartTime:       f.StartTime,
+		EndTime:         f.EndTime,
+		DurationSeconds: f.EndTime.Sub(f.StartTime).Seconds(),
+		RepositoryCount: len(f.Repos),
+		StatusCounts:    make(map[string]int),
+		Repositories:    make([]jsonRepo, 0, len(f.Repos)),
+	}
+
+	// Reuse the single-repository issue encoding, ordering the fixers once
+	suggest := (&Findings{Registry: f.Registry}).registry().Suggester()
+	for _, repo := range f.Repos {
+		doc.StatusCounts[repo.Status]++
+
+		out := jsonRepo{
+			Name:            repo.Name,
+			Repository:      repo.Path,
+			Bare:            repo.Bare,
+			Status:          repo.Status,
+			Error:           repo.Error,
+			DurationSeconds: repo.Duration.Seconds(),
+			IssueCount:      len(repo.Issues),
+			IssueCounts:     make(map[string]int),
+			Issues:          jsonIssues(repo.Issues, suggest),
+			LogDir:          repo.LogDir,
+		}
+		for t, n := range countByType(repo.Issues) {
+			out.IssueCounts[string(t)] = n
+		}
+		if repo.Fixed {
+			count := len(repo.Remaining)
+			out.RemainingCount = &count
+			out.Remaining = jsonIssues(repo.Remaining, suggest)
+		}
+		doc.Repositories = append(doc.Repositories, out)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// WriteScanCSV writes one row per repository with an issue count column per
+// issue type, so the columns are the same for every scan
+func WriteScanCSV(w io.Writer, f *ScanFindings) error {
+	cw := csv.NewWriter(w)
+
+	header := []string{"repository", "path", "bare", "status", "issue_count"}
+	for _, t := range git.IssueTypes {
+		header = append(header, string(t))
+	}
+	header = append(header, "remaining_count", "duration_seconds", "log_dir", "error")
+	if err := cw.Write(header); err != nil {
+		return fmt.Errorf("failed to write CSV header: %w", err)
+	}
+
+	for _, repo := range f.Repos {
+		counts := countByType(repo.Issues)
+		row := []string{
+			repo.Name,
+			repo.Path,
+			strconv.FormatBool(repo.Bare),
+			repo.Status,
+			strconv.Itoa(len(repo.Issues)),
+		}
+		for _, t := range git.IssueTypes {
+			row = append(row, strconv.Itoa(counts[t]))
+		}
+		remaining := ""
+		if repo.Fixed {
+			remaining = strconv.Itoa(len(repo.Remaining))
+		}
+		row = append(row, remaining, strconv.FormatFloat(repo.Duration.Seconds(), 'f', 2, 64), repo.LogDir, repo.Error)
+		if err := cw.Write(row); err != nil {
+			return fmt.Errorf("failed to write CSV row: %w", err)
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// countByType counts issues per type
+func countByType(issues []git.Issue) map[git.IssueType]int {
+	counts := make(map[git.IssueType]int)
+	for _, issue := range issues {
+		counts[issue.Type]++
+	}
+	return counts
+}